@@ -0,0 +1,54 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String returns the environment variable key, or def when it is unset or empty
+func String(key, def string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return def
+}
+
+// Int64 returns the environment variable key parsed as an integer, or def when it is unset or invalid
+func Int64(key string, def int64) int64 {
+	value, err := strconv.ParseInt(String(key, ""), 10, 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// Bool returns the environment variable key parsed as a boolean, or def when it is unset or invalid
+func Bool(key string, def bool) bool {
+	value, err := strconv.ParseBool(String(key, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// Duration returns the environment variable key parsed as a duration (e.g. "15m"), or def when it is unset or invalid
+func Duration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(String(key, ""))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// List returns the environment variable key split on commas, with empty entries removed
+func List(key string) []string {
+	var values []string
+	for _, value := range strings.Split(String(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"teltech/config"
+	"teltech/fsck"
+	"teltech/jobs"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetScrubReport returns a scrub run and the problems it found. The latest run is
+// reported unless run_id is given.
+func GetScrubReport(c *gin.Context) {
+	var run *models.ScrubRun
+	var err error
+	if runID := c.Query("run_id"); runID != "" {
+		id, convErr := strconv.Atoi(runID)
+		if convErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+			return
+		}
+		run, err = models.GetScrubRun(id)
+	} else {
+		run, err = models.GetLatestScrubRun()
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scrub run not found"})
+		return
+	}
+
+	issues, err := models.GetScrubIssues(run.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scrub issues"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"run":     run,
+		"running": run.FinishedAt == nil,
+		"issues":  issues,
+	})
+}
+
+// StartScrub starts an integrity scrub in the background
+func StartScrub(c *gin.Context) {
+	if err := jobs.StartScrub(storage.Default(), config.Int64("SCRUB_RATE", 0)); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Scrub started"})
+}
+
+// PreviewFsck compares storage with the database and lists the drift without changing
+// anything
+func PreviewFsck(c *gin.Context) {
+	runFsck(c, nil)
+}
+
+// RepairFsck repairs the drift a preview listed. The issues to repair are named by the
+// refs the preview gave them, so drift that appeared since is left alone.
+func RepairFsck(c *gin.Context) {
+	var input struct {
+		Issues []string `json:"issues" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "List the refs of the previewed issues to repair"})
+		return
+	}
+	runFsck(c, input.Issues)
+}
+
+// runFsck runs a consistency check and responds with its report
+func runFsck(c *gin.Context, repair []string) {
+	report, err := fsck.Run(c.Request.Context(), repair)
+	if errors.Is(err, fsck.ErrRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Consistency check failed"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
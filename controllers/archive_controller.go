@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"teltech/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// archiveEntry describes a member of an archive in listings
+type archiveEntry struct {
+	Name     string     `json:"name"` // Slash-separated path inside the archive
+	Size     int64      `json:"size"`
+	Modified *time.Time `json:"modified,omitempty"` // Unknown for implied folders
+	IsDir    bool       `json:"is_dir"`
+}
+
+// ListArchiveEntries lists the files and folders inside a stored ZIP or tar archive
+// without extracting it. With dir given, only the direct children of that folder inside
+// the archive are listed, so archives can be browsed like folders.
+func ListArchiveEntries(c *gin.Context) {
+	file, format, ok := loadArchive(c)
+	if !ok {
+		return
+	}
+	dir, browse := c.GetQuery("dir")
+	if dir = strings.Trim(path.Clean("/"+dir), "/"); dir == "" {
+		dir = "."
+	}
+
+	entries := map[string]*archiveEntry{}
+	err := walkArchive(c.Request.Context(), file, format, false, func(m archiveMember) error {
+		rel, err := memberPath(m.Name)
+		if err != nil || rel == "" || m.Kind == memberOther {
+			return nil // Unsafe names and links are never served, so not listed either
+		}
+		name := filepath.ToSlash(rel)
+
+		// Parent folders are not always recorded, so they are listed as implied
+		for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+			if _, ok := entries[parent]; !ok {
+				entries[parent] = &archiveEntry{Name: parent, IsDir: true}
+			}
+		}
+		entry := &archiveEntry{Name: name, Size: m.Size, IsDir: m.Kind == memberDir}
+		if !m.Modified.IsZero() {
+			entry.Modified = &m.Modified
+		}
+		entries[name] = entry
+		return nil
+	})
+	if err != nil {
+		respondExtractError(c, err)
+		return
+	}
+
+	listed := []*archiveEntry{}
+	for name, entry := range entries {
+		if browse && path.Dir(name) != dir {
+			continue
+		}
+		listed = append(listed, entry)
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Name < listed[j].Name })
+
+	c.JSON(http.StatusOK, gin.H{"archive": file.Path, "entries": listed})
+}
+
+// DownloadArchiveEntry streams a single file out of a stored ZIP or tar archive
+func DownloadArchiveEntry(c *gin.Context) {
+	file, format, ok := loadArchive(c)
+	if !ok {
+		return
+	}
+	wanted, err := memberPath(c.Query("name"))
+	if err != nil || wanted == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entry name"})
+		return
+	}
+
+	found := false
+	err = walkArchive(c.Request.Context(), file, format, true, func(m archiveMember) error {
+		rel, err := memberPath(m.Name)
+		if err != nil || rel != wanted || m.Kind != memberFile {
+			return nil
+		}
+		found = true
+
+		name := filepath.Base(rel)
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.DataFromReader(http.StatusOK, m.Size, contentType, m.Body, map[string]string{
+			"Content-Disposition": contentDisposition("attachment", name),
+		})
+		return errStopWalk
+	})
+	if err != nil && !found {
+		respondExtractError(c, err)
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found in archive"})
+	}
+}
+
+// loadArchive finds the archive named by the file_path parameter, responding with an
+// error when it is missing, not an archive or not the requesting user's
+func loadArchive(c *gin.Context) (*models.File, string, bool) {
+	filePath := c.Query("file_path")
+	if filePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File path is required"})
+		return nil, "", false
+	}
+	file, err := models.GetFileByPath(filePath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, "", false
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, "", false
+	}
+	format := archiveFormat(file.Name)
+	if format == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errUnsupportedArchive.Error()})
+		return nil, "", false
+	}
+	return file, format, true
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestArchiveEntries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	folder, _ := models.CreateFolder("root", root, uid)
+	store := func(name string, ownerID int) string {
+		data := zipArchive(t, map[string]string{"a.txt": "alpha", "docs/sub/b.txt": "bravo", "../evil.txt": "evil"})
+		path := filepath.Join(root, name)
+		os.WriteFile(path, data, 0644)
+		database.DB.Create(&models.File{Name: name, Path: path, Size: int64(len(data)), Version: 1, FolderID: folder.ID, OwnerID: ownerID})
+		return path
+	}
+	mine := store("mine.zip", uid)
+	theirs := store("theirs.zip", uid+1)
+	notArchive := filepath.Join(root, "a.txt")
+	database.DB.Create(&models.File{Name: "a.txt", Path: notArchive, Version: 1, FolderID: folder.ID, OwnerID: uid})
+
+	r := gin.New()
+	for path, handler := range map[string]gin.HandlerFunc{"/entries": ListArchiveEntries, "/entry": DownloadArchiveEntry} {
+		r.GET(path, func(c *gin.Context) {
+			c.Set("user_id", uid)
+			c.Set("role", "user")
+			handler(c)
+		})
+	}
+	get := func(path string, query url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil))
+		return w
+	}
+
+	t.Run("list", func(t *testing.T) {
+		tests := []struct {
+			dir   *string
+			names []string
+		}{
+			// The unsafe member is left out, and implied folders are listed
+			{names: []string{"a.txt", "docs", "docs/sub", "docs/sub/b.txt"}},
+			{dir: ptr(""), names: []string{"a.txt", "docs"}},
+			{dir: ptr("docs/sub"), names: []string{"docs/sub/b.txt"}},
+		}
+		for _, tt := range tests {
+			query := url.Values{"file_path": {mine}}
+			if tt.dir != nil {
+				query.Set("dir", *tt.dir)
+			}
+			w := get("/entries", query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			var resp struct{ Entries []archiveEntry }
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			var names []string
+			for _, entry := range resp.Entries {
+				names = append(names, entry.Name)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("listed %v, want %v", names, tt.names)
+			}
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		w := get("/entry", url.Values{"file_path": {mine}, "name": {"docs/sub/b.txt"}})
+		if w.Code != http.StatusOK || w.Body.String() != "bravo" {
+			t.Fatalf("got status %d with %q", w.Code, w.Body)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		want  int
+	}{
+		{name: "missing entry", path: "/entry", query: url.Values{"file_path": {mine}, "name": {"c.txt"}}, want: http.StatusNotFound},
+		{name: "folder entry", path: "/entry", query: url.Values{"file_path": {mine}, "name": {"docs"}}, want: http.StatusNotFound},
+		{name: "unsafe entry", path: "/entry", query: url.Values{"file_path": {mine}, "name": {"../evil.txt"}}, want: http.StatusBadRequest},
+		{name: "someone else's archive", path: "/entries", query: url.Values{"file_path": {theirs}}, want: http.StatusForbidden},
+		{name: "entry of someone else's archive", path: "/entry", query: url.Values{"file_path": {theirs}, "name": {"a.txt"}}, want: http.StatusForbidden},
+		{name: "not an archive", path: "/entries", query: url.Values{"file_path": {notArchive}}, want: http.StatusBadRequest},
+		{name: "unknown file", path: "/entries", query: url.Values{"file_path": {filepath.Join(root, "gone.zip")}}, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := get(tt.path, tt.query); w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"teltech/config"
+	"teltech/models"
+	"teltech/storage"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFileContent serves a text file for editing, with the ETag a save must send back in
+// If-Match. Only UTF-8 text up to EDIT_MAX_SIZE bytes can be edited.
+func GetFileContent(c *gin.Context) {
+	file, ok := loadEditableFile(c)
+	if !ok {
+		return
+	}
+	if file.Size > editMaxSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large to edit"})
+		return
+	}
+
+	etag := fileETag(file)
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	reader, err := storage.Default().Get(c.Request.Context(), file.ContentKey(), 0, -1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(reader, editMaxSize()+1))
+	reader.Close()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Only UTF-8 text files can be edited"})
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", content)
+}
+
+// SaveFileContent replaces the content of a text file with the request body, keeping the
+// previous content as a version. The If-Match header must hold the ETag the content was
+// loaded with; when the file has changed since, nothing is saved and 412 is returned so
+// the user can reload and redo their change.
+func SaveFileContent(c *gin.Context) {
+	file, ok := loadEditableFile(c)
+	if !ok {
+		return
+	}
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header required"})
+		return
+	}
+
+	if !etagMatches(ifMatch, fileETag(file)) {
+		c.Header("ETag", fileETag(file))
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "The file has changed since it was loaded"})
+		return
+	}
+
+	folder, err := models.GetFolderByID(file.FolderID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Parent folder not found"})
+		return
+	}
+
+	// The new content replaces the old in the owner's quota
+	limit := editMaxSize()
+	remaining, err := quotaRemaining(file.OwnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return
+	}
+	if remaining >= 0 && remaining+file.Size < limit {
+		limit = remaining + file.Size
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1)
+
+	// The file is only replaced if it still holds what was checked against If-Match when
+	// the new content is committed, whoever else writes to it in the meantime
+	saved, err := storeFile(c.Request.Context(), folder, file.Name, c.Request.Body, storeOptions{
+		Conflict:   storage.ConflictVersion,
+		MaxSize:    limit,
+		OwnerID:    file.OwnerID,
+		IfChecksum: file.Checksum,
+	})
+	if errors.Is(err, ErrFileChanged) {
+		if current, lookupErr := models.GetFileByID(file.ID); lookupErr == nil {
+			c.Header("ETag", fileETag(current))
+		}
+	}
+	if err != nil {
+		if limit < editMaxSize() && errors.Is(err, storage.ErrTooLarge) {
+			err = ErrQuotaExceeded
+		}
+		respondStoreError(c, err)
+		return
+	}
+
+	models.RecordAuditEvent("file.edited", c.GetInt("user_id"), saved.Path,
+		fmt.Sprintf("Saved version %d (%d bytes)", saved.Version, saved.Size))
+
+	c.Header("ETag", fileETag(saved))
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "File saved successfully",
+		"path":          saved.Path,
+		"size":          saved.Size,
+		"sha256":        saved.Checksum,
+		"version":       saved.Version,
+		"etag":          fileETag(saved),
+		"active_shares": activeShareCount(saved.ID),
+	})
+}
+
+// loadEditableFile finds the file named by the file_path parameter and checks that the
+// requesting user may edit it, responding with an error otherwise
+func loadEditableFile(c *gin.Context) (*models.File, bool) {
+	file, err := models.GetFileByPath(c.Query("file_path"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	// Without a checksum there is no entity tag to make saves conditional on
+	if err := ensureChecksum(c.Request.Context(), file); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return nil, false
+	}
+	return file, true
+}
+
+// editMaxSize returns the largest file that can be edited in the browser
+func editMaxSize() int64 {
+	return config.Int64("EDIT_MAX_SIZE", 1<<20)
+}
+
+// fileETag returns the strong entity tag of the file's current content
+func fileETag(file *models.File) string {
+	return `"` + file.Checksum + `"`
+}
+
+// etagMatches reports whether an If-Match header names etag. Weak tags never match, as
+// If-Match calls for strong comparison.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEditFileContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.AuditEvent{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	folder, _ := models.CreateFolder("root", root, uid)
+	store := func(name, content string, ownerID int) string {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, []byte(content), 0644)
+		// Stored without a checksum, as files from before checksums were recorded
+		database.DB.Create(&models.File{Name: name, Path: path, Size: int64(len(content)), Version: 1, FolderID: folder.ID, OwnerID: ownerID})
+		return path
+	}
+	notes := store("notes.txt", "first", uid)
+	theirs := store("theirs.txt", "private", uid+1)
+	binary := store("a.bin", "a\x00b", uid)
+
+	r := gin.New()
+	handle := func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Set("role", "user")
+		c.Next()
+	}
+	r.GET("/content", handle, GetFileContent)
+	r.PUT("/content", handle, SaveFileContent)
+	send := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/content?"+url.Values{"file_path": {path}}.Encode(), strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Content without a checksum is hashed, so it still gets an entity tag
+	w := send(http.MethodGet, notes, "", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "first" || etag == `""` || etag == "" {
+		t.Fatalf("got status %d with ETag %s: %s", w.Code, etag, w.Body)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		header   http.Header
+		want     int
+		wantBody string // Content of notes.txt afterwards
+	}{
+		{name: "not modified", method: http.MethodGet, path: notes, header: http.Header{"If-None-Match": {etag}}, want: http.StatusNotModified},
+		{name: "someone else's file", method: http.MethodGet, path: theirs, want: http.StatusForbidden},
+		{name: "not text", method: http.MethodGet, path: binary, want: http.StatusUnsupportedMediaType},
+		{name: "unknown file", method: http.MethodGet, path: filepath.Join(root, "gone.txt"), want: http.StatusNotFound},
+		{name: "save without If-Match", method: http.MethodPut, path: notes, want: http.StatusPreconditionRequired, wantBody: "first"},
+		{name: "save over other content", method: http.MethodPut, path: notes, header: http.Header{"If-Match": {`"stale"`}}, want: http.StatusPreconditionFailed, wantBody: "first"},
+		{name: "weak tags never match", method: http.MethodPut, path: notes, header: http.Header{"If-Match": {"W/" + etag}}, want: http.StatusPreconditionFailed, wantBody: "first"},
+		{name: "save", method: http.MethodPut, path: notes, header: http.Header{"If-Match": {etag}}, want: http.StatusOK, wantBody: "second"},
+		// The first save changed the content, so the same tag no longer matches
+		{name: "save again with the old tag", method: http.MethodPut, path: notes, header: http.Header{"If-Match": {etag}}, want: http.StatusPreconditionFailed, wantBody: "second"},
+		{name: "save someone else's file", method: http.MethodPut, path: theirs, header: http.Header{"If-Match": {"*"}}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.method, tt.path, "second", tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantBody != "" {
+				if data, _ := os.ReadFile(notes); string(data) != tt.wantBody {
+					t.Errorf("notes.txt holds %q, want %q", data, tt.wantBody)
+				}
+			}
+		})
+	}
+
+	versions, _ := models.GetFileVersions(1)
+	if len(versions) != 1 {
+		t.Fatalf("kept versions %+v", versions)
+	}
+	if data, _ := os.ReadFile(versions[0].Path); string(data) != "first" {
+		t.Errorf("kept version holds %q", data)
+	}
+}
@@ -0,0 +1,445 @@
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"teltech/config"
+	"teltech/database"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors that make an archive unsuitable for extraction
+var (
+	errUnsupportedArchive = errors.New("unsupported archive format")
+	errUnsafeArchivePath  = errors.New("archive contains a path outside the target folder")
+	errArchiveTooLarge    = errors.New("archive unpacks to more than the allowed size or number of entries")
+)
+
+// errStopWalk ends walkArchive early
+var errStopWalk = errors.New("stop walking the archive")
+
+// Kinds of archive member
+const (
+	memberFile = iota
+	memberDir
+	memberOther // Symlinks, hard links, devices and the like, which are never extracted
+)
+
+// archiveMember is one entry of an archive as it is walked
+type archiveMember struct {
+	Name     string // As recorded in the archive
+	Kind     int
+	Size     int64     // Uncompressed size the archive declares
+	Modified time.Time // Modification time the archive records
+	Body     io.Reader // Content, only set while extracting
+}
+
+// ExtractResult describes what an extraction created
+type ExtractResult struct {
+	Target  string   `json:"target"`
+	Folders int      `json:"folders"`
+	Files   int      `json:"files"`
+	Bytes   int64    `json:"bytes"`
+	Skipped []string `json:"skipped"` // Members left out: links, special and hidden files
+}
+
+// extraction holds the state of one archive being unpacked
+type extraction struct {
+	ctx      context.Context
+	archive  *models.File
+	target   string
+	ownerID  int
+	conflict string
+	budget   int64 // Bytes still allowed to be unpacked
+	result   *ExtractResult
+	folders  map[string]*models.Folder
+	created  []*models.Folder // Folders made, to remove if extraction fails
+	stored   []*models.File   // New files, to remove if extraction fails
+}
+
+// ExtractFile unpacks an archive that is already stored into a folder
+func ExtractFile(c *gin.Context) {
+	var input struct {
+		FilePath   string `json:"file_path" binding:"required"`
+		TargetPath string `json:"target_path"` // Defaults to a folder named after the archive
+		Conflict   string `json:"conflict"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conflict, err := storage.ParseConflict(input.Conflict, config.String("UPLOAD_CONFLICT_DEFAULT", storage.ConflictFail))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	file, err := models.GetFileByPath(input.FilePath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not own this file"})
+		return
+	}
+
+	result, err := extractArchive(c.Request.Context(), file, input.TargetPath, conflict, func(folder *models.Folder) bool {
+		return canAccessFolder(c, folder)
+	})
+	if err != nil {
+		respondExtractError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Archive extracted successfully", "extracted": result})
+}
+
+// respondExtractError maps an extraction failure to an HTTP response
+func respondExtractError(c *gin.Context, err error) {
+	var forbidden *folderOwnerError
+	switch {
+	case errors.Is(err, errUnsupportedArchive), errors.Is(err, errUnsafeArchivePath),
+		errors.Is(err, zip.ErrFormat), errors.Is(err, gzip.ErrHeader), errors.Is(err, tar.ErrHeader):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errArchiveTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.As(err, &forbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		respondStoreError(c, err)
+	}
+}
+
+// folderOwnerError reports a target folder the user does not own
+type folderOwnerError struct {
+	path string
+}
+
+func (e *folderOwnerError) Error() string {
+	return "you do not own the folder " + e.path
+}
+
+// archiveFormat returns the extension identifying the archive format of name, or ""
+// when it is not an archive extraction understands
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// extractArchive unpacks file into the folder at target, or next to the archive in a
+// folder named after it when target is empty. The archive is checked in full before
+// anything is written: member paths must stay inside the target, and the declared
+// contents must fit EXTRACT_MAX_ENTRIES, EXTRACT_MAX_SIZE, EXTRACT_MAX_RATIO and the
+// owner's quota. The same limits are enforced on the bytes actually unpacked, and
+// everything created is removed again if extraction fails part way. The folder
+// unpacked into, or the nearest existing folder above it, must pass allowed; what is
+// unpacked belongs to its owner.
+func extractArchive(ctx context.Context, file *models.File, target, conflict string, allowed func(*models.Folder) bool) (*ExtractResult, error) {
+	format := archiveFormat(file.Name)
+	if format == "" {
+		return nil, errUnsupportedArchive
+	}
+	if target == "" {
+		target = filepath.Join(filepath.Dir(file.Path), strings.TrimSuffix(file.Name, file.Name[len(file.Name)-len(format):]))
+	}
+	target = filepath.Clean(target)
+	if key, err := storage.KeyOf(target); err != nil || key == "" {
+		return nil, errUnsafeArchivePath
+	}
+
+	// Unpacking into an existing folder needs access to it, a new one to the parent
+	ownerID := file.OwnerID
+	for dir := target; ; dir = filepath.Dir(dir) {
+		if folder, err := models.GetFolderByPath(dir); err == nil {
+			if !allowed(folder) {
+				return nil, &folderOwnerError{path: dir}
+			}
+			ownerID = folder.OwnerID
+			break
+		}
+		if dir == storage.Root() {
+			break
+		}
+	}
+
+	x := &extraction{
+		ctx:      ctx,
+		archive:  file,
+		target:   target,
+		ownerID:  ownerID,
+		conflict: conflict,
+		result:   &ExtractResult{Target: target, Skipped: []string{}},
+		folders:  make(map[string]*models.Folder),
+	}
+	if err := x.check(format); err != nil {
+		return nil, err
+	}
+
+	err := walkArchive(ctx, file, format, true, x.extract)
+	if err != nil {
+		x.rollback()
+		return nil, err
+	}
+	return x.result, nil
+}
+
+// check walks the archive without unpacking it, validating member paths and what the
+// archive declares it unpacks to, and sets the byte budget for extraction
+func (x *extraction) check(format string) error {
+	maxEntries := int(config.Int64("EXTRACT_MAX_ENTRIES", 10000))
+	x.budget = config.Int64("EXTRACT_MAX_SIZE", 10<<30)
+	if ratio := config.Int64("EXTRACT_MAX_RATIO", 200); ratio > 0 && x.archive.Size*ratio < x.budget {
+		x.budget = x.archive.Size * ratio
+	}
+	remaining, err := quotaRemaining(x.ownerID)
+	if err != nil {
+		return err
+	}
+
+	entries := 0
+	var declared int64
+	err = walkArchive(x.ctx, x.archive, format, false, func(m archiveMember) error {
+		if _, err := memberPath(m.Name); err != nil {
+			return err
+		}
+		entries++
+		declared += m.Size
+		if (maxEntries > 0 && entries > maxEntries) || declared > x.budget {
+			return errArchiveTooLarge
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if remaining >= 0 && declared > remaining {
+		return ErrQuotaExceeded
+	}
+	if remaining >= 0 && remaining < x.budget {
+		x.budget = remaining
+	}
+	return nil
+}
+
+// extract stores one member below the target folder
+func (x *extraction) extract(m archiveMember) error {
+	rel, err := memberPath(m.Name)
+	if err != nil {
+		return err
+	}
+	if rel == "" {
+		return nil
+	}
+	if m.Kind == memberOther || hiddenPath(rel) {
+		x.result.Skipped = append(x.result.Skipped, m.Name)
+		return nil
+	}
+
+	path := filepath.Join(x.target, rel)
+	if m.Kind == memberDir {
+		_, err := x.folder(path)
+		return err
+	}
+
+	folder, err := x.folder(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if x.budget <= 0 {
+		return errArchiveTooLarge
+	}
+	_, existsErr := models.GetFileByPath(path)
+	file, err := storeFile(x.ctx, folder, filepath.Base(path), m.Body, storeOptions{
+		Conflict: x.conflict,
+		MaxSize:  x.budget,
+		OwnerID:  x.ownerID,
+	})
+	if errors.Is(err, storage.ErrTooLarge) {
+		return errArchiveTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	if existsErr != nil || file.Path != path {
+		x.stored = append(x.stored, file)
+	}
+
+	x.budget -= file.Size
+	x.result.Files++
+	x.result.Bytes += file.Size
+	return nil
+}
+
+// folder returns the row of the folder at path, creating it when needed
+func (x *extraction) folder(path string) (*models.Folder, error) {
+	return EnsureFolder(x.ctx, path, x.ownerID, x.folders, func(folder *models.Folder) {
+		x.created = append(x.created, folder)
+		x.result.Folders++
+	})
+}
+
+// rollback removes the files and folders a failed extraction created
+func (x *extraction) rollback() {
+	ctx := context.Background()
+	for _, file := range x.stored {
+		if file.BlobHash == "" {
+			storage.Default().Delete(ctx, file.ContentKey())
+		}
+		models.DeleteFileRecord(ctx, file)
+	}
+	for i := len(x.created) - 1; i >= 0; i-- {
+		if key, err := storage.KeyOf(x.created[i].Path); err == nil && key != "" {
+			storage.Default().Delete(ctx, key)
+		}
+		database.DB.Delete(x.created[i])
+	}
+}
+
+// memberPath turns the name of an archive member into a clean relative path, rejecting
+// absolute names and names that climb out of the target with ".."
+func memberPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errUnsafeArchivePath
+	}
+
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			return "", errUnsafeArchivePath
+		}
+		parts = append(parts, part)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// hiddenPath reports whether any part of a relative path is hidden. Such names are
+// rejected on upload, and would clash with the internal .teltech folder.
+func hiddenPath(rel string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// walkArchive calls fn for every member of the stored archive file, stopping early
+// without error when fn returns errStopWalk. Member content is only provided when
+// withBody is set.
+func walkArchive(ctx context.Context, file *models.File, format string, withBody bool, fn func(archiveMember) error) error {
+	var err error
+	if format == ".zip" {
+		err = walkZip(ctx, file, withBody, fn)
+	} else {
+		err = walkTar(ctx, file, format, withBody, fn)
+	}
+	if errors.Is(err, errStopWalk) {
+		return nil
+	}
+	return err
+}
+
+// walkTar calls fn for every member of a stored tar archive, gzipped unless format is
+// ".tar"
+func walkTar(ctx context.Context, file *models.File, format string, withBody bool, fn func(archiveMember) error) error {
+	reader, err := storage.Default().Get(ctx, file.ContentKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var stream io.Reader = reader
+	if format != ".tar" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		stream = gz
+	}
+
+	tr := tar.NewReader(stream)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m := archiveMember{Name: header.Name, Kind: memberOther, Modified: header.ModTime}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			m.Kind, m.Size = memberFile, header.Size
+		case tar.TypeDir:
+			m.Kind = memberDir
+		case tar.TypeXGlobalHeader:
+			continue
+		}
+		if withBody {
+			m.Body = tr
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+// walkZip calls fn for every member of a stored ZIP archive, reading the central
+// directory and members with ranged reads
+func walkZip(ctx context.Context, file *models.File, withBody bool, fn func(archiveMember) error) error {
+	zr, err := zip.NewReader(storage.NewReaderAt(ctx, storage.Default(), file.ContentKey()), file.Size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		m := archiveMember{Name: f.Name, Kind: memberOther, Modified: f.Modified}
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			m.Kind = memberDir
+		case mode.IsRegular():
+			m.Kind, m.Size = memberFile, int64(f.UncompressedSize64)
+		}
+
+		if !withBody || m.Kind != memberFile {
+			if err := fn(m); err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, err := f.Open()
+		if err != nil {
+			return err
+		}
+		m.Body = body
+		err = fn(m)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMemberPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string // Slash-separated
+		unsafe bool
+	}{
+		{name: "a.txt", want: "a.txt"},
+		{name: "docs/a.txt", want: "docs/a.txt"},
+		{name: "docs/", want: "docs"},
+		{name: "./docs//a.txt", want: "docs/a.txt"},
+		{name: `docs\a.txt`, want: "docs/a.txt"},
+		{name: "docs/./sub/a.txt", want: "docs/sub/a.txt"},
+		{name: "a..b/c..", want: "a..b/c.."},
+		{name: ".", want: ""},
+		{name: "../a.txt", unsafe: true},
+		{name: "docs/../../a.txt", unsafe: true},
+		{name: "docs/../a.txt", unsafe: true},
+		{name: `..\a.txt`, unsafe: true},
+		{name: `docs\..\..\a.txt`, unsafe: true},
+		{name: "/etc/passwd", unsafe: true},
+		{name: `\windows\system.ini`, unsafe: true},
+		{name: "C:/windows/system.ini", unsafe: true},
+		{name: `c:\windows\system.ini`, unsafe: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := memberPath(tt.name)
+			if tt.unsafe {
+				if !errors.Is(err, errUnsafeArchivePath) {
+					t.Fatalf("got %q, %v; want it rejected", got, err)
+				}
+				return
+			}
+			if err != nil || got != filepath.FromSlash(tt.want) {
+				t.Fatalf("got %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHiddenPath(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"a.txt", false},
+		{"docs/a.txt", false},
+		{"docs/a.b.txt", false},
+		{".env", true},
+		{"docs/.git/config", true},
+		{".teltech/blobs/ab", true},
+		{filepath.Join("docs", ".hidden"), true},
+	}
+	for _, tt := range tests {
+		if got := hiddenPath(tt.rel); got != tt.want {
+			t.Errorf("hiddenPath(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"a.zip", ".zip"},
+		{"A.ZIP", ".zip"},
+		{"a.tar", ".tar"},
+		{"a.tar.gz", ".tar.gz"},
+		{"a.tgz", ".tgz"},
+		{"a.gz", ""},
+		{"a.zip.txt", ""},
+		{"zip", ""},
+	}
+	for _, tt := range tests {
+		if got := archiveFormat(tt.name); got != tt.want {
+			t.Errorf("archiveFormat(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// zipArchive returns a ZIP archive holding the given members
+func zipArchive(t *testing.T, members map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range members {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	uid := os.Getuid()
+	other := uid + 1
+
+	tests := []struct {
+		name      string
+		members   map[string]string
+		archiveBy int    // Owner of the archive, defaults to the requesting user
+		role      string // Role of the requesting user
+		target    string // Relative to the storage root, defaults to next to the archive
+		maxSize   string
+		want      int
+		wantFiles map[string]string // Content by path relative to the storage root
+	}{
+		{name: "own archive", members: map[string]string{"a.txt": "alpha", "docs/b.txt": "bravo"}, want: http.StatusOK, wantFiles: map[string]string{"bundle/a.txt": "alpha", "bundle/docs/b.txt": "bravo"}},
+		{name: "into a folder", members: map[string]string{"a.txt": "alpha"}, target: "mine/out", want: http.StatusOK, wantFiles: map[string]string{"mine/out/a.txt": "alpha"}},
+		{name: "hidden members are skipped", members: map[string]string{"a.txt": "alpha", ".env": "secret"}, want: http.StatusOK, wantFiles: map[string]string{"bundle/a.txt": "alpha"}},
+		{name: "path leaving the target", members: map[string]string{"a.txt": "alpha", "../evil.txt": "evil"}, want: http.StatusBadRequest},
+		{name: "over the size limit", members: map[string]string{"a.txt": "alpha"}, maxSize: "4", want: http.StatusRequestEntityTooLarge},
+		{name: "someone else's archive", members: map[string]string{"a.txt": "alpha"}, archiveBy: other, want: http.StatusForbidden},
+		{name: "into someone else's folder", members: map[string]string{"a.txt": "alpha"}, target: "theirs/out", want: http.StatusForbidden},
+		{name: "admin", members: map[string]string{"a.txt": "alpha"}, archiveBy: other, role: "admin", target: "theirs/out", want: http.StatusOK, wantFiles: map[string]string{"theirs/out/a.txt": "alpha"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{})
+			t.Setenv("EXTRACT_MAX_SIZE", tt.maxSize)
+			root := t.TempDir()
+			t.Setenv("PARENT_FOLDER", root)
+			if err := storage.Init(nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			archiveBy := uid
+			if tt.archiveBy != 0 {
+				archiveBy = tt.archiveBy
+			}
+			rootFolder, _ := models.CreateFolder("root", root, uid)
+			models.CreateFolder("mine", filepath.Join(root, "mine"), uid)
+			models.CreateFolder("theirs", filepath.Join(root, "theirs"), other)
+			os.MkdirAll(filepath.Join(root, "mine"), 0755)
+			os.MkdirAll(filepath.Join(root, "theirs"), 0755)
+			data := zipArchive(t, tt.members)
+			archive := filepath.Join(root, "bundle.zip")
+			os.WriteFile(archive, data, 0644)
+			database.DB.Create(&models.File{Name: "bundle.zip", Path: archive, Size: int64(len(data)), Version: 1, FolderID: rootFolder.ID, OwnerID: archiveBy})
+
+			input := map[string]string{"file_path": archive}
+			if tt.target != "" {
+				input["target_path"] = filepath.Join(root, tt.target)
+			}
+			body, _ := json.Marshal(input)
+			r := gin.New()
+			r.POST("/extract", func(c *gin.Context) {
+				c.Set("user_id", uid)
+				c.Set("role", tt.role)
+				ExtractFile(c)
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/extract", bytes.NewReader(body)))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var files []models.File
+			database.DB.Where("name <> ?", "bundle.zip").Find(&files)
+			if len(files) != len(tt.wantFiles) {
+				t.Fatalf("stored %d files, want %v", len(files), tt.wantFiles)
+			}
+			for path, content := range tt.wantFiles {
+				file, err := models.GetFileByPath(filepath.Join(root, path))
+				if err != nil {
+					t.Fatalf("%s was not stored: %v", path, err)
+				}
+				if data, _ := os.ReadFile(file.Path); string(data) != content {
+					t.Errorf("%s holds %q", path, data)
+				}
+			}
+			if tt.want != http.StatusOK {
+				// Nothing is left of a failed extraction
+				if _, err := os.Stat(filepath.Join(root, "bundle")); !os.IsNotExist(err) {
+					t.Errorf("target folder left behind: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -1,43 +1,83 @@
 package controllers
 
 import (
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"teltech/config"
 	"teltech/database"
 	"teltech/models"
+	"teltech/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-var parentFolder = os.Getenv("PARENT_FOLDER") // Load parent folder from .env
-
-// RenderFolder lists the contents of a folder
+// RenderFolder lists the contents of a folder. With content-addressable storage the
+// content of files is kept apart from the folder tree, so the listing is read from the
+// database instead of storage.
 func RenderFolder(c *gin.Context) {
 	folderPath := c.Query("path") // Optional query param for folder navigation
 	if folderPath == "" {
-		folderPath = parentFolder
+		folderPath = storage.Root()
 	}
 
-	files, err := os.ReadDir(folderPath)
+	key, err := storage.KeyOf(folderPath)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read folder contents"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder path"})
 		return
 	}
 
 	contents := []map[string]string{}
-	for _, file := range files {
-		contents = append(contents, map[string]string{
-			"name": file.Name(),
-			"type": func() string {
-				if file.IsDir() {
-					return "folder"
-				}
-				return "file"
-			}(),
-		})
+	if casEnabled() {
+		folder, err := models.GetFolderByPath(folderPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+		subfolders, err := models.GetSubfolders(folder.Path)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read folder contents"})
+			return
+		}
+		files, err := models.GetFilesInFolder(folder.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read folder contents"})
+			return
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		for _, sub := range subfolders {
+			contents = append(contents, map[string]string{"name": sub.Name, "type": "folder"})
+		}
+		for _, file := range files {
+			contents = append(contents, map[string]string{"name": file.Name, "type": "file"})
+		}
+	} else {
+		files, err := storage.Default().List(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read folder contents"})
+			return
+		}
+		for _, file := range files {
+			if path.Base(file.Key) == storage.InternalDir {
+				continue
+			}
+			contents = append(contents, map[string]string{
+				"name": path.Base(file.Key),
+				"type": func() string {
+					if file.IsDir {
+						return "folder"
+					}
+					return "file"
+				}(),
+			})
+		}
 	}
 
 	c.HTML(http.StatusOK, "folder.html", gin.H{
@@ -62,19 +102,24 @@ func CreateFolder(c *gin.Context) {
 	}
 
 	if input.ParentPath == "" {
-		input.ParentPath = parentFolder
+		input.ParentPath = storage.Root()
 	}
 
 	fullPath := filepath.Join(input.ParentPath, input.FolderName)
+	key, err := storage.KeyOf(fullPath)
+	if err != nil || key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder path"})
+		return
+	}
 
 	// Check if folder already exists
-	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+	if storage.Exists(c.Request.Context(), storage.Default(), key) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder already exists"})
 		return
 	}
 
 	// Create the folder
-	if err := os.MkdirAll(fullPath, 0755); err != nil {
+	if err := storage.MkdirAll(c.Request.Context(), storage.Default(), key); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
 		return
 	}
@@ -89,7 +134,7 @@ func CreateFolder(c *gin.Context) {
 	uid, _ := strconv.Atoi(currentUser.Uid)
 	gid, _ := strconv.Atoi(currentUser.Gid)
 
-	if err := SetOwnership(fullPath, uid, gid); err != nil {
+	if err := setOwnership(key, uid, gid); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set folder ownership"})
 		return
 	}
@@ -131,15 +176,24 @@ func RenameFolder(c *gin.Context) {
 	oldPath := folder.Path
 	newPath := filepath.Join(filepath.Dir(oldPath), input.NewName)
 
-	if err := os.Rename(oldPath, newPath); err != nil {
+	oldKey, err := storage.KeyOf(oldPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename folder"})
+		return
+	}
+	newKey, err := storage.KeyOf(newPath)
+	if err != nil || newKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+		return
+	}
+
+	if err := storage.Default().Move(c.Request.Context(), oldKey, newKey); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename folder"})
 		return
 	}
 
-	// Update database entry
-	folder.Name = input.NewName
-	folder.Path = newPath
-	if err := database.DB.Save(&folder).Error; err != nil {
+	// Update the folder and everything below it
+	if err := models.MoveFolderPaths(oldPath, newPath); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder metadata"})
 		return
 	}
@@ -165,12 +219,23 @@ func DeleteFolder(c *gin.Context) {
 		return
 	}
 
-	// Delete the folder from the file system
-	if err := os.RemoveAll(folder.Path); err != nil {
+	// Delete the folder from storage
+	key, err := storage.KeyOf(folder.Path)
+	if err != nil || key == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+	if err := storage.Default().Delete(c.Request.Context(), key); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
 		return
 	}
 
+	// Remove the records of the files it contained
+	if err := models.DeleteFilesUnder(c.Request.Context(), folder.Path); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file metadata"})
+		return
+	}
+
 	// Remove the folder from the database
 	if err := database.DB.Delete(&folder).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder metadata"})
@@ -180,14 +245,67 @@ func DeleteFolder(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Folder deleted successfully"})
 }
 
-// UploadFile uploads a file to a folder
+// UploadFile streams a file into a folder. The parent_path and conflict form fields must
+// precede the file part (they may also be passed as query parameters). The content is
+// hashed while streaming, checked against the optional X-Content-SHA256 header and only
+// then moved into place.
 func UploadFile(c *gin.Context) {
-	parentPath := c.PostForm("parent_path")
+	userID := c.GetInt("user_id")
+
+	maxSize := config.Int64("UPLOAD_MAX_SIZE", 0)
+	if maxSize > 0 {
+		// Leave headroom for the multipart envelope; the file part itself is limited exactly
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1<<20)
+	}
+
+	digest, err := storage.ParseDigest(c.GetHeader("X-Content-SHA256"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a multipart/form-data upload"})
+		return
+	}
+
+	// Read the plain form fields up to the file part, which is then streamed
+	fields := map[string]string{
+		"parent_path":  c.Query("parent_path"),
+		"conflict":     c.Query("conflict"),
+		"extract":      c.Query("extract"),
+		"extract_path": c.Query("extract_path"),
+	}
+	var part *multipart.Part
+	for part == nil {
+		next, err := reader.NextPart()
+		if err == io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Malformed upload"})
+			return
+		}
+		if next.FormName() == "file" {
+			part = next
+			continue
+		}
+		value, _ := io.ReadAll(io.LimitReader(next, 4096))
+		fields[next.FormName()] = string(value)
+	}
+
+	parentPath := fields["parent_path"]
 	if parentPath == "" {
-		parentPath = parentFolder
+		parentPath = storage.Root()
 	}
 
-	userID := c.GetInt("user_id")
+	conflict, err := storage.ParseConflict(fields["conflict"], config.String("UPLOAD_CONFLICT_DEFAULT", storage.ConflictFail))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// Check if parent folder exists
 	var folder models.Folder
@@ -201,16 +319,38 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
-	// Handle file upload
-	file, err := c.FormFile("file")
+	fileName := filepath.Base(filepath.Clean("/" + part.FileName()))
+	if fileName == "/" || strings.HasPrefix(fileName, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+		return
+	}
+
+	// The upload may take the user up to their quota but not past it
+	remaining, err := quotaRemaining(userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return
+	}
+	if remaining == 0 {
+		respondStoreError(c, ErrQuotaExceeded)
 		return
 	}
+	limit := maxSize
+	if remaining > 0 && (limit == 0 || remaining < limit) {
+		limit = remaining
+	}
 
-	uploadPath := filepath.Join(parentPath, file.Filename)
-	if err := c.SaveUploadedFile(file, uploadPath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+	file, err := storeFile(c.Request.Context(), &folder, fileName, part, storeOptions{
+		Conflict: conflict,
+		MaxSize:  limit,
+		Digest:   digest,
+		OwnerID:  userID,
+	})
+	if errors.Is(err, storage.ErrTooLarge) && limit != maxSize {
+		err = ErrQuotaExceeded
+	}
+	if err != nil {
+		respondStoreError(c, err)
 		return
 	}
 
@@ -224,12 +364,160 @@ func UploadFile(c *gin.Context) {
 	uid, _ := strconv.Atoi(currentUser.Uid)
 	gid, _ := strconv.Atoi(currentUser.Gid)
 
-	if err := SetOwnership(uploadPath, uid, gid); err != nil {
+	if err := setOwnership(file.ContentKey(), uid, gid); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set file ownership"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "path": uploadPath})
+	response := gin.H{
+		"message":       "File uploaded successfully",
+		"path":          file.Path,
+		"name":          file.Name,
+		"size":          file.Size,
+		"sha256":        file.Checksum,
+		"version":       file.Version,
+		"metadata":      file.Metadata,
+		"active_shares": activeShareCount(file.ID),
+	}
+
+	// Unpack archives on request, keeping the archive itself
+	if fields["extract"] == "true" {
+		result, err := extractArchive(c.Request.Context(), file, fields["extract_path"], conflict, func(folder *models.Folder) bool {
+			return folder.OwnerID == userID
+		})
+		if err != nil {
+			respondExtractError(c, err)
+			return
+		}
+		response["extracted"] = result
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// respondStoreError maps an error from storeFile to an HTTP response
+func respondStoreError(c *gin.Context, err error) {
+	status, message := storeErrorStatus(err)
+	c.JSON(status, gin.H{"error": message})
+}
+
+// storeErrorStatus returns the HTTP status and message for an error from storeFile
+func storeErrorStatus(err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, storage.ErrTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size"
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, "Storage quota exceeded"
+	case errors.Is(err, storage.ErrDigestMismatch):
+		return http.StatusBadRequest, "File content does not match the supplied digest"
+	case errors.Is(err, storage.ErrExists):
+		return http.StatusConflict, "A file with this name already exists"
+	case errors.Is(err, ErrFileChanged):
+		return http.StatusPreconditionFailed, "The file has changed since it was loaded"
+	default:
+		return http.StatusInternalServerError, "Failed to upload file"
+	}
+}
+
+// UploadByHash records a file whose content is already stored as a blob with the
+// declared hash, letting clients skip the upload entirely. Only content the caller's own
+// files already hold may be linked, or any for admins, so a hash cannot be used to read
+// someone else's file. It responds 404 when the server does not have the blob, or the
+// caller may not link it, and the content must be uploaded normally.
+func UploadByHash(c *gin.Context) {
+	var input struct {
+		ParentPath string `json:"parent_path"`
+		Name       string `json:"name" binding:"required"`
+		SHA256     string `json:"sha256" binding:"required"`
+		Conflict   string `json:"conflict"`
+	}
+
+	userID := c.GetInt("user_id")
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !casEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content-addressable storage is not enabled"})
+		return
+	}
+
+	hash, err := storage.ParseDigest(input.SHA256)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conflict, err := storage.ParseConflict(input.Conflict, config.String("UPLOAD_CONFLICT_DEFAULT", storage.ConflictFail))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.ParentPath == "" {
+		input.ParentPath = storage.Root()
+	}
+
+	var folder models.Folder
+	if err := database.DB.Where("path = ?", input.ParentPath).First(&folder).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Parent folder does not exist"})
+		return
+	}
+
+	role, _ := c.Get("role")
+	if role != "admin" && folder.OwnerID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not own this folder"})
+		return
+	}
+
+	fileName := filepath.Base(filepath.Clean("/" + input.Name))
+	if fileName == "/" || strings.HasPrefix(fileName, ".") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+		return
+	}
+
+	if !models.BlobExists(hash) || role != "admin" && !models.UserReferencesBlob(userID, hash) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found, upload the file instead"})
+		return
+	}
+
+	// The file belongs to the folder's owner, within their quota
+	remaining, err := quotaRemaining(folder.OwnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return
+	}
+	if remaining == 0 {
+		respondStoreError(c, ErrQuotaExceeded)
+		return
+	}
+
+	file, err := linkBlob(c.Request.Context(), &folder, fileName, hash, storeOptions{Conflict: conflict, MaxSize: max(remaining, 0), OwnerID: folder.OwnerID})
+	if err != nil {
+		if errors.Is(err, storage.ErrTooLarge) {
+			err = ErrQuotaExceeded
+		}
+		if errors.Is(err, storage.ErrExists) || errors.Is(err, ErrQuotaExceeded) {
+			respondStoreError(c, err)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found, upload the file instead"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "File stored from existing content",
+		"path":          file.Path,
+		"name":          file.Name,
+		"size":          file.Size,
+		"sha256":        file.Checksum,
+		"version":       file.Version,
+		"metadata":      file.Metadata,
+		"active_shares": activeShareCount(file.ID),
+	})
 }
 
 // DownloadFile serves a file as a download
@@ -240,12 +528,44 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// Check if the file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	file, err := models.GetFileByPath(filePath)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	// Serve the file as a download, from its blob when in blob storage
+	serveObject(c, file.ContentKey(), file.Name, serveOptions{Attachment: true, File: file})
+}
 
-	// Serve the file as a download
-	c.FileAttachment(filePath, filepath.Base(filePath))
+// GetFileInfo describes a file, including the metadata read from its content
+func GetFileInfo(c *gin.Context) {
+	file, err := models.GetFileByPath(c.Query("file_path"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":            file.ID,
+		"path":          file.Path,
+		"name":          file.Name,
+		"size":          file.Size,
+		"sha256":        file.Checksum,
+		"mime_type":     file.MimeType,
+		"version":       file.Version,
+		"owner_id":      file.OwnerID,
+		"created_at":    file.CreatedAt,
+		"updated_at":    file.UpdatedAt,
+		"metadata":      file.Metadata,
+		"active_shares": activeShareCount(file.ID),
+	})
 }
@@ -0,0 +1,303 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadRequest builds a multipart upload of content as name with the given form fields
+func uploadRequest(t *testing.T, fields map[string]string, name, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for key, value := range fields {
+		mw.WriteField(key, value)
+	}
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestUploadFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// Chown to ourselves works without privileges
+	uid := os.Getuid()
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	tests := []struct {
+		name     string
+		conflict string
+		maxSize  string
+		digest   string
+		ownerID  int
+		existing bool
+		want     int
+		wantName string
+		wantBody string // Content of the stored file, defaults to the upload
+	}{
+		{name: "new file", want: http.StatusOK, wantName: "a.txt"},
+		{name: "fail on conflict", existing: true, want: http.StatusConflict, wantBody: "old"},
+		{name: "rename on conflict", conflict: "rename", existing: true, want: http.StatusOK, wantName: "a (2).txt"},
+		{name: "overwrite", conflict: "overwrite", existing: true, want: http.StatusOK, wantName: "a.txt"},
+		{name: "version", conflict: "version", existing: true, want: http.StatusOK, wantName: "a.txt"},
+		{name: "unknown policy", conflict: "replace", want: http.StatusBadRequest},
+		{name: "over the size limit", conflict: "overwrite", maxSize: "4", existing: true, want: http.StatusRequestEntityTooLarge, wantBody: "old"},
+		{name: "matching digest", digest: sum("new content"), want: http.StatusOK, wantName: "a.txt"},
+		{name: "wrong digest", conflict: "overwrite", digest: sum("other"), existing: true, want: http.StatusBadRequest, wantBody: "old"},
+		{name: "malformed digest", digest: "abc", want: http.StatusBadRequest},
+		{name: "not the folder owner", ownerID: uid + 1, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{})
+			t.Setenv("UPLOAD_MAX_SIZE", tt.maxSize)
+			dir := t.TempDir()
+			t.Setenv("PARENT_FOLDER", dir)
+			if err := storage.Init(nil, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			ownerID := uid
+			if tt.ownerID != 0 {
+				ownerID = tt.ownerID
+			}
+			folder, err := models.CreateFolder("root", dir, ownerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing {
+				path := filepath.Join(dir, "a.txt")
+				os.WriteFile(path, []byte("old"), 0644)
+				database.DB.Create(&models.File{Name: "a.txt", Path: path, Size: 3, Checksum: sum("old"), Version: 1, FolderID: folder.ID, OwnerID: uid})
+			}
+
+			r := gin.New()
+			r.POST("/upload", func(c *gin.Context) {
+				c.Set("user_id", uid)
+				UploadFile(c)
+			})
+			req := uploadRequest(t, map[string]string{"parent_path": dir, "conflict": tt.conflict}, "a.txt", "new content")
+			if tt.digest != "" {
+				req.Header.Set("X-Content-SHA256", tt.digest)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantBody != "" {
+				if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != tt.wantBody {
+					t.Errorf("stored file holds %q, want %q", data, tt.wantBody)
+				}
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Path    string
+				Name    string
+				Size    int64
+				Sha256  string
+				Version int
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Name != tt.wantName || resp.Size != int64(len("new content")) || resp.Sha256 != sum("new content") {
+				t.Errorf("unexpected response %+v", resp)
+			}
+			if data, _ := os.ReadFile(resp.Path); string(data) != "new content" {
+				t.Errorf("stored file holds %q", data)
+			}
+			if tt.conflict == "version" {
+				versions, _ := models.GetFileVersions(1)
+				if resp.Version != 2 || len(versions) != 1 || versions[0].Checksum != sum("old") {
+					t.Fatalf("version %d with previous versions %+v", resp.Version, versions)
+				}
+				if data, _ := os.ReadFile(versions[0].Path); string(data) != "old" {
+					t.Errorf("kept version holds %q", data)
+				}
+			}
+
+			// No temporary file is left behind
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Name(), ".upload-") {
+					t.Errorf("temporary file %s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestUploadByHash(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.Blob{})
+	t.Setenv("STORAGE_MODE", "cas")
+	uid := os.Getuid()
+	other := uid + 1
+
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mine, _ := models.CreateFolder("mine", filepath.Join(root, "mine"), uid)
+	theirs, _ := models.CreateFolder("theirs", filepath.Join(root, "theirs"), other)
+
+	as := func(userID int, role string, handler gin.HandlerFunc) *gin.Engine {
+		r := gin.New()
+		r.POST("/upload", func(c *gin.Context) {
+			c.Set("user_id", userID)
+			c.Set("role", role)
+			handler(c)
+		})
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	as(uid, "user", UploadFile).ServeHTTP(w, uploadRequest(t, map[string]string{"parent_path": mine.Path}, "a.txt", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload failed with %d: %s", w.Code, w.Body)
+	}
+	h := sha256.Sum256([]byte("secret"))
+	hash := hex.EncodeToString(h[:])
+
+	tests := []struct {
+		name   string
+		userID int
+		role   string
+		folder *models.Folder
+		hash   string
+		want   int
+	}{
+		{name: "own content", userID: uid, role: "user", folder: mine, hash: hash, want: http.StatusOK},
+		{name: "someone else's content", userID: other, role: "user", folder: theirs, hash: hash, want: http.StatusNotFound},
+		{name: "admin", userID: other, role: "admin", folder: theirs, hash: hash, want: http.StatusOK},
+		{name: "admin in someone else's folder", userID: other, role: "admin", folder: mine, hash: hash, want: http.StatusOK},
+		{name: "unknown content", userID: uid, role: "user", folder: mine, hash: strings.Repeat("0", 64), want: http.StatusNotFound},
+		{name: "someone else's folder", userID: other, role: "user", folder: mine, hash: hash, want: http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{
+				"parent_path": tt.folder.Path,
+				"name":        "copy" + string(rune('a'+i)) + ".txt",
+				"sha256":      tt.hash,
+			})
+			w := httptest.NewRecorder()
+			as(tt.userID, tt.role, UploadByHash).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body)))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// The upload and the three links reference the blob
+	if blob, err := models.GetBlobByHash(hash); err != nil || blob.RefCount != 4 {
+		t.Fatalf("blob %+v, %v", blob, err)
+	}
+	// A file an admin links belongs to the owner of the folder
+	var linked models.File
+	database.DB.Where("name = ?", "copyd.txt").First(&linked)
+	if linked.OwnerID != uid {
+		t.Fatalf("linked file owned by %d, want %d", linked.OwnerID, uid)
+	}
+}
+
+func TestGetFileInfo(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	models.CreateFolder("root", root, uid)
+
+	as := func(userID int, handler gin.HandlerFunc) *gin.Engine {
+		r := gin.New()
+		r.Any("/file", func(c *gin.Context) {
+			c.Set("user_id", userID)
+			c.Set("role", "user")
+			handler(c)
+		})
+		return r
+	}
+
+	// The metadata is read as the file is stored
+	var pic bytes.Buffer
+	png.Encode(&pic, image.NewGray(image.Rect(0, 0, 7, 5)))
+	req := uploadRequest(t, map[string]string{"parent_path": root}, "a.png", pic.String())
+	req.URL.Path = "/file"
+	w := httptest.NewRecorder()
+	as(uid, UploadFile).ServeHTTP(w, req)
+	var resp struct{ Metadata *models.FileMetadata }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp.Metadata == nil || resp.Metadata.Image == nil || resp.Metadata.Image.Width != 7 {
+		t.Fatalf("upload gave %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		path   string
+		want   int
+	}{
+		{name: "own file", userID: uid, path: filepath.Join(root, "a.png"), want: http.StatusOK},
+		{name: "someone else's file", userID: uid + 1, path: filepath.Join(root, "a.png"), want: http.StatusForbidden},
+		{name: "unknown file", userID: uid, path: filepath.Join(root, "b.png"), want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			as(tt.userID, GetFileInfo).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file?file_path="+tt.path, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var info struct {
+				MimeType string `json:"mime_type"`
+				Metadata *models.FileMetadata
+			}
+			json.Unmarshal(w.Body.Bytes(), &info)
+			if info.MimeType != "image/png" || info.Metadata == nil || info.Metadata.Image == nil || info.Metadata.Image.Height != 5 {
+				t.Fatalf("unexpected info %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"teltech/metadata"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serveOptions controls how serveObject serves an object
+type serveOptions struct {
+	File       *models.File // Record of the file, if it has one, for its ETag and type
+	Attachment bool         // Ask the browser to save the file instead of showing it
+	StripGPS   bool         // Remove the location from the EXIF data of photos
+}
+
+// serveObject serves the stored object at key to the client under name. Files with a
+// record and a checksum get a strong ETag from it. Conditional requests, HEAD and single
+// and multiple byte ranges are answered by http.ServeContent; the object is read from
+// storage by ranges, which every driver supports, including encrypted and compressed
+// storage.
+func serveObject(c *gin.Context, key, name string, opts serveOptions) {
+	ctx := c.Request.Context()
+	info, err := storage.Default().Stat(ctx, key)
+	if err != nil || info.IsDir {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	reader := storage.NewReadSeeker(ctx, storage.Default(), key, info.Size)
+	defer reader.Close()
+	var content io.ReadSeeker = reader
+
+	modified := info.ModTime
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if opts.File != nil {
+		// Files stored before checksums were recorded have no tag, rather than one that
+		// would match any other such file; Last-Modified still validates them
+		if opts.File.Checksum != "" {
+			etag := fileETag(opts.File)
+			if opts.StripGPS {
+				// The stripped content is a different representation with its own tag
+				etag = `"` + opts.File.Checksum + `-nogps"`
+			}
+			c.Header("ETag", etag)
+		}
+		modified = opts.File.UpdatedAt
+		if contentType == "" {
+			contentType = opts.File.MimeType
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if opts.StripGPS {
+		if content, err = metadata.StripGPSSeeker(reader); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+	}
+
+	disposition := "inline"
+	if opts.Attachment {
+		disposition = "attachment"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", contentDisposition(disposition, name))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if !opts.Attachment && scriptable(contentType) {
+		// Shown inline, the content could run scripts on this site
+		c.Header("Content-Security-Policy", "sandbox")
+	}
+	http.ServeContent(c.Writer, c.Request, name, modified.Truncate(time.Second), content)
+}
+
+// scriptable reports whether content of the type can run scripts when a browser shows it
+func scriptable(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml":
+		return true
+	}
+	return false
+}
+
+// contentDisposition returns a Content-Disposition header naming the file, as RFC 6266
+// describes: filename holds an ASCII fallback for old clients, and filename* the name
+// in UTF-8 when it is not plain ASCII.
+func contentDisposition(disposition, name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7F || r == '"' || r == '\\' || r == '/' {
+			return '_'
+		}
+		return r
+	}, name)
+	header := disposition + `; filename="` + fallback + `"`
+	if fallback != name && utf8.ValidString(name) {
+		header += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes s for an RFC 5987 extended parameter value, keeping
+// only attr-char bytes as they are
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", ch) >= 0 {
+			b.WriteByte(ch)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[ch>>4])
+		b.WriteByte(hex[ch&0x0F])
+	}
+	return b.String()
+}
+
+// canAccessFile reports whether the requesting user may see and change the file: admins
+// and the user who uploaded it may
+func canAccessFile(c *gin.Context, file *models.File) bool {
+	role, _ := c.Get("role")
+	return role == "admin" || file.OwnerID == c.GetInt("user_id")
+}
+
+// canAccessFolder reports whether the requesting user may see and change the folder,
+// as canAccessFile does for files
+func canAccessFolder(c *gin.Context, folder *models.Folder) bool {
+	role, _ := c.Get("role")
+	return role == "admin" || folder.OwnerID == c.GetInt("user_id")
+}
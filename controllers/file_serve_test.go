@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition, name string
+		want              string
+	}{
+		{"attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "photo 1.jpg", `inline; filename="photo 1.jpg"`},
+		{"attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"attachment", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"attachment", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "日本.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+		{"attachment", "a\r\nSet-Cookie: x=1", `attachment; filename="a__Set-Cookie: x=1"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x%3D1`},
+		{"attachment", "bad\xff.txt", `attachment; filename="bad_.txt"`},
+		{"attachment", "50%.txt", `attachment; filename="50%.txt"`},
+	}
+
+	for _, tt := range tests {
+		got := contentDisposition(tt.disposition, tt.name)
+		if got != tt.want {
+			t.Errorf("contentDisposition(%q, %q) = %s, want %s", tt.disposition, tt.name, got, tt.want)
+			continue
+		}
+		// Whatever the name, the header parses and names a file
+		disposition, params, err := mime.ParseMediaType(got)
+		if err != nil || disposition != tt.disposition || params["filename"] == "" {
+			t.Errorf("header %s parses as %q %v, %v", got, disposition, params, err)
+		}
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(name, checksum string, ownerID int) string {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, []byte("0123456789"), 0644)
+		database.DB.Create(&models.File{Name: name, Path: path, Size: 10, Checksum: checksum, Version: 1, FolderID: 1, OwnerID: ownerID})
+		return path
+	}
+	file := store("a.txt", "sum", uid)
+	unhashed := store("old.txt", "", uid)
+	theirs := store("theirs.txt", "other", uid+1)
+
+	r := gin.New()
+	handle := func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Set("role", "user")
+		DownloadFile(c)
+	}
+	r.GET("/download", handle)
+	r.HEAD("/download", handle)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		header   http.Header
+		want     int
+		wantETag string
+		wantBody string
+	}{
+		{name: "whole file", path: file, want: http.StatusOK, wantETag: `"sum"`, wantBody: "0123456789"},
+		{name: "head", method: http.MethodHead, path: file, want: http.StatusOK, wantETag: `"sum"`},
+		{name: "range", path: file, header: http.Header{"Range": {"bytes=2-4"}}, want: http.StatusPartialContent, wantETag: `"sum"`, wantBody: "234"},
+		{name: "range past the end", path: file, header: http.Header{"Range": {"bytes=20-"}}, want: http.StatusRequestedRangeNotSatisfiable},
+		{name: "not modified", path: file, header: http.Header{"If-None-Match": {`"sum"`}}, want: http.StatusNotModified, wantETag: `"sum"`},
+		{name: "changed since", path: file, header: http.Header{"If-Match": {`"stale"`}}, want: http.StatusPreconditionFailed, wantETag: `"sum"`},
+		// Without a checksum there is no tag, so none can match
+		{name: "no checksum", path: unhashed, want: http.StatusOK, wantBody: "0123456789"},
+		{name: "no checksum with a tag", path: unhashed, header: http.Header{"If-None-Match": {`""`}}, want: http.StatusOK, wantBody: "0123456789"},
+		{name: "someone else's file", path: theirs, want: http.StatusForbidden},
+		{name: "unknown file", path: filepath.Join(root, "gone.txt"), want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/download?"+url.Values{"file_path": {tt.path}}.Encode(), nil)
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Errorf("got ETag %s, want %s", got, tt.wantETag)
+			}
+			if w.Body.String() != tt.wantBody && (tt.wantBody != "" || w.Code < 300) {
+				t.Errorf("got body %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"path/filepath"
+	"teltech/config"
+	"teltech/database"
+	"teltech/metadata"
+	"teltech/models"
+	"teltech/storage"
+	"teltech/thumbnail"
+)
+
+// storeOptions controls how storeFile handles an incoming file
+type storeOptions struct {
+	Conflict string // One of the storage.Conflict* policies
+	MaxSize  int64  // Maximum accepted size in bytes, 0 for no limit
+	Digest   string // Expected hex SHA-256, empty to skip verification
+	OwnerID  int    // User the file is recorded against
+
+	// With ConflictVersion, only replace the file while it still holds content with this
+	// checksum, failing with ErrFileChanged otherwise
+	IfChecksum string
+}
+
+// ErrFileChanged is returned when a file no longer holds the content a conditional store
+// expected
+var ErrFileChanged = errors.New("file changed since it was loaded")
+
+// casEnabled reports whether file contents go to content-addressable blob storage
+func casEnabled() bool {
+	return config.String("STORAGE_MODE", storage.ModePath) == storage.ModeCAS
+}
+
+// setOwnership hands the stored object at key to uid and gid when it lives on local disk
+func setOwnership(key string, uid, gid int) error {
+	localPath, ok := storage.LocalPath(storage.Default(), key)
+	if !ok {
+		return nil // Object stores have no notion of file ownership
+	}
+	return SetOwnership(localPath, uid, gid)
+}
+
+// EnsureFolder returns the row of the folder at path, creating it and any missing parents
+// in storage and the database. Rows are cached in known, and created is called for each
+// folder made.
+func EnsureFolder(ctx context.Context, path string, ownerID int, known map[string]*models.Folder, created func(*models.Folder)) (*models.Folder, error) {
+	if folder, ok := known[path]; ok {
+		return folder, nil
+	}
+	if folder, err := models.GetFolderByPath(path); err == nil {
+		known[path] = folder
+		return folder, nil
+	}
+	if path != storage.Root() {
+		if _, err := EnsureFolder(ctx, filepath.Dir(path), ownerID, known, created); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := storage.KeyOf(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.MkdirAll(ctx, storage.Default(), key); err != nil {
+		return nil, err
+	}
+	folder, err := models.CreateFolder(filepath.Base(path), path, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	known[path] = folder
+	created(folder)
+	return folder, nil
+}
+
+// resolveName applies the conflict policy to name in folder, returning the name to store
+// the file under
+func resolveName(ctx context.Context, folder *models.Folder, name, conflict string) (string, error) {
+	taken := func(candidate string) bool {
+		candidatePath := filepath.Join(folder.Path, candidate)
+		if key, err := storage.KeyOf(candidatePath); err == nil && storage.Exists(ctx, storage.Default(), key) {
+			return true
+		}
+		_, err := models.GetFileByPath(candidatePath)
+		return err == nil
+	}
+
+	switch {
+	case conflict == storage.ConflictRename:
+		return storage.AvailableName(name, taken), nil
+	case conflict == storage.ConflictFail && taken(name):
+		return "", storage.ErrExists
+	}
+	return name, nil
+}
+
+// StoreVersion stores r in folder under name for ownerID, keeping whatever was there
+// before as a previous version, the way an upload with the version policy does
+func StoreVersion(ctx context.Context, folder *models.Folder, name string, r io.Reader, ownerID int) (*models.File, error) {
+	return storeFile(ctx, folder, name, r, storeOptions{Conflict: storage.ConflictVersion, OwnerID: ownerID})
+}
+
+// storeFile streams r into folder under name, applying the conflict policy, and records
+// the result in the files table. Content that fails the size or digest check never
+// replaces an existing file.
+func storeFile(ctx context.Context, folder *models.Folder, name string, r io.Reader, opts storeOptions) (*models.File, error) {
+	name, err := resolveName(ctx, folder, name, opts.Conflict)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(folder.Path, name)
+	key, err := storage.KeyOf(path)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := storage.Default()
+	ingest := storage.NewIngestReader(r, opts.MaxSize, opts.Digest)
+	putOpts := storage.PutOptions{ContentType: mime.TypeByExtension(filepath.Ext(name))}
+
+	if casEnabled() {
+		staging := storage.BlobStagingKey()
+		info, err := driver.Put(ctx, staging, ingest, putOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer driver.Delete(context.Background(), staging) // No-op once the blob has been moved into place
+
+		content := storedContent{Size: ingest.Size(), StoredSize: info.StoredSize, Checksum: ingest.Sum(), MimeType: ingest.ContentType(name)}
+		if err := commitBlob(ctx, staging, content.Checksum, content.Size); err != nil {
+			return nil, err
+		}
+		content.BlobHash = content.Checksum
+		return saveFileRecord(ctx, folder, name, content, opts)
+	}
+
+	// New versions are staged in full before the current content is moved aside, so the
+	// file is never missing while the upload streams in
+	existing, _ := models.GetFileByPath(path)
+	if opts.IfChecksum != "" && (existing == nil || existing.Checksum != opts.IfChecksum) {
+		return nil, ErrFileChanged
+	}
+	versioning := existing != nil && opts.Conflict == storage.ConflictVersion
+	target := key
+	if versioning {
+		target = storage.StagingKey()
+		defer driver.Delete(context.Background(), target) // No-op once moved into place
+	}
+
+	putOpts.NoOverwrite = opts.Conflict == storage.ConflictFail || opts.Conflict == storage.ConflictRename
+	info, err := driver.Put(ctx, target, ingest, putOpts)
+	if err != nil {
+		return nil, err
+	}
+	if versioning {
+		if err := claimFile(existing, opts.IfChecksum, ingest.Sum()); err != nil {
+			return nil, err
+		}
+		version, err := keepVersion(ctx, existing)
+		if err != nil {
+			unclaimFile(existing, opts.IfChecksum, ingest.Sum())
+			return nil, err
+		}
+		if err := driver.Move(ctx, target, key); err != nil {
+			restoreVersion(existing, version)
+			unclaimFile(existing, opts.IfChecksum, ingest.Sum())
+			return nil, err
+		}
+	}
+
+	file := existing
+	if file == nil {
+		file = &models.File{Name: name, Path: path, FolderID: folder.ID, OwnerID: opts.OwnerID}
+	}
+	file.Size = ingest.Size()
+	file.StoredSize = info.StoredSize
+	file.Checksum = ingest.Sum()
+	file.MimeType = ingest.ContentType(name)
+	file.Metadata = ReadMetadata(ctx, file)
+
+	if err := database.DB.Save(file).Error; err != nil {
+		if existing == nil {
+			driver.Delete(context.Background(), key)
+		}
+		return nil, err
+	}
+	thumbnail.Enqueue(file)
+	return file, nil
+}
+
+// storedContent describes content that is already in storage and about to be recorded
+type storedContent struct {
+	Size       int64
+	StoredSize int64
+	Checksum   string
+	MimeType   string
+	BlobHash   string
+}
+
+// linkBlob records a file in folder whose content is the existing blob with the given
+// hash, so clients that already know the hash can skip the upload entirely
+func linkBlob(ctx context.Context, folder *models.Folder, name, hash string, opts storeOptions) (*models.File, error) {
+	blob, err := models.GetBlobByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxSize > 0 && blob.Size > opts.MaxSize {
+		return nil, storage.ErrTooLarge
+	}
+	if !storage.Exists(ctx, storage.Default(), storage.BlobKey(hash)) {
+		return nil, errors.New("blob content is missing")
+	}
+
+	name, err = resolveName(ctx, folder, name, opts.Conflict)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.AcquireBlob(hash, blob.Size); err != nil {
+		return nil, err
+	}
+
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	content := storedContent{Size: blob.Size, Checksum: hash, MimeType: mimeType, BlobHash: hash}
+	if info, err := storage.Default().Stat(ctx, storage.BlobKey(hash)); err == nil {
+		content.StoredSize = info.StoredSize
+	}
+	return saveFileRecord(ctx, folder, name, content, opts)
+}
+
+// saveFileRecord points the file at name in folder to a blob the caller has already
+// acquired, keeping or releasing whatever content it referenced before
+func saveFileRecord(ctx context.Context, folder *models.Folder, name string, content storedContent, opts storeOptions) (*models.File, error) {
+	path := filepath.Join(folder.Path, name)
+	existing, _ := models.GetFileByPath(path)
+	if opts.IfChecksum != "" && (existing == nil || existing.Checksum != opts.IfChecksum) {
+		models.ReleaseBlob(content.BlobHash)
+		return nil, ErrFileChanged
+	}
+
+	var previous *models.File
+	if existing != nil {
+		if opts.Conflict == storage.ConflictVersion {
+			if err := claimFile(existing, opts.IfChecksum, content.Checksum); err != nil {
+				models.ReleaseBlob(content.BlobHash)
+				return nil, err
+			}
+			if _, err := keepVersion(ctx, existing); err != nil {
+				unclaimFile(existing, opts.IfChecksum, content.Checksum)
+				models.ReleaseBlob(content.BlobHash)
+				return nil, err
+			}
+		} else {
+			snapshot := *existing
+			previous = &snapshot
+		}
+	}
+
+	file := existing
+	if file == nil {
+		file = &models.File{Name: name, Path: path, FolderID: folder.ID, OwnerID: opts.OwnerID}
+	}
+	file.Size = content.Size
+	file.StoredSize = content.StoredSize
+	file.Checksum = content.Checksum
+	file.MimeType = content.MimeType
+	file.BlobHash = content.BlobHash
+	file.Metadata = ReadMetadata(ctx, file)
+
+	if err := database.DB.Save(file).Error; err != nil {
+		models.ReleaseBlob(content.BlobHash)
+		return nil, err
+	}
+
+	// The overwritten content is no longer referenced by this file
+	if previous != nil {
+		if previous.BlobHash != "" {
+			models.ReleaseBlob(previous.BlobHash)
+		} else {
+			storage.Default().Delete(ctx, previous.ContentKey())
+		}
+	}
+	thumbnail.Enqueue(file)
+	return file, nil
+}
+
+// ReadMetadata reads the metadata of a file's content. Failures are only logged, as
+// content that cannot be parsed is stored all the same.
+func ReadMetadata(ctx context.Context, file *models.File) *models.FileMetadata {
+	properties, err := metadata.Extract(ctx, file)
+	if err != nil {
+		log.Printf("Failed to read metadata of %s: %v", file.Path, err)
+	}
+	return properties
+}
+
+// ensureChecksum hashes the content of a file stored before checksums were recorded and
+// records the result, so entity tags and conditional saves always have one to go by
+func ensureChecksum(ctx context.Context, file *models.File) error {
+	if file.Checksum != "" {
+		return nil
+	}
+	reader, err := storage.Default().Get(ctx, file.ContentKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return err
+	}
+	if err := models.SetFileChecksum(file.ID, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		return err
+	}
+	// Someone else may have stored new content, with its checksum, meanwhile
+	current, err := models.GetFileByID(file.ID)
+	if err != nil {
+		return err
+	}
+	*file = *current
+	return nil
+}
+
+// commitBlob records a reference to the blob with the given hash and makes sure its
+// content is in storage, moving the staged upload into place unless an identical blob
+// already exists
+func commitBlob(ctx context.Context, staging, hash string, size int64) error {
+	if err := models.AcquireBlob(hash, size); err != nil {
+		return err
+	}
+
+	driver := storage.Default()
+	if storage.Exists(ctx, driver, storage.BlobKey(hash)) {
+		return nil
+	}
+	if err := driver.Move(ctx, staging, storage.BlobKey(hash)); err != nil {
+		models.ReleaseBlob(hash)
+		return err
+	}
+	return nil
+}
+
+// keepVersion keeps the current content of file as a numbered version and bumps the
+// file's version counter. Content at the file's own key is moved aside; blob content
+// stays where it is, with the version inheriting the file's reference. The caller saves
+// the file record.
+func keepVersion(ctx context.Context, file *models.File) (*models.FileVersion, error) {
+	version := models.FileVersion{
+		FileID:   file.ID,
+		Version:  file.Version,
+		Path:     file.Path,
+		Size:     file.Size,
+		Checksum: file.Checksum,
+		BlobHash: file.BlobHash,
+	}
+
+	if file.BlobHash == "" {
+		versionKey := storage.VersionKey(file.ID, file.Version)
+		if err := storage.Default().Move(ctx, file.ContentKey(), versionKey); err != nil {
+			return nil, err
+		}
+		version.Path = storage.PathOf(versionKey)
+	}
+
+	if err := database.DB.Create(&version).Error; err != nil {
+		if file.BlobHash == "" {
+			storage.Default().Move(ctx, storage.VersionKey(file.ID, version.Version), file.ContentKey())
+		}
+		return nil, err
+	}
+
+	file.Version++
+	return &version, nil
+}
+
+// claimFile takes the row of file, as loaded, for new content with the given checksum
+// when the store is conditional on the file still holding content with checksum
+// expected. Doing so in the database makes the check and the write that follows atomic
+// against every other writer, in this process or not.
+func claimFile(file *models.File, expected, checksum string) error {
+	if expected == "" {
+		return nil
+	}
+	claimed, err := models.ClaimFileVersion(file, expected, checksum)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrFileChanged
+	}
+	return nil
+}
+
+// unclaimFile undoes claimFile after the new content failed to store
+func unclaimFile(file *models.File, expected, checksum string) {
+	if expected == "" {
+		return
+	}
+	if err := models.UnclaimFileVersion(file, checksum); err != nil {
+		log.Printf("Failed to release the claim on %s: %v", file.Path, err)
+	}
+}
+
+// restoreVersion undoes keepVersion after the new content failed to store
+func restoreVersion(file *models.File, version *models.FileVersion) {
+	file.Version = version.Version
+	if version.BlobHash == "" {
+		storage.Default().Move(context.Background(), storage.VersionKey(file.ID, version.Version), file.ContentKey())
+	}
+	database.DB.Delete(version)
+}
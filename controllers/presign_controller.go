@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"teltech/config"
+	"teltech/models"
+	"teltech/presign"
+	"teltech/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PresignURL mints a URL that downloads one file (GET) or uploads into one folder (PUT)
+// without a token, for handing to scripts, CI jobs or <img> tags. The URL stops working
+// after expires_in seconds and can be bound to one client address and, for uploads, a
+// file name and a most size.
+func PresignURL(c *gin.Context) {
+	var input struct {
+		Method     string `json:"method" binding:"required"`
+		FilePath   string `json:"file_path"`   // File to download
+		FolderPath string `json:"folder_path"` // Folder to upload into
+		FileName   string `json:"file_name"`   // Name the upload is stored under, if fixed
+		Conflict   string `json:"conflict"`
+		ExpiresIn  int64  `json:"expires_in"` // Seconds the URL is valid for
+		IP         string `json:"ip"`         // Address to bind the URL to
+		BindIP     bool   `json:"bind_ip"`    // Bind the URL to the requesting address
+		MaxSize    int64  `json:"max_size"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	grant := presign.Grant{UserID: c.GetInt("user_id"), IP: input.IP}
+	if input.BindIP {
+		grant.IP = c.ClientIP()
+	}
+
+	switch strings.ToUpper(input.Method) {
+	case http.MethodGet:
+		file, err := models.GetFileByPath(input.FilePath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if !canAccessFile(c, file) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		grant.Method, grant.Path = http.MethodGet, file.Path
+
+	case http.MethodPut:
+		folder, err := models.GetFolderByPath(input.FolderPath)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+		if !canAccessFolder(c, folder) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not own this folder"})
+			return
+		}
+		if input.FileName != "" && !validFileName(input.FileName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+			return
+		}
+		conflict, err := storage.ParseConflict(input.Conflict, config.String("UPLOAD_CONFLICT_DEFAULT", storage.ConflictFail))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if input.MaxSize < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_size"})
+			return
+		}
+		grant.Method, grant.Path, grant.Name = http.MethodPut, folder.Path, input.FileName
+		grant.Conflict, grant.MaxSize = conflict, input.MaxSize
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Method must be GET or PUT"})
+		return
+	}
+
+	expiresIn := time.Duration(input.ExpiresIn) * time.Second
+	if input.ExpiresIn == 0 {
+		expiresIn = config.Duration("PRESIGN_DEFAULT_EXPIRY", 15*time.Minute)
+	}
+	if expiresIn <= 0 || expiresIn > config.Duration("PRESIGN_MAX_EXPIRY", 7*24*time.Hour) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_in"})
+		return
+	}
+	grant.Expires = time.Now().Add(expiresIn).Truncate(time.Second)
+
+	query, err := presign.Sign(grant)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url":        baseURL(c) + "/file/presigned?" + query.Encode(),
+		"method":     grant.Method,
+		"expires_at": grant.Expires,
+	})
+}
+
+// PresignedDownload serves the file a pre-signed GET URL grants, like DownloadFile but
+// inline, so the URL can be used as the source of an image or video
+func PresignedDownload(c *gin.Context) {
+	grant, ok := verifyPresigned(c)
+	if !ok {
+		return
+	}
+	file, err := models.GetFileByPath(grant.Path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	serveObject(c, file.ContentKey(), file.Name, serveOptions{File: file})
+}
+
+// PresignedUpload stores the request body in the folder a pre-signed PUT URL grants,
+// under the name the URL fixes or else the filename parameter. Uploads are limited by
+// the URL's size, UPLOAD_MAX_SIZE and the quota of the user who minted it.
+func PresignedUpload(c *gin.Context) {
+	grant, ok := verifyPresigned(c)
+	if !ok {
+		return
+	}
+	folder, err := models.GetFolderByPath(grant.Path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+	name := grant.Name
+	if name == "" {
+		name = c.Query("filename")
+	}
+	if !validFileName(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name"})
+		return
+	}
+	digest, err := storage.ParseDigest(c.GetHeader("X-Content-SHA256"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := config.Int64("UPLOAD_MAX_SIZE", 0)
+	if grant.MaxSize > 0 && (limit == 0 || grant.MaxSize < limit) {
+		limit = grant.MaxSize
+	}
+	sizeLimit := limit
+	remaining, err := quotaRemaining(grant.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return
+	}
+	if remaining == 0 {
+		respondStoreError(c, ErrQuotaExceeded)
+		return
+	}
+	if remaining > 0 && (limit == 0 || remaining < limit) {
+		limit = remaining
+	}
+	if limit > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1)
+	}
+
+	file, err := storeFile(c.Request.Context(), folder, name, c.Request.Body, storeOptions{
+		Conflict: grant.Conflict,
+		MaxSize:  limit,
+		Digest:   digest,
+		OwnerID:  grant.UserID,
+	})
+	var maxBytesErr *http.MaxBytesError
+	if (errors.Is(err, storage.ErrTooLarge) || errors.As(err, &maxBytesErr)) && limit != sizeLimit {
+		err = ErrQuotaExceeded
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	models.RecordAuditEvent("file.presigned_upload", grant.UserID, file.Path,
+		fmt.Sprintf("Uploaded %d bytes from %s", file.Size, c.ClientIP()))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "File uploaded successfully",
+		"path":          file.Path,
+		"name":          file.Name,
+		"size":          file.Size,
+		"sha256":        file.Checksum,
+		"version":       file.Version,
+		"metadata":      file.Metadata,
+		"active_shares": activeShareCount(file.ID),
+	})
+}
+
+// verifyPresigned checks the signature of a pre-signed URL, responding with an error
+// when it cannot be used
+func verifyPresigned(c *gin.Context) (*presign.Grant, bool) {
+	grant, err := presign.Verify(c.Request.URL.Query(), c.Request.Method, c.ClientIP())
+	switch {
+	case errors.Is(err, presign.ErrNotConfigured):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		return grant, true
+	}
+	return nil, false
+}
+
+// validFileName reports whether name can be used as the name of an uploaded file: a
+// single path element that does not start with a dot
+func validFileName(name string) bool {
+	return name != "" && name == filepath.Base(filepath.Clean("/"+name)) && !strings.HasPrefix(name, ".")
+}
+
+// baseURL returns PUBLIC_BASE_URL, for building absolute URLs to hand out. Only when it
+// is not set are the scheme and host taken from the request, which the client controls.
+func baseURL(c *gin.Context) string {
+	if base := strings.TrimRight(config.String("PUBLIC_BASE_URL", ""), "/"); base != "" {
+		return base
+	}
+	scheme := "http"
+	if isHTTPS(c) {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
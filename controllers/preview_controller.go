@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"teltech/models"
+	"teltech/preview"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreviewFile renders a text file as an HTML fragment for viewing in the browser. The
+// page parameter picks the page of CSV and TSV tables and charset overrides the
+// character set detected.
+func PreviewFile(c *gin.Context) {
+	file, err := models.GetFileByPath(c.Query("file_path"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	respondPreview(c, file)
+}
+
+// PreviewSharedFile renders a shared file, or the file at the relative path parameter
+// inside a shared folder, like PreviewFile
+func PreviewSharedFile(c *gin.Context) {
+	share, ok := loadReadableShare(c)
+	if !ok {
+		return
+	}
+	file, ok := sharedFile(c, share)
+	if !ok {
+		return
+	}
+	serveShared(c, share, false, func() { respondPreview(c, file) })
+}
+
+// respondPreview renders file and responds with the preview
+func respondPreview(c *gin.Context, file *models.File) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+		return
+	}
+
+	p, err := preview.Render(c.Request.Context(), file, preview.Options{Page: page, Charset: c.Query("charset")})
+	switch {
+	case errors.Is(err, preview.ErrUnsupported):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, preview.ErrCharset):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render preview"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"name": file.Name, "size": file.Size, "preview": p})
+	}
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/preview"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPreviewFile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, _ := models.CreateFolder("docs", filepath.Join(root, "docs"), uid)
+	os.MkdirAll(docs.Path, 0755)
+	store := func(path, mimeType, content string, ownerID int) *models.File {
+		os.WriteFile(path, []byte(content), 0644)
+		file := &models.File{Name: filepath.Base(path), Path: path, Size: int64(len(content)), MimeType: mimeType, Version: 1, FolderID: docs.ID, OwnerID: ownerID}
+		database.DB.Create(file)
+		return file
+	}
+	readme := store(filepath.Join(docs.Path, "README.md"), "text/markdown", "# Hello", uid)
+	store(filepath.Join(docs.Path, "a.png"), "image/png", "\x89PNG", uid)
+	store(filepath.Join(docs.Path, "theirs.txt"), "text/plain", "private", uid+1)
+	store(filepath.Join(root, "outside.txt"), "text/plain", "outside", uid)
+	database.DB.Create(&models.FileShare{FolderID: &docs.ID, ShareLink: "folder", AccessType: "read"})
+	database.DB.Create(&models.FileShare{FileID: &readme.ID, ShareLink: "file", AccessType: "read"})
+
+	r := gin.New()
+	r.GET("/preview", func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Set("role", "user")
+		PreviewFile(c)
+	})
+	r.GET("/share/:share_link/preview", PreviewSharedFile)
+
+	tests := []struct {
+		name     string
+		target   string
+		want     int
+		wantKind string
+	}{
+		{name: "own file", target: "/preview?" + url.Values{"file_path": {readme.Path}}.Encode(), want: http.StatusOK, wantKind: preview.Markdown},
+		{name: "invalid page", target: "/preview?" + url.Values{"file_path": {readme.Path}, "page": {"0"}}.Encode(), want: http.StatusBadRequest},
+		{name: "unknown charset", target: "/preview?" + url.Values{"file_path": {readme.Path}, "charset": {"klingon"}}.Encode(), want: http.StatusBadRequest},
+		{name: "not text", target: "/preview?" + url.Values{"file_path": {filepath.Join(docs.Path, "a.png")}}.Encode(), want: http.StatusUnsupportedMediaType},
+		{name: "someone else's file", target: "/preview?" + url.Values{"file_path": {filepath.Join(docs.Path, "theirs.txt")}}.Encode(), want: http.StatusForbidden},
+		{name: "unknown file", target: "/preview?" + url.Values{"file_path": {filepath.Join(docs.Path, "gone.txt")}}.Encode(), want: http.StatusNotFound},
+		{name: "shared file", target: "/share/file/preview", want: http.StatusOK, wantKind: preview.Markdown},
+		// Everything in a shared folder is shared, whoever owns it
+		{name: "file in a shared folder", target: "/share/folder/preview?path=theirs.txt", want: http.StatusOK, wantKind: preview.Text},
+		{name: "path leaving the shared folder", target: "/share/folder/preview?path=../outside.txt", want: http.StatusNotFound},
+		{name: "unknown link", target: "/share/nope/preview", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var resp struct{ Preview preview.Preview }
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Preview.Kind != tt.wantKind || resp.Preview.HTML == "" {
+				t.Fatalf("unexpected preview %s", w.Body)
+			}
+		})
+	}
+}
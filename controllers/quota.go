@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"errors"
+	"teltech/config"
+	"teltech/models"
+)
+
+// ErrQuotaExceeded is returned when storing content would take a user past USER_QUOTA
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// quotaRemaining returns how many more bytes a user may store, or -1 when there is no
+// quota
+func quotaRemaining(userID int) (int64, error) {
+	quota := config.Int64("USER_QUOTA", 0)
+	if quota <= 0 {
+		return -1, nil
+	}
+	used, err := models.GetStorageUsed(userID)
+	if err != nil {
+		return 0, err
+	}
+	if used >= quota {
+		return 0, nil
+	}
+	return quota - used, nil
+}
@@ -0,0 +1,238 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"teltech/models"
+	"teltech/preview"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sharedEntry is a folder or file listed on the page of a shared folder
+type sharedEntry struct {
+	Name        string
+	Size        string
+	Modified    string
+	URL         string // Page of a folder, or view of a file
+	DownloadURL string // Download of a file
+}
+
+// uploadNotice is the outcome of an upload shown on the page of a write share
+type uploadNotice struct {
+	Message string
+	Error   bool
+}
+
+// renderSharedFolder renders the page of a shared folder, or of the subfolder at the
+// relative path parameter, listing its folders and files with links to browse, view
+// and download them. Write shares add a form to upload files, with the outcome of the
+// last upload if there is one, and upload-only shares show nothing but the form.
+func renderSharedFolder(c *gin.Context, share *models.FileShare, status int, notice *uploadNotice) {
+	root, err := models.GetFolderByID(*share.FolderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+	base := "/file/share/" + share.ShareLink
+	data := gin.H{"Title": root.Name, "Notice": notice}
+	if share.TakesUploads() {
+		data["Upload"] = gin.H{
+			"URL":    base + "/upload",
+			"Accept": share.AllowedTypes,
+			"Limits": uploadLimits(share),
+			"Closed": share.UploadsClosed(),
+		}
+	}
+	if share.UploadOnly() {
+		data["Hidden"] = true
+		c.HTML(status, "share_folder.html", data)
+		return
+	}
+
+	rel := sharedRel(c.Query("path"))
+	folder, err := models.GetFolderByPath(filepath.Join(root.Path, filepath.FromSlash(rel)))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+
+	subfolders, err := models.GetSubfolders(folder.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+		return
+	}
+	files, err := models.GetFilesInFolder(folder.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	var folders, entries []sharedEntry
+	for _, sub := range subfolders {
+		folders = append(folders, sharedEntry{Name: sub.Name, URL: sharedURL(base, "", path.Join(rel, sub.Name))})
+	}
+	for _, file := range files {
+		entries = append(entries, sharedEntry{
+			Name:        file.Name,
+			Size:        formatSize(file.Size),
+			Modified:    file.UpdatedAt.Format("2006-01-02 15:04"),
+			URL:         sharedURL(base, "/view", path.Join(rel, file.Name)),
+			DownloadURL: sharedURL(base, "/file", path.Join(rel, file.Name)),
+		})
+	}
+
+	// Breadcrumbs lead from the shared folder down to this one
+	crumbs := []sharedEntry{{Name: root.Name, URL: base}}
+	if rel != "" {
+		for i, part := range strings.Split(rel, "/") {
+			crumbs = append(crumbs, sharedEntry{Name: part, URL: sharedURL(base, "", strings.Join(strings.Split(rel, "/")[:i+1], "/"))})
+		}
+	}
+
+	data["Title"] = folder.Name
+	data["Breadcrumbs"] = crumbs
+	data["Folders"] = folders
+	data["Files"] = entries
+	data["ZipURL"] = sharedURL(base, "/zip", rel)
+	c.HTML(status, "share_folder.html", data)
+}
+
+// DownloadSharedFolderFile downloads the file at the relative path parameter inside a
+// shared folder. With inline=1 it is served for display in the browser instead.
+func DownloadSharedFolderFile(c *gin.Context) {
+	share, ok := loadReadableShare(c)
+	if !ok {
+		return
+	}
+	if share.FolderID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only files in shared folders can be picked by path"})
+		return
+	}
+	file, ok := sharedFile(c, share)
+	if !ok {
+		return
+	}
+	download := c.Query("inline") != "1"
+	serveShared(c, share, download, func() {
+		serveObject(c, file.ContentKey(), file.Name, serveOptions{
+			File:       file,
+			Attachment: download,
+			StripGPS:   share.StripGPS,
+		})
+	})
+}
+
+// ViewSharedFile renders a page showing a shared file, or the file at the relative path
+// parameter inside a shared folder: text is previewed, images, audio and video are
+// embedded and anything else is offered for download
+func ViewSharedFile(c *gin.Context) {
+	share, ok := loadReadableShare(c)
+	if !ok {
+		return
+	}
+	renderSharedFile(c, share)
+}
+
+// renderSharedFile renders the page of ViewSharedFile, which is also the landing page of
+// file shares
+func renderSharedFile(c *gin.Context, share *models.FileShare) {
+	file, ok := sharedFile(c, share)
+	if !ok {
+		return
+	}
+
+	base := "/file/share/" + share.ShareLink
+	rel := sharedRel(c.Query("path"))
+	data := gin.H{
+		"Title":       file.Name,
+		"Name":        file.Name,
+		"Size":        formatSize(file.Size),
+		"DownloadURL": base + "?dl=1",
+		"BackURL":     "",
+	}
+	if share.FolderID != nil {
+		data["DownloadURL"] = sharedURL(base, "/file", rel)
+		data["BackURL"] = sharedURL(base, "", path.Dir("/" + rel)[1:])
+	}
+	inlineURL := data["DownloadURL"].(string)
+	if strings.Contains(inlineURL, "?") {
+		inlineURL += "&inline=1"
+	} else {
+		inlineURL += "?inline=1"
+	}
+
+	mimeType := strings.ToLower(strings.TrimSpace(strings.Split(file.MimeType, ";")[0]))
+	switch {
+	case strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml":
+		data["Image"] = inlineURL
+	case strings.HasPrefix(mimeType, "video/"):
+		data["Video"] = inlineURL
+	case strings.HasPrefix(mimeType, "audio/"):
+		data["Audio"] = inlineURL
+	default:
+		if p, err := preview.Render(c.Request.Context(), file, preview.Options{Page: 1}); err == nil {
+			data["Preview"] = template.HTML(p.HTML) // Sanitized by the preview package
+			data["Truncated"] = p.Truncated
+		}
+	}
+	c.HTML(http.StatusOK, "share_view.html", data)
+	if data["Preview"] != nil {
+		touchShare(c, share) // The content was shown, though not downloaded
+	}
+}
+
+// sharedFile finds the file of a file share, or the file at the relative path parameter
+// inside a folder share, responding with an error when there is none
+func sharedFile(c *gin.Context, share *models.FileShare) (*models.File, bool) {
+	var file *models.File
+	var err error
+	if share.FolderID != nil {
+		var folder *models.Folder
+		if folder, err = models.GetFolderByID(*share.FolderID); err == nil {
+			file, err = models.GetFileByPath(filepath.Join(folder.Path, filepath.FromSlash(sharedRel(c.Query("path")))))
+		}
+	} else if share.FileID != nil {
+		file, err = models.GetFileByID(*share.FileID)
+	}
+	if file == nil || err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	return file, true
+}
+
+// sharedRel cleans a path relative to a shared folder so it cannot leave it, returning
+// it slash-separated without leading or trailing slashes
+func sharedRel(rel string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(rel, `\`, "/")), "/")
+}
+
+// sharedURL returns the URL of a page or download of a share for the relative path
+func sharedURL(base, suffix, rel string) string {
+	if rel == "" {
+		return base + suffix
+	}
+	return base + suffix + "?" + url.Values{"path": {rel}}.Encode()
+}
+
+// formatSize formats a byte count for people
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSharedRel(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"/":            "",
+		"sub/a.txt":    "sub/a.txt",
+		"/sub/":        "sub",
+		"../a.txt":     "a.txt",
+		"sub/../../b":  "b",
+		`..\..\etc`:    "etc",
+		"./sub//a.txt": "sub/a.txt",
+	}
+	for rel, want := range tests {
+		if got := sharedRel(rel); got != want {
+			t.Errorf("sharedRel(%q) = %q, want %q", rel, got, want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{0: "0 B", 1023: "1023 B", 1024: "1.0 KiB", 1536: "1.5 KiB", 5 << 20: "5.0 MiB", 3 << 30: "3.0 GiB"}
+	for size, want := range tests {
+		if got := formatSize(size); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
+
+func TestBrowseSharedFolder(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	uid := 7
+
+	folder := func(path string) *models.Folder {
+		os.MkdirAll(path, 0755)
+		created, _ := models.CreateFolder(filepath.Base(path), path, uid)
+		return created
+	}
+	store := func(parent *models.Folder, name, mimeType string) {
+		path := filepath.Join(parent.Path, name)
+		os.WriteFile(path, []byte("content of "+name), 0644)
+		database.DB.Create(&models.File{Name: name, Path: path, Size: int64(len("content of " + name)), Checksum: "sum-" + name,
+			MimeType: mimeType, Version: 1, FolderID: parent.ID, OwnerID: uid})
+	}
+	outside := folder(filepath.Join(root, "private"))
+	docs := folder(filepath.Join(root, "docs"))
+	sub := folder(filepath.Join(docs.Path, "sub"))
+	store(outside, "secret.txt", "text/plain")
+	store(docs, "a.txt", "text/plain")
+	store(sub, "b.md", "text/markdown")
+	database.DB.Create(&models.FileShare{FolderID: &docs.ID, ShareLink: "docs", AccessType: "read", CreatedBy: uid})
+
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.GET("/file/share/:share_link", AccessSharedFile)
+	r.GET("/file/share/:share_link/file", DownloadSharedFolderFile)
+	r.GET("/file/share/:share_link/view", ViewSharedFile)
+
+	tests := []struct {
+		name       string
+		target     string
+		html       bool
+		want       int
+		wantBody   []string // Text the response must hold
+		rejectBody []string // Text it must not
+	}{
+		{name: "folder page", target: "/file/share/docs", html: true, want: http.StatusOK,
+			wantBody: []string{"sub", "a.txt", "/file/share/docs/zip"}, rejectBody: []string{"b.md", "secret.txt"}},
+		{name: "subfolder page", target: "/file/share/docs?path=sub", html: true, want: http.StatusOK,
+			wantBody: []string{"b.md", "/file/share/docs/view?path=sub%2Fb.md"}, rejectBody: []string{"a.txt"}},
+		// Paths cannot climb out of the shared folder
+		{name: "path leaving the folder", target: "/file/share/docs?path=../private", html: true, want: http.StatusNotFound},
+		{name: "parent clamped to the folder", target: "/file/share/docs?path=sub/../..", html: true, want: http.StatusOK, wantBody: []string{"a.txt"}},
+		{name: "file in a subfolder", target: "/file/share/docs/file?path=sub/b.md", want: http.StatusOK, wantBody: []string{"content of b.md"}},
+		{name: "file outside the folder", target: "/file/share/docs/file?path=../private/secret.txt", want: http.StatusNotFound},
+		{name: "text file view", target: "/file/share/docs/view?path=sub/b.md", want: http.StatusOK, wantBody: []string{"content of b.md"}},
+		{name: "unknown file view", target: "/file/share/docs/view?path=gone.txt", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.html {
+				req.Header.Set("Accept", "text/html,application/xhtml+xml")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			for _, text := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), text) {
+					t.Errorf("%q missing from %s", text, w.Body)
+				}
+			}
+			for _, text := range tt.rejectBody {
+				if strings.Contains(w.Body.String(), text) {
+					t.Errorf("%q in %s", text, w.Body)
+				}
+			}
+		})
+	}
+
+	// Files shown inline on a page are not downloads; attachments are
+	for _, target := range []string{"/file/share/docs/file?path=a.txt&inline=1", "/file/share/docs/file?path=a.txt"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	share, _ := models.GetShareByID(1)
+	if share.DownloadCount != 2 || share.LastAccessedAt == nil {
+		t.Fatalf("counted %d downloads", share.DownloadCount)
+	}
+}
+
+func TestSharedFileLanding(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{}, &models.FileShare{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	uid := 7
+
+	store := func(name, mimeType, content string) *models.File {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, []byte(content), 0644)
+		file := &models.File{Name: name, Path: path, Size: int64(len(content)), Checksum: "sum-" + name,
+			MimeType: mimeType, Version: 1, FolderID: 1, OwnerID: uid}
+		database.DB.Create(file)
+		return file
+	}
+	notes := store("notes.md", "text/markdown", "# Meeting notes")
+	photo := store("photo.png", "image/png", "\x89PNG")
+	database.DB.Create(&models.FileShare{FileID: &notes.ID, ShareLink: "notes", AccessType: "read", CreatedBy: uid})
+	database.DB.Create(&models.FileShare{FileID: &photo.ID, ShareLink: "photo", AccessType: "read", CreatedBy: uid})
+
+	r := gin.New()
+	r.LoadHTMLGlob("../templates/*")
+	r.GET("/file/share/:share_link", AccessSharedFile)
+
+	tests := []struct {
+		name           string
+		target         string
+		html           bool
+		wantBody       []string // Text the response must hold
+		wantAttachment bool
+	}{
+		{name: "landing page", target: "/file/share/notes", html: true,
+			wantBody: []string{"notes.md", "15 B", "Meeting notes", `href="/file/share/notes?dl=1"`}},
+		{name: "image landing page", target: "/file/share/photo", html: true,
+			wantBody: []string{"photo.png", `src="/file/share/photo?dl=1&amp;inline=1"`}},
+		{name: "download button", target: "/file/share/notes?dl=1", html: true, wantBody: []string{"# Meeting notes"}, wantAttachment: true},
+		// Scripts get the file without asking for it
+		{name: "other clients", target: "/file/share/notes", wantBody: []string{"# Meeting notes"}},
+		{name: "direct download", target: "/file/share/notes?dl=1", wantBody: []string{"# Meeting notes"}, wantAttachment: true},
+		{name: "embedded on the page", target: "/file/share/photo?dl=1&inline=1", wantBody: []string{"PNG"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.html {
+				req.Header.Set("Accept", "text/html,application/xhtml+xml")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			for _, text := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), text) {
+					t.Errorf("%q missing from %s", text, w.Body)
+				}
+			}
+			if attachment := strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment"); attachment != tt.wantAttachment {
+				t.Errorf("got Content-Disposition %q", w.Header().Get("Content-Disposition"))
+			}
+		})
+	}
+
+	// Landing pages and what they embed are not downloads
+	for id, want := range map[int]int{1: 3, 2: 0} {
+		share, _ := models.GetShareByID(id)
+		if share.DownloadCount != want {
+			t.Errorf("share %s counted %d downloads, want %d", share.ShareLink, share.DownloadCount, want)
+		}
+	}
+}
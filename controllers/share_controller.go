@@ -3,22 +3,40 @@ package controllers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
+	"log"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
 	"time"
 
+	"teltech/config"
 	"teltech/database"
+	"teltech/mailer"
 	"teltech/models"
 
 	"github.com/gin-gonic/gin"
 )
 
-// GenerateShareableLink generates a link for sharing a file
+// GenerateShareableLink generates a link for sharing a file or a folder. Only admins and
+// the owner of the file or folder may share it.
 func GenerateShareableLink(c *gin.Context) {
 	var input struct {
-		FileID     int    `json:"file_id" binding:"required"` // ID of the file to share
-		AccessType string `json:"access_type"`                // "read" or "write"
-		Expiration string `json:"expiration"`                 // Expiration date (optional, RFC3339 format)
-		Password   string `json:"password"`                   // Password for protection (optional)
+		FileID       int    `json:"file_id"`       // ID of the file to share
+		FolderID     int    `json:"folder_id"`     // ID of the folder to share, instead of a file
+		AccessType   string `json:"access_type"`   // "read" or "write"
+		Expiration   string `json:"expiration"`    // Expiration date (optional, RFC3339 format, SHARE_LINK_EXPIRY_DAYS from now by default)
+		Password     string `json:"password"`      // Password for protection (optional)
+		StripGPS     *bool  `json:"strip_gps"`     // Remove the location from shared photos (optional)
+		MaxDownloads int    `json:"max_downloads"` // Downloads after which the link stops working (optional)
+		Notify       bool   `json:"notify"`        // Email the creator of the first access and of uploads (optional)
+
+		// Write shares of folders take uploads, as drop boxes
+		HideContents   bool   `json:"hide_contents"`   // Only take uploads, without showing the folder (optional)
+		MaxUploadSize  int64  `json:"max_upload_size"` // Largest file that may be uploaded (optional)
+		AllowedTypes   string `json:"allowed_types"`   // Comma separated extensions or MIME types that may be uploaded (optional)
+		UploadDeadline string `json:"upload_deadline"` // When uploads close (optional, RFC3339 format)
 	}
 
 	// Bind JSON input
@@ -26,18 +44,84 @@ func GenerateShareableLink(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if (input.FileID == 0) == (input.FolderID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either file_id or folder_id is required"})
+		return
+	}
 
-	// Verify the file exists
-	var file models.File
-	if err := database.DB.First(&file, input.FileID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	// Verify the file or folder exists
+	if input.MaxDownloads < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_downloads"})
+		return
+	}
+	if input.AccessType == "" {
+		input.AccessType = "read"
+	}
+	if input.AccessType != "read" && input.AccessType != "write" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Access type must be read or write"})
+		return
+	}
+	if input.AccessType == "write" && input.FolderID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Write access needs a folder share"})
+		return
+	}
+	if input.MaxUploadSize < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_upload_size"})
+		return
+	}
+	share := models.FileShare{
+		AccessType:    input.AccessType,
+		CreatedBy:     c.GetInt("user_id"),
+		MaxDownloads:  input.MaxDownloads,
+		Notify:        input.Notify,
+		HideContents:  input.HideContents,
+		MaxUploadSize: input.MaxUploadSize,
+		AllowedTypes:  input.AllowedTypes,
+	}
+	if input.UploadDeadline != "" {
+		deadline, err := time.Parse(time.RFC3339, input.UploadDeadline)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload_deadline format"})
+			return
+		}
+		share.UploadDeadline = &deadline
+	}
+	if err := share.SetPassword(input.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
+	share.StripGPS = config.Bool("SHARE_STRIP_GPS", false)
+	if input.StripGPS != nil {
+		share.StripGPS = *input.StripGPS
+	}
+	if input.FileID != 0 {
+		var file models.File
+		if err := database.DB.First(&file, input.FileID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if !canAccessFile(c, &file) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You may not share this file"})
+			return
+		}
+		share.FileID = &file.ID
+	} else {
+		folder, err := models.GetFolderByID(input.FolderID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+		if !canAccessFolder(c, folder) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You may not share this folder"})
+			return
+		}
+		share.FolderID = &folder.ID
+	}
 
 	// Generate a random share link
 	shareLink := generateRandomLink()
 
-	// Parse expiration date (if provided)
+	// Parse expiration date (if provided), or apply the default
 	var expiration *time.Time
 	if input.Expiration != "" {
 		exp, err := time.Parse(time.RFC3339, input.Expiration)
@@ -46,68 +130,536 @@ func GenerateShareableLink(c *gin.Context) {
 			return
 		}
 		expiration = &exp
+	} else if days := config.Int64("SHARE_LINK_EXPIRY_DAYS", 0); days > 0 {
+		exp := time.Now().AddDate(0, 0, int(days))
+		expiration = &exp
 	}
 
 	// Create the share record
-	share := models.FileShare{
-		FileID:     input.FileID,
-		ShareLink:  shareLink,
-		AccessType: input.AccessType,
-		Expiration: expiration,
-		Password:   input.Password,
-	}
+	share.ShareLink = shareLink
+	share.Expiration = expiration
 
 	if err := database.DB.Create(&share).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
 		return
 	}
 
+	models.RecordAuditEvent("share.created", share.CreatedBy, shareLink, shareSubject(&share))
+
 	c.JSON(http.StatusOK, gin.H{
-		"share_link": shareLink,
-		"message":    "Share link generated successfully",
+		"id":           share.ID,
+		"share_link":   shareLink,
+		"url":          shareURL(c, &share),
+		"download_url": shareURL(c, &share) + "?dl=1",
+		"expiration":   share.Expiration,
+		"message":      "Share link generated successfully",
 	})
 }
 
-// AccessSharedFile allows users to access a file via a shareable link
+// AccessSharedFile allows users to access a file via a shareable link. Browsers get a
+// landing page: shared files show their name, size and a preview with a download
+// button, shared folders a page to browse them, and to upload to write shares. Other
+// clients, and links with dl=1, download the file, or the folder as a ZIP archive.
 func AccessSharedFile(c *gin.Context) {
+	share, ok := loadShare(c)
+	if !ok {
+		return
+	}
+	landing := wantsHTML(c) && c.Query("dl") != "1"
+	if share.FolderID != nil {
+		if landing {
+			renderSharedFolder(c, share, http.StatusOK, nil)
+			return
+		}
+		if share.UploadOnly() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This share only accepts uploads"})
+			return
+		}
+		serveShared(c, share, true, func() { serveSharedFolderZip(c, share) })
+		return
+	}
+
+	if landing {
+		renderSharedFile(c, share)
+		return
+	}
+
+	// Find the file and serve it
+	var file models.File
+	if share.FileID == nil || database.DB.First(&file, *share.FileID).Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Serve the file, as an attachment for the download button; what the landing page
+	// embeds with inline=1 is not a download
+	download := c.Query("inline") != "1"
+	serveShared(c, share, download, func() {
+		serveObject(c, file.ContentKey(), file.Name, serveOptions{
+			File:       &file,
+			Attachment: download && c.Query("dl") == "1",
+			StripGPS:   share.StripGPS,
+		})
+	})
+}
+
+// loadShare finds the share named in the request and checks that it may be used,
+// responding with an error otherwise. Shares with a password must have been unlocked
+// with UnlockShare.
+func loadShare(c *gin.Context) (*models.FileShare, bool) {
+	share, ok := findShare(c)
+	if !ok {
+		return nil, false
+	}
+	if share.Password != "" && !unlocked(c, share) {
+		c.Set("share_outcome", models.SharePasswordRequired)
+		respondLocked(c, share, http.StatusUnauthorized, "Password required")
+		return nil, false
+	}
+	return share, true
+}
+
+// findShare finds the share named in the request and checks that it is neither revoked,
+// expired nor used up, responding with an error otherwise. The share is kept in the
+// context for ShareAccessLog.
+func findShare(c *gin.Context) (*models.FileShare, bool) {
 	shareLink := c.Param("share_link")
 	var share models.FileShare
 
 	// Find the share record
 	if err := database.DB.Where("share_link = ?", shareLink).First(&share).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
-		return
+		return nil, false
+	}
+
+	c.Set("share", &share)
+
+	if share.RevokedAt != nil {
+		c.Set("share_outcome", models.ShareRevoked)
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has been revoked"})
+		return nil, false
 	}
 
 	// Check expiration
 	if share.Expiration != nil && time.Now().After(*share.Expiration) {
+		c.Set("share_outcome", models.ShareExpired)
 		c.JSON(http.StatusForbidden, gin.H{"error": "Share link has expired"})
+		return nil, false
+	}
+
+	if share.MaxDownloads > 0 && share.DownloadCount >= share.MaxDownloads {
+		c.Set("share_outcome", models.ShareLimitReached)
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has reached its download limit"})
+		return nil, false
+	}
+	return &share, true
+}
+
+// generateRandomLink generates a secure random string for the share link
+func generateRandomLink() string {
+	bytes := make([]byte, 16)
+	_, _ = rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// ListShares lists share links. The file_id or folder_id parameter lists the links of a
+// file or of a folder and the files in it, user_id the links a user created and no
+// parameter the caller's own links, or every link for admins. Revoked and expired links
+// are left out unless include_inactive is true.
+func ListShares(c *gin.Context) {
+	var filter models.ShareFilter
+	var err error
+	for param, field := range map[string]*int{"file_id": &filter.FileID, "folder_id": &filter.FolderID, "user_id": &filter.CreatedBy} {
+		if value := c.Query(param); value != "" {
+			if *field, err = strconv.Atoi(value); err != nil || *field <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+		}
+	}
+	filter.IncludeInactive = c.Query("include_inactive") == "true"
+
+	userID := c.GetInt("user_id")
+	role, _ := c.Get("role")
+	switch {
+	case filter.FileID != 0:
+		file, err := models.GetFileByID(filter.FileID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if !canAccessFile(c, file) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+	case filter.FolderID != 0:
+		folder, err := models.GetFolderByID(filter.FolderID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+		if !canAccessFolder(c, folder) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+	case filter.CreatedBy != 0:
+		if role != "admin" && filter.CreatedBy != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+	case role != "admin":
+		filter.CreatedBy = userID
+	}
+
+	shares, err := models.ListShares(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list shares"})
+		return
+	}
+	response := make([]gin.H, len(shares))
+	for i := range shares {
+		response[i] = shareResponse(c, &shares[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": response})
+}
+
+// UpdateShare changes the settings of a share link. Only the fields given change; an
+// empty expiration, password or upload deadline removes it.
+func UpdateShare(c *gin.Context) {
+	var input struct {
+		AccessType   *string `json:"access_type"`
+		Expiration   *string `json:"expiration"` // RFC3339
+		Password     *string `json:"password"`
+		StripGPS     *bool   `json:"strip_gps"`
+		MaxDownloads *int    `json:"max_downloads"` // 0 removes the limit
+		Notify       *bool   `json:"notify"`
+
+		HideContents   *bool   `json:"hide_contents"`
+		MaxUploadSize  *int64  `json:"max_upload_size"` // 0 removes the limit
+		AllowedTypes   *string `json:"allowed_types"`   // Empty allows any type
+		UploadDeadline *string `json:"upload_deadline"` // RFC3339
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	share, ok := loadManagedShare(c)
+	if !ok {
 		return
 	}
 
-	// Check password (if set)
-	if share.Password != "" {
-		providedPassword := c.Query("password")
-		if providedPassword != share.Password {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+	if input.AccessType != nil {
+		if *input.AccessType != "read" && *input.AccessType != "write" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Access type must be read or write"})
+			return
+		}
+		if *input.AccessType == "write" && share.FolderID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Write access needs a folder share"})
+			return
+		}
+		share.AccessType = *input.AccessType
+	}
+	if input.Expiration != nil {
+		share.Expiration = nil
+		if *input.Expiration != "" {
+			exp, err := time.Parse(time.RFC3339, *input.Expiration)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiration format"})
+				return
+			}
+			share.Expiration = &exp
+		}
+	}
+	if input.Password != nil {
+		if err := share.SetPassword(*input.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+	}
+	if input.StripGPS != nil {
+		share.StripGPS = *input.StripGPS
+	}
+	if input.MaxDownloads != nil {
+		if *input.MaxDownloads < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_downloads"})
+			return
+		}
+		share.MaxDownloads = *input.MaxDownloads
+	}
+	if input.Notify != nil {
+		share.Notify = *input.Notify
+	}
+	if input.HideContents != nil {
+		share.HideContents = *input.HideContents
+	}
+	if input.MaxUploadSize != nil {
+		if *input.MaxUploadSize < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid max_upload_size"})
 			return
 		}
+		share.MaxUploadSize = *input.MaxUploadSize
+	}
+	if input.AllowedTypes != nil {
+		share.AllowedTypes = *input.AllowedTypes
+	}
+	if input.UploadDeadline != nil {
+		share.UploadDeadline = nil
+		if *input.UploadDeadline != "" {
+			deadline, err := time.Parse(time.RFC3339, *input.UploadDeadline)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload_deadline format"})
+				return
+			}
+			share.UploadDeadline = &deadline
+		}
 	}
 
-	// Find the file and serve it
-	var file models.File
-	if err := database.DB.First(&file, share.FileID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	if err := database.DB.Select("access_type", "expiration", "password", "strip_gps", "max_downloads", "notify",
+		"hide_contents", "max_upload_size", "allowed_types", "upload_deadline").Save(share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update share"})
 		return
 	}
+	models.RecordAuditEvent("share.updated", c.GetInt("user_id"), share.ShareLink, shareSubject(share))
+	c.JSON(http.StatusOK, gin.H{"message": "Share updated successfully", "share": shareResponse(c, share)})
+}
 
-	// Serve the file
-	c.File(file.Path)
+// RevokeShare stops a share link from working. It is kept, revoked, for the record.
+func RevokeShare(c *gin.Context) {
+	share, ok := loadManagedShare(c)
+	if !ok {
+		return
+	}
+	if err := models.RevokeShare(share.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share"})
+		return
+	}
+	models.RecordAuditEvent("share.revoked", c.GetInt("user_id"), share.ShareLink, shareSubject(share))
+	c.JSON(http.StatusOK, gin.H{"message": "Share revoked successfully"})
 }
 
-// generateRandomLink generates a secure random string for the share link
-func generateRandomLink() string {
-	bytes := make([]byte, 16)
-	_, _ = rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+// loadManagedShare finds the share named by the id parameter and checks that the
+// requesting user may manage it: admins, the user who created it and the owner of what
+// it shares may
+func loadManagedShare(c *gin.Context) (*models.FileShare, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share ID"})
+		return nil, false
+	}
+	share, err := models.GetShareByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return nil, false
+	}
+
+	allowed := share.CreatedBy == c.GetInt("user_id")
+	if !allowed && share.FileID != nil {
+		file, err := models.GetFileByID(*share.FileID)
+		allowed = err == nil && canAccessFile(c, file)
+	} else if !allowed && share.FolderID != nil {
+		folder, err := models.GetFolderByID(*share.FolderID)
+		allowed = err == nil && canAccessFolder(c, folder)
+	}
+	if role, _ := c.Get("role"); !allowed && role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return share, true
+}
+
+// shareResponse describes a share link to its managers. The password itself is never
+// returned, only whether there is one.
+func shareResponse(c *gin.Context, share *models.FileShare) gin.H {
+	return gin.H{
+		"id":               share.ID,
+		"share_link":       share.ShareLink,
+		"url":              shareURL(c, share),
+		"file_id":          share.FileID,
+		"folder_id":        share.FolderID,
+		"access_type":      share.AccessType,
+		"expiration":       share.Expiration,
+		"has_password":     share.Password != "",
+		"strip_gps":        share.StripGPS,
+		"created_by":       share.CreatedBy,
+		"created_at":       share.CreatedAt,
+		"revoked_at":       share.RevokedAt,
+		"max_downloads":    share.MaxDownloads,
+		"download_count":   share.DownloadCount,
+		"last_accessed_at": share.LastAccessedAt,
+		"notify":           share.Notify,
+		"hide_contents":    share.HideContents,
+		"max_upload_size":  share.MaxUploadSize,
+		"allowed_types":    share.AllowedTypes,
+		"upload_deadline":  share.UploadDeadline,
+		"active":           share.Active(),
+	}
+}
+
+// shareURL returns the fully qualified URL of a share link, on SHARE_LINK_BASE_URL or
+// else the base URL of other links
+func shareURL(c *gin.Context, share *models.FileShare) string {
+	base := strings.TrimRight(config.String("SHARE_LINK_BASE_URL", ""), "/")
+	if base == "" {
+		base = baseURL(c)
+	}
+	return base + "/file/share/" + share.ShareLink
+}
+
+// validEmail reports whether s is a bare email address
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s
+}
+
+// shareSubject names what a share link shares, for the audit log
+func shareSubject(share *models.FileShare) string {
+	if share.FolderID != nil {
+		return "Folder " + strconv.Itoa(*share.FolderID)
+	}
+	if share.FileID != nil {
+		return "File " + strconv.Itoa(*share.FileID)
+	}
+	return ""
+}
+
+// activeShareCount returns how many working share links a file has, for file responses
+func activeShareCount(fileID int) int64 {
+	count, err := models.CountActiveShares(fileID)
+	if err != nil {
+		log.Printf("Failed to count shares of file %d: %v", fileID, err)
+	}
+	return count
+}
+
+// ListShareAccesses lists the requests made through a share link, newest first, a page
+// of limit entries at a time
+func ListShareAccesses(c *gin.Context) {
+	share, ok := loadManagedShare(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 1000"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	accesses, total, err := models.GetShareAccesses(share.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share accesses"})
+		return
+	}
+	response := make([]gin.H, len(accesses))
+	for i, access := range accesses {
+		response[i] = gin.H{
+			"accessed_at": access.AccessedAt,
+			"ip":          access.IP,
+			"user_agent":  access.UserAgent,
+			"request":     access.Request,
+			"status":      access.Status,
+			"bytes":       access.Bytes,
+			"outcome":     access.Outcome,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"share":    shareResponse(c, share),
+		"total":    total,
+		"accesses": response,
+	})
+}
+
+// serveShared serves content through a share with serve, counting it when it is a
+// download: an attachment or archive rather than a preview or an embedded image or
+// video. Links with a download limit claim a download before serving, given back when
+// no content is sent after all, and always serve whole downloads, as each part of a
+// range download would otherwise count. The first time content is served, the share's
+// creator is emailed if the share asks for it.
+func serveShared(c *gin.Context, share *models.FileShare, download bool, serve func()) {
+	if !download {
+		serve()
+		if c.Writer.Status() < 300 {
+			touchShare(c, share)
+		}
+		return
+	}
+
+	get := c.Request.Method == http.MethodGet
+	limited := share.MaxDownloads > 0
+	if limited {
+		c.Request.Header.Del("Range")
+		c.Request.Header.Del("If-Range")
+	}
+	if limited && get {
+		claimed, err := models.ClaimShareDownload(share.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count download"})
+			return
+		}
+		if !claimed {
+			c.Set("share_outcome", models.ShareLimitReached)
+			c.JSON(http.StatusGone, gin.H{"error": "Share link has reached its download limit"})
+			return
+		}
+	}
+
+	serve()
+
+	// Ranges from the start count, so a download that is resumed counts once
+	status := c.Writer.Status()
+	counted := get && (status == http.StatusOK ||
+		status == http.StatusPartialContent && strings.HasPrefix(c.Writer.Header().Get("Content-Range"), "bytes 0-"))
+	var err error
+	switch {
+	case limited && get && !counted:
+		err = models.ReleaseShareDownload(share.ID)
+	case !limited && counted:
+		err = models.CountShareDownload(share.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to count download of share %d: %v", share.ID, err)
+	}
+	if counted {
+		c.Set("share_outcome", models.ShareDownloaded)
+	}
+	if status < 300 {
+		touchShare(c, share)
+	}
+}
+
+// touchShare records that content was served through a share, emailing its creator the
+// first time when the share asks for it
+func touchShare(c *gin.Context, share *models.FileShare) {
+	first, err := models.TouchShare(share.ID)
+	if err != nil {
+		log.Printf("Failed to record access to share %d: %v", share.ID, err)
+	}
+	if first && share.Notify {
+		go notifyFirstAccess(share, shareURL(c, share), c.ClientIP(), c.Request.UserAgent())
+	}
+}
+
+// notifyFirstAccess emails the creator of a share that it has been used
+func notifyFirstAccess(share *models.FileShare, link, ip, userAgent string) {
+	body := fmt.Sprintf("Your share link %s was opened for the first time.\n\n"+
+		"Shared:  %s\nTime:    %s\nAddress: %s\nBrowser: %s\n",
+		link, shareSubject(share), time.Now().Format(time.RFC1123), ip, userAgent)
+	notifyShareCreator(share, "Your share link was opened", body)
+}
+
+// notifyShareCreator emails the user who created a share. Notices only ever go to the
+// address on their account, so a share link cannot be used to send mail elsewhere.
+func notifyShareCreator(share *models.FileShare, subject, body string) {
+	user, err := models.GetUserByID(share.CreatedBy)
+	if err != nil || user.Email == "" {
+		log.Printf("Not notifying of share %d: its creator has no email address", share.ID)
+		return
+	}
+	if err := mailer.Send(user.Email, subject, body); err != nil {
+		log.Printf("Failed to notify %s of share %d: %v", user.Email, share.ID, err)
+	}
 }
@@ -0,0 +1,378 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/middleware"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shareRouter serves the share management endpoints as the given user
+func shareRouter(userID int, role string) *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", userID)
+		c.Set("role", role)
+	})
+	r.POST("/file/share", GenerateShareableLink)
+	r.GET("/file/shares", ListShares)
+	r.PATCH("/file/shares/:id", UpdateShare)
+	r.DELETE("/file/shares/:id", RevokeShare)
+	return r
+}
+
+// sendJSON makes a request with body as JSON
+func sendJSON(r *gin.Engine, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestListShares(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{})
+	uid := 7
+
+	folder, _ := models.CreateFolder("docs", "/data/docs", uid)
+	mine := models.File{Name: "a.txt", Path: "/data/docs/a.txt", FolderID: folder.ID, OwnerID: uid}
+	theirs := models.File{Name: "b.txt", Path: "/data/b.txt", FolderID: folder.ID + 1, OwnerID: uid + 1}
+	database.DB.Create(&mine)
+	database.DB.Create(&theirs)
+	past := time.Now().Add(-time.Hour)
+	for _, share := range []models.FileShare{
+		{FileID: &mine.ID, ShareLink: "file", CreatedBy: uid},
+		{FolderID: &folder.ID, ShareLink: "folder", CreatedBy: uid},
+		{FileID: &mine.ID, ShareLink: "expired", CreatedBy: uid, Expiration: &past},
+		{FileID: &theirs.ID, ShareLink: "theirs", CreatedBy: uid + 1},
+	} {
+		database.DB.Create(&share)
+	}
+
+	tests := []struct {
+		name  string
+		role  string
+		query string
+		want  int
+		links string // Links listed, newest first
+	}{
+		{name: "own links", query: "", want: http.StatusOK, links: "folder,file"},
+		{name: "every link for admins", role: "admin", want: http.StatusOK, links: "theirs,folder,file"},
+		{name: "file", query: "file_id=1", want: http.StatusOK, links: "file"},
+		{name: "inactive too", query: "file_id=1&include_inactive=true", want: http.StatusOK, links: "expired,file"},
+		{name: "folder and its files", query: "folder_id=1", want: http.StatusOK, links: "folder,file"},
+		{name: "someone else's file", query: "file_id=2", want: http.StatusForbidden},
+		{name: "someone else's links", query: "user_id=" + strconv.Itoa(uid+1), want: http.StatusForbidden},
+		{name: "someone else's links for admins", role: "admin", query: "user_id=" + strconv.Itoa(uid+1), want: http.StatusOK, links: "theirs"},
+		{name: "unknown file", query: "file_id=99", want: http.StatusNotFound},
+		{name: "invalid ID", query: "folder_id=x", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := tt.role
+			if role == "" {
+				role = "user"
+			}
+			w := sendJSON(shareRouter(uid, role), http.MethodGet, "/file/shares?"+tt.query, "")
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Shares []struct {
+					ShareLink   string `json:"share_link"`
+					HasPassword bool   `json:"has_password"`
+				}
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			var links []string
+			for _, share := range resp.Shares {
+				links = append(links, share.ShareLink)
+			}
+			if got := strings.Join(links, ","); got != tt.links {
+				t.Fatalf("listed %s, want %s", got, tt.links)
+			}
+		})
+	}
+}
+
+func TestUpdateShare(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{}, &models.AuditEvent{})
+	uid := 7
+
+	file := models.File{Name: "a.txt", Path: "/data/a.txt", FolderID: 1, OwnerID: uid}
+	theirs := models.File{Name: "b.txt", Path: "/data/b.txt", FolderID: 1, OwnerID: uid + 1}
+	database.DB.Create(&file)
+	database.DB.Create(&theirs)
+	database.DB.Create(&models.FileShare{FileID: &file.ID, ShareLink: "mine", AccessType: "read", CreatedBy: uid})
+	database.DB.Create(&models.FileShare{FileID: &theirs.ID, ShareLink: "theirs", AccessType: "read", CreatedBy: uid + 1})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{name: "set a password and expiry", method: http.MethodPatch, target: "/file/shares/1", body: `{"password": "secret", "expiration": "2099-01-01T00:00:00Z"}`, want: http.StatusOK},
+		{name: "invalid access type", method: http.MethodPatch, target: "/file/shares/1", body: `{"access_type": "admin"}`, want: http.StatusBadRequest},
+		{name: "invalid expiry", method: http.MethodPatch, target: "/file/shares/1", body: `{"expiration": "tomorrow"}`, want: http.StatusBadRequest},
+		{name: "someone else's link", method: http.MethodPatch, target: "/file/shares/2", body: `{"password": ""}`, want: http.StatusForbidden},
+		{name: "unknown link", method: http.MethodPatch, target: "/file/shares/99", body: `{}`, want: http.StatusNotFound},
+		{name: "revoke someone else's link", method: http.MethodDelete, target: "/file/shares/2", want: http.StatusForbidden},
+		{name: "revoke", method: http.MethodDelete, target: "/file/shares/1", want: http.StatusOK},
+	}
+	r := shareRouter(uid, "user")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := sendJSON(r, tt.method, tt.target, tt.body); w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// Only the fields given changed, and the password is stored hashed
+	share, _ := models.GetShareByID(1)
+	if share.AccessType != "read" || share.Expiration == nil || share.Expiration.Year() != 2099 {
+		t.Errorf("unexpected share %+v", share)
+	}
+	if share.Password == "secret" || !share.CheckPassword("secret") {
+		t.Errorf("password stored as %q", share.Password)
+	}
+	if share.RevokedAt == nil || share.Active() {
+		t.Error("share not revoked")
+	}
+	if other, _ := models.GetShareByID(2); other.RevokedAt != nil || other.Password != "" {
+		t.Errorf("someone else's share changed: %+v", other)
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{}, &models.FileShare{}, &models.ShareAccess{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	uid := 7
+
+	path := filepath.Join(root, "a.txt")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	file := models.File{Name: "a.txt", Path: path, Size: 10, Checksum: "sum", Version: 1, FolderID: 1, OwnerID: uid}
+	database.DB.Create(&file)
+	database.DB.Create(&models.FileShare{FileID: &file.ID, ShareLink: "limited", MaxDownloads: 2, CreatedBy: uid})
+	database.DB.Create(&models.FileShare{FileID: &file.ID, ShareLink: "open", CreatedBy: uid})
+
+	r := shareRouter(uid, "user")
+	r.GET("/file/share/:share_link", middleware.ShareAccessLog(), AccessSharedFile)
+	r.HEAD("/file/share/:share_link", middleware.ShareAccessLog(), AccessSharedFile)
+	r.GET("/file/shares/:id/accesses", ListShareAccesses)
+
+	tests := []struct {
+		name      string
+		method    string
+		link      string
+		rangeSpec string
+		want      int
+	}{
+		{name: "head is not a download", method: http.MethodHead, link: "limited", want: http.StatusOK},
+		// Each part of a ranged download would count, so limited links serve whole files
+		{name: "range on a limited link", link: "limited", rangeSpec: "bytes=2-4", want: http.StatusOK},
+		{name: "last download", link: "limited", want: http.StatusOK},
+		{name: "limit reached", link: "limited", want: http.StatusGone},
+		{name: "first range", link: "open", rangeSpec: "bytes=0-4", want: http.StatusPartialContent},
+		{name: "resumed range", link: "open", rangeSpec: "bytes=5-", want: http.StatusPartialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/file/share/"+tt.link, nil)
+			if tt.rangeSpec != "" {
+				req.Header.Set("Range", tt.rangeSpec)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// A download resumed with a range counts once
+	for id, want := range map[int]int{1: 2, 2: 1} {
+		share, _ := models.GetShareByID(id)
+		if share.DownloadCount != want || share.LastAccessedAt == nil {
+			t.Errorf("share %s counted %d downloads, want %d", share.ShareLink, share.DownloadCount, want)
+		}
+	}
+
+	w := sendJSON(r, http.MethodGet, "/file/shares/1/accesses", "")
+	var resp struct {
+		Total    int
+		Accesses []struct{ Outcome string }
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var outcomes []string
+	for _, access := range resp.Accesses {
+		outcomes = append(outcomes, access.Outcome)
+	}
+	if got := strings.Join(outcomes, ","); resp.Total != 4 || got != "limit_reached,downloaded,downloaded,served" {
+		t.Fatalf("logged %d accesses: %s", resp.Total, got)
+	}
+	other := shareRouter(uid+1, "user")
+	other.GET("/file/shares/:id/accesses", ListShareAccesses)
+	if w := sendJSON(other, http.MethodGet, "/file/shares/1/accesses", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("someone else got status %d for the access log", w.Code)
+	}
+}
+
+func TestShareNotify(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{}, &models.FileShare{}, &models.AuditEvent{})
+	uid := 7
+	file := models.File{Name: "a.txt", Path: "/data/a.txt", FolderID: 1, OwnerID: uid}
+	database.DB.Create(&file)
+	r := shareRouter(uid, "user")
+
+	// Notices go to the creator's own address, so no other can be given
+	w := sendJSON(r, http.MethodPost, "/file/share", `{"file_id": 1, "notify": true, "notify_email": "someone@example.com"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	share, _ := models.GetShareByID(1)
+	if !share.Notify || share.CreatedBy != uid {
+		t.Fatalf("unexpected share %+v", share)
+	}
+	if w := sendJSON(r, http.MethodPatch, "/file/shares/1", `{"notify": false}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if share, _ := models.GetShareByID(1); share.Notify {
+		t.Fatal("notify still set")
+	}
+}
+
+func TestGenerateShareableLink(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{}, &models.AuditEvent{})
+	uid := 7
+	folder, _ := models.CreateFolder("docs", "/data/docs", uid)
+	file := models.File{Name: "a.txt", Path: "/data/docs/a.txt", FolderID: folder.ID, OwnerID: uid}
+	theirs := models.File{Name: "b.txt", Path: "/data/b.txt", FolderID: folder.ID, OwnerID: uid + 1}
+	database.DB.Create(&file)
+	database.DB.Create(&theirs)
+
+	tests := []struct {
+		name       string
+		body       string
+		want       int
+		wantAccess string
+	}{
+		{name: "read by default", body: `{"file_id": 1}`, want: http.StatusOK, wantAccess: "read"},
+		{name: "drop box", body: `{"folder_id": 1, "access_type": "write", "max_upload_size": 1024, "upload_deadline": "2099-01-01T00:00:00Z"}`, want: http.StatusOK, wantAccess: "write"},
+		{name: "unknown access type", body: `{"file_id": 1, "access_type": "admin"}`, want: http.StatusBadRequest},
+		{name: "write access to a file", body: `{"file_id": 1, "access_type": "write"}`, want: http.StatusBadRequest},
+		{name: "negative upload size", body: `{"folder_id": 1, "access_type": "write", "max_upload_size": -1}`, want: http.StatusBadRequest},
+		{name: "invalid deadline", body: `{"folder_id": 1, "access_type": "write", "upload_deadline": "soon"}`, want: http.StatusBadRequest},
+		{name: "file and folder", body: `{"file_id": 1, "folder_id": 1}`, want: http.StatusBadRequest},
+		{name: "someone else's file", body: `{"file_id": 2}`, want: http.StatusForbidden},
+		{name: "unknown folder", body: `{"folder_id": 99}`, want: http.StatusNotFound},
+	}
+	r := shareRouter(uid, "user")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := sendJSON(r, http.MethodPost, "/file/share", tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var resp struct{ ID int }
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			share, _ := models.GetShareByID(resp.ID)
+			if share.AccessType != tt.wantAccess || share.CreatedBy != uid || len(share.ShareLink) != 32 {
+				t.Fatalf("unexpected share %+v", share)
+			}
+		})
+	}
+}
+
+func TestShareLinkURLs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{}, &models.FileShare{}, &models.AuditEvent{})
+	uid := 7
+	database.DB.Create(&models.File{Name: "a.txt", Path: "/data/a.txt", FolderID: 1, OwnerID: uid})
+	t.Setenv("SHARE_LINK_EXPIRY_DAYS", "7")
+	t.Setenv("PUBLIC_BASE_URL", "")
+
+	tests := []struct {
+		name           string
+		shareBase      string
+		publicBase     string
+		body           string
+		wantBase       string
+		wantExpiration time.Time
+	}{
+		{name: "default expiry", shareBase: "https://share.example.com/", body: `{"file_id": 1}`,
+			wantBase: "https://share.example.com", wantExpiration: time.Now().AddDate(0, 0, 7)},
+		{name: "given expiry", shareBase: "https://share.example.com", body: `{"file_id": 1, "expiration": "2099-01-01T00:00:00Z"}`,
+			wantBase: "https://share.example.com", wantExpiration: time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "public base URL", publicBase: "https://files.example.com", body: `{"file_id": 1}`,
+			wantBase: "https://files.example.com", wantExpiration: time.Now().AddDate(0, 0, 7)},
+		{name: "host of the request", body: `{"file_id": 1}`, wantBase: "http://example.com", wantExpiration: time.Now().AddDate(0, 0, 7)},
+	}
+	r := shareRouter(uid, "user")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHARE_LINK_BASE_URL", tt.shareBase)
+			t.Setenv("PUBLIC_BASE_URL", tt.publicBase)
+			w := sendJSON(r, http.MethodPost, "/file/share", tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			var resp struct {
+				ShareLink   string     `json:"share_link"`
+				URL         string     `json:"url"`
+				DownloadURL string     `json:"download_url"`
+				Expiration  *time.Time `json:"expiration"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if want := tt.wantBase + "/file/share/" + resp.ShareLink; resp.URL != want || resp.DownloadURL != want+"?dl=1" {
+				t.Errorf("got URLs %s and %s, want %s", resp.URL, resp.DownloadURL, want)
+			}
+			if resp.Expiration == nil || resp.Expiration.Sub(tt.wantExpiration).Abs() > time.Minute {
+				t.Errorf("got expiration %v, want %v", resp.Expiration, tt.wantExpiration)
+			}
+		})
+	}
+
+	// Without a default, links do not expire
+	t.Setenv("SHARE_LINK_EXPIRY_DAYS", "0")
+	w := sendJSON(r, http.MethodPost, "/file/share", `{"file_id": 1}`)
+	var resp struct{ ID int }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if share, _ := models.GetShareByID(resp.ID); share.Expiration != nil {
+		t.Fatalf("link expires at %v", share.Expiration)
+	}
+}
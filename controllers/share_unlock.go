@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"teltech/config"
+	"teltech/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unlockAttempts counts wrong share passwords per client address and per link
+var unlockAttempts = &attemptLimiter{entries: map[string]*attempts{}}
+
+// unlockKey signs unlock cookies when SHARE_UNLOCK_SECRET is not set, in which case
+// they stop working when the server restarts
+var unlockKey = func() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}()
+
+// UnlockShare checks the password posted for a protected share and, when it is right,
+// sets a cookie unlocking the share for SHARE_UNLOCK_TTL. Wrong passwords are counted
+// per client address and per link, and either is locked out for a while once it has
+// too many. Browsers posting the unlock form are sent back to the share.
+func UnlockShare(c *gin.Context) {
+	share, ok := findShare(c)
+	if !ok {
+		return
+	}
+	link, ip := share.ShareLink, c.ClientIP()
+
+	if wait := unlockAttempts.lockedFor("ip:"+ip, "link:"+link); wait > 0 {
+		c.Set("share_outcome", models.ShareLockedOut)
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondLocked(c, share, http.StatusTooManyRequests, "Too many wrong passwords, try again later")
+		return
+	}
+	if !share.CheckPassword(c.PostForm("password")) {
+		window := config.Duration("SHARE_UNLOCK_WINDOW", 15*time.Minute)
+		lockout := config.Duration("SHARE_UNLOCK_LOCKOUT", 15*time.Minute)
+		ipLocked := unlockAttempts.fail("ip:"+ip, int(config.Int64("SHARE_UNLOCK_MAX_ATTEMPTS", 5)), window, lockout)
+		linkLocked := unlockAttempts.fail("link:"+link, int(config.Int64("SHARE_UNLOCK_LINK_MAX_ATTEMPTS", 20)), window, lockout)
+		if ipLocked || linkLocked {
+			models.RecordAuditEvent("share.locked", 0, link, "Too many wrong passwords, last from "+ip)
+		}
+		c.Set("share_outcome", models.ShareWrongPassword)
+		respondLocked(c, share, http.StatusUnauthorized, "Invalid password")
+		return
+	}
+
+	c.Set("share_outcome", models.ShareUnlocked)
+	ttl := config.Duration("SHARE_UNLOCK_TTL", time.Hour)
+	expires := time.Now().Add(ttl)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(unlockCookieName(share), unlockToken(share, expires), int(ttl.Seconds()),
+		"/file/share/"+link, "", isHTTPS(c), true)
+
+	if wantsHTML(c) {
+		c.Redirect(http.StatusSeeOther, "/file/share/"+link)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Share unlocked", "expires_at": expires.Truncate(time.Second)})
+}
+
+// unlocked reports whether the request carries a valid unlock cookie for the share
+func unlocked(c *gin.Context, share *models.FileShare) bool {
+	value, err := c.Cookie(unlockCookieName(share))
+	if err != nil {
+		return false
+	}
+	unix, _, ok := strings.Cut(value, ".")
+	expires, err := strconv.ParseInt(unix, 10, 64)
+	if !ok || err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(unlockToken(share, time.Unix(expires, 0))))
+}
+
+// respondLocked tells the client the share needs a password: browsers get the unlock
+// form, other clients an error with where to post the password
+func respondLocked(c *gin.Context, share *models.FileShare, status int, message string) {
+	unlockURL := "/file/share/" + share.ShareLink + "/unlock"
+	if wantsHTML(c) {
+		c.HTML(status, "share_unlock.html", gin.H{"UnlockURL": unlockURL, "Error": message})
+		return
+	}
+	c.JSON(status, gin.H{"error": message, "unlock_url": unlockURL})
+}
+
+// unlockCookieName returns the name of the cookie unlocking the share
+func unlockCookieName(share *models.FileShare) string {
+	return "share_unlock_" + share.ShareLink
+}
+
+// unlockToken returns the unlock cookie value for the share valid until expires. The
+// signature covers the password hash, so changing the password locks everyone out.
+func unlockToken(share *models.FileShare, expires time.Time) string {
+	key := unlockKey
+	if secret := config.String("SHARE_UNLOCK_SECRET", ""); secret != "" {
+		key = []byte(secret)
+	}
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(share.ShareLink + "\n" + unix + "\n" + share.Password))
+	return unix + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// wantsHTML reports whether the client prefers an HTML page to JSON
+func wantsHTML(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "text/html")
+}
+
+// isHTTPS reports whether the client connected over HTTPS, directly or through a proxy
+func isHTTPS(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// attemptLimiter counts failures per key, locking a key out for a while once it has too
+// many within a window
+type attemptLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*attempts
+}
+
+// attempts are the recent failures of one key
+type attempts struct {
+	count       int
+	windowEnd   time.Time // When the count starts over
+	lockedUntil time.Time
+}
+
+// lockedFor returns how much longer the most locked out of keys stays locked, or 0 when
+// none is
+func (l *attemptLimiter) lockedFor(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if a := l.entries[key]; a != nil {
+			wait = max(wait, time.Until(a.lockedUntil))
+		}
+	}
+	return wait
+}
+
+// fail counts a failure for key, locking it out for lockout once it reaches limit
+// failures within window. It reports whether the key became locked.
+func (l *attemptLimiter) fail(key string, limit int, window, lockout time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.entries) > 10000 {
+		l.prune(now)
+	}
+	a := l.entries[key]
+	if a == nil || now.After(a.windowEnd) {
+		a = &attempts{windowEnd: now.Add(window)}
+		l.entries[key] = a
+	}
+	a.count++
+	if a.count < limit {
+		return false
+	}
+	a.count, a.windowEnd, a.lockedUntil = 0, now.Add(lockout), now.Add(lockout)
+	return true
+}
+
+// prune drops keys that are neither counting nor locked out
+func (l *attemptLimiter) prune(now time.Time) {
+	for key, a := range l.entries {
+		if now.After(a.windowEnd) && now.After(a.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
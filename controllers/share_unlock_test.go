@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	const window, lockout = time.Minute, time.Hour
+
+	tests := []struct {
+		name       string
+		limit      int
+		failures   int                          // Failures counted for "a"
+		age        time.Duration                // How long ago the counting window of "a" started
+		wantLocked bool                         // Whether the last failure locked "a" out
+		check      func(l *attemptLimiter) bool // Extra condition that must hold afterwards
+	}{
+		{name: "under the limit", limit: 3, failures: 2},
+		{name: "at the limit", limit: 3, failures: 3, wantLocked: true},
+		{name: "limit of one", limit: 1, failures: 1, wantLocked: true},
+		{
+			name: "count restarts after the lockout",
+			// The third failure locks "a" out and starts the count over
+			limit: 3, failures: 5,
+		},
+		{
+			name: "window expired", limit: 3, failures: 2, age: 2 * window,
+			// Only the failure after the window ended counts
+			check: func(l *attemptLimiter) bool { return l.entries["a"].count == 1 },
+		},
+		{
+			name: "other keys unaffected", limit: 1, failures: 1, wantLocked: true,
+			check: func(l *attemptLimiter) bool { return l.lockedFor("b") == 0 },
+		},
+		{
+			name: "longest lockout of several keys", limit: 1, failures: 1, wantLocked: true,
+			check: func(l *attemptLimiter) bool {
+				wait := l.lockedFor("b", "a")
+				return wait > lockout-time.Minute && wait <= lockout
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &attemptLimiter{entries: map[string]*attempts{}}
+			var locked bool
+			for i := 0; i < tt.failures; i++ {
+				if i == tt.failures-1 && tt.age > 0 {
+					l.entries["a"].windowEnd = time.Now().Add(window - tt.age)
+				}
+				locked = l.fail("a", tt.limit, window, lockout)
+			}
+			if locked != tt.wantLocked {
+				t.Fatalf("last failure locked %v, want %v", locked, tt.wantLocked)
+			}
+			if wait := l.lockedFor("a"); (wait > 0) != (tt.wantLocked || tt.failures > tt.limit) {
+				t.Fatalf("locked out for %v", wait)
+			}
+			if tt.check != nil && !tt.check(l) {
+				t.Fatal("check failed")
+			}
+		})
+	}
+}
+
+func TestAttemptLimiterPrune(t *testing.T) {
+	l := &attemptLimiter{entries: map[string]*attempts{}}
+	past := time.Now().Add(-time.Minute)
+	l.entries["idle"] = &attempts{count: 2, windowEnd: past, lockedUntil: past}
+	l.entries["counting"] = &attempts{count: 2, windowEnd: time.Now().Add(time.Minute)}
+	l.entries["locked"] = &attempts{windowEnd: past, lockedUntil: time.Now().Add(time.Minute)}
+
+	l.prune(time.Now())
+	if _, ok := l.entries["idle"]; ok {
+		t.Fatal("kept an idle key")
+	}
+	if len(l.entries) != 2 {
+		t.Fatalf("kept %d keys, want 2", len(l.entries))
+	}
+}
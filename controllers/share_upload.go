@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"teltech/config"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UploadToShare stores a file uploaded through a write share link in the shared folder,
+// as a drop box. Uploaders give their name and email address in the uploader_name and
+// uploader_email fields, ahead of the file part. Uploads are limited by the share's
+// size, types and deadline, UPLOAD_MAX_SIZE and the quota of the folder's owner; files
+// are renamed rather than overwrite anything. The share's creator is emailed of each
+// upload if the share asks for it.
+func UploadToShare(c *gin.Context) {
+	share, ok := loadShare(c)
+	if !ok {
+		return
+	}
+	if !share.TakesUploads() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This share does not accept uploads"})
+		return
+	}
+	if share.UploadsClosed() {
+		respondShareUpload(c, share, http.StatusForbidden, "Uploads to this share have closed")
+		return
+	}
+	folder, err := models.GetFolderByID(*share.FolderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+
+	// The upload may take the owner up to their quota but not past it
+	sizeLimit := shareUploadLimit(share)
+	remaining, err := quotaRemaining(folder.OwnerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return
+	}
+	if remaining == 0 {
+		status, message := storeErrorStatus(ErrQuotaExceeded)
+		respondShareUpload(c, share, status, message)
+		return
+	}
+	limit := sizeLimit
+	if remaining > 0 && (limit == 0 || remaining < limit) {
+		limit = remaining
+	}
+	if limit > 0 {
+		// Leave headroom for the multipart envelope; the file part itself is limited exactly
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+1<<20)
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		respondShareUpload(c, share, http.StatusBadRequest, "Expected a multipart/form-data upload")
+		return
+	}
+
+	// Read the uploader's details up to the file part, which is then streamed
+	fields := map[string]string{}
+	var part *multipart.Part
+	for part == nil {
+		next, err := reader.NextPart()
+		if err == io.EOF {
+			respondShareUpload(c, share, http.StatusBadRequest, "No file uploaded")
+			return
+		}
+		if err != nil {
+			respondShareUpload(c, share, http.StatusBadRequest, "Malformed upload")
+			return
+		}
+		if next.FormName() == "file" {
+			part = next
+			continue
+		}
+		value, _ := io.ReadAll(io.LimitReader(next, 4096))
+		fields[next.FormName()] = strings.TrimSpace(string(value))
+	}
+
+	uploaderName, uploaderEmail := fields["uploader_name"], fields["uploader_email"]
+	if uploaderName == "" || len(uploaderName) > 255 {
+		respondShareUpload(c, share, http.StatusBadRequest, "Your name is required")
+		return
+	}
+	if len(uploaderEmail) > 255 || !validEmail(uploaderEmail) {
+		respondShareUpload(c, share, http.StatusBadRequest, "A valid email address is required")
+		return
+	}
+	fileName := filepath.Base(filepath.Clean("/" + part.FileName()))
+	if !validFileName(fileName) {
+		respondShareUpload(c, share, http.StatusBadRequest, "Invalid file name")
+		return
+	}
+	if !share.Accepts(fileName) {
+		respondShareUpload(c, share, http.StatusUnsupportedMediaType, "This type of file is not accepted here")
+		return
+	}
+
+	file, err := storeFile(c.Request.Context(), folder, fileName, part, storeOptions{
+		Conflict: storage.ConflictRename,
+		MaxSize:  limit,
+		OwnerID:  folder.OwnerID,
+	})
+	var maxBytesErr *http.MaxBytesError
+	if (errors.Is(err, storage.ErrTooLarge) || errors.As(err, &maxBytesErr)) && limit != sizeLimit {
+		err = ErrQuotaExceeded
+	}
+	if err != nil {
+		status, message := storeErrorStatus(err)
+		respondShareUpload(c, share, status, message)
+		return
+	}
+
+	upload := models.ShareUpload{
+		ShareID:       share.ID,
+		FileID:        file.ID,
+		FileName:      file.Name,
+		Size:          file.Size,
+		UploaderName:  uploaderName,
+		UploaderEmail: uploaderEmail,
+		IP:            c.ClientIP(),
+	}
+	if err := models.RecordShareUpload(&upload); err != nil {
+		log.Printf("Failed to record upload to share %d: %v", share.ID, err)
+	}
+	models.RecordAuditEvent("share.uploaded", 0, file.Path,
+		fmt.Sprintf("Uploaded %d bytes through share %s by %s <%s> from %s", file.Size, share.ShareLink, uploaderName, uploaderEmail, c.ClientIP()))
+	if share.Notify {
+		go notifyShareUpload(share, shareURL(c, share), folder.Name, &upload)
+	}
+	c.Set("share_outcome", models.ShareUploaded)
+
+	if wantsHTML(c) {
+		renderSharedFolder(c, share, http.StatusCreated, &uploadNotice{Message: "Thank you, " + file.Name + " was uploaded."})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "File uploaded successfully",
+		"name":    file.Name,
+		"size":    file.Size,
+	})
+}
+
+// ListShareUploads lists the files uploaded through a share link, newest first
+func ListShareUploads(c *gin.Context) {
+	share, ok := loadManagedShare(c)
+	if !ok {
+		return
+	}
+	uploads, err := models.GetShareUploads(share.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share uploads"})
+		return
+	}
+	response := make([]gin.H, len(uploads))
+	for i, upload := range uploads {
+		response[i] = gin.H{
+			"file_id":        upload.FileID,
+			"file_name":      upload.FileName,
+			"size":           upload.Size,
+			"uploader_name":  upload.UploaderName,
+			"uploader_email": upload.UploaderEmail,
+			"ip":             upload.IP,
+			"uploaded_at":    upload.CreatedAt,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"share":   shareResponse(c, share),
+		"uploads": response,
+	})
+}
+
+// loadReadableShare is loadShare for requests that read what is shared, which
+// upload-only shares refuse
+func loadReadableShare(c *gin.Context) (*models.FileShare, bool) {
+	share, ok := loadShare(c)
+	if !ok {
+		return nil, false
+	}
+	if share.UploadOnly() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This share only accepts uploads"})
+		return nil, false
+	}
+	return share, true
+}
+
+// respondShareUpload responds to an upload through a share that did not succeed, with
+// the share's page for browsers and JSON otherwise
+func respondShareUpload(c *gin.Context, share *models.FileShare, status int, message string) {
+	if wantsHTML(c) {
+		renderSharedFolder(c, share, status, &uploadNotice{Message: message, Error: true})
+		return
+	}
+	c.JSON(status, gin.H{"error": message})
+}
+
+// shareUploadLimit returns the largest file that may be uploaded through a share, leaving
+// quotas aside, or 0 for no limit
+func shareUploadLimit(share *models.FileShare) int64 {
+	limit := config.Int64("UPLOAD_MAX_SIZE", 0)
+	if share.MaxUploadSize > 0 && (limit == 0 || share.MaxUploadSize < limit) {
+		limit = share.MaxUploadSize
+	}
+	return limit
+}
+
+// uploadLimits describes the limits on uploads through a share for its page
+func uploadLimits(share *models.FileShare) string {
+	var limits []string
+	if limit := shareUploadLimit(share); limit > 0 {
+		limits = append(limits, "Files up to "+formatSize(limit))
+	}
+	if share.AllowedTypes != "" {
+		limits = append(limits, "Accepted types: "+share.AllowedTypes)
+	}
+	if share.UploadDeadline != nil {
+		limits = append(limits, "Open until "+share.UploadDeadline.Format("2006-01-02 15:04 MST"))
+	}
+	return strings.Join(limits, " · ")
+}
+
+// notifyShareUpload emails the creator of a share that a file was uploaded through it
+func notifyShareUpload(share *models.FileShare, link, folderName string, upload *models.ShareUpload) {
+	body := fmt.Sprintf("A file was uploaded through your share link %s.\n\n"+
+		"Folder:  %s\nFile:    %s\nSize:    %s\nFrom:    %s <%s>\nTime:    %s\nAddress: %s\n",
+		link, folderName, upload.FileName, formatSize(upload.Size),
+		upload.UploaderName, upload.UploaderEmail, time.Now().Format(time.RFC1123), upload.IP)
+	notifyShareCreator(share, "A file was uploaded to "+folderName, body)
+}
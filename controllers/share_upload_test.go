@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestUploadToShare(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.FileShare{},
+		&models.ShareUpload{}, &models.AuditEvent{})
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, _ := models.CreateFolder("inbox", filepath.Join(root, "inbox"), uid)
+	os.MkdirAll(inbox.Path, 0755)
+	past := time.Now().Add(-time.Minute)
+	for _, share := range []models.FileShare{
+		{FolderID: &inbox.ID, ShareLink: "drop", AccessType: "write", MaxUploadSize: 16, AllowedTypes: ".txt, image/*", HideContents: true, CreatedBy: uid},
+		{FolderID: &inbox.ID, ShareLink: "read", AccessType: "read", CreatedBy: uid},
+		{FolderID: &inbox.ID, ShareLink: "closed", AccessType: "write", UploadDeadline: &past, CreatedBy: uid},
+	} {
+		database.DB.Create(&share)
+	}
+
+	r := gin.New()
+	r.POST("/file/share/:share_link/upload", UploadToShare)
+	r.GET("/file/share/:share_link", AccessSharedFile)
+	r.GET("/file/shares/:id/uploads", func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Set("role", "user")
+		ListShareUploads(c)
+	})
+	uploader := map[string]string{"uploader_name": "Ann", "uploader_email": "ann@example.com"}
+
+	tests := []struct {
+		name     string
+		link     string
+		fields   map[string]string
+		file     string
+		content  string
+		want     int
+		wantName string
+	}{
+		{name: "upload", link: "drop", fields: uploader, file: "a.txt", content: "hello", want: http.StatusCreated, wantName: "a.txt"},
+		{name: "same name", link: "drop", fields: uploader, file: "a.txt", content: "again", want: http.StatusCreated, wantName: "a (2).txt"},
+		{name: "path in the name", link: "drop", fields: uploader, file: "../../b.txt", content: "hi", want: http.StatusCreated, wantName: "b.txt"},
+		{name: "image", link: "drop", fields: uploader, file: "c.png", content: "png", want: http.StatusCreated, wantName: "c.png"},
+		{name: "type not accepted", link: "drop", fields: uploader, file: "run.exe", content: "MZ", want: http.StatusUnsupportedMediaType},
+		{name: "too large", link: "drop", fields: uploader, file: "big.txt", content: strings.Repeat("x", 17), want: http.StatusRequestEntityTooLarge},
+		{name: "no name", link: "drop", fields: map[string]string{"uploader_email": "ann@example.com"}, file: "d.txt", content: "x", want: http.StatusBadRequest},
+		{name: "invalid email", link: "drop", fields: map[string]string{"uploader_name": "Ann", "uploader_email": "Ann <ann@example.com>"}, file: "d.txt", content: "x", want: http.StatusBadRequest},
+		{name: "read share", link: "read", fields: uploader, file: "d.txt", content: "x", want: http.StatusForbidden},
+		{name: "deadline passed", link: "closed", fields: uploader, file: "d.txt", content: "x", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := uploadRequest(t, tt.fields, tt.file, tt.content)
+			req.URL.Path = "/file/share/" + tt.link + "/upload"
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusCreated {
+				return
+			}
+			if data, err := os.ReadFile(filepath.Join(inbox.Path, tt.wantName)); err != nil || string(data) != tt.content {
+				t.Fatalf("%s holds %q, %v", tt.wantName, data, err)
+			}
+			if file, _ := models.GetFileByPath(filepath.Join(inbox.Path, tt.wantName)); file == nil || file.OwnerID != uid {
+				t.Fatalf("%s not recorded for the folder's owner", tt.wantName)
+			}
+		})
+	}
+
+	// Drop boxes that hide the folder do not hand it out
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/share/drop", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %d for the hidden folder", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/shares/1/uploads", nil))
+	var resp struct {
+		Uploads []struct {
+			FileName     string `json:"file_name"`
+			UploaderName string `json:"uploader_name"`
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Uploads) != 4 || resp.Uploads[0].FileName != "c.png" || resp.Uploads[0].UploaderName != "Ann" {
+		t.Fatalf("listed uploads %s", w.Body)
+	}
+}
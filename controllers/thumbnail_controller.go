@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"teltech/models"
+	"teltech/thumbnail"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetThumbnail serves a scaled-down copy of an image file. The size parameter picks the
+// closest configured size and format is jpeg or webp, chosen from the Accept header when
+// left out. Thumbnails not rendered yet are queued and answered with 202 Accepted.
+// Requests carrying the file's checksum as v may be cached for good, since a change of
+// content changes the URL.
+func GetThumbnail(c *gin.Context) {
+	file, err := models.GetFileByPath(c.Query("file_path"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if !canAccessFile(c, file) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	if !thumbnail.Supported(file.MimeType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "No thumbnails for this type of file"})
+		return
+	}
+
+	size, err := strconv.Atoi(c.DefaultQuery("size", "0"))
+	if err != nil || size < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+		return
+	}
+	format := c.Query("format")
+	if format == "" {
+		format = thumbnail.JPEG
+		if strings.Contains(c.GetHeader("Accept"), "image/webp") {
+			format = thumbnail.WebP
+		}
+	}
+	if format != thumbnail.JPEG && format != thumbnail.WebP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be jpeg or webp"})
+		return
+	}
+
+	if !thumbnail.Ready(file) {
+		thumbnail.Enqueue(file)
+		c.Header("Retry-After", "2")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Thumbnail is being generated"})
+		return
+	}
+
+	size = thumbnail.Fit(size)
+	etag := `"` + file.Checksum + "-" + strconv.Itoa(size) + "-" + format + `"`
+	c.Header("ETag", etag)
+	c.Header("Vary", "Accept")
+	if c.Query("v") == file.Checksum {
+		c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	reader, _, err := thumbnail.Open(c.Request.Context(), file, size, format)
+	if err != nil {
+		// Stored thumbnails went missing, so render them again
+		models.ClearThumbsFor(file.ID)
+		file.ThumbsFor = ""
+		thumbnail.Enqueue(file)
+		c.Header("Retry-After", "2")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Thumbnail is being generated"})
+		return
+	}
+	defer reader.Close()
+	c.DataFromReader(http.StatusOK, -1, "image/"+format, reader, nil)
+}
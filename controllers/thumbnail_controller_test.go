@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+	"teltech/thumbnail"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetThumbnail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	databasetest.Open(t, &models.File{})
+	t.Setenv("THUMBNAIL_SIZES", "32")
+	uid := os.Getuid()
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)))
+	store := func(name, mimeType string, ownerID int) *models.File {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, buf.Bytes(), 0644)
+		file := &models.File{Name: name, Path: path, Size: int64(buf.Len()), Checksum: "sum-" + name, MimeType: mimeType, Version: 1, FolderID: 1, OwnerID: ownerID}
+		database.DB.Create(file)
+		return file
+	}
+	photo := store("a.png", "image/png", uid)
+	store("theirs.png", "image/png", uid+1)
+	store("a.txt", "text/plain", uid)
+
+	r := gin.New()
+	r.GET("/thumbnail", func(c *gin.Context) {
+		c.Set("user_id", uid)
+		c.Set("role", "user")
+		GetThumbnail(c)
+	})
+	get := func(query url.Values, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/thumbnail?"+query.Encode(), nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Thumbnails not rendered yet are on their way
+	w := get(url.Values{"file_path": {photo.Path}}, nil)
+	if w.Code != http.StatusAccepted || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got status %d before rendering: %s", w.Code, w.Body)
+	}
+	if err := thumbnail.Generate(context.Background(), photo); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		header     http.Header
+		want       int
+		wantType   string
+		wantCached bool
+	}{
+		{name: "jpeg by default", query: url.Values{"file_path": {photo.Path}}, want: http.StatusOK, wantType: "image/jpeg"},
+		{name: "webp when accepted", query: url.Values{"file_path": {photo.Path}}, header: http.Header{"Accept": {"image/webp,*/*"}}, want: http.StatusOK, wantType: "image/webp"},
+		{name: "format asked for", query: url.Values{"file_path": {photo.Path}, "format": {"webp"}, "size": {"500"}}, want: http.StatusOK, wantType: "image/webp"},
+		{name: "versioned URL", query: url.Values{"file_path": {photo.Path}, "v": {photo.Checksum}}, want: http.StatusOK, wantType: "image/jpeg", wantCached: true},
+		{name: "not modified", query: url.Values{"file_path": {photo.Path}}, header: http.Header{"If-None-Match": {`"sum-a.png-32-jpeg"`}}, want: http.StatusNotModified},
+		{name: "unknown format", query: url.Values{"file_path": {photo.Path}, "format": {"gif"}}, want: http.StatusBadRequest},
+		{name: "invalid size", query: url.Values{"file_path": {photo.Path}, "size": {"-1"}}, want: http.StatusBadRequest},
+		{name: "not an image", query: url.Values{"file_path": {filepath.Join(root, "a.txt")}}, want: http.StatusUnsupportedMediaType},
+		{name: "someone else's image", query: url.Values{"file_path": {filepath.Join(root, "theirs.png")}}, want: http.StatusForbidden},
+		{name: "unknown file", query: url.Values{"file_path": {filepath.Join(root, "gone.png")}}, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.query, tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("got type %s, want %s", got, tt.wantType)
+			}
+			if cached := w.Header().Get("Cache-Control") == "private, max-age=31536000, immutable"; cached != tt.wantCached {
+				t.Errorf("Cache-Control %q", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+
+	// Thumbnails that went missing are rendered again
+	os.RemoveAll(filepath.Join(root, storage.ThumbnailPrefix(photo.ID)))
+	if w := get(url.Values{"file_path": {photo.Path}}, nil); w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d for missing thumbnails", w.Code)
+	}
+	if file, _ := models.GetFileByID(photo.ID); file.ThumbsFor != "" {
+		t.Fatalf("missing thumbnails still recorded for %q", file.ThumbsFor)
+	}
+}
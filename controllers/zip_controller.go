@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"teltech/metadata"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// zipEntry is a file or an empty folder going into a ZIP download
+type zipEntry struct {
+	Name     string       // Slash-separated path inside the archive
+	File     *models.File // Nil for folders
+	Modified time.Time
+}
+
+// DownloadZip streams the files and folders given as path parameters as one ZIP
+// archive, keeping their layout relative to the folder they have in common. Only
+// content the requesting user owns is included, unless they are an admin.
+func DownloadZip(c *gin.Context) {
+	paths := append(c.QueryArray("path"), c.PostFormArray("path")...)
+	if len(paths) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one path is required"})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	role, _ := c.Get("role")
+	canRead := func(ownerID int) bool { return role == "admin" || ownerID == userID }
+
+	for i, path := range paths {
+		paths[i] = filepath.Clean(path)
+		if _, err := storage.KeyOf(paths[i]); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+			return
+		}
+	}
+	base := commonDir(paths)
+
+	var entries []zipEntry
+	for _, path := range paths {
+		if folder, err := models.GetFolderByPath(path); err == nil {
+			if !canRead(folder.OwnerID) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to " + path})
+				return
+			}
+			folderEntries, err := zipFolderEntries(folder, base, canRead)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+				return
+			}
+			entries = append(entries, folderEntries...)
+			continue
+		}
+
+		file, err := models.GetFileByPath(path)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found: " + path})
+			return
+		}
+		if !canRead(file.OwnerID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied to " + path})
+			return
+		}
+		entries = append(entries, zipEntry{Name: zipName(base, file.Path), File: file, Modified: file.UpdatedAt})
+	}
+
+	name := "download.zip"
+	if len(paths) == 1 {
+		name = filepath.Base(paths[0]) + ".zip"
+	}
+	streamZip(c, name, entries, false)
+}
+
+// DownloadSharedZip streams a shared folder as a ZIP archive. Optional path parameters,
+// relative to the shared folder, limit the archive to those files and folders.
+func DownloadSharedZip(c *gin.Context) {
+	share, ok := loadReadableShare(c)
+	if !ok {
+		return
+	}
+	if share.FolderID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only shared folders can be downloaded as an archive"})
+		return
+	}
+	serveShared(c, share, true, func() { serveSharedFolderZip(c, share) })
+}
+
+// serveSharedFolderZip streams the folder of share, or the parts of it selected by path
+// parameters, as a ZIP archive
+func serveSharedFolderZip(c *gin.Context, share *models.FileShare) {
+	folder, err := models.GetFolderByID(*share.FolderID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+		return
+	}
+	everyone := func(int) bool { return true }
+
+	selected := c.QueryArray("path")
+	if len(selected) == 0 {
+		entries, err := zipFolderEntries(folder, filepath.Dir(folder.Path), everyone)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+			return
+		}
+		streamZip(c, folder.Name+".zip", entries, share.StripGPS)
+		return
+	}
+
+	var entries []zipEntry
+	for _, rel := range selected {
+		path := filepath.Join(folder.Path, filepath.Clean("/"+rel))
+		if path == folder.Path {
+			sub, err := zipFolderEntries(folder, filepath.Dir(folder.Path), everyone)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+				return
+			}
+			entries = append(entries, sub...)
+			continue
+		}
+		if sub, err := models.GetFolderByPath(path); err == nil {
+			subEntries, err := zipFolderEntries(sub, folder.Path, everyone)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+				return
+			}
+			entries = append(entries, subEntries...)
+			continue
+		}
+		file, err := models.GetFileByPath(path)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found: " + rel})
+			return
+		}
+		entries = append(entries, zipEntry{Name: zipName(folder.Path, file.Path), File: file, Modified: file.UpdatedAt})
+	}
+	streamZip(c, folder.Name+".zip", entries, share.StripGPS)
+}
+
+// zipFolderEntries lists the folder, its subfolders and the files below it that canRead
+// allows, named relative to base
+func zipFolderEntries(folder *models.Folder, base string, canRead func(ownerID int) bool) ([]zipEntry, error) {
+	entries := []zipEntry{{Name: zipName(base, folder.Path) + "/"}}
+
+	folders, err := models.GetFoldersUnder(folder.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range folders {
+		if canRead(sub.OwnerID) {
+			entries = append(entries, zipEntry{Name: zipName(base, sub.Path) + "/"})
+		}
+	}
+
+	files, err := models.GetFilesUnder(folder.Path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if canRead(files[i].OwnerID) {
+			entries = append(entries, zipEntry{Name: zipName(base, files[i].Path), File: &files[i], Modified: files[i].UpdatedAt})
+		}
+	}
+	return entries, nil
+}
+
+// streamZip writes the entries to the client as a ZIP archive named name, reading each
+// file from storage as it goes so nothing is staged on disk. Entries are written in
+// name order and duplicates are dropped. ZIP64 records are added for archives past the
+// classic 4 GiB and 65535-entry limits. With stripGPS, the location is removed from
+// the EXIF data of photos.
+func streamZip(c *gin.Context, name string, entries []zipEntry, stripGPS bool) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", contentDisposition("attachment", name))
+	c.Status(http.StatusOK)
+
+	ctx := c.Request.Context()
+	zw := zip.NewWriter(c.Writer)
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.Name == "" || entry.Name == "/" || seen[entry.Name] {
+			continue
+		}
+		seen[entry.Name] = true
+
+		header := &zip.FileHeader{Name: entry.Name, Modified: entry.Modified, Method: zip.Store}
+		if entry.File != nil && compressibleType(entry.File.MimeType) {
+			header.Method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			log.Printf("Failed to write ZIP entry %s: %v", entry.Name, err)
+			return
+		}
+		if entry.File == nil {
+			continue
+		}
+
+		reader, err := storage.Default().Get(ctx, entry.File.ContentKey(), 0, -1)
+		if err != nil {
+			// The archive is left without its central directory, so clients see it as broken
+			log.Printf("Failed to read %s for ZIP download: %v", entry.File.Path, err)
+			return
+		}
+		var content io.Reader = reader
+		if stripGPS {
+			content = metadata.StripGPS(reader)
+		}
+		_, err = io.Copy(w, content)
+		reader.Close()
+		if err != nil {
+			log.Printf("Failed to stream %s in ZIP download: %v", entry.File.Path, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish ZIP download: %v", err)
+	}
+}
+
+// compressibleType reports whether content of the given type is worth deflating
+func compressibleType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, prefix := range storage.DefaultIncompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// zipName returns path relative to base as a slash-separated archive name
+func zipName(base, path string) string {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// commonDir returns the deepest folder containing every path
+func commonDir(paths []string) string {
+	dir := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for dir != filepath.Dir(dir) && dir != path && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
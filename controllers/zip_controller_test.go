@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// zipTree stores docs/a.txt, docs/sub/b.txt and docs/private.txt, the last owned by
+// another user, and returns the storage root
+func zipTree(t *testing.T, uid int) string {
+	t.Helper()
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileShare{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, _ := models.CreateFolder("docs", filepath.Join(root, "docs"), uid)
+	sub, _ := models.CreateFolder("sub", filepath.Join(docs.Path, "sub"), uid)
+	os.MkdirAll(sub.Path, 0755)
+	for _, f := range []struct {
+		folder  *models.Folder
+		name    string
+		ownerID int
+	}{{docs, "a.txt", uid}, {sub, "b.txt", uid}, {docs, "private.txt", uid + 1}} {
+		path := filepath.Join(f.folder.Path, f.name)
+		os.WriteFile(path, []byte(f.name), 0644)
+		database.DB.Create(&models.File{Name: f.name, Path: path, Size: int64(len(f.name)), MimeType: "text/plain", Version: 1, FolderID: f.folder.ID, OwnerID: f.ownerID})
+	}
+	return root
+}
+
+// readZip returns the names in the archive w holds, checking each file holds its own name
+func readZip(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("invalid archive: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != filepath.Base(f.Name) {
+			t.Errorf("%s holds %q", f.Name, data)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDownloadZip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	uid := os.Getuid()
+	root := zipTree(t, uid)
+	docs := filepath.Join(root, "docs")
+
+	tests := []struct {
+		name  string
+		role  string
+		paths []string
+		want  int
+		files []string
+	}{
+		{name: "folder", role: "user", paths: []string{docs}, want: http.StatusOK, files: []string{"docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt"}},
+		{name: "folder as admin", role: "admin", paths: []string{docs}, want: http.StatusOK, files: []string{"docs/", "docs/a.txt", "docs/private.txt", "docs/sub/", "docs/sub/b.txt"}},
+		{name: "selection", role: "user", paths: []string{filepath.Join(docs, "a.txt"), filepath.Join(docs, "sub")}, want: http.StatusOK, files: []string{"a.txt", "sub/", "sub/b.txt"}},
+		{name: "someone else's file", role: "user", paths: []string{filepath.Join(docs, "private.txt")}, want: http.StatusForbidden},
+		{name: "missing", role: "user", paths: []string{filepath.Join(docs, "gone.txt")}, want: http.StatusNotFound},
+		{name: "outside storage", role: "user", paths: []string{"/etc"}, want: http.StatusBadRequest},
+		{name: "no paths", role: "user", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/zip", func(c *gin.Context) {
+				c.Set("user_id", uid)
+				c.Set("role", tt.role)
+				DownloadZip(c)
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/zip?"+url.Values{"path": tt.paths}.Encode(), nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := readZip(t, w); !reflect.DeepEqual(got, tt.files) {
+				t.Fatalf("archive holds %v, want %v", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestDownloadSharedZip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	uid := os.Getuid()
+	root := zipTree(t, uid)
+	docs, _ := models.GetFolderByPath(filepath.Join(root, "docs"))
+	file, _ := models.GetFileByPath(filepath.Join(docs.Path, "a.txt"))
+	database.DB.Create(&models.FileShare{FolderID: &docs.ID, ShareLink: "folder", AccessType: "read"})
+	database.DB.Create(&models.FileShare{FileID: &file.ID, ShareLink: "file", AccessType: "read"})
+
+	r := gin.New()
+	r.GET("/share/:share_link/zip", DownloadSharedZip)
+
+	tests := []struct {
+		name  string
+		link  string
+		query string
+		want  int
+		files []string
+	}{
+		// Everything in a shared folder is shared, whoever owns it
+		{name: "folder", link: "folder", want: http.StatusOK, files: []string{"docs/", "docs/a.txt", "docs/private.txt", "docs/sub/", "docs/sub/b.txt"}},
+		{name: "selection", link: "folder", query: "?path=sub&path=a.txt", want: http.StatusOK, files: []string{"a.txt", "sub/", "sub/b.txt"}},
+		{name: "selection cannot leave the folder", link: "folder", query: "?path=../../etc/passwd", want: http.StatusNotFound},
+		{name: "file share", link: "file", want: http.StatusBadRequest},
+		{name: "unknown link", link: "nope", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/share/"+tt.link+"/zip"+tt.query, nil))
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := readZip(t, w); !reflect.DeepEqual(got, tt.files) {
+				t.Fatalf("archive holds %v, want %v", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestCommonDir(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"/data/a/x.txt"}, "/data/a"},
+		{[]string{"/data/a/x.txt", "/data/a/y.txt"}, "/data/a"},
+		{[]string{"/data/a/x.txt", "/data/b/y.txt"}, "/data"},
+		{[]string{"/data/a", "/data/a/b/c.txt"}, "/data"},
+		{[]string{"/data/ab/x.txt", "/data/a/y.txt"}, "/data"},
+	}
+	for _, tt := range tests {
+		if got := commonDir(tt.paths); got != tt.want {
+			t.Errorf("commonDir(%v) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Package databasetest stands an in-memory SQLite database in for MySQL in tests
+package databasetest
+
+import (
+	"strings"
+	"testing"
+
+	"teltech/database"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Open points database.DB at a fresh in-memory database with tables for models, for
+// the duration of the test. Enum columns, which SQLite lacks, are created as text.
+func Open(t testing.TB, models ...any) *gorm.DB {
+	t.Helper()
+	// A shared cache keeps the database alive across the pool's connections
+	db, err := gorm.Open(sqlite.Open("file:"+strings.ReplaceAll(t.Name(), "/", "_")+"?mode=memory&cache=shared"),
+		&gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if strings.HasPrefix(string(field.DataType), "enum") {
+				field.DataType = "text"
+			}
+		}
+		if err := db.AutoMigrate(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		sqlDB.Close()
+	})
+	return db
+}
@@ -0,0 +1,447 @@
+// Package fsck compares the storage tree with the folders, files and file_shares tables
+// and optionally repairs the differences. It is meant to run while the server is idle:
+// uploads that land during a check can show up as drift.
+package fsck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"teltech/database"
+	"teltech/models"
+	"teltech/storage"
+)
+
+// Kinds of drift a check reports
+const (
+	OrphanFolder  = "orphan_folder"  // Folder in storage without a row
+	OrphanFile    = "orphan_file"    // File in storage without a row
+	StalePath     = "stale_path"     // Row left at its old path when a parent folder was renamed
+	MissingFolder = "missing_folder" // Folder row whose folder is gone from storage
+	MissingFile   = "missing_file"   // File row whose content is gone from storage
+	DanglingShare = "dangling_share" // Share pointing at a file that no longer exists
+)
+
+// ErrRunning is returned when a check is started while another one is running
+var ErrRunning = errors.New("a consistency check is already running")
+
+var running atomic.Bool
+
+// Issue is one difference between storage and the database
+type Issue struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path,omitempty"`   // Path the row or object is at
+	ID     int    `json:"id,omitempty"`     // ID of the row involved, if any
+	Target string `json:"target,omitempty"` // Corrected path, for stale paths
+	Action string `json:"action"`           // What repairing does
+	Ref    string `json:"ref"`              // Names the issue when asking for it to be repaired
+	Fixed  bool   `json:"fixed,omitempty"`  // Whether the issue was repaired
+	Error  string `json:"error,omitempty"`  // Why the repair failed
+}
+
+// ref names an issue by what it is about, so the same drift found again by a later check
+// has the same name
+func (i Issue) ref() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s", i.Kind, i.Path, i.ID, i.Target)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Report is the outcome of a check
+type Report struct {
+	Repair bool           `json:"repair"` // Whether repairs were asked for or the issues only previewed
+	Issues []Issue        `json:"issues"`
+	Counts map[string]int `json:"counts"`
+	Failed int            `json:"failed"`         // Repairs that failed
+	Gone   []string       `json:"gone,omitempty"` // Refs asked to be repaired that no longer describe any drift
+}
+
+// checker holds one snapshot of storage and the database
+type checker struct {
+	ctx       context.Context
+	root      string
+	dirs      map[string]bool           // Folders in storage, by path
+	objects   map[string]bool           // Files in storage, by path
+	folders   map[string]*models.Folder // Folder rows by path
+	folderIDs map[int]*models.Folder
+	files     []*models.File
+	filePaths map[string]*models.File
+	renamed   map[string]string // Old folder paths to their new ones, learned from file rows
+	stale     []Issue           // Stale paths, found before anything is repaired
+}
+
+// Run checks storage against the database and repairs the issues named in repair by the
+// Refs an earlier check reported. Drift that was not previewed that way is only reported.
+func Run(ctx context.Context, repair []string) (*Report, error) {
+	if !running.CompareAndSwap(false, true) {
+		return nil, ErrRunning
+	}
+	defer running.Store(false)
+
+	c := &checker{
+		ctx:       ctx,
+		root:      storage.Root(),
+		dirs:      make(map[string]bool),
+		objects:   make(map[string]bool),
+		folders:   make(map[string]*models.Folder),
+		folderIDs: make(map[int]*models.Folder),
+		filePaths: make(map[string]*models.File),
+		renamed:   make(map[string]string),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, ref := range repair {
+		wanted[ref] = true
+	}
+	report := &Report{Repair: len(repair) > 0, Issues: []Issue{}, Counts: make(map[string]int)}
+	add := func(issue Issue, fix func() error) {
+		issue.Ref = issue.ref()
+		if wanted[issue.Ref] {
+			delete(wanted, issue.Ref)
+			if err := fix(); err != nil {
+				issue.Error = err.Error()
+				report.Failed++
+			} else {
+				issue.Fixed = true
+				models.RecordAuditEvent("fsck."+issue.Kind, 0, issue.Path, issue.Action)
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+		report.Counts[issue.Kind]++
+	}
+
+	// Stale paths go first, so their rows are not also reported as missing and the
+	// content they point at as orphaned
+	c.stale = c.stalePaths()
+	for _, issue := range c.stale {
+		add(issue, func() error { return c.relocate(issue) })
+	}
+	for _, path := range c.orphanFolders() {
+		add(Issue{Kind: OrphanFolder, Path: path, Action: "create folder row"}, func() error { return c.recordFolder(path) })
+	}
+	for _, path := range c.orphanFiles() {
+		add(Issue{Kind: OrphanFile, Path: path, Action: "create file row"}, func() error { return c.recordFile(path) })
+	}
+
+	removed := make(map[int]bool)
+	for _, file := range c.missingFiles() {
+		removed[file.ID] = true
+		add(Issue{Kind: MissingFile, Path: file.Path, ID: file.ID, Action: "delete file row and its versions"},
+			func() error { return models.DeleteFileRecord(ctx, file) })
+	}
+	removedFolders := make(map[int]bool)
+	for _, folder := range c.missingFolders() {
+		removedFolders[folder.ID] = true
+		add(Issue{Kind: MissingFolder, Path: folder.Path, ID: folder.ID, Action: "delete folder row"},
+			func() error { return models.DeleteFolder(folder.ID) })
+	}
+
+	shares, err := c.danglingShares(removed, removedFolders)
+	if err != nil {
+		return report, err
+	}
+	for _, share := range shares {
+		add(Issue{Kind: DanglingShare, ID: share.ID, Path: share.ShareLink, Action: "delete share"},
+			func() error { return database.DB.Delete(&share).Error })
+	}
+
+	for ref := range wanted {
+		report.Gone = append(report.Gone, ref)
+	}
+	sort.Strings(report.Gone)
+	return report, nil
+}
+
+// load takes the snapshot
+func (c *checker) load() error {
+	if err := c.walk(""); err != nil {
+		return err
+	}
+
+	var folders []models.Folder
+	if err := database.DB.Find(&folders).Error; err != nil {
+		return err
+	}
+	for i := range folders {
+		c.folders[folders[i].Path] = &folders[i]
+		c.folderIDs[folders[i].ID] = &folders[i]
+	}
+
+	files, err := models.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		file := &files[i]
+		c.files = append(c.files, file)
+		c.filePaths[file.Path] = file
+
+		// A file whose folder row moved on while its own path did not shows where the
+		// folder went
+		dir := filepath.Dir(file.Path)
+		if folder, ok := c.folderIDs[file.FolderID]; ok && folder.Path != dir && !c.dirs[dir] {
+			c.renamed[dir] = folder.Path
+		}
+	}
+	return nil
+}
+
+// walk records everything in storage below key, skipping internal data
+func (c *checker) walk(key string) error {
+	children, err := storage.Default().List(c.ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.Key == storage.InternalDir {
+			continue
+		}
+		path := storage.PathOf(child.Key)
+		if !child.IsDir {
+			c.objects[path] = true
+			continue
+		}
+		c.dirs[path] = true
+		if err := c.walk(child.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDir reports whether path is a folder in storage
+func (c *checker) isDir(path string) bool {
+	return path == c.root || c.dirs[path]
+}
+
+// hasContent reports whether the content of file is in storage
+func (c *checker) hasContent(file *models.File) bool {
+	if file.BlobHash != "" {
+		return storage.Exists(c.ctx, storage.Default(), file.ContentKey())
+	}
+	return c.objects[file.Path]
+}
+
+// stalePaths finds rows whose path is gone because a parent folder was renamed without
+// them, and where they belong now
+func (c *checker) stalePaths() []Issue {
+	var issues []Issue
+	for path, folder := range c.folders {
+		if c.isDir(path) {
+			continue
+		}
+		if target, ok := c.relocated(path, c.isDir); ok {
+			issues = append(issues, Issue{Kind: StalePath, Path: path, ID: folder.ID, Target: target, Action: "move folder row"})
+		}
+	}
+	for _, file := range c.files {
+		present := func(p string) bool { return c.objects[p] }
+		if file.BlobHash != "" {
+			// Blob content is not kept at the file's path, so its folder has to do
+			present = func(p string) bool { return c.isDir(filepath.Dir(p)) }
+		}
+		if present(file.Path) {
+			continue
+		}
+		if target, ok := c.relocated(file.Path, present); ok {
+			issues = append(issues, Issue{Kind: StalePath, Path: file.Path, ID: file.ID, Target: target, Action: "move file row"})
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Path < issues[j].Path })
+	return issues
+}
+
+// relocated looks for the folder a missing path went to. The current RenameFolder
+// keeps a folder in its parent, so the new name is one of the siblings of the nearest
+// missing ancestor, unless file rows already told us.
+func (c *checker) relocated(path string, exists func(string) bool) (string, bool) {
+	for ancestor := filepath.Dir(path); ancestor != c.root && strings.HasPrefix(ancestor, c.root); ancestor = filepath.Dir(ancestor) {
+		if c.isDir(ancestor) {
+			return "", false // Nothing above the path was renamed
+		}
+		if _, ok := c.folders[ancestor]; ok {
+			continue // A stale row itself; the rename happened higher up
+		}
+
+		var candidates []string
+		if newPath, ok := c.renamed[ancestor]; ok {
+			candidates = append(candidates, newPath)
+		} else {
+			for sibling := range c.folders {
+				if filepath.Dir(sibling) == filepath.Dir(ancestor) && c.isDir(sibling) {
+					candidates = append(candidates, sibling)
+				}
+			}
+		}
+
+		var matches []string
+		for _, candidate := range candidates {
+			target := candidate + strings.TrimPrefix(path, ancestor)
+			_, taken := c.filePaths[target]
+			if _, takenByFolder := c.folders[target]; !taken && !takenByFolder && exists(target) {
+				matches = append(matches, target)
+			}
+		}
+		if len(matches) == 1 {
+			return matches[0], true
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// relocate moves a stale row to its target path
+func (c *checker) relocate(issue Issue) error {
+	if folder, ok := c.folders[issue.Path]; ok && folder.ID == issue.ID {
+		delete(c.folders, issue.Path)
+		folder.Path = issue.Target
+		c.folders[issue.Target] = folder
+		return database.DB.Model(folder).Update("path", issue.Target).Error
+	}
+
+	file := c.filePaths[issue.Path]
+	delete(c.filePaths, issue.Path)
+	file.Path = issue.Target
+	c.filePaths[issue.Target] = file
+	updates := map[string]interface{}{"path": issue.Target}
+	if parent, ok := c.folders[filepath.Dir(issue.Target)]; ok {
+		updates["folder_id"] = parent.ID
+	}
+	return database.DB.Model(file).Updates(updates).Error
+}
+
+// orphanFolders lists folders in storage without a row, parents first. Targets of
+// stale paths are not orphans.
+func (c *checker) orphanFolders() []string {
+	targets := c.staleTargets()
+	var paths []string
+	for path := range c.dirs {
+		if _, ok := c.folders[path]; !ok && !targets[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// orphanFiles lists files in storage without a row
+func (c *checker) orphanFiles() []string {
+	targets := c.staleTargets()
+	var paths []string
+	for path := range c.objects {
+		if _, ok := c.filePaths[path]; !ok && !targets[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// staleTargets returns the paths stale rows belong at
+func (c *checker) staleTargets() map[string]bool {
+	targets := make(map[string]bool)
+	for _, issue := range c.stale {
+		targets[issue.Target] = true
+	}
+	return targets
+}
+
+// missingFiles lists file rows whose content is gone and that are not merely stale
+func (c *checker) missingFiles() []*models.File {
+	stale := make(map[string]bool)
+	for _, issue := range c.stale {
+		stale[issue.Path] = true
+	}
+
+	var missing []*models.File
+	for _, file := range c.files {
+		if !stale[file.Path] && !c.hasContent(file) {
+			missing = append(missing, file)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Path < missing[j].Path })
+	return missing
+}
+
+// missingFolders lists folder rows without a folder in storage, children first
+func (c *checker) missingFolders() []*models.Folder {
+	stale := make(map[string]bool)
+	for _, issue := range c.stale {
+		stale[issue.Path] = true
+	}
+
+	var missing []*models.Folder
+	for path, folder := range c.folders {
+		if !c.isDir(path) && !stale[path] {
+			missing = append(missing, folder)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Path > missing[j].Path })
+	return missing
+}
+
+// danglingShares lists shares whose file or folder row is gone or about to be removed
+func (c *checker) danglingShares(removed, removedFolders map[int]bool) ([]models.FileShare, error) {
+	var shares []models.FileShare
+	if err := database.DB.Find(&shares).Error; err != nil {
+		return nil, err
+	}
+
+	exists := make(map[int]bool, len(c.files))
+	for _, file := range c.files {
+		exists[file.ID] = !removed[file.ID]
+	}
+	folderExists := make(map[int]bool, len(c.folders))
+	for _, folder := range c.folders {
+		folderExists[folder.ID] = !removedFolders[folder.ID]
+	}
+	var dangling []models.FileShare
+	for _, share := range shares {
+		if (share.FileID != nil && !exists[*share.FileID]) ||
+			(share.FolderID != nil && !folderExists[*share.FolderID]) ||
+			(share.FileID == nil && share.FolderID == nil) {
+			dangling = append(dangling, share)
+		}
+	}
+	return dangling, nil
+}
+
+// recordFolder creates the row of a folder found in storage
+func (c *checker) recordFolder(path string) error {
+	folder, _, err := models.RecordFoundFolder(path)
+	if err != nil {
+		return err
+	}
+	c.folders[path] = folder
+	return nil
+}
+
+// recordFile creates the row of a file found in storage
+func (c *checker) recordFile(path string) error {
+	dir := filepath.Dir(path)
+	parent, ok := c.folders[dir]
+	if !ok {
+		if dir != c.root {
+			return fmt.Errorf("folder %s has no row", dir)
+		}
+		if err := c.recordFolder(dir); err != nil {
+			return err
+		}
+		parent = c.folders[dir]
+	}
+
+	found, err := models.ReadFoundFile(c.ctx, path)
+	if err != nil {
+		return err
+	}
+	_, _, err = models.RecordFoundFile(parent, path, found)
+	return err
+}
@@ -0,0 +1,105 @@
+package fsck
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+func TestRun(t *testing.T) {
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.Blob{},
+		&models.FileShare{}, &models.AuditEvent{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	at := func(rel string) string { return filepath.Join(root, rel) }
+	write := func(rel string) {
+		os.MkdirAll(filepath.Dir(at(rel)), 0755)
+		os.WriteFile(at(rel), []byte(rel), 0644)
+	}
+
+	// "old" was renamed to "new" the way RenameFolder used to, moving only the folder's
+	// own row, so the rows below it still carry the old path
+	rootFolder, _ := models.CreateFolder(filepath.Base(root), root, 1)
+	renamed, _ := models.CreateFolder("new", at("new"), 1)
+	sub, _ := models.CreateFolder("sub", at("old/sub"), 1)
+	os.MkdirAll(at("new/sub"), 0755)
+	write("new/a.txt")
+	moved := models.File{Name: "a.txt", Path: at("old/a.txt"), FolderID: renamed.ID, OwnerID: 1}
+	database.DB.Create(&moved)
+
+	// A file added behind the database's back, one deleted and a share of a file long gone
+	write("stray.txt")
+	gone := models.File{Name: "gone.txt", Path: at("gone.txt"), FolderID: rootFolder.ID, OwnerID: 1}
+	database.DB.Create(&gone)
+	missing := 999
+	database.DB.Create(&models.FileShare{FileID: &missing, ShareLink: "dangling", AccessType: "read"})
+
+	report, err := Run(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{StalePath: 2, OrphanFile: 1, MissingFile: 1, DanglingShare: 1}
+	if len(report.Counts) != len(want) {
+		t.Errorf("got counts %v, want %v", report.Counts, want)
+	}
+	for kind, n := range want {
+		if report.Counts[kind] != n {
+			t.Errorf("%s: got %d issues, want %d", kind, report.Counts[kind], n)
+		}
+	}
+	targets := map[string]string{}
+	var refs []string
+	for _, issue := range report.Issues {
+		if issue.Fixed {
+			t.Errorf("previewed issue %+v was repaired", issue)
+		}
+		if issue.Kind == StalePath {
+			targets[issue.Path] = issue.Target
+		}
+		refs = append(refs, issue.Ref)
+	}
+	if targets[at("old/sub")] != at("new/sub") || targets[at("old/a.txt")] != at("new/a.txt") {
+		t.Errorf("got stale path targets %v", targets)
+	}
+
+	// Repair what was previewed, and only that
+	report, err = Run(ctx, append(refs, "unknown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Fixed {
+			t.Errorf("issue %+v was not repaired", issue)
+		}
+	}
+	if len(report.Gone) != 1 || report.Gone[0] != "unknown" {
+		t.Errorf("got gone refs %v", report.Gone)
+	}
+	if folder, err := models.GetFolderByID(sub.ID); err != nil || folder.Path != at("new/sub") {
+		t.Errorf("stale folder: got %+v, %v", folder, err)
+	}
+	if file, err := models.GetFileByPath(at("new/a.txt")); err != nil || file.ID != moved.ID {
+		t.Errorf("stale file: got %+v, %v", file, err)
+	}
+	if _, err := models.GetFileByPath(at("stray.txt")); err != nil {
+		t.Error("orphan file was not recorded")
+	}
+	if _, err := models.GetFileByPath(at("gone.txt")); err == nil {
+		t.Error("missing file was not removed")
+	}
+
+	report, err = Run(ctx, nil)
+	if err != nil || len(report.Issues) != 0 {
+		t.Fatalf("issues left after repairing: %+v, %v", report, err)
+	}
+}
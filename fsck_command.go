@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"teltech/fsck"
+)
+
+// runFsck implements the fsck command, which lists the drift between storage and the
+// database and, with --repair, fixes what it listed once confirmed
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the drift after listing it")
+	yes := flags.Bool("yes", false, "repair without asking for confirmation")
+	flags.Parse(args)
+
+	report, err := fsck.Run(context.Background(), nil)
+	if err != nil {
+		log.Fatalf("Consistency check failed: %v", err)
+	}
+	printFsckReport(report)
+	if !*repair || len(report.Issues) == 0 {
+		return
+	}
+	if !*yes && !confirm(fmt.Sprintf("\nRepair these %d issues? [y/N] ", len(report.Issues))) {
+		return
+	}
+
+	// Only what was listed is repaired, even if more drift appeared since
+	refs := make([]string, len(report.Issues))
+	for i, issue := range report.Issues {
+		refs[i] = issue.Ref
+	}
+	fmt.Println("\nRepairing...")
+	report, err = fsck.Run(context.Background(), refs)
+	if err != nil {
+		log.Fatalf("Repair failed: %v", err)
+	}
+	printFsckReport(report)
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// confirm asks a yes or no question on the terminal
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printFsckReport writes a report as one line per issue followed by a summary
+func printFsckReport(report *fsck.Report) {
+	for _, issue := range report.Issues {
+		line := fmt.Sprintf("%-15s %s", issue.Kind, issue.Path)
+		if issue.Target != "" {
+			line += " -> " + issue.Target
+		}
+		if issue.ID != 0 {
+			line += fmt.Sprintf(" (id %d)", issue.ID)
+		}
+		switch {
+		case issue.Error != "":
+			line += ": failed to " + issue.Action + ": " + issue.Error
+		case issue.Fixed:
+			line += ": " + issue.Action + " done"
+		case report.Repair:
+			line += ": left alone, not previewed"
+		default:
+			line += ": would " + issue.Action
+		}
+		fmt.Println(line)
+	}
+	if len(report.Issues) == 0 {
+		fmt.Println("No drift found")
+		return
+	}
+	fmt.Printf("%d issues", len(report.Issues))
+	if report.Failed > 0 {
+		fmt.Printf(", %d repairs failed", report.Failed)
+	}
+	if len(report.Gone) > 0 {
+		fmt.Printf(", %d previewed issues already gone", len(report.Gone))
+	}
+	fmt.Println()
+}
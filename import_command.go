@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"teltech/importer"
+	"teltech/storage"
+)
+
+// runImport implements the import command, which brings an existing directory tree into
+// storage. Running it again after an interruption picks up where it stopped.
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	source := flags.String("source", "", "directory to import")
+	target := flags.String("target", "", "folder to import into, relative to PARENT_FOLDER")
+	adopt := flags.Bool("adopt", false, "move files into storage instead of copying them")
+	ownerMap := flags.String("owners", "", "file mapping on-disk owners to users")
+	owner := flags.String("owner", "", "user recorded for files whose owner is not mapped")
+	reportPath := flags.String("report", "", "write the summary report to this file as JSON")
+	flags.Parse(args)
+
+	if *source == "" || *owner == "" {
+		log.Fatal("Usage: teltech import --source DIR --owner USER [--target FOLDER] [--owners FILE] [--adopt] [--report FILE]")
+	}
+
+	opts := importer.Options{
+		Source: *source,
+		Target: filepath.Join(storage.Root(), *target),
+		Adopt:  *adopt,
+	}
+	var err error
+	if opts.DefaultOwner, err = importer.LookupUserID(*owner); err != nil {
+		log.Fatalf("Unknown user %q", *owner)
+	}
+	if *ownerMap != "" {
+		if opts.Owners, err = importer.LoadOwnerMap(*ownerMap); err != nil {
+			log.Fatalf("Failed to read owner map: %v", err)
+		}
+	}
+
+	report, err := importer.Run(context.Background(), opts)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	fmt.Printf("Imported %d files (%d bytes) and created %d folders\n", report.Files, report.Bytes, report.Folders)
+	fmt.Printf("%d files were already imported, %d entries skipped, %d failed\n", report.Resumed, report.Skipped, report.Failed)
+	for uid, count := range report.Unmapped {
+		fmt.Printf("%d entries owned by unmapped UID %s\n", count, uid)
+	}
+	for _, msg := range report.Errors {
+		fmt.Println(msg)
+	}
+
+	if *reportPath != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*reportPath, data, 0644); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package importer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the UID owning a file on Unix-based systems
+func fileOwner(fi fs.FileInfo) (int, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
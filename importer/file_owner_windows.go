@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package importer
+
+import (
+	"io/fs"
+)
+
+// fileOwner reports no owner on Windows, where files have no UID
+func fileOwner(fi fs.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,324 @@
+// Package importer brings an existing directory tree on local disk into storage,
+// recording its folders and files with their owners. It backs the import command.
+package importer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"teltech/config"
+	"teltech/controllers"
+	"teltech/database"
+	"teltech/models"
+	"teltech/storage"
+	"teltech/thumbnail"
+)
+
+// Options controls how Run brings a directory tree into storage
+type Options struct {
+	Source       string      // Directory on local disk to import
+	Target       string      // Folder path the tree is imported into
+	Adopt        bool        // Move files into storage instead of copying them
+	Owners       map[int]int // On-disk owner UIDs to TelTech user IDs
+	DefaultOwner int         // User recorded for files whose owner is not mapped
+}
+
+// Report summarises an import
+type Report struct {
+	Folders  int            `json:"folders"`  // Folders created
+	Files    int            `json:"files"`    // Files imported
+	Bytes    int64          `json:"bytes"`    // Bytes imported
+	Resumed  int            `json:"resumed"`  // Files already imported by an earlier run
+	Skipped  int            `json:"skipped"`  // Symlinks and other entries that are not regular files
+	Failed   int            `json:"failed"`   // Files or folders that could not be imported
+	Unmapped map[string]int `json:"unmapped"` // Entries per on-disk owner without a mapping
+	Errors   []string       `json:"errors"`   // The first failures, for the record
+}
+
+// maxErrors caps the failures kept in a report
+const maxErrors = 100
+
+// importer holds the state of one import
+type importer struct {
+	ctx     context.Context
+	opts    Options
+	report  *Report
+	folders map[string]*models.Folder // Folder rows by path, for the tree being imported
+}
+
+// Run imports the directory tree at opts.Source below the folder at opts.Target,
+// recording folders and files with their checksums and mapped owners. Files already
+// imported with the same size are skipped, so an interrupted import can simply be run
+// again. Adopted files are moved rather than copied and need plain local path storage
+// on the same file system as the source.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	source, err := filepath.Abs(opts.Source)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(source); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", source)
+	}
+	if _, err := storage.KeyOf(opts.Target); err != nil {
+		return nil, err
+	}
+	if opts.Adopt {
+		if _, ok := storage.Default().(*storage.Local); !ok || config.String("STORAGE_MODE", storage.ModePath) == storage.ModeCAS {
+			return nil, errors.New("adopting files needs unencrypted, uncompressed local storage in path mode")
+		}
+	}
+	opts.Source = source
+	opts.Target = filepath.Clean(opts.Target)
+
+	im := &importer{
+		ctx:     ctx,
+		opts:    opts,
+		report:  &Report{Unmapped: make(map[string]int), Errors: []string{}},
+		folders: make(map[string]*models.Folder),
+	}
+	if _, err := im.folder(opts.Target, opts.DefaultOwner); err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			im.fail(path, err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(source, path)
+		target := filepath.Join(opts.Target, rel)
+
+		switch {
+		case d.IsDir():
+			if path == source {
+				return nil
+			}
+			if _, err := im.folder(target, im.owner(d)); err != nil {
+				im.fail(path, err)
+				return filepath.SkipDir
+			}
+		case d.Type().IsRegular():
+			if err := im.file(path, target, d); err != nil {
+				im.fail(path, err)
+			}
+		default:
+			im.report.Skipped++
+		}
+		return nil
+	})
+	if err == nil {
+		models.RecordAuditEvent("import.completed", 0, opts.Target, fmt.Sprintf(
+			"Imported %d files (%d bytes) and %d folders from %s, %d failed",
+			im.report.Files, im.report.Bytes, im.report.Folders, source, im.report.Failed))
+	}
+	return im.report, err
+}
+
+// folder returns the row of the folder at path, creating it and any missing parents
+func (im *importer) folder(path string, ownerID int) (*models.Folder, error) {
+	return controllers.EnsureFolder(im.ctx, path, ownerID, im.folders, func(*models.Folder) { im.report.Folders++ })
+}
+
+// file imports the file at path to target unless an earlier run already did
+func (im *importer) file(path, target string, d fs.DirEntry) error {
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+	if existing, err := models.GetFileByPath(target); err == nil && existing.Size == fi.Size() &&
+		storage.Exists(im.ctx, storage.Default(), existing.ContentKey()) {
+		im.report.Resumed++
+		return nil
+	}
+
+	folder, err := im.folder(filepath.Dir(target), im.opts.DefaultOwner)
+	if err != nil {
+		return err
+	}
+	ownerID := im.owner(d)
+	if im.opts.Adopt {
+		err = im.adopt(path, folder, fi, ownerID)
+	} else {
+		err = im.copy(path, folder, fi, ownerID)
+	}
+	if err != nil {
+		return err
+	}
+
+	im.report.Files++
+	im.report.Bytes += fi.Size()
+	if im.report.Files%1000 == 0 {
+		log.Printf("Imported %d files (%d bytes)", im.report.Files, im.report.Bytes)
+	}
+	return nil
+}
+
+// copy stores the content of the file at path through the regular upload path, keeping
+// whatever was at the target before as a previous version
+func (im *importer) copy(path string, folder *models.Folder, fi fs.FileInfo, ownerID int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file, err := controllers.StoreVersion(im.ctx, folder, filepath.Base(path), f, ownerID)
+	if err != nil {
+		return err
+	}
+	if file.Size != fi.Size() {
+		return errors.New("file changed while it was imported")
+	}
+	return nil
+}
+
+// adopt records the file at path and moves it into place. The row is saved first, so an
+// interruption leaves a row without content that the next run completes.
+func (im *importer) adopt(path string, folder *models.Folder, fi fs.FileInfo, ownerID int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	ingest := storage.NewIngestReader(f, 0, "")
+	_, err = io.Copy(io.Discard, ingest)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if ingest.Size() != fi.Size() {
+		return errors.New("file changed while it was imported")
+	}
+
+	target := filepath.Join(folder.Path, filepath.Base(path))
+	key, err := storage.KeyOf(target)
+	if err != nil {
+		return err
+	}
+	localPath, _ := storage.LocalPath(storage.Default(), key)
+
+	file, err := models.GetFileByPath(target)
+	isNew := err != nil
+	if isNew {
+		file = &models.File{Name: filepath.Base(target), Path: target, FolderID: folder.ID, OwnerID: ownerID}
+	}
+	file.Size = ingest.Size()
+	file.StoredSize = ingest.Size()
+	file.Checksum = ingest.Sum()
+	file.MimeType = ingest.ContentType(file.Name)
+	file.BlobHash = ""
+	file.Metadata = nil
+	if err := database.DB.Save(file).Error; err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, localPath); err != nil {
+		if isNew {
+			database.DB.Delete(file)
+		}
+		return err
+	}
+	if properties := controllers.ReadMetadata(im.ctx, file); properties != nil {
+		models.SetFileMetadata(file.ID, file.Checksum, properties)
+	}
+	thumbnail.Enqueue(file)
+	return nil
+}
+
+// owner maps the on-disk owner of an entry to a TelTech user
+func (im *importer) owner(d fs.DirEntry) int {
+	fi, err := d.Info()
+	if err != nil {
+		return im.opts.DefaultOwner
+	}
+	uid, ok := fileOwner(fi)
+	if !ok {
+		return im.opts.DefaultOwner
+	}
+	if userID, ok := im.opts.Owners[uid]; ok {
+		return userID
+	}
+	im.report.Unmapped[strconv.Itoa(uid)]++
+	return im.opts.DefaultOwner
+}
+
+// fail records an entry that could not be imported
+func (im *importer) fail(path string, err error) {
+	im.report.Failed++
+	if len(im.report.Errors) < maxErrors {
+		im.report.Errors = append(im.report.Errors, fmt.Sprintf("%s: %v", path, err))
+	}
+	log.Printf("Failed to import %s: %v", path, err)
+}
+
+// LoadOwnerMap reads a file mapping on-disk owners to TelTech users. Each line holds an
+// owner, as a UID or a local user name, and the TelTech user name or ID it maps to.
+// Blank lines and lines starting with # are ignored.
+func LoadOwnerMap(path string) (map[int]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	owners := make(map[int]int)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected an owner and a user", path, n)
+		}
+
+		uid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			local, lookupErr := user.Lookup(fields[0])
+			if lookupErr != nil {
+				return nil, fmt.Errorf("%s:%d: unknown owner %q", path, n, fields[0])
+			}
+			uid, _ = strconv.Atoi(local.Uid)
+		}
+
+		userID, err := LookupUserID(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: unknown user %q", path, n, fields[1])
+		}
+		owners[uid] = userID
+	}
+	return owners, scanner.Err()
+}
+
+// LookupUserID resolves a TelTech user name or numeric ID to the user's ID
+func LookupUserID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		var u models.User
+		if err := database.DB.First(&u, id).Error; err != nil {
+			return 0, err
+		}
+		return u.ID, nil
+	}
+	u, err := models.FindByUsername(name)
+	if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+// setup opens a test database and storage, returning the storage root and a source tree
+// holding a.txt and sub/b.txt
+func setup(t *testing.T) (root, source string) {
+	t.Helper()
+	databasetest.Open(t, &models.User{}, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.AuditEvent{})
+	root = t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	source = t.TempDir()
+	os.Mkdir(filepath.Join(source, "sub"), 0755)
+	os.WriteFile(filepath.Join(source, "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(source, "sub", "b.txt"), []byte("bravo"), 0644)
+	return root, source
+}
+
+func TestRun(t *testing.T) {
+	root, source := setup(t)
+	uid := os.Getuid()
+	target := filepath.Join(root, "imported")
+	opts := Options{Source: source, Target: target, Owners: map[int]int{uid: 7}, DefaultOwner: 1}
+
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Bytes != 10 || report.Folders != 3 || report.Failed != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for path, content := range map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"} {
+		file, err := models.GetFileByPath(filepath.Join(target, path))
+		if err != nil {
+			t.Fatalf("%s was not recorded: %v", path, err)
+		}
+		if file.OwnerID != 7 {
+			t.Errorf("%s is owned by %d, want the mapped user", path, file.OwnerID)
+		}
+		if data, _ := os.ReadFile(filepath.Join(target, path)); string(data) != content {
+			t.Errorf("%s holds %q", path, data)
+		}
+	}
+	// The source is left alone
+	if _, err := os.Stat(filepath.Join(source, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running again resumes past the files already imported
+	report, err = Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 0 || report.Resumed != 2 || report.Folders != 0 {
+		t.Fatalf("unexpected report on resume %+v", report)
+	}
+
+	// A file that changed size is imported again, keeping the earlier import as a version
+	os.WriteFile(filepath.Join(source, "a.txt"), []byte("alpha two"), 0644)
+	report, err = Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 1 || report.Resumed != 1 {
+		t.Fatalf("unexpected report after a change %+v", report)
+	}
+	file, _ := models.GetFileByPath(filepath.Join(target, "a.txt"))
+	if versions, _ := models.GetFileVersions(file.ID); file.Version != 2 || len(versions) != 1 {
+		t.Fatalf("version %d with previous versions %+v", file.Version, versions)
+	}
+}
+
+func TestRunUnmappedOwner(t *testing.T) {
+	root, source := setup(t)
+	target := filepath.Join(root, "imported")
+
+	report, err := Run(context.Background(), Options{Source: source, Target: target, DefaultOwner: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Unmapped[strconv.Itoa(os.Getuid())]; got != 3 {
+		t.Fatalf("counted %d unmapped entries, want the folder and both files", got)
+	}
+	file, err := models.GetFileByPath(filepath.Join(target, "sub", "b.txt"))
+	if err != nil || file.OwnerID != 3 {
+		t.Fatalf("file %+v, %v", file, err)
+	}
+}
+
+func TestRunAdopt(t *testing.T) {
+	root, source := setup(t)
+	target := filepath.Join(root, "imported")
+
+	report, err := Run(context.Background(), Options{Source: source, Target: target, Adopt: true, DefaultOwner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 2 || report.Failed != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// Adopted files are moved, not copied
+	if _, err := os.Stat(filepath.Join(source, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("source file still there: %v", err)
+	}
+	file, err := models.GetFileByPath(filepath.Join(target, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file.Path); string(data) != "alpha" || file.Size != 5 || file.Checksum == "" {
+		t.Fatalf("file %+v holds %q", file, data)
+	}
+}
+
+func TestRunAdoptNeedsPlainStorage(t *testing.T) {
+	root, source := setup(t)
+	t.Setenv("STORAGE_MODE", storage.ModeCAS)
+
+	if _, err := Run(context.Background(), Options{Source: source, Target: root, Adopt: true}); err == nil {
+		t.Fatal("adopting into CAS storage succeeded")
+	}
+}
+
+func TestLoadOwnerMap(t *testing.T) {
+	databasetest.Open(t, &models.User{})
+	alice := models.User{Username: "alice", Password: "x", Role: "user"}
+	bob := models.User{Username: "bob", Password: "x", Role: "user"}
+	database.DB.Create(&alice)
+	database.DB.Create(&bob)
+
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "owners")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	owners, err := LoadOwnerMap(write("# disk owner to user\n1000 alice\n\n1001 " + strconv.Itoa(bob.ID) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 || owners[1000] != alice.ID || owners[1001] != bob.ID {
+		t.Fatalf("got %v", owners)
+	}
+
+	for _, content := range []string{"1000\n", "1000 carol\n", "1000 99\n", "no-such-local-user alice\n"} {
+		if _, err := LoadOwnerMap(write(content)); err == nil {
+			t.Errorf("loaded %q without an error", content)
+		}
+	}
+}
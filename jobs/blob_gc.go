@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+)
+
+// StartBlobGC periodically removes blobs that no file or version references anymore.
+// Blobs are only collected once they have been unreferenced for at least grace, which
+// gives in-flight uploads of the same content time to claim them.
+func StartBlobGC(driver storage.Driver, interval, grace time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			removed, err := CollectBlobs(context.Background(), driver, grace)
+			if err != nil {
+				log.Printf("Blob garbage collection failed: %v", err)
+				continue
+			}
+			if removed > 0 {
+				log.Printf("Blob garbage collection removed %d blobs", removed)
+			}
+		}
+	}()
+}
+
+// CollectBlobs removes unreferenced blobs and returns how many were removed
+func CollectBlobs(ctx context.Context, driver storage.Driver, grace time.Duration) (int, error) {
+	blobs, err := models.GetUnreferencedBlobs(time.Now().Add(-grace))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, blob := range blobs {
+		deleted, err := models.DeleteBlobIfUnreferenced(blob.Hash)
+		if err != nil {
+			return removed, err
+		}
+		if !deleted {
+			continue // Referenced again since the query
+		}
+
+		// Move the content aside first so an upload that claims the hash concurrently
+		// either sees it in place or stores its own copy, then restore it if so
+		blobKey := storage.BlobKey(blob.Hash)
+		trashKey := storage.BlobTrashKey(blob.Hash)
+		if err := driver.Move(ctx, blobKey, trashKey); err != nil {
+			if !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Failed to remove blob %s: %v", blob.Hash, err)
+			}
+			continue
+		}
+		if models.BlobExists(blob.Hash) && !storage.Exists(ctx, driver, blobKey) {
+			if err := driver.Move(ctx, trashKey, blobKey); err != nil {
+				log.Printf("Failed to restore blob %s: %v", blob.Hash, err)
+			}
+			continue
+		}
+		driver.Delete(ctx, trashKey)
+		if !models.BlobExists(blob.Hash) {
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+func TestCollectBlobs(t *testing.T) {
+	databasetest.Open(t, &models.Blob{})
+	driver, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	hour := time.Now().Add(-time.Hour)
+	blobs := []struct {
+		hash     string
+		refCount int
+		updated  time.Time
+		kept     bool
+	}{
+		{hash: "aa00", refCount: 0, updated: hour, kept: false},
+		{hash: "bb00", refCount: 1, updated: hour, kept: true},
+		{hash: "cc00", refCount: 0, updated: time.Now(), kept: true}, // Within the grace period
+	}
+	for _, b := range blobs {
+		if _, err := driver.Put(ctx, storage.BlobKey(b.hash), strings.NewReader(b.hash), storage.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		database.DB.Create(&models.Blob{Hash: b.hash, Size: 4, RefCount: b.refCount})
+		database.DB.Model(&models.Blob{}).Where("hash = ?", b.hash).UpdateColumn("updated_at", b.updated)
+	}
+
+	removed, err := CollectBlobs(ctx, driver, 10*time.Minute)
+	if err != nil || removed != 1 {
+		t.Fatalf("removed %d blobs, %v", removed, err)
+	}
+	for _, b := range blobs {
+		if storage.Exists(ctx, driver, storage.BlobKey(b.hash)) != b.kept || models.BlobExists(b.hash) != b.kept {
+			t.Errorf("blob %s: kept %v, want %v", b.hash, !b.kept, b.kept)
+		}
+	}
+}
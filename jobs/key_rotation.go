@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"log"
+	"teltech/database"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+)
+
+// StartKeyRotation re-wraps data keys sealed with a retired master key under the active
+// one, once at startup and then periodically. Only the small wrapped keys are rewritten;
+// the encrypted file contents stay untouched.
+func StartKeyRotation(master *storage.MasterKeys, interval time.Duration) {
+	go func() {
+		for {
+			rotated, err := RotateDataKeys(master)
+			if err != nil {
+				log.Printf("Data key rotation failed: %v", err)
+			} else if rotated > 0 {
+				log.Printf("Re-wrapped %d data keys with master key %q", rotated, master.Active)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// RotateDataKeys re-wraps every data key not yet wrapped with the active master key and
+// returns how many were rotated
+func RotateDataKeys(master *storage.MasterKeys) (int, error) {
+	rotated := 0
+	failed := map[int]bool{}
+	for {
+		dataKeys, err := models.GetDataKeysNotWrappedWith(master.Active, 500+len(failed))
+		if err != nil {
+			return rotated, err
+		}
+
+		progress := false
+		for _, dataKey := range dataKeys {
+			if failed[dataKey.ID] {
+				continue
+			}
+			wrapped, err := master.Rewrap(storage.WrappedKey{MasterKeyID: dataKey.MasterKeyID, Key: dataKey.WrappedKey})
+			if err != nil {
+				log.Printf("Cannot re-wrap data key of %s: %v", dataKey.ObjectKey, err)
+				failed[dataKey.ID] = true
+				continue
+			}
+
+			// Only replace the key if it was not changed concurrently
+			result := database.DB.Model(&models.DataKey{}).
+				Where("id = ? AND master_key_id = ?", dataKey.ID, dataKey.MasterKeyID).
+				Updates(map[string]interface{}{"master_key_id": wrapped.MasterKeyID, "wrapped_key": wrapped.Key})
+			if result.Error != nil {
+				return rotated, result.Error
+			}
+			rotated += int(result.RowsAffected)
+			progress = true
+		}
+		if !progress {
+			return rotated, nil
+		}
+	}
+}
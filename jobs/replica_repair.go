@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"teltech/metrics"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+)
+
+// StartReplicaRepair periodically verifies every replicated object and restores the
+// configured number of intact copies
+func StartReplicaRepair(replicas *storage.Replicated, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			repaired, err := RepairReplicas(context.Background(), replicas)
+			if err != nil {
+				log.Printf("Replica repair failed: %v", err)
+				continue
+			}
+			if repaired > 0 {
+				log.Printf("Replica repair fixed %d objects", repaired)
+			}
+		}
+	}()
+}
+
+// RepairReplicas repairs every object in storage and returns how many needed it.
+// Objects without a single intact copy are reported as audit events.
+func RepairReplicas(ctx context.Context, replicas *storage.Replicated) (int, error) {
+	repaired := 0
+	err := storage.Walk(ctx, replicas, "", func(info storage.Info) error {
+		if info.IsDir {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		changed, err := replicas.Repair(ctx, info.Key)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			// Deleted while walking
+		case errors.Is(err, storage.ErrReplicaLost):
+			metrics.Add("replica_lost_total", 1)
+			log.Printf("No intact replica of %s is left", info.Key)
+			models.RecordAuditEvent("replica.lost", 0, info.Key, err.Error())
+		case err != nil:
+			log.Printf("Failed to repair replicas of %s: %v", info.Key, err)
+		case changed:
+			repaired++
+			metrics.Add("replica_repairs_total", 1)
+			models.RecordAuditEvent("replica.repaired", 0, info.Key, "Restored missing or damaged replicas")
+		}
+		return nil
+	})
+	return repaired, err
+}
@@ -0,0 +1,311 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"teltech/database"
+	"teltech/metrics"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+)
+
+// ErrScrubRunning is returned when a scrub is requested while another one is in progress
+var ErrScrubRunning = errors.New("a scrub is already running")
+
+// scrubbing guards against overlapping scrub runs
+var scrubbing atomic.Bool
+
+// scrubTarget is content the database expects to find in storage
+type scrubTarget struct {
+	checksum string
+	fileID   int
+	tracked  func() bool // Reports whether the database still expects the content
+}
+
+// StartScrubber periodically re-hashes everything in storage and compares it with the
+// checksums recorded in the database, reading at most rate bytes per second (0 for no
+// limit)
+func StartScrubber(driver storage.Driver, interval time.Duration, rate int64) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if _, err := Scrub(context.Background(), driver, rate); err != nil {
+				log.Printf("Integrity scrub failed: %v", err)
+			}
+		}
+	}()
+}
+
+// Scrub runs one integrity pass and returns its summary. Corrupted, missing and
+// unexpected objects are recorded as scrub issues and audit events.
+func Scrub(ctx context.Context, driver storage.Driver, rate int64) (*models.ScrubRun, error) {
+	if !scrubbing.CompareAndSwap(false, true) {
+		return nil, ErrScrubRunning
+	}
+	defer scrubbing.Store(false)
+	return runScrub(ctx, driver, rate)
+}
+
+// StartScrub starts a scrub in the background, failing right away if one is in progress
+func StartScrub(driver storage.Driver, rate int64) error {
+	if !scrubbing.CompareAndSwap(false, true) {
+		return ErrScrubRunning
+	}
+	go func() {
+		defer scrubbing.Store(false)
+		if _, err := runScrub(context.Background(), driver, rate); err != nil {
+			log.Printf("Integrity scrub failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// runScrub performs a scrub the caller holds the scrubbing flag for
+func runScrub(ctx context.Context, driver storage.Driver, rate int64) (*models.ScrubRun, error) {
+	run := &models.ScrubRun{StartedAt: time.Now()}
+	if err := database.DB.Create(run).Error; err != nil {
+		return nil, err
+	}
+
+	err := scrub(ctx, driver, run, newRateLimiter(rate))
+	if err != nil {
+		run.Error = err.Error()
+	}
+	finished := time.Now()
+	run.FinishedAt = &finished
+	if err := database.DB.Save(run).Error; err != nil {
+		return run, err
+	}
+
+	metrics.Add("scrub_runs_total", 1)
+	metrics.Set("scrub_last_run_timestamp_seconds", finished.Unix())
+	metrics.Set("scrub_corrupted", int64(run.Corrupted))
+	metrics.Set("scrub_missing", int64(run.Missing))
+	metrics.Set("scrub_unexpected", int64(run.Unexpected))
+	models.RecordAuditEvent("scrub.completed", 0, "", fmt.Sprintf(
+		"Checked %d objects: %d corrupted, %d missing, %d unexpected",
+		run.Checked, run.Corrupted, run.Missing, run.Unexpected))
+	return run, err
+}
+
+// scrub walks storage, re-hashing every object the database knows about
+func scrub(ctx context.Context, driver storage.Driver, run *models.ScrubRun, limiter *rateLimiter) error {
+	targets, err := scrubTargets()
+	if err != nil {
+		return err
+	}
+
+	err = storage.Walk(ctx, driver, "", func(info storage.Info) error {
+		if info.IsDir || untrackedKey(info.Key) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, ok := targets[info.Key]
+		if !ok {
+			// Content that appeared after the targets were loaded is not a stray
+			if info.ModTime.Before(run.StartedAt) {
+				recordIssue(run, models.ScrubIssue{Kind: models.ScrubUnexpected, ObjectKey: info.Key})
+			}
+			return nil
+		}
+		delete(targets, info.Key)
+
+		actual, n, err := hashObject(ctx, driver, info.Key, limiter)
+		run.Checked++
+		run.BytesHashed += n
+		metrics.Add("scrub_objects_checked_total", 1)
+		metrics.Add("scrub_bytes_hashed_total", n)
+
+		switch {
+		case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			return err
+		case errors.Is(err, storage.ErrNotFound):
+			targets[info.Key] = target // Gone while walking, judged with the missing ones below
+		case err != nil:
+			recordIssue(run, models.ScrubIssue{Kind: models.ScrubCorrupted, ObjectKey: info.Key,
+				FileID: target.fileID, Expected: target.checksum, Detail: err.Error()})
+		case target.checksum == "":
+			// Stored before checksums were recorded, so this becomes the reference
+			if target.fileID != 0 {
+				models.SetFileChecksum(target.fileID, actual)
+			}
+		case actual != target.checksum && target.tracked():
+			recordIssue(run, models.ScrubIssue{Kind: models.ScrubCorrupted, ObjectKey: info.Key,
+				FileID: target.fileID, Expected: target.checksum, Actual: actual})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, target := range targets {
+		if storage.Exists(ctx, driver, key) || !target.tracked() {
+			continue // Created or deleted since the targets were loaded
+		}
+		recordIssue(run, models.ScrubIssue{Kind: models.ScrubMissing, ObjectKey: key,
+			FileID: target.fileID, Expected: target.checksum})
+	}
+	return nil
+}
+
+// scrubTargets maps the storage key of everything the database refers to onto what
+// the content should hash to
+func scrubTargets() (map[string]scrubTarget, error) {
+	targets := make(map[string]scrubTarget)
+
+	files, err := models.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.BlobHash != "" {
+			continue // Checked through the blob
+		}
+		path := file.Path
+		targets[file.ContentKey()] = scrubTarget{checksum: file.Checksum, fileID: file.ID, tracked: func() bool {
+			current, err := models.GetFileByPath(path)
+			return err == nil && current.BlobHash == ""
+		}}
+	}
+
+	versions, err := models.GetAllFileVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.BlobHash != "" {
+			continue
+		}
+		targets[version.ContentKey()] = scrubTarget{checksum: version.Checksum, tracked: func() bool { return true }}
+	}
+
+	blobs, err := models.GetAllBlobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		hash := blob.Hash
+		targets[storage.BlobKey(hash)] = scrubTarget{checksum: hash, tracked: func() bool { return models.BlobExists(hash) }}
+	}
+	return targets, nil
+}
+
+// untrackedKey reports whether key holds internal data the database does not record
+// checksums for, such as staged uploads or blobs being garbage collected
+func untrackedKey(key string) bool {
+	if !strings.HasPrefix(key, storage.InternalDir+"/") {
+		return false
+	}
+	if strings.HasPrefix(key, storage.InternalDir+"/blobs/tmp/") || strings.HasPrefix(key, storage.InternalDir+"/blobs/trash/") {
+		return true
+	}
+	return !strings.HasPrefix(key, storage.InternalDir+"/blobs/") && !strings.HasPrefix(key, storage.InternalDir+"/versions/")
+}
+
+// hashObject returns the hex SHA-256 of the object at key and how many bytes were read
+func hashObject(ctx context.Context, driver storage.Driver, key string, limiter *rateLimiter) (string, int64, error) {
+	rc, err := driver.Get(ctx, key, 0, -1)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, limiter.reader(ctx, rc))
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// recordIssue stores a problem found during run and emits an audit event for it
+func recordIssue(run *models.ScrubRun, issue models.ScrubIssue) {
+	switch issue.Kind {
+	case models.ScrubCorrupted:
+		run.Corrupted++
+	case models.ScrubMissing:
+		run.Missing++
+	case models.ScrubUnexpected:
+		run.Unexpected++
+	}
+	metrics.Add("scrub_"+issue.Kind+"_total", 1)
+
+	issue.RunID = run.ID
+	if err := database.DB.Create(&issue).Error; err != nil {
+		log.Printf("Failed to record scrub issue for %s: %v", issue.ObjectKey, err)
+	}
+	if err := models.RecordAuditEvent("scrub."+issue.Kind, 0, issue.ObjectKey, issue.Detail); err != nil {
+		log.Printf("Failed to record audit event for %s: %v", issue.ObjectKey, err)
+	}
+	log.Printf("Integrity scrub found %s object %s", issue.Kind, issue.ObjectKey)
+}
+
+// rateLimiter spreads reads out so they average at most rate bytes per second
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or no limit when rate is 0
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// reader wraps r so reads through it count against the limit
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// wait sleeps until n more bytes fit within the rate
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitedReader is an io.Reader throttled by a rateLimiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.limiter.wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+func TestScrub(t *testing.T) {
+	databasetest.Open(t, &models.File{}, &models.FileVersion{}, &models.Blob{},
+		&models.ScrubRun{}, &models.ScrubIssue{}, &models.AuditEvent{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	driver := storage.Default()
+	ctx := context.Background()
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	put := func(key, content string) {
+		if _, err := driver.Put(ctx, key, strings.NewReader(content), storage.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		// Older than the run, so strays count as unexpected
+		hour := time.Now().Add(-time.Hour)
+		os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), hour, hour)
+	}
+
+	files := []struct {
+		name     string
+		content  string // Empty for a file missing from storage
+		checksum string
+	}{
+		{name: "good.txt", content: "good", checksum: sum("good")},
+		{name: "bad.txt", content: "bit rot", checksum: sum("bad")},
+		{name: "gone.txt", checksum: sum("gone")},
+		{name: "legacy.txt", content: "legacy"},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, f.name)
+		if f.content != "" {
+			put(f.name, f.content)
+		}
+		database.DB.Create(&models.File{Name: f.name, Path: path, Checksum: f.checksum, FolderID: 1})
+	}
+	put("stray.txt", "stray")
+	put(storage.BlobKey(sum("blob")), "blob")
+	database.DB.Create(&models.Blob{Hash: sum("blob"), Size: 4, RefCount: 1})
+	put(storage.InternalDir+"/blobs/tmp/upload", "staged") // Not tracked
+
+	run, err := Scrub(ctx, driver, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Checked != 4 || run.Corrupted != 1 || run.Missing != 1 || run.Unexpected != 1 || run.FinishedAt == nil {
+		t.Fatalf("unexpected run %+v", run)
+	}
+
+	issues, _ := models.GetScrubIssues(run.ID)
+	found := map[string]string{}
+	for _, issue := range issues {
+		found[issue.ObjectKey] = issue.Kind
+	}
+	want := map[string]string{
+		"bad.txt":   models.ScrubCorrupted,
+		"gone.txt":  models.ScrubMissing,
+		"stray.txt": models.ScrubUnexpected,
+	}
+	for key, kind := range want {
+		if found[key] != kind {
+			t.Errorf("%s: got issue %q, want %q", key, found[key], kind)
+		}
+	}
+	if len(found) != len(want) {
+		t.Errorf("got issues %v", found)
+	}
+
+	// Content stored without a checksum becomes the reference
+	if legacy, _ := models.GetFileByPath(filepath.Join(root, "legacy.txt")); legacy.Checksum != sum("legacy") {
+		t.Errorf("legacy file has checksum %q", legacy.Checksum)
+	}
+
+	var events int64
+	database.DB.Model(&models.AuditEvent{}).Count(&events)
+	if events != 4 { // One per issue and the summary
+		t.Errorf("recorded %d audit events", events)
+	}
+}
+
+func TestScrubOverlap(t *testing.T) {
+	scrubbing.Store(true)
+	defer scrubbing.Store(false)
+	if err := StartScrub(nil, 0); err != ErrScrubRunning {
+		t.Fatalf("got %v, want ErrScrubRunning", err)
+	}
+}
@@ -0,0 +1,58 @@
+// Package mailer sends plain text notification emails through the SMTP server set in
+// SMTP_HOST
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"teltech/config"
+	"time"
+)
+
+// ErrNotConfigured is returned when no SMTP server is set
+var ErrNotConfigured = errors.New("no SMTP server configured")
+
+// Enabled reports whether emails can be sent
+func Enabled() bool {
+	return config.String("SMTP_HOST", "") != ""
+}
+
+// Send emails a plain text message to one address
+func Send(to, subject, body string) error {
+	host := config.String("SMTP_HOST", "")
+	if host == "" {
+		return ErrNotConfigured
+	}
+	from := config.String("SMTP_FROM", "teltech@localhost")
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return err
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + fromAddr.String() + "\r\n")
+	msg.WriteString("To: " + toAddr.String() + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if username := config.String("SMTP_USERNAME", ""); username != "" {
+		auth = smtp.PlainAuth("", username, config.String("SMTP_PASSWORD", ""), host)
+	}
+	addr := net.JoinHostPort(host, strconv.FormatInt(config.Int64("SMTP_PORT", 587), 10))
+	return smtp.SendMail(addr, auth, fromAddr.Address, []string{toAddr.Address}, []byte(msg.String()))
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"log"
 	"os"
+	"teltech/config"
+	"teltech/jobs"
 	"teltech/models"
+	"teltech/storage"
+	"teltech/thumbnail"
+	"teltech/watcher"
+	"time"
 
 	"teltech/database"
 	"teltech/routes"
@@ -26,10 +32,88 @@ func main() {
 		&models.User{},
 		&models.Folder{},
 		&models.File{},
+		&models.FileVersion{},
+		&models.Blob{},
+		&models.DataKey{},
+		&models.ReplicaSum{},
+		&models.ObjectSize{},
 		&models.FileShare{},
+		&models.ShareAccess{},
+		&models.ShareUpload{},
+		&models.AuditEvent{},
+		&models.ScrubRun{},
+		&models.ScrubIssue{},
 	); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
+	if err := models.MigrateDataKeys(); err != nil {
+		log.Fatalf("Failed to migrate data keys: %v", err)
+	}
+	if n, err := models.HashSharePasswords(); err != nil {
+		log.Fatalf("Failed to hash share passwords: %v", err)
+	} else if n > 0 {
+		log.Printf("Hashed %d share passwords stored in plaintext", n)
+	}
+	if n, err := models.BackfillOwners(); err != nil {
+		log.Fatalf("Failed to backfill owners: %v", err)
+	} else if n > 0 {
+		log.Printf("Gave %d unowned folders and files the owner of their parent folder", n)
+	}
+
+	// Open file storage
+	if err := storage.Init(models.DataKeyStore{}, models.ReplicaSumStore{}, models.ObjectSizeStore{}); err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	// Paths are stored relative to the cleaned storage root
+	if err := models.MigrateRootPaths(config.String("PARENT_FOLDER", "./data"), storage.Root()); err != nil {
+		log.Fatalf("Failed to migrate stored paths: %v", err)
+	}
+
+	// Run a maintenance command instead of serving when asked to
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			runFsck(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		}
+	}
+
+	// Re-wrap data keys after a master key rotation
+	if master := storage.Master(); master != nil {
+		jobs.StartKeyRotation(master, config.Duration("ENCRYPTION_ROTATION_INTERVAL", time.Hour))
+	}
+
+	// Restore replicas lost to failed or damaged disks
+	if replicas := storage.Replicas(); replicas != nil {
+		jobs.StartReplicaRepair(replicas, config.Duration("REPLICA_REPAIR_INTERVAL", 6*time.Hour))
+	}
+
+	// Collect unreferenced blobs when file contents are deduplicated
+	if config.String("STORAGE_MODE", storage.ModePath) == storage.ModeCAS {
+		jobs.StartBlobGC(storage.Default(), config.Duration("BLOB_GC_INTERVAL", time.Hour), config.Duration("BLOB_GC_GRACE", time.Hour))
+	}
+
+	// Re-hash stored files to catch silent corruption
+	if interval := config.Duration("SCRUB_INTERVAL", 24*time.Hour); interval > 0 {
+		jobs.StartScrubber(storage.Default(), interval, config.Int64("SCRUB_RATE", 0))
+	}
+
+	// Render image thumbnails in the background
+	thumbnail.Start(int(config.Int64("THUMBNAIL_WORKERS", 2)))
+
+	// Pick up files copied straight into PARENT_FOLDER
+	if config.Bool("WATCHER_ENABLED", false) {
+		// It hashes what is on disk as file content, which encryption and compression change
+		if _, plain := storage.Default().(*storage.Local); !plain {
+			log.Println("The file watcher needs the local storage driver without replicas, encryption or compression, not starting it")
+		} else if _, err := watcher.Start(storage.Root(), config.Duration("WATCHER_DEBOUNCE", 2*time.Second), config.Duration("WATCHER_RESCAN_INTERVAL", time.Hour)); err != nil {
+			log.Fatalf("Failed to start file watcher: %v", err)
+		}
+	}
 
 	// Create a new Gin router
 	router := gin.Default()
@@ -0,0 +1,413 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"teltech/models"
+	"time"
+)
+
+// EXIF tags read from photos
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+	tagGPSAltitudeRef   = 0x0005
+	tagGPSAltitude      = 0x0006
+)
+
+// exifHeader starts the APP1 segment of a JPEG holding EXIF data
+var exifHeader = []byte("Exif\x00\x00")
+
+// errNotJPEG is returned for streams that do not start like a JPEG
+var errNotJPEG = errors.New("not a JPEG image")
+
+// maxJPEGHeader caps the bytes of metadata segments read before the image data
+const maxJPEGHeader = 1 << 20
+
+// StripGPS returns a reader yielding the JPEG read from r with the GPS tags of its EXIF
+// data blanked out. Everything else, including the length, stays the same, so the
+// result can be served with the stored size. Other content passes through unchanged.
+func StripGPS(r io.Reader) io.Reader {
+	head, _ := readJPEGHeader(r, func(marker byte, payload []byte) {
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			stripGPS(payload[len(exifHeader):])
+		}
+	})
+	return io.MultiReader(bytes.NewReader(head), r)
+}
+
+// StripGPSSeeker is StripGPS for content read at arbitrary offsets, such as byte ranges
+// of a download. The metadata segments are read from the start of rs once and the
+// stripped copy is served in their place.
+func StripGPSSeeker(rs io.ReadSeeker) (io.ReadSeeker, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head, _ := readJPEGHeader(rs, func(marker byte, payload []byte) {
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			stripGPS(payload[len(exifHeader):])
+		}
+	})
+	return &patchedSeeker{head: head, rs: rs, pos: int64(len(head))}, nil
+}
+
+// patchedSeeker reads rs with its first bytes replaced by head
+type patchedSeeker struct {
+	head     []byte
+	rs       io.ReadSeeker
+	off, pos int64 // Offset reached by the reader and the position of rs
+}
+
+func (p *patchedSeeker) Read(b []byte) (int, error) {
+	if p.off < int64(len(p.head)) {
+		n := copy(b, p.head[p.off:])
+		p.off += int64(n)
+		return n, nil
+	}
+	if p.pos != p.off {
+		if _, err := p.rs.Seek(p.off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		p.pos = p.off
+	}
+	n, err := p.rs.Read(b)
+	p.off += int64(n)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *patchedSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset, whence = p.off+offset, io.SeekStart
+	}
+	abs, err := p.rs.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	p.off, p.pos = abs, abs
+	return abs, nil
+}
+
+// readJPEGHeader reads the metadata segments at the start of a JPEG stream, calling fn
+// with the payload of each. Changes fn makes to a payload are kept in the bytes
+// returned, which are everything read from r.
+func readJPEGHeader(r io.Reader, fn func(marker byte, payload []byte)) ([]byte, error) {
+	var head bytes.Buffer
+	read := func(p []byte) error {
+		n, err := io.ReadFull(r, p)
+		head.Write(p[:n])
+		return err
+	}
+
+	buf := make([]byte, 2)
+	if err := read(buf); err != nil {
+		return head.Bytes(), err
+	}
+	if buf[0] != 0xFF || buf[1] != 0xD8 {
+		return head.Bytes(), errNotJPEG
+	}
+
+	for head.Len() < maxJPEGHeader {
+		if err := read(buf); err != nil {
+			return head.Bytes(), err
+		}
+		marker := buf[1]
+		if buf[0] != 0xFF || !(marker >= 0xE0 && marker <= 0xEF || marker == 0xFE) {
+			return head.Bytes(), nil // The image data follows
+		}
+		if err := read(buf); err != nil {
+			return head.Bytes(), err
+		}
+		length := int(binary.BigEndian.Uint16(buf))
+		if length < 2 {
+			return head.Bytes(), nil
+		}
+
+		payload := make([]byte, length-2)
+		n, err := io.ReadFull(r, payload)
+		if err == nil {
+			fn(marker, payload)
+		}
+		head.Write(payload[:n])
+		if err != nil {
+			return head.Bytes(), err
+		}
+	}
+	return head.Bytes(), nil
+}
+
+// jpegEXIF reads the metadata segments of a JPEG, returning the bytes read and the
+// TIFF structure of its EXIF data, if any
+func jpegEXIF(r io.Reader) ([]byte, []byte, error) {
+	var exif []byte
+	head, err := readJPEGHeader(r, func(marker byte, payload []byte) {
+		if exif == nil && marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			exif = payload[len(exifHeader):]
+		}
+	})
+	return head, exif, err
+}
+
+// tiff reads the TIFF structure EXIF data is kept in
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is a tag of an image file directory
+type ifdEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int // Where the value starts in the TIFF data
+	size   int // Bytes taken by the value
+}
+
+// Sizes of the TIFF value types in bytes, by type number
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// parseTIFF checks the TIFF header and returns the offset of the first directory
+func parseTIFF(b []byte) (*tiff, uint32, bool) {
+	if len(b) < 8 {
+		return nil, 0, false
+	}
+	t := &tiff{b: b}
+	switch string(b[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, false
+	}
+	return t, t.order.Uint32(b[4:]), true
+}
+
+// entries returns the well-formed entries of the directory at off
+func (t *tiff) entries(off uint32) []ifdEntry {
+	if off == 0 || int64(off)+2 > int64(len(t.b)) {
+		return nil
+	}
+	n := int(t.order.Uint16(t.b[off:]))
+	var entries []ifdEntry
+	for i := 0; i < n; i++ {
+		at := int(off) + 2 + i*12
+		if at+12 > len(t.b) {
+			break
+		}
+		e := ifdEntry{
+			tag:   t.order.Uint16(t.b[at:]),
+			typ:   t.order.Uint16(t.b[at+2:]),
+			count: t.order.Uint32(t.b[at+4:]),
+		}
+		typeSize, ok := tiffTypeSizes[e.typ]
+		if !ok || int64(e.count)*int64(typeSize) > int64(len(t.b)) {
+			continue
+		}
+		e.size = int(e.count) * typeSize
+		e.offset = at + 8
+		if e.size > 4 {
+			e.offset = int(t.order.Uint32(t.b[at+8:]))
+		}
+		if e.offset+e.size > len(t.b) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// ascii returns a text value
+func (t *tiff) ascii(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(t.b[e.offset:e.offset+e.size]), "\x00"))
+}
+
+// uint returns the i-th value of an unsigned integer tag
+func (t *tiff) uint(e ifdEntry, i int) (uint32, bool) {
+	if uint32(i) >= e.count {
+		return 0, false
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(t.b[e.offset+i]), true
+	case 3:
+		return uint32(t.order.Uint16(t.b[e.offset+2*i:])), true
+	case 4:
+		return t.order.Uint32(t.b[e.offset+4*i:]), true
+	}
+	return 0, false
+}
+
+// rational returns the i-th value of a fractional tag
+func (t *tiff) rational(e ifdEntry, i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || uint32(i) >= e.count {
+		return 0, false
+	}
+	at := e.offset + 8*i
+	num, den := t.order.Uint32(t.b[at:]), t.order.Uint32(t.b[at+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+// parseEXIF fills in the properties of a photo from its EXIF data
+func parseEXIF(b []byte, image *models.ImageMetadata) {
+	t, ifd0, ok := parseTIFF(b)
+	if !ok {
+		return
+	}
+
+	var dateTime, original, offset string
+	var exifIFD, gpsIFD uint32
+	for _, e := range t.entries(ifd0) {
+		switch e.tag {
+		case tagMake:
+			image.CameraMake = t.ascii(e)
+		case tagModel:
+			image.CameraModel = t.ascii(e)
+		case tagOrientation:
+			if v, ok := t.uint(e, 0); ok && v >= 1 && v <= 8 {
+				image.Orientation = int(v)
+			}
+		case tagDateTime:
+			dateTime = t.ascii(e)
+		case tagExifIFD:
+			exifIFD, _ = t.uint(e, 0)
+		case tagGPSIFD:
+			gpsIFD, _ = t.uint(e, 0)
+		}
+	}
+	for _, e := range t.entries(exifIFD) {
+		switch e.tag {
+		case tagDateTimeOriginal:
+			original = t.ascii(e)
+		case tagOffsetOriginal:
+			offset = t.ascii(e)
+		}
+	}
+	if original == "" {
+		original, offset = dateTime, ""
+	}
+	if captured, ok := exifTime(original, offset); ok {
+		image.CapturedAt = &captured
+	}
+	image.Location = parseGPS(t, gpsIFD)
+}
+
+// exifTime parses an EXIF timestamp. Cameras record local time, so timestamps without an
+// offset are taken as they are, in UTC.
+func exifTime(value, offset string) (time.Time, bool) {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	return t, err == nil
+}
+
+// parseGPS reads the position recorded in the GPS directory at off
+func parseGPS(t *tiff, off uint32) *models.GeoLocation {
+	var latRef, lonRef string
+	var lat, lon, alt *float64
+	var below bool
+	for _, e := range t.entries(off) {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.ascii(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.ascii(e)
+		case tagGPSLatitude:
+			lat = degrees(t, e)
+		case tagGPSLongitude:
+			lon = degrees(t, e)
+		case tagGPSAltitudeRef:
+			v, _ := t.uint(e, 0)
+			below = v == 1
+		case tagGPSAltitude:
+			if v, ok := t.rational(e, 0); ok {
+				alt = &v
+			}
+		}
+	}
+	if lat == nil || lon == nil {
+		return nil
+	}
+
+	location := &models.GeoLocation{Latitude: *lat, Longitude: *lon}
+	if latRef == "S" {
+		location.Latitude = -location.Latitude
+	}
+	if lonRef == "W" {
+		location.Longitude = -location.Longitude
+	}
+	if alt != nil {
+		if below {
+			*alt = -*alt
+		}
+		location.Altitude = alt
+	}
+	return location
+}
+
+// degrees converts a GPS coordinate recorded as degrees, minutes and seconds
+func degrees(t *tiff, e ifdEntry) *float64 {
+	var value float64
+	for i, scale := range []float64{1, 60, 3600} {
+		part, ok := t.rational(e, i)
+		if !ok {
+			if i == 0 {
+				return nil
+			}
+			break
+		}
+		value += part / scale
+	}
+	return &value
+}
+
+// stripGPS blanks out the GPS directory of EXIF data in place, leaving an empty
+// directory behind so no offsets change
+func stripGPS(b []byte) {
+	t, ifd0, ok := parseTIFF(b)
+	if !ok {
+		return
+	}
+	for _, e := range t.entries(ifd0) {
+		if e.tag != tagGPSIFD {
+			continue
+		}
+		off, _ := t.uint(e, 0)
+		if off == 0 || int64(off)+2 > int64(len(b)) {
+			return
+		}
+		for _, entry := range t.entries(off) {
+			if entry.size > 4 {
+				clear(b[entry.offset : entry.offset+entry.size])
+			}
+		}
+		end := min(int(off)+2+int(t.order.Uint16(b[off:]))*12+4, len(b))
+		clear(b[off:end])
+		return
+	}
+}
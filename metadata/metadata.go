@@ -0,0 +1,100 @@
+// Package metadata reads the properties recorded inside stored files: the EXIF data of
+// photos, the tags of audio files and the document information of PDFs
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	_ "image/gif"  // Register the GIF decoder
+	_ "image/jpeg" // Register the JPEG decoder
+	_ "image/png"  // Register the PNG decoder
+	"io"
+	"strings"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/dhowden/tag"
+	_ "golang.org/x/image/webp" // Register the WebP decoder
+)
+
+// Extract reads the metadata of file from its stored content. It returns nil for kinds
+// of files it has nothing to read from.
+func Extract(ctx context.Context, file *models.File) (*models.FileMetadata, error) {
+	mimeType := strings.ToLower(strings.TrimSpace(strings.Split(file.MimeType, ";")[0]))
+	driver := storage.Default()
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		img, err := readImage(ctx, driver, file.ContentKey())
+		if err != nil || img == nil {
+			return nil, err
+		}
+		return &models.FileMetadata{Image: img}, nil
+
+	case strings.HasPrefix(mimeType, "audio/") || mimeType == "application/ogg":
+		r := io.NewSectionReader(storage.NewReaderAt(ctx, driver, file.ContentKey()), 0, file.Size)
+		audio, err := readAudio(r)
+		if err != nil || audio == nil {
+			return nil, err
+		}
+		return &models.FileMetadata{Audio: audio}, nil
+
+	case mimeType == "application/pdf":
+		doc, err := readPDF(storage.NewReaderAt(ctx, driver, file.ContentKey()), file.Size)
+		if err != nil {
+			return nil, err
+		}
+		return &models.FileMetadata{Document: doc}, nil
+	}
+	return nil, nil
+}
+
+// readImage reads the dimensions of an image and, for JPEG photos, their EXIF data. It
+// returns nil for formats it cannot decode.
+func readImage(ctx context.Context, driver storage.Driver, key string) (*models.ImageMetadata, error) {
+	reader, err := driver.Get(ctx, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The EXIF data comes before the frame header giving the dimensions
+	head, exif, _ := jpegEXIF(reader)
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), reader))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	img := &models.ImageMetadata{Width: cfg.Width, Height: cfg.Height}
+	if exif != nil {
+		parseEXIF(exif, img)
+	}
+	return img, nil
+}
+
+// readAudio reads the tags of an audio file, returning nil when it has none
+func readAudio(r io.ReadSeeker) (*models.AudioMetadata, error) {
+	m, err := tag.ReadFrom(r)
+	if errors.Is(err, tag.ErrNoTagsFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	audio := &models.AudioMetadata{
+		Format:      string(m.Format()),
+		Title:       strings.TrimSpace(m.Title()),
+		Artist:      strings.TrimSpace(m.Artist()),
+		Album:       strings.TrimSpace(m.Album()),
+		AlbumArtist: strings.TrimSpace(m.AlbumArtist()),
+		Composer:    strings.TrimSpace(m.Composer()),
+		Genre:       strings.TrimSpace(m.Genre()),
+		Year:        m.Year(),
+	}
+	audio.Track, _ = m.Track()
+	audio.Disc, _ = m.Disc()
+	return audio, nil
+}
@@ -0,0 +1,284 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"teltech/models"
+	"teltech/storage"
+)
+
+// tiffField is a tag written by tiffBuilder.dir
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // Little-endian
+}
+
+func asciiField(tag uint16, s string) tiffField {
+	return tiffField{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func shortField(tag uint16, v uint16) tiffField {
+	return tiffField{tag: tag, typ: 3, count: 1, value: binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func longField(tag uint16, v uint32) tiffField {
+	return tiffField{tag: tag, typ: 4, count: 1, value: binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func rationalField(tag uint16, values ...[2]uint32) tiffField {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, v[0])
+		b = binary.LittleEndian.AppendUint32(b, v[1])
+	}
+	return tiffField{tag: tag, typ: 5, count: uint32(len(values)), value: b}
+}
+
+// tiffBuilder lays out little-endian TIFF directories one after the other
+type tiffBuilder struct{ b []byte }
+
+func newTIFF() *tiffBuilder {
+	return &tiffBuilder{b: []byte("II*\x00\x00\x00\x00\x00")}
+}
+
+// dir writes a directory and the values that do not fit its entries, returning its offset
+func (t *tiffBuilder) dir(fields ...tiffField) uint32 {
+	off := uint32(len(t.b))
+	data := off + 2 + uint32(len(fields))*12 + 4
+	var values []byte
+	t.b = binary.LittleEndian.AppendUint16(t.b, uint16(len(fields)))
+	for _, f := range fields {
+		t.b = binary.LittleEndian.AppendUint16(t.b, f.tag)
+		t.b = binary.LittleEndian.AppendUint16(t.b, f.typ)
+		t.b = binary.LittleEndian.AppendUint32(t.b, f.count)
+		if len(f.value) <= 4 {
+			t.b = append(t.b, append(f.value, make([]byte, 4-len(f.value))...)...)
+			continue
+		}
+		t.b = binary.LittleEndian.AppendUint32(t.b, data+uint32(len(values)))
+		values = append(values, f.value...)
+	}
+	t.b = append(t.b, 0, 0, 0, 0)
+	t.b = append(t.b, values...)
+	return off
+}
+
+// photo returns a 4×3 JPEG whose EXIF data records a camera, a time and a position
+func photo(t *testing.T) []byte {
+	t.Helper()
+	tb := newTIFF()
+	exifIFD := tb.dir(asciiField(tagDateTimeOriginal, "2024:05:06 07:08:09"), asciiField(tagOffsetOriginal, "+02:00"))
+	gpsIFD := tb.dir(
+		asciiField(tagGPSLatitudeRef, "N"),
+		rationalField(tagGPSLatitude, [2]uint32{51, 1}, [2]uint32{30, 1}, [2]uint32{0, 1}),
+		asciiField(tagGPSLongitudeRef, "W"),
+		rationalField(tagGPSLongitude, [2]uint32{0, 1}, [2]uint32{7, 1}, [2]uint32{39, 1}),
+		tiffField{tag: tagGPSAltitudeRef, typ: 1, count: 1, value: []byte{0}},
+		rationalField(tagGPSAltitude, [2]uint32{35, 1}),
+	)
+	ifd0 := tb.dir(
+		asciiField(tagMake, "Acme"),
+		asciiField(tagModel, "Snapper 3000"),
+		shortField(tagOrientation, 6),
+		longField(tagExifIFD, exifIFD),
+		longField(tagGPSIFD, gpsIFD),
+	)
+	binary.LittleEndian.PutUint32(tb.b[4:], ifd0)
+
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 3)), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte(exifHeader), tb.b...)
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, img.Bytes()[2:]...)
+}
+
+func TestReadPhoto(t *testing.T) {
+	img := &models.ImageMetadata{}
+	_, exif, err := jpegEXIF(bytes.NewReader(photo(t)))
+	if err != nil || exif == nil {
+		t.Fatalf("no EXIF data found: %v", err)
+	}
+	parseEXIF(exif, img)
+
+	if img.CameraMake != "Acme" || img.CameraModel != "Snapper 3000" || img.Orientation != 6 {
+		t.Errorf("camera %q %q, orientation %d", img.CameraMake, img.CameraModel, img.Orientation)
+	}
+	want := time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*3600))
+	if img.CapturedAt == nil || !img.CapturedAt.Equal(want) {
+		t.Errorf("captured at %v, want %v", img.CapturedAt, want)
+	}
+	loc := img.Location
+	if loc == nil || math.Abs(loc.Latitude-51.5) > 1e-9 || math.Abs(loc.Longitude+0.1275) > 1e-9 ||
+		loc.Altitude == nil || *loc.Altitude != 35 {
+		t.Errorf("location %+v", loc)
+	}
+}
+
+func TestStripGPS(t *testing.T) {
+	original := photo(t)
+	stripped, err := io.ReadAll(StripGPS(bytes.NewReader(original)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != len(original) {
+		t.Fatalf("length changed from %d to %d", len(original), len(stripped))
+	}
+
+	img := &models.ImageMetadata{}
+	_, exif, _ := jpegEXIF(bytes.NewReader(stripped))
+	parseEXIF(exif, img)
+	if img.Location != nil {
+		t.Errorf("location %+v left in", img.Location)
+	}
+	if img.CameraMake != "Acme" || img.CapturedAt == nil {
+		t.Errorf("other EXIF data lost: %+v", img)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped photo no longer decodes: %v", err)
+	}
+
+	// Other content passes through as it is
+	text := []byte("not a photo at all")
+	if got, _ := io.ReadAll(StripGPS(bytes.NewReader(text))); !bytes.Equal(got, text) {
+		t.Errorf("text came out as %q", got)
+	}
+}
+
+func TestReadPDF(t *testing.T) {
+	pdf := "%PDF-1.7\n" +
+		"1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj\n" +
+		"2 0 obj << /Type /Pages /Kids [3 0 R] /Count 12 >> endobj\n" +
+		"3 0 obj << /Type /Pages /Parent 2 0 R /Count 5 >> endobj\n" +
+		"4 0 obj << /Title (Annual \\(draft\\) report) /TitleSort (Z) /Author <FEFF00C90076006100>" +
+		" /CreationDate (D:20240102150405+02'00') /ModDate (D:2024) >> endobj\n" +
+		"trailer << /Root 1 0 R /Info 4 0 R >>\n%%EOF\n"
+
+	doc, err := readPDF(bytes.NewReader([]byte(pdf)), int64(len(pdf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != "1.7" || doc.Pages != 12 || doc.Title != "Annual (draft) report" || doc.Author != "Éva" {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("", 2*3600))
+	if doc.CreatedAt == nil || !doc.CreatedAt.Equal(created) {
+		t.Errorf("created at %v", doc.CreatedAt)
+	}
+	if doc.ModifiedAt == nil || !doc.ModifiedAt.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("modified at %v", doc.ModifiedAt)
+	}
+}
+
+func TestPDFDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+		none  bool
+	}{
+		{value: "D:20240102150405Z", want: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{value: "D:20240102150405-05'30'", want: time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("", -(5*3600+30*60)))},
+		{value: "D:202403", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "19991231", want: time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{value: "D:99", none: true},
+		{value: "", none: true},
+	}
+	for _, tt := range tests {
+		got := pdfDate(tt.value)
+		if tt.none {
+			if got != nil {
+				t.Errorf("pdfDate(%q) = %v, want none", tt.value, got)
+			}
+			continue
+		}
+		if got == nil || !got.Equal(tt.want) {
+			t.Errorf("pdfDate(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// id3 returns an ID3v2.3 tag holding the given text frames
+func id3(frames map[string]string) []byte {
+	var body []byte
+	for id, text := range frames {
+		body = append(body, id...)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(text)+1))
+		body = append(body, 0, 0, 0) // No flags, then Latin-1 text
+		body = append(body, text...)
+	}
+	size := len(body)
+	return append([]byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}, body...)
+}
+
+func TestReadAudio(t *testing.T) {
+	tagged := append(id3(map[string]string{"TIT2": "Song", "TPE1": "Band", "TALB": "Record", "TRCK": "3/10", "TYER": "1999"}), make([]byte, 64)...)
+	audio, err := readAudio(bytes.NewReader(tagged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio == nil || audio.Title != "Song" || audio.Artist != "Band" || audio.Album != "Record" || audio.Track != 3 || audio.Year != 1999 {
+		t.Fatalf("unexpected tags %+v", audio)
+	}
+
+	if audio, err := readAudio(bytes.NewReader(make([]byte, 256))); audio != nil || err != nil {
+		t.Fatalf("untagged audio gave %+v, %v", audio, err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var pic bytes.Buffer
+	png.Encode(&pic, image.NewGray(image.Rect(0, 0, 7, 5)))
+
+	store := func(name, mimeType string, content []byte) *models.File {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, content, 0644)
+		return &models.File{Name: name, Path: path, Size: int64(len(content)), MimeType: mimeType}
+	}
+	ctx := context.Background()
+
+	got, err := Extract(ctx, store("a.jpg", "image/jpeg", photo(t)))
+	if err != nil || got == nil || got.Image == nil || got.Image.Width != 4 || got.Image.Height != 3 || got.Image.Location == nil {
+		t.Fatalf("photo gave %+v, %v", got, err)
+	}
+	got, err = Extract(ctx, store("a.png", "image/png", pic.Bytes()))
+	if err != nil || got == nil || got.Image == nil || got.Image.Width != 7 || got.Image.CameraMake != "" {
+		t.Fatalf("picture gave %+v, %v", got, err)
+	}
+	got, err = Extract(ctx, store("a.mp3", "audio/mpeg", append(id3(map[string]string{"TIT2": "Song"}), make([]byte, 64)...)))
+	if err != nil || got == nil || got.Audio == nil || got.Audio.Title != "Song" {
+		t.Fatalf("audio gave %+v, %v", got, err)
+	}
+	got, err = Extract(ctx, store("a.pdf", "application/pdf", []byte("%PDF-1.4\n1 0 obj << /Type /Pages /Count 2 >> endobj\n")))
+	if err != nil || got == nil || got.Document == nil || got.Document.Pages != 2 {
+		t.Fatalf("document gave %+v, %v", got, err)
+	}
+
+	// Nothing is read from other kinds of files, or images that do not decode
+	for _, file := range []*models.File{store("a.txt", "text/plain", []byte("text")), store("b.png", "image/png", []byte("broken"))} {
+		if got, err := Extract(ctx, file); got != nil || err != nil {
+			t.Errorf("%s gave %+v, %v", file.Name, got, err)
+		}
+	}
+}
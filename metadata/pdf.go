@@ -0,0 +1,304 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"teltech/models"
+	"time"
+	"unicode/utf16"
+)
+
+// pdfWindow is how much of the start and the end of a PDF is searched for its
+// properties. The document information and page tree sit near one end or the other.
+const pdfWindow = 1 << 20
+
+// maxObjectStream caps the bytes inflated from one compressed object stream
+const maxObjectStream = 8 << 20
+
+var (
+	pdfVersionPattern = regexp.MustCompile(`^%PDF-(\d\.\d)`)
+	pdfObjectPattern  = regexp.MustCompile(`(?s)(\d+)\s+\d+\s+obj\b(.*?)\bendobj`)
+	pdfInfoPattern    = regexp.MustCompile(`/Info\s+(\d+)\s+\d+\s+R`)
+	pdfPagesPattern   = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfCountPattern   = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfStreamPattern  = regexp.MustCompile(`(?s)stream\r?\n(.*)endstream`)
+	pdfFirstPattern   = regexp.MustCompile(`/First\s+(\d+)`)
+)
+
+// readPDF reads the version, page count and document information of a PDF of the given
+// size. This is a best effort: properties kept where they are not looked for are left
+// out rather than reported as errors.
+func readPDF(r io.ReaderAt, size int64) (*models.DocumentMetadata, error) {
+	data, err := pdfWindows(r, size)
+	if err != nil {
+		return nil, err
+	}
+	doc := &models.DocumentMetadata{}
+	if m := pdfVersionPattern.FindSubmatch(data); m != nil {
+		doc.Version = string(m[1])
+	}
+
+	objects := pdfObjects(data)
+	for _, body := range objects {
+		if pdfPagesPattern.Match(body) {
+			if m := pdfCountPattern.FindSubmatch(body); m != nil {
+				// Nested page trees count their own pages, the root counts them all
+				count, _ := strconv.Atoi(string(m[1]))
+				doc.Pages = max(doc.Pages, count)
+			}
+		}
+	}
+
+	// Later trailers belong to incremental updates, so the last one counts
+	if refs := pdfInfoPattern.FindAllSubmatch(data, -1); refs != nil {
+		num, _ := strconv.Atoi(string(refs[len(refs)-1][1]))
+		if info, ok := objects[num]; ok {
+			for key, value := range map[string]*string{
+				"Title": &doc.Title, "Author": &doc.Author, "Subject": &doc.Subject,
+				"Keywords": &doc.Keywords, "Creator": &doc.Creator, "Producer": &doc.Producer,
+			} {
+				*value = pdfString(info, key)
+			}
+			doc.CreatedAt = pdfDate(pdfString(info, "CreationDate"))
+			doc.ModifiedAt = pdfDate(pdfString(info, "ModDate"))
+		}
+	}
+	return doc, nil
+}
+
+// pdfWindows reads the start and the end of a PDF
+func pdfWindows(r io.ReaderAt, size int64) ([]byte, error) {
+	if size <= 2*pdfWindow {
+		data := make([]byte, size)
+		if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return data, nil
+	}
+	data := make([]byte, 2*pdfWindow)
+	if _, err := r.ReadAt(data[:pdfWindow], 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if _, err := r.ReadAt(data[pdfWindow:], size-pdfWindow); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// pdfObjects returns the bodies of the objects found in data by number, including those
+// packed into compressed object streams. Later definitions replace earlier ones.
+func pdfObjects(data []byte) map[int][]byte {
+	objects := map[int][]byte{}
+	var streams [][]byte
+	for _, m := range pdfObjectPattern.FindAllSubmatch(data, -1) {
+		num, _ := strconv.Atoi(string(m[1]))
+		objects[num] = m[2]
+		if bytes.Contains(m[2], []byte("/ObjStm")) {
+			streams = append(streams, m[2])
+		}
+	}
+
+	for _, stream := range streams {
+		for num, body := range pdfObjectStream(stream) {
+			if _, ok := objects[num]; !ok {
+				objects[num] = body
+			}
+		}
+	}
+	return objects
+}
+
+// pdfObjectStream unpacks the objects of a compressed object stream
+func pdfObjectStream(stream []byte) map[int][]byte {
+	m := pdfStreamPattern.FindSubmatch(stream)
+	first := pdfFirstPattern.FindSubmatch(stream)
+	if m == nil || first == nil || !bytes.Contains(stream, []byte("/FlateDecode")) {
+		return nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(m[1]))
+	if err != nil {
+		return nil
+	}
+	content, _ := io.ReadAll(io.LimitReader(zr, maxObjectStream))
+	start, _ := strconv.Atoi(string(first[1]))
+	if start > len(content) {
+		return nil
+	}
+
+	// The header lists each object's number and offset from start
+	header := strings.Fields(string(content[:start]))
+	objects := map[int][]byte{}
+	for i := 0; i+1 < len(header); i += 2 {
+		num, err1 := strconv.Atoi(header[i])
+		off, err2 := strconv.Atoi(header[i+1])
+		end := len(content) - start
+		if i+3 < len(header) {
+			end, _ = strconv.Atoi(header[i+3])
+		}
+		if err1 != nil || err2 != nil || off < 0 || off > end || start+end > len(content) {
+			continue
+		}
+		objects[num] = content[start+off : start+end]
+	}
+	return objects
+}
+
+// pdfString returns the text of the string entry key of a dictionary
+func pdfString(dict []byte, key string) string {
+	at := bytes.Index(dict, []byte("/"+key))
+	for at >= 0 {
+		rest := dict[at+len(key)+1:]
+		if len(rest) > 0 && !isPDFDelimiter(rest[0]) {
+			// A longer key with the same start
+			next := bytes.Index(rest, []byte("/"+key))
+			if next < 0 {
+				return ""
+			}
+			at += len(key) + 1 + next
+			continue
+		}
+		rest = bytes.TrimLeft(rest, " \t\r\n")
+		if len(rest) == 0 {
+			return ""
+		}
+		switch rest[0] {
+		case '(':
+			return pdfText(pdfLiteral(rest[1:]))
+		case '<':
+			if end := bytes.IndexByte(rest, '>'); end > 0 {
+				return pdfText(pdfHex(rest[1:end]))
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// isPDFDelimiter reports whether b ends a PDF name
+func isPDFDelimiter(b byte) bool {
+	return strings.IndexByte(" \t\r\n()<>[]{}/%", b) >= 0
+}
+
+// pdfLiteral decodes a literal string up to its closing parenthesis
+func pdfLiteral(b []byte) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; c {
+		case '(':
+			depth++
+			out = append(out, c)
+		case ')':
+			if depth == 0 {
+				return out
+			}
+			depth--
+			out = append(out, c)
+		case '\\':
+			if i++; i >= len(b) {
+				return out
+			}
+			switch e := b[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+				// A line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v, n := 0, 0
+					for ; n < 3 && i+n < len(b) && b[i+n] >= '0' && b[i+n] <= '7'; n++ {
+						v = v*8 + int(b[i+n]-'0')
+					}
+					out = append(out, byte(v))
+					i += n - 1
+				} else {
+					out = append(out, e)
+				}
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// pdfHex decodes a hexadecimal string
+func pdfHex(b []byte) []byte {
+	var digits []byte
+	for _, c := range b {
+		if _, err := strconv.ParseUint(string(c), 16, 8); err == nil {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		v, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		out[i] = byte(v)
+	}
+	return out
+}
+
+// pdfText converts a decoded string to UTF-8. Strings are UTF-16 when they start with a
+// byte order mark and otherwise close enough to Latin-1.
+func pdfText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		units := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// pdfDate parses a PDF date such as D:20240102150405+02'00'. Parts may be left out
+// from the right.
+func pdfDate(value string) *time.Time {
+	value = strings.TrimPrefix(value, "D:")
+	digits := 0
+	for digits < len(value) && digits < 14 && value[digits] >= '0' && value[digits] <= '9' {
+		digits++
+	}
+	if digits < 4 {
+		return nil
+	}
+	stamp := value[:digits] + "0101000000"[digits-4:]
+	t, err := time.Parse("20060102150405", stamp)
+	if err != nil {
+		return nil
+	}
+
+	zone := strings.ReplaceAll(value[digits:], "'", "")
+	if len(zone) >= 3 && (zone[0] == '+' || zone[0] == '-') {
+		hours, _ := strconv.Atoi(zone[1:3])
+		minutes := 0
+		if len(zone) >= 5 {
+			minutes, _ = strconv.Atoi(zone[3:5])
+		}
+		offset := (hours*60 + minutes) * 60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone("", offset))
+	}
+	return &t
+}
@@ -0,0 +1,34 @@
+// Package metrics keeps process wide counters and gauges and exposes them in the
+// Prometheus text format
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// values holds every metric by name; it is also published through expvar
+var values = expvar.NewMap("teltech")
+
+// Add increments the counter name by delta
+func Add(name string, delta int64) {
+	values.Add(name, delta)
+}
+
+// Set sets the gauge name to value
+func Set(name string, value int64) {
+	gauge := new(expvar.Int)
+	gauge.Set(value)
+	values.Set(name, gauge)
+}
+
+// Handler serves every metric as "teltech_<name> <value>" lines
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		values.Do(func(kv expvar.KeyValue) { // Do visits keys in sorted order
+			fmt.Fprintf(w, "teltech_%s %s\n", kv.Key, kv.Value.String())
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"teltech/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShareAccessLog records every request made through a share link once it has been
+// answered. The handler stores the share it found under "share" and may name the
+// outcome under "share_outcome"; otherwise the outcome follows from the status.
+func ShareAccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		value, ok := c.Get("share")
+		if !ok {
+			return
+		}
+		share := value.(*models.FileShare)
+		status := c.Writer.Status()
+		outcome := c.GetString("share_outcome")
+		if outcome == "" {
+			switch {
+			case status == http.StatusPartialContent:
+				outcome = models.SharePartial
+			case status == http.StatusNotModified:
+				outcome = models.ShareNotModified
+			case status < 300:
+				outcome = models.ShareServed
+			default:
+				outcome = models.ShareFailed
+			}
+		}
+
+		access := &models.ShareAccess{
+			ShareID:   share.ID,
+			IP:        c.ClientIP(),
+			UserAgent: truncate(c.Request.UserAgent(), 512),
+			Request:   truncate(c.Request.Method+" "+c.Request.URL.RequestURI(), 1024),
+			Status:    status,
+			Bytes:     int64(max(c.Writer.Size(), 0)),
+			Outcome:   outcome,
+		}
+		if err := models.RecordShareAccess(access); err != nil {
+			log.Printf("Failed to record access to share %d: %v", share.ID, err)
+		}
+	}
+}
+
+// truncate cuts s to at most n bytes, dropping a character cut in half
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"teltech/database"
+	"time"
+)
+
+// AuditEvent records something noteworthy that happened to stored data
+type AuditEvent struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	Action    string    `gorm:"size:64;not null;index"` // What happened, e.g. "scrub.corrupted"
+	UserID    int       `gorm:"not null;default:0"`     // User who caused the event, 0 for the system
+	Subject   string    `gorm:"size:1024"`              // Path or storage key the event concerns
+	Detail    string    `gorm:"type:text"`              // Human readable description
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`   // Timestamp when the event happened
+}
+
+// RecordAuditEvent stores an audit event
+func RecordAuditEvent(action string, userID int, subject, detail string) error {
+	event := AuditEvent{Action: action, UserID: userID, Subject: subject, Detail: detail}
+	return database.DB.Create(&event).Error
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"teltech/database"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Blob is a piece of content stored once in content-addressable storage and shared by
+// every file and version whose content has the same hash
+type Blob struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	Hash      string    `gorm:"size:64;unique;not null"` // Hex SHA-256 of the content
+	Size      int64     `gorm:"not null"`                // Content size in bytes
+	RefCount  int       `gorm:"not null;default:0"`      // Number of files and versions referencing the blob
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// GetBlobByHash retrieves a blob by its content hash
+func GetBlobByHash(hash string) (*Blob, error) {
+	var blob Blob
+	if err := database.DB.Where("hash = ?", hash).First(&blob).Error; err != nil {
+		return nil, errors.New("blob not found")
+	}
+	return &blob, nil
+}
+
+// AcquireBlob adds a reference to the blob with the given hash, creating it if needed
+func AcquireBlob(hash string, size int64) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Blob{}).Where("hash = ?", hash).
+			Updates(map[string]interface{}{"ref_count": gorm.Expr("ref_count + 1"), "updated_at": time.Now()})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			return nil
+		}
+		return tx.Create(&Blob{Hash: hash, Size: size, RefCount: 1}).Error
+	})
+}
+
+// ReleaseBlob drops a reference to the blob with the given hash. Blobs left without
+// references are removed later by the garbage collector.
+func ReleaseBlob(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	return database.DB.Model(&Blob{}).Where("hash = ? AND ref_count > 0", hash).
+		Updates(map[string]interface{}{"ref_count": gorm.Expr("ref_count - 1"), "updated_at": time.Now()}).Error
+}
+
+// GetAllBlobs retrieves every blob record
+func GetAllBlobs() ([]Blob, error) {
+	var blobs []Blob
+	if err := database.DB.Find(&blobs).Error; err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// GetUnreferencedBlobs retrieves blobs without references that have not changed since before
+func GetUnreferencedBlobs(before time.Time) ([]Blob, error) {
+	var blobs []Blob
+	if err := database.DB.Where("ref_count = 0 AND updated_at < ?", before).Find(&blobs).Error; err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// DeleteBlobIfUnreferenced removes the blob record if it still has no references,
+// reporting whether it was removed
+func DeleteBlobIfUnreferenced(hash string) (bool, error) {
+	result := database.DB.Where("hash = ? AND ref_count = 0", hash).Delete(&Blob{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// BlobExists reports whether a blob record exists for the given hash
+func BlobExists(hash string) bool {
+	var count int64
+	database.DB.Model(&Blob{}).Where("hash = ?", hash).Count(&count)
+	return count > 0
+}
+
+// UserReferencesBlob reports whether a file of the user, or a previous version of one,
+// holds the blob with the given hash
+func UserReferencesBlob(userID int, hash string) bool {
+	var count int64
+	database.DB.Model(&File{}).Where("blob_hash = ? AND owner_id = ?", hash, userID).Count(&count)
+	if count > 0 {
+		return true
+	}
+	database.DB.Model(&FileVersion{}).
+		Joins("JOIN files ON files.id = file_versions.file_id").
+		Where("file_versions.blob_hash = ? AND files.owner_id = ?", hash, userID).
+		Count(&count)
+	return count > 0
+}
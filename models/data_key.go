@@ -0,0 +1,109 @@
+package models
+
+import (
+	"strings"
+	"teltech/database"
+	"teltech/storage"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DataKey is the wrapped encryption key of a stored object. An object being overwritten
+// has a key for its old content and one for its new.
+type DataKey struct {
+	ID          int       `gorm:"primaryKey;autoIncrement"`
+	ObjectKey   string    `gorm:"size:768;not null;index"`     // Storage key of the encrypted object
+	KeyID       string    `gorm:"size:32;not null;default:''"` // ID in the object's header, empty for objects without one
+	MasterKeyID string    `gorm:"size:64;not null;index"`      // Master key the data key is wrapped with
+	WrappedKey  []byte    `gorm:"not null"`                    // Data key sealed under the master key
+	CreatedAt   time.Time `gorm:"autoCreateTime"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime"`
+}
+
+// DataKeyStore keeps the data keys of encrypted objects in the data_keys table
+type DataKeyStore struct{}
+
+// LoadKeys retrieves the wrapped data keys of the object at key, oldest first
+func (DataKeyStore) LoadKeys(key string) ([]storage.WrappedKey, error) {
+	var dataKeys []DataKey
+	if err := database.DB.Where("object_key = ?", key).Order("id").Find(&dataKeys).Error; err != nil {
+		return nil, err
+	}
+	if len(dataKeys) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	keys := make([]storage.WrappedKey, len(dataKeys))
+	for i, dataKey := range dataKeys {
+		keys[i] = storage.WrappedKey{ID: dataKey.KeyID, MasterKeyID: dataKey.MasterKeyID, Key: dataKey.WrappedKey}
+	}
+	return keys, nil
+}
+
+// SaveKey adds a wrapped data key of the object at key
+func (DataKeyStore) SaveKey(key string, wrapped storage.WrappedKey) error {
+	return database.DB.Create(&DataKey{ObjectKey: key, KeyID: wrapped.ID, MasterKeyID: wrapped.MasterKeyID, WrappedKey: wrapped.Key}).Error
+}
+
+// DeleteKey removes the data key with the given ID of the object at key
+func (DataKeyStore) DeleteKey(key, id string) error {
+	return database.DB.Where("object_key = ? AND key_id = ?", key, id).Delete(&DataKey{}).Error
+}
+
+// MoveKeys re-keys the data keys of the object at src, or of every object below it, to dst
+func (DataKeyStore) MoveKeys(src, dst string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var dataKeys []DataKey
+		if err := tx.Where("object_key = ? OR object_key LIKE ?", src, likePrefix(src)).Find(&dataKeys).Error; err != nil {
+			return err
+		}
+		if len(dataKeys) == 0 {
+			return nil
+		}
+		// Keys of objects being replaced go, but not those of an object with several keys
+		// that have already moved
+		moved := make([]int, len(dataKeys))
+		for i, dataKey := range dataKeys {
+			moved[i] = dataKey.ID
+		}
+		for _, dataKey := range dataKeys {
+			newKey := dst + strings.TrimPrefix(dataKey.ObjectKey, src)
+			if err := tx.Where("object_key = ? AND id NOT IN ?", newKey, moved).Delete(&DataKey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&dataKey).Update("object_key", newKey).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteKeys removes the data keys of the object at key, or of every object below it
+func (DataKeyStore) DeleteKeys(key string) error {
+	return database.DB.Where("object_key = ? OR object_key LIKE ?", key, likePrefix(key)).Delete(&DataKey{}).Error
+}
+
+// MigrateDataKeys drops the unique index data_keys.object_key had when objects had a
+// single data key, which AutoMigrate leaves in place
+func MigrateDataKeys() error {
+	migrator := database.DB.Migrator()
+	for _, name := range []string{"object_key", "uni_data_keys_object_key"} {
+		if migrator.HasIndex(&DataKey{}, name) {
+			if err := migrator.DropIndex(&DataKey{}, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetDataKeysNotWrappedWith retrieves up to limit data keys wrapped with a master key
+// other than masterKeyID
+func GetDataKeysNotWrappedWith(masterKeyID string, limit int) ([]DataKey, error) {
+	var dataKeys []DataKey
+	if err := database.DB.Where("master_key_id <> ?", masterKeyID).Limit(limit).Find(&dataKeys).Error; err != nil {
+		return nil, err
+	}
+	return dataKeys, nil
+}
@@ -1,14 +1,239 @@
 package models
 
-import "time"
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"teltech/database"
+	"teltech/storage"
+	"time"
+)
 
 // File represents a file in the system
 type File struct {
-	ID        int       `gorm:"primaryKey;autoIncrement"`
-	Name      string    `gorm:"not null"`        // Name of the file
-	Path      string    `gorm:"unique;not null"` // File path in the file system
-	Size      int64     `gorm:"not null"`        // File size in bytes
-	FolderID  int       `gorm:"not null"`        // Foreign key to the parent folder
-	CreatedAt time.Time `gorm:"autoCreateTime"`  // Timestamp when the file was created
-	UpdatedAt time.Time `gorm:"autoUpdateTime"`  // Timestamp when the file was last updated
+	ID         int           `gorm:"primaryKey;autoIncrement"`
+	Name       string        `gorm:"not null"`                  // Name of the file
+	Path       string        `gorm:"unique;not null"`           // File path in the file system
+	Size       int64         `gorm:"not null"`                  // Original file size in bytes
+	StoredSize int64         `gorm:"not null;default:0"`        // Bytes occupied in storage after compression and encryption
+	Checksum   string        `gorm:"size:64"`                   // Hex SHA-256 of the content
+	BlobHash   string        `gorm:"size:64;index"`             // Content-addressable blob holding the content, if any
+	MimeType   string        `gorm:"size:255"`                  // Detected content type
+	ThumbsFor  string        `gorm:"size:64"`                   // Checksum of the content the stored thumbnails were made from
+	Metadata   *FileMetadata `gorm:"type:json;serializer:json"` // Properties read from the content, such as EXIF data
+	Version    int           `gorm:"not null;default:1"`        // Current version number
+	FolderID   int           `gorm:"not null"`                  // Foreign key to the parent folder
+	OwnerID    int           `gorm:"not null;default:0"`        // User who uploaded the file
+	CreatedAt  time.Time     `gorm:"autoCreateTime"`            // Timestamp when the file was created
+	UpdatedAt  time.Time     `gorm:"autoUpdateTime"`            // Timestamp when the file was last updated
+}
+
+// ContentKey returns the storage key holding the content of the file
+func (f *File) ContentKey() string {
+	return contentKey(f.BlobHash, f.Path)
+}
+
+// contentKey returns the blob key when content is deduplicated, or the key of path
+func contentKey(blobHash, path string) string {
+	if blobHash != "" {
+		return storage.BlobKey(blobHash)
+	}
+	key, err := storage.KeyOf(path)
+	if err != nil {
+		return path // Drivers confine keys to their root, so this simply won't be found
+	}
+	return key
+}
+
+// GetFileByPath retrieves a file by its path
+func GetFileByPath(path string) (*File, error) {
+	var file File
+	if err := database.DB.Where("path = ?", path).First(&file).Error; err != nil {
+		return nil, errors.New("file not found")
+	}
+	return &file, nil
+}
+
+// GetFileByID retrieves a file by its ID
+func GetFileByID(id int) (*File, error) {
+	var file File
+	if err := database.DB.First(&file, id).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetFilesUnder retrieves all files stored anywhere below the folder at path
+func GetFilesUnder(path string) ([]File, error) {
+	var files []File
+	if err := database.DB.Where("path LIKE ?", likePrefix(path)).Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetFilesInFolder retrieves the files directly inside a folder
+func GetFilesInFolder(folderID int) ([]File, error) {
+	var files []File
+	if err := database.DB.Where("folder_id = ?", folderID).Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetAllFiles retrieves every file record
+func GetAllFiles() ([]File, error) {
+	var files []File
+	if err := database.DB.Find(&files).Error; err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// GetStorageUsed returns the total size of the files owned by a user
+func GetStorageUsed(ownerID int) (int64, error) {
+	var used int64
+	err := database.DB.Model(&File{}).Where("owner_id = ?", ownerID).Select("COALESCE(SUM(size), 0)").Scan(&used).Error
+	return used, err
+}
+
+// SetThumbsFor records that thumbnails exist for the content with the given checksum,
+// unless the file has changed since. The update time is left alone, as the content is.
+func SetThumbsFor(id int, checksum string) error {
+	return database.DB.Model(&File{}).Where("id = ? AND checksum = ?", id, checksum).
+		UpdateColumn("thumbs_for", checksum).Error
+}
+
+// ClearThumbsFor forgets the thumbnails of a file, so they are rendered again
+func ClearThumbsFor(id int) error {
+	return database.DB.Model(&File{}).Where("id = ?", id).UpdateColumn("thumbs_for", "").Error
+}
+
+// SetFileChecksum records the checksum of a file that was stored without one
+func SetFileChecksum(id int, checksum string) error {
+	return database.DB.Model(&File{}).Where("id = ? AND (checksum IS NULL OR checksum = '')", id).
+		Update("checksum", checksum).Error
+}
+
+// ClaimFileVersion moves the row of file from the version it was loaded at to the next,
+// about to hold content with the given checksum, provided the row has not changed since
+// it held checksum expected. It reports whether the claim was made; as a single
+// compare-and-swap, no other writer can slip in between the check and the claim.
+func ClaimFileVersion(file *File, expected, checksum string) (bool, error) {
+	result := database.DB.Model(&File{}).
+		Where("id = ? AND version = ? AND checksum = ?", file.ID, file.Version, expected).
+		Updates(map[string]interface{}{"version": file.Version + 1, "checksum": checksum})
+	return result.RowsAffected == 1, result.Error
+}
+
+// UnclaimFileVersion undoes ClaimFileVersion after the new content failed to store
+func UnclaimFileVersion(file *File, checksum string) error {
+	return database.DB.Model(&File{}).
+		Where("id = ? AND version = ? AND checksum = ?", file.ID, file.Version+1, checksum).
+		Updates(map[string]interface{}{"version": file.Version, "checksum": file.Checksum}).Error
+}
+
+// DeleteFileRecord removes the record of a file along with its versions, releasing the
+// blobs they referenced and deleting version content kept in storage
+func DeleteFileRecord(ctx context.Context, file *File) error {
+	versions, err := GetFileVersions(file.ID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		ReleaseBlob(version.BlobHash)
+	}
+	ReleaseBlob(file.BlobHash)
+	storage.Default().Delete(ctx, storage.VersionPrefix(file.ID))
+	storage.Default().Delete(ctx, storage.ThumbnailPrefix(file.ID))
+
+	if err := database.DB.Where("file_id = ?", file.ID).Delete(&FileVersion{}).Error; err != nil {
+		return err
+	}
+	return database.DB.Delete(file).Error
+}
+
+// DeleteFilesUnder removes the records of every file below path, as DeleteFileRecord does
+func DeleteFilesUnder(ctx context.Context, path string) error {
+	files, err := GetFilesUnder(path)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if err := DeleteFileRecord(ctx, &files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FoundFile describes the content of a file found in storage without a row
+type FoundFile struct {
+	Size       int64
+	StoredSize int64
+	Checksum   string
+	MimeType   string
+}
+
+// ReadFoundFile hashes the file at path through the storage driver, so content that was
+// stored encrypted or compressed is judged by what it decodes to
+func ReadFoundFile(ctx context.Context, path string) (*FoundFile, error) {
+	key, err := storage.KeyOf(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := storage.Default().Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := storage.Default().Get(ctx, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	ingest := storage.NewIngestReader(rc, 0, "")
+	if _, err := io.Copy(io.Discard, ingest); err != nil {
+		return nil, err
+	}
+	if ingest.Size() != info.Size {
+		return nil, errors.New("file changed while it was read")
+	}
+	return &FoundFile{
+		Size:       ingest.Size(),
+		StoredSize: info.StoredSize,
+		Checksum:   ingest.Sum(),
+		MimeType:   ingest.ContentType(filepath.Base(path)),
+	}, nil
+}
+
+// RecordFoundFile adds the row of a file found in storage without one to folder, owned by
+// the folder's owner. It returns the row and whether it was created, rather than recorded
+// in the meantime by an upload.
+func RecordFoundFile(folder *Folder, path string, found *FoundFile) (*File, bool, error) {
+	file := &File{
+		Name:       filepath.Base(path),
+		Path:       path,
+		Size:       found.Size,
+		StoredSize: found.StoredSize,
+		Checksum:   found.Checksum,
+		MimeType:   found.MimeType,
+		FolderID:   folder.ID,
+		OwnerID:    folder.OwnerID,
+	}
+	if err := database.DB.Create(file).Error; err != nil {
+		if existing, lookupErr := GetFileByPath(path); lookupErr == nil {
+			return existing, false, nil
+		}
+		return nil, false, err
+	}
+	return file, true, nil
+}
+
+// likePrefix builds a LIKE pattern matching everything below path
+func likePrefix(path string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSuffix(path, "/"))
+	return escaped + "/%"
 }
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"time"
+
+	"teltech/database"
+)
+
+// FileMetadata holds the properties read from a file's content when it was stored.
+// Only the part matching the kind of file is set.
+type FileMetadata struct {
+	Image    *ImageMetadata    `json:"image,omitempty"`
+	Audio    *AudioMetadata    `json:"audio,omitempty"`
+	Document *DocumentMetadata `json:"document,omitempty"`
+}
+
+// ImageMetadata describes a picture, with the EXIF data of photos
+type ImageMetadata struct {
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	CapturedAt  *time.Time   `json:"captured_at,omitempty"`  // When the photo was taken
+	CameraMake  string       `json:"camera_make,omitempty"`  // Manufacturer of the camera
+	CameraModel string       `json:"camera_model,omitempty"` // Model of the camera
+	Orientation int          `json:"orientation,omitempty"`  // EXIF orientation, 1 to 8
+	Location    *GeoLocation `json:"location,omitempty"`     // Where the photo was taken
+}
+
+// GeoLocation is a position recorded by a GPS receiver
+type GeoLocation struct {
+	Latitude  float64  `json:"latitude"`           // Degrees, negative south of the equator
+	Longitude float64  `json:"longitude"`          // Degrees, negative west of Greenwich
+	Altitude  *float64 `json:"altitude,omitempty"` // Metres above sea level
+}
+
+// AudioMetadata holds the tags of an audio file
+type AudioMetadata struct {
+	Format      string `json:"format,omitempty"` // Tag format, such as ID3v2.4
+	Title       string `json:"title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+	Composer    string `json:"composer,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+}
+
+// DocumentMetadata holds the document properties of a PDF
+type DocumentMetadata struct {
+	Version    string     `json:"version,omitempty"` // PDF version, such as 1.7
+	Pages      int        `json:"pages,omitempty"`
+	Title      string     `json:"title,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Subject    string     `json:"subject,omitempty"`
+	Keywords   string     `json:"keywords,omitempty"`
+	Creator    string     `json:"creator,omitempty"`  // Application the document was made with
+	Producer   string     `json:"producer,omitempty"` // Application that wrote the PDF
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	ModifiedAt *time.Time `json:"modified_at,omitempty"`
+}
+
+// SetFileMetadata records the metadata read from the content with the given checksum,
+// unless the file has changed since. The update time is left alone, as the content is.
+func SetFileMetadata(id int, checksum string, metadata *FileMetadata) error {
+	return database.DB.Model(&File{}).Where("id = ? AND checksum = ?", id, checksum).
+		UpdateColumn("metadata", metadata).Error
+}
@@ -1,15 +1,214 @@
 package models
 
-import "time"
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+	"teltech/database"
+	"time"
 
-// FileShare represents a shareable link for a file
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// FileShare represents a shareable link for a file or a folder
 type FileShare struct {
-	ID         int        `gorm:"primaryKey;autoIncrement"`
-	FileID     int        `gorm:"not null"`                                  // Foreign key for the file
-	ShareLink  string     `gorm:"unique;not null"`                           // Unique shareable link
-	AccessType string     `gorm:"type:enum('read', 'write');default:'read'"` // Access type: "read" or "write"
-	Expiration *time.Time `gorm:"default:null"`                              // Optional expiration date
-	Password   string     `gorm:"default:null"`                              // Optional password for the link
-	CreatedAt  time.Time  `gorm:"autoCreateTime"`
-	UpdatedAt  time.Time  `gorm:"autoUpdateTime"`
+	ID             int        `gorm:"primaryKey;autoIncrement"`
+	FileID         *int       `gorm:"default:null"`                              // Foreign key for the file, nil for folder shares
+	FolderID       *int       `gorm:"index;default:null"`                        // Foreign key for the folder, nil for file shares
+	ShareLink      string     `gorm:"unique;not null"`                           // Unique shareable link
+	AccessType     string     `gorm:"type:enum('read', 'write');default:'read'"` // Access type: "read" or "write"
+	Expiration     *time.Time `gorm:"default:null"`                              // Optional expiration date
+	Password       string     `gorm:"default:null"`                              // Optional bcrypt hash of the password for the link
+	StripGPS       bool       `gorm:"not null;default:false"`                    // Remove the location from the EXIF data of shared photos
+	CreatedBy      int        `gorm:"not null;default:0;index"`                  // User who created the link
+	RevokedAt      *time.Time `gorm:"default:null"`                              // When the link was revoked, nil while it works
+	MaxDownloads   int        `gorm:"not null;default:0"`                        // Downloads after which the link stops working, 0 for no limit
+	DownloadCount  int        `gorm:"not null;default:0"`                        // Downloads made through the link
+	LastAccessedAt *time.Time `gorm:"default:null"`                              // When content was last served through the link
+	Notify         bool       `gorm:"not null;default:false"`                    // Email the user who created the link of the first access and of uploads
+	HideContents   bool       `gorm:"not null;default:false"`                    // Write shares only take uploads, without showing the folder
+	MaxUploadSize  int64      `gorm:"not null;default:0"`                        // Largest file that may be uploaded through the link, 0 for no limit
+	AllowedTypes   string     `gorm:"size:1024"`                                 // Comma separated extensions (.pdf) or MIME types (image/*) that may be uploaded, empty for any
+	UploadDeadline *time.Time `gorm:"default:null"`                              // When uploads through the link close
+	CreatedAt      time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime"`
+}
+
+// SetPassword protects the share with password, storing only its bcrypt hash. An empty
+// password removes the protection.
+func (s *FileShare) SetPassword(password string) error {
+	if password == "" {
+		s.Password = ""
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.Password = string(hash)
+	return nil
+}
+
+// CheckPassword reports whether password unlocks the share
+func (s *FileShare) CheckPassword(password string) bool {
+	return s.Password == "" || bcrypt.CompareHashAndPassword([]byte(s.Password), []byte(password)) == nil
+}
+
+// HashSharePasswords replaces the plaintext passwords stored by earlier versions with
+// their hashes, returning how many were hashed
+func HashSharePasswords() (int, error) {
+	var shares []FileShare
+	if err := database.DB.Where("password IS NOT NULL AND password <> '' AND password NOT LIKE ?", "$2_$%").Find(&shares).Error; err != nil {
+		return 0, err
+	}
+	for i := range shares {
+		if err := shares[i].SetPassword(shares[i].Password); err != nil {
+			return i, err
+		}
+		if err := database.DB.Model(&shares[i]).Update("password", shares[i].Password).Error; err != nil {
+			return i, err
+		}
+	}
+	return len(shares), nil
+}
+
+// ShareFilter selects the shares ListShares returns. Zero fields do not filter.
+type ShareFilter struct {
+	FileID          int  // Shares of the file
+	FolderID        int  // Shares of the folder and of the files directly in it
+	CreatedBy       int  // Shares created by the user
+	IncludeInactive bool // Include revoked and expired shares
+}
+
+// TakesUploads reports whether the share is a write share of a folder, which takes
+// uploads as a drop box
+func (s *FileShare) TakesUploads() bool {
+	return s.AccessType == "write" && s.FolderID != nil
+}
+
+// UploadOnly reports whether the share takes uploads without showing the folder
+func (s *FileShare) UploadOnly() bool {
+	return s.TakesUploads() && s.HideContents
+}
+
+// UploadsClosed reports whether the upload deadline of the share has passed
+func (s *FileShare) UploadsClosed() bool {
+	return s.UploadDeadline != nil && time.Now().After(*s.UploadDeadline)
+}
+
+// Accepts reports whether a file named name may be uploaded through the share, going by
+// its extension or the MIME type that implies
+func (s *FileShare) Accepts(name string) bool {
+	if strings.TrimSpace(s.AllowedTypes) == "" {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	mimeType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+	for _, allowed := range strings.Split(strings.ToLower(s.AllowedTypes), ",") {
+		allowed = strings.TrimSpace(allowed)
+		switch {
+		case allowed == "":
+		case strings.HasPrefix(allowed, "."):
+			if ext == allowed {
+				return true
+			}
+		case strings.HasSuffix(allowed, "/*"):
+			if mimeType != "" && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+				return true
+			}
+		case mimeType == allowed:
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the share can still be used
+func (s *FileShare) Active() bool {
+	return s.RevokedAt == nil && (s.Expiration == nil || time.Now().Before(*s.Expiration)) &&
+		(s.MaxDownloads == 0 || s.DownloadCount < s.MaxDownloads)
+}
+
+// GetShareByID retrieves a share by its ID
+func GetShareByID(id int) (*FileShare, error) {
+	var share FileShare
+	if err := database.DB.First(&share, id).Error; err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// ListShares returns the shares matching filter, newest first
+func ListShares(filter ShareFilter) ([]FileShare, error) {
+	query := database.DB.Order("created_at DESC, id DESC")
+	if filter.FileID != 0 {
+		query = query.Where("file_id = ?", filter.FileID)
+	}
+	if filter.FolderID != 0 {
+		query = query.Where("folder_id = ? OR file_id IN (?)", filter.FolderID,
+			database.DB.Model(&File{}).Select("id").Where("folder_id = ?", filter.FolderID))
+	}
+	if filter.CreatedBy != 0 {
+		query = query.Where("created_by = ?", filter.CreatedBy)
+	}
+	if !filter.IncludeInactive {
+		query = activeShares(query)
+	}
+	var shares []FileShare
+	if err := query.Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// CountActiveShares returns how many working share links the file has
+func CountActiveShares(fileID int) (int64, error) {
+	var count int64
+	err := activeShares(database.DB.Model(&FileShare{}).Where("file_id = ?", fileID)).Count(&count).Error
+	return count, err
+}
+
+// RevokeShare stops a share link from working
+func RevokeShare(id int) error {
+	return database.DB.Model(&FileShare{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now()).Error
+}
+
+// ClaimShareDownload counts a download against the limit of a share before it is made,
+// reporting false when the limit has been reached. Claims are atomic, so concurrent
+// downloads cannot overshoot the limit.
+func ClaimShareDownload(id int) (bool, error) {
+	result := database.DB.Model(&FileShare{}).
+		Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", id).
+		Update("download_count", gorm.Expr("download_count + 1"))
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReleaseShareDownload gives back a download claimed with ClaimShareDownload that was
+// not made after all
+func ReleaseShareDownload(id int) error {
+	return database.DB.Model(&FileShare{}).Where("id = ? AND download_count > 0", id).
+		Update("download_count", gorm.Expr("download_count - 1")).Error
+}
+
+// CountShareDownload counts a download made through a share without a limit
+func CountShareDownload(id int) error {
+	return database.DB.Model(&FileShare{}).Where("id = ?", id).
+		Update("download_count", gorm.Expr("download_count + 1")).Error
+}
+
+// TouchShare records that content was served through a share, reporting whether it was
+// the first time
+func TouchShare(id int) (bool, error) {
+	now := time.Now()
+	result := database.DB.Model(&FileShare{}).Where("id = ? AND last_accessed_at IS NULL", id).Update("last_accessed_at", now)
+	if result.Error != nil || result.RowsAffected == 1 {
+		return result.RowsAffected == 1, result.Error
+	}
+	return false, database.DB.Model(&FileShare{}).Where("id = ?", id).Update("last_accessed_at", now).Error
+}
+
+// activeShares narrows query to shares that are neither revoked, expired nor used up
+func activeShares(query *gorm.DB) *gorm.DB {
+	return query.Where("revoked_at IS NULL AND (expiration IS NULL OR expiration > ?) AND (max_downloads = 0 OR download_count < max_downloads)", time.Now())
 }
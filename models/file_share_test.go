@@ -0,0 +1,53 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileShareAccepts(t *testing.T) {
+	tests := []struct {
+		allowed string
+		name    string
+		want    bool
+	}{
+		{"", "anything.exe", true},
+		{".pdf", "report.PDF", true},
+		{".pdf", "report.pdf.exe", false},
+		{"image/*", "photo.jpg", true},
+		{"image/*", "notes.txt", false},
+		{"image/*", "no-extension", false},
+		{"application/pdf, .docx", "letter.docx", true},
+		{"application/pdf, .docx", "report.pdf", true},
+		{"APPLICATION/PDF", "report.pdf", true},
+		{".txt", ".txt", true},
+	}
+	for _, tt := range tests {
+		share := FileShare{AllowedTypes: tt.allowed}
+		if got := share.Accepts(tt.name); got != tt.want {
+			t.Errorf("Accepts(%q) with %q = %v, want %v", tt.name, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestFileShareUploads(t *testing.T) {
+	folderID := 1
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name              string
+		share             FileShare
+		takes, only, shut bool
+	}{
+		{name: "read share", share: FileShare{AccessType: "read", FolderID: &folderID}},
+		{name: "write share of a file", share: FileShare{AccessType: "write"}},
+		{name: "drop box", share: FileShare{AccessType: "write", FolderID: &folderID, UploadDeadline: &future}, takes: true},
+		{name: "hidden drop box", share: FileShare{AccessType: "write", FolderID: &folderID, HideContents: true}, takes: true, only: true},
+		{name: "hidden read share", share: FileShare{AccessType: "read", FolderID: &folderID, HideContents: true}},
+		{name: "closed drop box", share: FileShare{AccessType: "write", FolderID: &folderID, UploadDeadline: &past}, takes: true, shut: true},
+	}
+	for _, tt := range tests {
+		if takes, only, shut := tt.share.TakesUploads(), tt.share.UploadOnly(), tt.share.UploadsClosed(); takes != tt.takes || only != tt.only || shut != tt.shut {
+			t.Errorf("%s: takes uploads %v, upload only %v, closed %v", tt.name, takes, only, shut)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"teltech/database"
+	"time"
+)
+
+// FileVersion records a previous version of a file kept when new content replaced it
+type FileVersion struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	FileID    int       `gorm:"not null;index"` // Foreign key to the file
+	Version   int       `gorm:"not null"`       // Version number the content had
+	Path      string    `gorm:"not null"`       // Where the old content is kept
+	Size      int64     `gorm:"not null"`       // Size of the old content in bytes
+	Checksum  string    `gorm:"size:64"`        // Hex SHA-256 of the old content
+	BlobHash  string    `gorm:"size:64"`        // Content-addressable blob holding the old content, if any
+	CreatedAt time.Time `gorm:"autoCreateTime"` // Timestamp when the version was superseded
+}
+
+// ContentKey returns the storage key holding the content of the version
+func (v *FileVersion) ContentKey() string {
+	return contentKey(v.BlobHash, v.Path)
+}
+
+// GetFileVersions retrieves the previous versions of a file, newest first
+func GetFileVersions(fileID int) ([]FileVersion, error) {
+	var versions []FileVersion
+	if err := database.DB.Where("file_id = ?", fileID).Order("version desc").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetAllFileVersions retrieves every kept file version
+func GetAllFileVersions() ([]FileVersion, error) {
+	var versions []FileVersion
+	if err := database.DB.Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
@@ -2,7 +2,11 @@ package models
 
 import (
 	"errors"
+	"path/filepath"
+	"strings"
 	"teltech/database"
+
+	"gorm.io/gorm"
 )
 
 // Folder represents a folder in the TelTech application
@@ -82,3 +86,150 @@ func GetFoldersByOwner(ownerID int) ([]Folder, error) {
 	}
 	return folders, nil
 }
+
+// GetSubfolders retrieves the folders directly inside the folder at path, by name
+func GetSubfolders(path string) ([]Folder, error) {
+	var folders []Folder
+	if err := database.DB.Where("path LIKE ? AND path NOT LIKE ?", likePrefix(path), likePrefix(path)+"/%").
+		Order("name").Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// GetFoldersUnder retrieves all folders anywhere below the folder at path
+func GetFoldersUnder(path string) ([]Folder, error) {
+	var folders []Folder
+	if err := database.DB.Where("path LIKE ?", likePrefix(path)).Find(&folders).Error; err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// MoveFolderPaths rewrites the paths of the folder at oldPath and of every folder and
+// file below it to live under newPath instead, keeping their IDs
+func MoveFolderPaths(oldPath, newPath string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var folders []Folder
+		if err := tx.Where("path = ? OR path LIKE ?", oldPath, likePrefix(oldPath)).Find(&folders).Error; err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			updates := map[string]interface{}{"path": newPath + strings.TrimPrefix(folder.Path, oldPath)}
+			if folder.Path == oldPath {
+				updates["name"] = filepath.Base(newPath)
+			}
+			if err := tx.Model(&folder).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		var files []File
+		if err := tx.Where("path LIKE ?", likePrefix(oldPath)).Find(&files).Error; err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := tx.Model(&file).Update("path", newPath+strings.TrimPrefix(file.Path, oldPath)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InheritedOwner returns the owner of the nearest folder above path that has one, or 0
+// when none does
+func InheritedOwner(path string) int {
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		var folder Folder
+		if err := database.DB.Where("path = ?", dir).First(&folder).Error; err == nil && folder.OwnerID != 0 {
+			return folder.OwnerID
+		}
+		if filepath.Dir(dir) == dir {
+			return 0
+		}
+	}
+}
+
+// RecordFoundFolder adds the row of a folder found in storage without one, owned like the
+// nearest folder above it. It returns the row and whether it was created, rather than
+// recorded in the meantime by an upload.
+func RecordFoundFolder(path string) (*Folder, bool, error) {
+	folder, err := CreateFolder(filepath.Base(path), path, InheritedOwner(path))
+	if err != nil {
+		if existing, lookupErr := GetFolderByPath(path); lookupErr == nil {
+			return existing, false, nil
+		}
+		return nil, false, err
+	}
+	return folder, true, nil
+}
+
+// BackfillOwners gives the folders and files recorded without an owner, by earlier
+// versions, the watcher or fsck, the owner of the nearest folder above them that has one.
+// It returns how many rows were given an owner.
+func BackfillOwners() (int, error) {
+	var orphans []Folder
+	if err := database.DB.Where("owner_id = 0").Order("LENGTH(path)").Find(&orphans).Error; err != nil {
+		return 0, err
+	}
+	// Parents come first, so each folder sees the owner just given to the one above it
+	n := 0
+	for _, folder := range orphans {
+		ownerID := InheritedOwner(folder.Path)
+		if ownerID == 0 {
+			continue
+		}
+		if err := database.DB.Model(&folder).Update("owner_id", ownerID).Error; err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	result := database.DB.Exec("UPDATE files SET owner_id = (SELECT owner_id FROM folders WHERE folders.id = files.folder_id) " +
+		"WHERE owner_id = 0 AND folder_id IN (SELECT id FROM folders WHERE owner_id <> 0)")
+	return n + int(result.RowsAffected), result.Error
+}
+
+// MigrateRootPaths rewrites folder and file paths stored under oldRoot, the storage root
+// as it was configured, to start with root instead. Paths used to keep the configured
+// form, such as ./data, while the storage layer cleans it to data.
+func MigrateRootPaths(oldRoot, root string) error {
+	if oldRoot == root {
+		return nil
+	}
+	prefix := strings.TrimSuffix(oldRoot, "/")
+	rewrite := func(path string) string {
+		if path == oldRoot {
+			return root
+		}
+		return root + strings.TrimPrefix(path, prefix)
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var folders []Folder
+		if err := tx.Where("path = ? OR path LIKE ?", oldRoot, likePrefix(oldRoot)).Find(&folders).Error; err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			if newPath := rewrite(folder.Path); newPath != folder.Path {
+				if err := tx.Model(&Folder{}).Where("id = ?", folder.ID).Update("path", newPath).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		var files []File
+		if err := tx.Where("path LIKE ?", likePrefix(oldRoot)).Find(&files).Error; err != nil {
+			return err
+		}
+		for _, file := range files {
+			if newPath := rewrite(file.Path); newPath != file.Path {
+				if err := tx.Model(&File{}).Where("id = ?", file.ID).Update("path", newPath).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"strings"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+)
+
+func TestMigrateRootPaths(t *testing.T) {
+	tests := []struct {
+		oldRoot, root string
+		paths         map[string]string // Stored folder path to the path after the migration
+	}{
+		{
+			oldRoot: "./data", root: "data",
+			paths: map[string]string{
+				"./data":         "data",
+				"./data/a":       "data/a",
+				"./data/a/b.txt": "data/a/b.txt",
+				"data/c":         "data/c",
+				"./database/d":   "./database/d",
+			},
+		},
+		{
+			oldRoot: "/srv/files/", root: "/srv/files",
+			paths: map[string]string{
+				"/srv/files/":      "/srv/files",
+				"/srv/files/a":     "/srv/files/a",
+				"/srv/files/a/b.c": "/srv/files/a/b.c",
+			},
+		},
+		{
+			oldRoot: "data", root: "data",
+			paths: map[string]string{"data/a": "data/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.oldRoot, func(t *testing.T) {
+			databasetest.Open(t, &Folder{}, &File{})
+			for path := range tt.paths {
+				database.DB.Create(&Folder{Name: "f", Path: path})
+				database.DB.Create(&File{Name: "file", Path: strings.TrimSuffix(path, "/") + "/file"})
+			}
+
+			if err := MigrateRootPaths(tt.oldRoot, tt.root); err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range tt.paths {
+				if _, err := GetFolderByPath(want); err != nil {
+					t.Errorf("folder %s not moved to %s", path, want)
+				}
+				if _, err := GetFileByPath(want + "/file"); err != nil {
+					t.Errorf("file in %s not moved to %s", path, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillOwners(t *testing.T) {
+	databasetest.Open(t, &Folder{}, &File{})
+	folders := []Folder{
+		{Name: "data", Path: "data", OwnerID: 3},
+		{Name: "a", Path: "data/a"},
+		{Name: "b", Path: "data/a/b"},
+		{Name: "c", Path: "data/c", OwnerID: 4},
+		{Name: "stray", Path: "elsewhere/stray"},
+	}
+	for i := range folders {
+		database.DB.Create(&folders[i])
+	}
+	database.DB.Create(&File{Name: "f", Path: "data/a/b/f", FolderID: folders[2].ID})
+	database.DB.Create(&File{Name: "g", Path: "data/c/g", FolderID: folders[3].ID, OwnerID: 7})
+
+	n, err := BackfillOwners()
+	if err != nil || n != 3 {
+		t.Fatalf("backfilled %d rows, %v", n, err)
+	}
+	want := map[string]int{"data/a": 3, "data/a/b": 3, "data/c": 4, "elsewhere/stray": 0}
+	for path, owner := range want {
+		if folder, _ := GetFolderByPath(path); folder.OwnerID != owner {
+			t.Errorf("folder %s owned by %d, want %d", path, folder.OwnerID, owner)
+		}
+	}
+	for path, owner := range map[string]int{"data/a/b/f": 3, "data/c/g": 7} {
+		if file, _ := GetFileByPath(path); file.OwnerID != owner {
+			t.Errorf("file %s owned by %d, want %d", path, file.OwnerID, owner)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"strings"
+	"teltech/database"
+	"teltech/storage"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ObjectSize is the original size of an object written through compression
+type ObjectSize struct {
+	ID         int       `gorm:"primaryKey;autoIncrement"`
+	ObjectKey  string    `gorm:"size:768;unique;not null"` // Storage key of the object
+	StoredSize int64     `gorm:"not null"`                 // Bytes in storage when the size was recorded
+	Size       int64     `gorm:"not null"`                 // Size before compression
+	CreatedAt  time.Time `gorm:"autoCreateTime"`
+	UpdatedAt  time.Time `gorm:"autoUpdateTime"`
+}
+
+// ObjectSizeStore keeps the original sizes of compressed objects in the object_sizes table
+type ObjectSizeStore struct{}
+
+// LoadSizes retrieves the original sizes recorded for the objects at keys
+func (ObjectSizeStore) LoadSizes(keys []string) (map[string]storage.OriginalSize, error) {
+	sizes := make(map[string]storage.OriginalSize, len(keys))
+	for start := 0; start < len(keys); start += 500 {
+		var rows []ObjectSize
+		batch := keys[start:min(start+500, len(keys))]
+		if err := database.DB.Where("object_key IN ?", batch).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			sizes[row.ObjectKey] = storage.OriginalSize{StoredSize: row.StoredSize, Size: row.Size}
+		}
+	}
+	return sizes, nil
+}
+
+// SaveSize stores the original size of the object at key, replacing any previous one
+func (ObjectSizeStore) SaveSize(key string, size storage.OriginalSize) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("object_key = ?", key).Delete(&ObjectSize{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ObjectSize{ObjectKey: key, StoredSize: size.StoredSize, Size: size.Size}).Error
+	})
+}
+
+// MoveSizes re-keys the size of the object at src, or of every object below it, to dst
+func (ObjectSizeStore) MoveSizes(src, dst string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var sizes []ObjectSize
+		if err := tx.Where("object_key = ? OR object_key LIKE ?", src, likePrefix(src)).Find(&sizes).Error; err != nil {
+			return err
+		}
+		for _, size := range sizes {
+			newKey := dst + strings.TrimPrefix(size.ObjectKey, src)
+			if err := tx.Where("object_key = ?", newKey).Delete(&ObjectSize{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&size).Update("object_key", newKey).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteSizes removes the size of the object at key, or of every object below it
+func (ObjectSizeStore) DeleteSizes(key string) error {
+	return database.DB.Where("object_key = ? OR object_key LIKE ?", key, likePrefix(key)).Delete(&ObjectSize{}).Error
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"teltech/database"
+	"teltech/storage"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReplicaSum is the checksum of a replicated object as written to each replica
+type ReplicaSum struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	ObjectKey string    `gorm:"size:768;unique;not null"` // Storage key of the object
+	Size      int64     `gorm:"not null"`                 // Stored size in bytes
+	Checksum  string    `gorm:"size:64;not null"`         // Hex SHA-256 of the stored bytes
+	ChunkSums []byte    `gorm:"type:longblob"`            // SHA-256 of each chunk of the stored bytes, concatenated
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime"`
+}
+
+// ReplicaSumStore keeps the checksums of replicated objects in the replica_sums table
+type ReplicaSumStore struct{}
+
+// LoadSum retrieves the checksum of the object at key
+func (ReplicaSumStore) LoadSum(key string) (*storage.StoredSum, error) {
+	var sum ReplicaSum
+	if err := database.DB.Where("object_key = ?", key).First(&sum).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	return &storage.StoredSum{Size: sum.Size, SHA256: sum.Checksum, Chunks: sum.ChunkSums}, nil
+}
+
+// SaveSum stores the checksum of the object at key, replacing any previous one
+func (ReplicaSumStore) SaveSum(key string, sum storage.StoredSum) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("object_key = ?", key).Delete(&ReplicaSum{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ReplicaSum{ObjectKey: key, Size: sum.Size, Checksum: sum.SHA256, ChunkSums: sum.Chunks}).Error
+	})
+}
+
+// MoveSums re-keys the checksum of the object at src, or of every object below it, to dst
+func (ReplicaSumStore) MoveSums(src, dst string) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var sums []ReplicaSum
+		if err := tx.Where("object_key = ? OR object_key LIKE ?", src, likePrefix(src)).Find(&sums).Error; err != nil {
+			return err
+		}
+		for _, sum := range sums {
+			newKey := dst + strings.TrimPrefix(sum.ObjectKey, src)
+			if err := tx.Where("object_key = ?", newKey).Delete(&ReplicaSum{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&sum).Update("object_key", newKey).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteSums removes the checksum of the object at key, or of every object below it
+func (ReplicaSumStore) DeleteSums(key string) error {
+	return database.DB.Where("object_key = ? OR object_key LIKE ?", key, likePrefix(key)).Delete(&ReplicaSum{}).Error
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"teltech/database"
+	"time"
+)
+
+// Kinds of problems the scrubber reports
+const (
+	ScrubCorrupted  = "corrupted"  // Content no longer matches its recorded checksum
+	ScrubMissing    = "missing"    // Content recorded in the database is gone from storage
+	ScrubUnexpected = "unexpected" // Content in storage that the database knows nothing about
+)
+
+// ScrubRun summarises one pass of the integrity scrubber
+type ScrubRun struct {
+	ID          int        `gorm:"primaryKey;autoIncrement"`
+	StartedAt   time.Time  `gorm:"not null"` // Timestamp when the pass started
+	FinishedAt  *time.Time // Timestamp when the pass finished, nil while running
+	Checked     int        `gorm:"not null;default:0"` // Objects re-hashed
+	BytesHashed int64      `gorm:"not null;default:0"` // Bytes read while re-hashing
+	Corrupted   int        `gorm:"not null;default:0"` // Objects whose content changed
+	Missing     int        `gorm:"not null;default:0"` // Objects that were not found
+	Unexpected  int        `gorm:"not null;default:0"` // Objects nothing refers to
+	Error       string     `gorm:"type:text"`          // Why the pass stopped early, if it did
+}
+
+// ScrubIssue is a problem found during a scrub run
+type ScrubIssue struct {
+	ID        int       `gorm:"primaryKey;autoIncrement"`
+	RunID     int       `gorm:"not null;index"`     // Foreign key to the scrub run
+	Kind      string    `gorm:"size:16;not null"`   // One of the Scrub* kinds
+	ObjectKey string    `gorm:"size:768;not null"`  // Storage key of the affected object
+	FileID    int       `gorm:"not null;default:0"` // File the object belongs to, 0 for blobs and strays
+	Expected  string    `gorm:"size:64"`            // Recorded checksum
+	Actual    string    `gorm:"size:64"`            // Checksum of the content found
+	Detail    string    `gorm:"type:text"`          // Read error or other context
+	CreatedAt time.Time `gorm:"autoCreateTime"`     // Timestamp when the problem was found
+}
+
+// GetScrubRun retrieves a scrub run by its ID
+func GetScrubRun(id int) (*ScrubRun, error) {
+	var run ScrubRun
+	if err := database.DB.First(&run, id).Error; err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// GetLatestScrubRun retrieves the most recently started scrub run
+func GetLatestScrubRun() (*ScrubRun, error) {
+	var run ScrubRun
+	if err := database.DB.Order("id desc").First(&run).Error; err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// GetScrubIssues retrieves the problems found during a scrub run
+func GetScrubIssues(runID int) ([]ScrubIssue, error) {
+	var issues []ScrubIssue
+	if err := database.DB.Where("run_id = ?", runID).Order("id").Find(&issues).Error; err != nil {
+		return nil, err
+	}
+	return issues, nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"teltech/database"
+	"time"
+)
+
+// Outcomes of share accesses
+const (
+	ShareDownloaded       = "downloaded"        // Content was served and counted as a download
+	ShareServed           = "served"            // Content was served, but not counted, e.g. a HEAD request
+	SharePartial          = "partial"           // A range of the content was served
+	ShareNotModified      = "not_modified"      // The client's cached copy was still current
+	ShareUploaded         = "uploaded"          // A file was uploaded through a write share
+	SharePasswordRequired = "password_required" // The share is protected and was not unlocked
+	ShareUnlocked         = "unlocked"          // The right password was entered
+	ShareWrongPassword    = "wrong_password"    // A wrong password was entered
+	ShareLockedOut        = "locked_out"        // Too many wrong passwords were entered
+	ShareLimitReached     = "limit_reached"     // The share has no downloads left
+	ShareExpired          = "expired"           // The share has expired
+	ShareRevoked          = "revoked"           // The share has been revoked
+	ShareFailed           = "failed"            // The request failed otherwise
+)
+
+// ShareAccess records one request made through a share link
+type ShareAccess struct {
+	ID         int       `gorm:"primaryKey;autoIncrement"`
+	ShareID    int       `gorm:"not null;index"`       // Foreign key to the share
+	AccessedAt time.Time `gorm:"autoCreateTime;index"` // When the request was made
+	IP         string    `gorm:"size:64"`              // Client address
+	UserAgent  string    `gorm:"size:512"`             // Client software
+	Request    string    `gorm:"size:1024"`            // Method and URL requested
+	Status     int       `gorm:"not null"`             // HTTP status of the response
+	Bytes      int64     `gorm:"not null;default:0"`   // Bytes of the response body
+	Outcome    string    `gorm:"size:32;not null"`     // One of the Share* outcomes
+}
+
+// RecordShareAccess stores a share access
+func RecordShareAccess(access *ShareAccess) error {
+	return database.DB.Create(access).Error
+}
+
+// GetShareAccesses returns the latest accesses of a share, newest first, skipping offset
+func GetShareAccesses(shareID, limit, offset int) ([]ShareAccess, int64, error) {
+	var total int64
+	query := database.DB.Model(&ShareAccess{}).Where("share_id = ?", shareID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var accesses []ShareAccess
+	if err := query.Order("accessed_at DESC, id DESC").Limit(limit).Offset(offset).Find(&accesses).Error; err != nil {
+		return nil, 0, err
+	}
+	return accesses, total, nil
+}
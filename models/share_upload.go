@@ -0,0 +1,33 @@
+package models
+
+import (
+	"teltech/database"
+	"time"
+)
+
+// ShareUpload records a file uploaded through a write share link
+type ShareUpload struct {
+	ID            int       `gorm:"primaryKey;autoIncrement"`
+	ShareID       int       `gorm:"not null;index"`    // Foreign key to the share
+	FileID        int       `gorm:"not null"`          // Foreign key to the file uploaded
+	FileName      string    `gorm:"size:255;not null"` // Name the file was stored under
+	Size          int64     `gorm:"not null"`          // Size of the file in bytes
+	UploaderName  string    `gorm:"size:255;not null"` // Name the uploader gave
+	UploaderEmail string    `gorm:"size:255;not null"` // Email address the uploader gave
+	IP            string    `gorm:"size:64"`           // Client address of the uploader
+	CreatedAt     time.Time `gorm:"autoCreateTime"`    // When the file was uploaded
+}
+
+// RecordShareUpload stores a share upload
+func RecordShareUpload(upload *ShareUpload) error {
+	return database.DB.Create(upload).Error
+}
+
+// GetShareUploads returns the uploads made through a share, newest first
+func GetShareUploads(shareID int) ([]ShareUpload, error) {
+	var uploads []ShareUpload
+	if err := database.DB.Where("share_id = ?", shareID).Order("created_at DESC, id DESC").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
@@ -13,6 +13,7 @@ type User struct {
 	Username string `gorm:"size:100;unique;not null"`
 	Password string `gorm:"not null"`
 	Role     string `gorm:"type:enum('user', 'admin');not null"`
+	Email    string `gorm:"size:255"` // Address notices are emailed to, if any
 }
 
 // HashPassword hashes the user's password using bcrypt
@@ -40,6 +41,15 @@ func FindByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
+// GetUserByID retrieves a user by their ID
+func GetUserByID(id int) (*User, error) {
+	var user User
+	if err := database.DB.First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 // CreateUser creates a new user in the database
 func CreateUser(username, password, role string) (*User, error) {
 	// Check if the user already exists
@@ -0,0 +1,103 @@
+package presign
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	t.Setenv("PRESIGN_SECRET", "test secret")
+	grant := Grant{
+		Method:   "PUT",
+		Path:     "/data/docs",
+		Name:     "report.pdf",
+		Conflict: "rename",
+		Expires:  time.Now().Add(time.Hour),
+		IP:       "10.0.0.1",
+		MaxSize:  1 << 20,
+		UserID:   7,
+	}
+
+	tests := []struct {
+		name   string
+		grant  func(g *Grant)     // Changes the grant before signing
+		tamper func(q url.Values) // Changes the signed query
+		method string             // Method of the request, PUT when empty
+		ip     string             // Client address, 10.0.0.1 when empty
+		env    func(t *testing.T) // Changes the configuration after signing
+		want   error
+	}{
+		{name: "valid"},
+		{name: "other path", tamper: func(q url.Values) { q.Set("path", "/data/other") }, want: ErrInvalid},
+		{name: "other name", tamper: func(q url.Values) { q.Set("name", "evil.exe") }, want: ErrInvalid},
+		{name: "name dropped", tamper: func(q url.Values) { q.Del("name") }, want: ErrInvalid},
+		{name: "conflict changed", tamper: func(q url.Values) { q.Set("conflict", "overwrite") }, want: ErrInvalid},
+		{name: "later expiry", tamper: func(q url.Values) { q.Set("expires", "99999999999") }, want: ErrInvalid},
+		{name: "address dropped", tamper: func(q url.Values) { q.Del("ip") }, want: ErrInvalid},
+		{name: "larger size", tamper: func(q url.Values) { q.Set("max_size", "1099511627776") }, want: ErrInvalid},
+		{name: "size dropped", tamper: func(q url.Values) { q.Del("max_size") }, want: ErrInvalid},
+		{name: "other user", tamper: func(q url.Values) { q.Set("uid", "1") }, want: ErrInvalid},
+		{name: "method changed", tamper: func(q url.Values) { q.Set("method", "GET") }, method: "GET", want: ErrInvalid},
+		{name: "signature dropped", tamper: func(q url.Values) { q.Del("signature") }, want: ErrInvalid},
+		{name: "signature garbled", tamper: func(q url.Values) { q.Set("signature", "%%%") }, want: ErrInvalid},
+		{name: "wrong method", method: "GET", want: ErrInvalid},
+		{name: "other address", ip: "10.0.0.2", want: ErrAddress},
+		{name: "expired", grant: func(g *Grant) { g.Expires = time.Now().Add(-time.Second) }, want: ErrExpired},
+		{name: "secret changed", env: func(t *testing.T) { t.Setenv("PRESIGN_SECRET", "another secret") }, want: ErrInvalid},
+		{name: "secret removed", env: func(t *testing.T) { t.Setenv("PRESIGN_SECRET", "") }, want: ErrNotConfigured},
+		{
+			name:   "HEAD on a GET",
+			grant:  func(g *Grant) { g.Method, g.Name, g.Conflict, g.MaxSize = "GET", "", "", 0 },
+			method: "HEAD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := grant
+			if tt.grant != nil {
+				tt.grant(&g)
+			}
+			q, err := Sign(g)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(q)
+			}
+			if tt.env != nil {
+				tt.env(t)
+			}
+			method, ip := "PUT", "10.0.0.1"
+			if tt.method != "" {
+				method = tt.method
+			}
+			if tt.ip != "" {
+				ip = tt.ip
+			}
+
+			// Round trip through the URL, as clients do
+			q, _ = url.ParseQuery(q.Encode())
+			got, err := Verify(q, method, ip)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+			if got.Method != g.Method || got.Path != g.Path || got.Name != g.Name || got.Conflict != g.Conflict ||
+				got.IP != g.IP || got.MaxSize != g.MaxSize || got.UserID != g.UserID || got.Expires.Unix() != g.Expires.Unix() {
+				t.Fatalf("got grant %+v, want %+v", *got, g)
+			}
+		})
+	}
+}
+
+func TestSignNotConfigured(t *testing.T) {
+	t.Setenv("PRESIGN_SECRET", "")
+	if _, err := Sign(Grant{Method: "GET", Path: "/data/a.txt"}); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package preview
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// decode converts data to UTF-8 from the given character set, or the one it appears to
+// be in. Files without a byte order mark that are not valid UTF-8 are taken as
+// Windows-1252, a superset of Latin-1 that decodes any byte. A truncated file may end
+// in the middle of a character, which is dropped.
+func decode(data []byte, charset string, truncated bool) (string, string, error) {
+	if charset != "" {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return "", "", ErrCharset
+		}
+		name, _ := htmlindex.Name(enc)
+		text, err := decodeWith(enc, data)
+		return text, name, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return trimPartial(string(data[3:]), truncated), "utf-8", nil
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		text, err := decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), data)
+		return text, "utf-16le", err
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		text, err := decodeWith(unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), data)
+		return text, "utf-16be", err
+	}
+
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", "", ErrUnsupported // Text never holds NUL bytes
+	}
+	if text := trimPartial(string(data), truncated); utf8.ValidString(text) {
+		return text, "utf-8", nil
+	}
+	text, err := decodeWith(charmap.Windows1252, data)
+	return text, "windows-1252", err
+}
+
+// decodeWith converts data to UTF-8 from enc
+func decodeWith(enc encoding.Encoding, data []byte) (string, error) {
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(string(out), "�"), nil
+}
+
+// trimPartial drops an incomplete UTF-8 sequence from the end of text cut off at a size
+// limit
+func trimPartial(text string, truncated bool) string {
+	if !truncated {
+		return text
+	}
+	for i := 1; i < utf8.UTFMax && i <= len(text); i++ {
+		if utf8.RuneStart(text[len(text)-i]) {
+			if !utf8.FullRuneInString(text[len(text)-i:]) {
+				return text[:len(text)-i]
+			}
+			break
+		}
+	}
+	return text
+}
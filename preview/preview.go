@@ -0,0 +1,144 @@
+// Package preview renders the content of text files as HTML fragments for viewing in the
+// browser: Markdown as sanitized HTML, source code highlighted, CSV and TSV as paged
+// tables and JSON as a collapsible tree
+package preview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"teltech/config"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+// Kinds of preview
+const (
+	Markdown = "markdown"
+	Code     = "code"
+	Table    = "table"
+	JSON     = "json"
+	Text     = "text"
+)
+
+var (
+	// ErrUnsupported is returned for files that are not text
+	ErrUnsupported = errors.New("no preview for this type of file")
+	// ErrCharset is returned for character sets that are not known
+	ErrCharset = errors.New("unknown character set")
+)
+
+// Options controls how a preview is rendered
+type Options struct {
+	Page    int    // Page of a table to render, from 1
+	Charset string // Character set of the content, empty to detect it
+}
+
+// Preview is a file rendered as an HTML fragment. The HTML is safe to insert into a page
+// as it is.
+type Preview struct {
+	Kind      string `json:"kind"`
+	HTML      string `json:"html"`
+	Charset   string `json:"charset"`            // Character set the content was read as
+	Language  string `json:"language,omitempty"` // Language source code was highlighted as
+	Truncated bool   `json:"truncated"`          // Only the start of the file was rendered
+	Page      int    `json:"page,omitempty"`     // Page of a table rendered
+	Pages     int    `json:"pages,omitempty"`    // Pages the table has
+	Rows      int    `json:"rows,omitempty"`     // Rows the table has, below its header
+}
+
+// MaxSize returns how many bytes of a file are rendered at most
+func MaxSize() int64 {
+	return config.Int64("PREVIEW_MAX_SIZE", 1<<20)
+}
+
+// Render renders the start of file, up to MaxSize bytes, as HTML
+func Render(ctx context.Context, file *models.File, opts Options) (*Preview, error) {
+	kind := kindOf(file.Name, file.MimeType)
+	if kind == "" {
+		return nil, ErrUnsupported
+	}
+
+	limit := MaxSize()
+	reader, err := storage.Default().Get(ctx, file.ContentKey(), 0, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	truncated := int64(len(data)) > limit
+	if truncated {
+		data = data[:limit]
+	}
+
+	text, charset, err := decode(data, opts.Charset, truncated)
+	if err != nil {
+		return nil, err
+	}
+	p := &Preview{Kind: kind, Charset: charset, Truncated: truncated}
+	switch p.Kind {
+	case Markdown:
+		p.HTML, err = renderMarkdown(text)
+	case Table:
+		if err = renderTable(p, text, file.Name, opts.Page); err != nil {
+			p.Kind, p.HTML, err = Text, renderText(text), nil
+		}
+	case JSON:
+		if p.HTML, err = renderJSON(text); err != nil {
+			// Broken or cut off JSON is still worth reading
+			p.Kind, p.Language = Code, "JSON"
+			p.HTML, err = renderCode(text, lexers.Get("json"))
+		}
+	case Code:
+		lexer := lexers.Match(filepath.Base(file.Name))
+		p.Language = lexer.Config().Name
+		p.HTML, err = renderCode(text, lexer)
+	default:
+		p.HTML = renderText(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// kindOf picks the kind of preview for a file from its name, then its content type. It
+// returns an empty string for files that are not text.
+func kindOf(name, mimeType string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown", ".mdown", ".mkd":
+		return Markdown
+	case ".csv", ".tsv", ".tab":
+		return Table
+	case ".json", ".geojson", ".jsonld":
+		return JSON
+	case ".txt", ".text", ".log":
+		return Text
+	}
+	if lexers.Match(filepath.Base(name)) != nil {
+		return Code
+	}
+
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	switch {
+	case mimeType == "text/markdown":
+		return Markdown
+	case mimeType == "text/csv" || mimeType == "text/tab-separated-values":
+		return Table
+	case mimeType == "application/json":
+		return JSON
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/", "application/pdf", "application/zip"} {
+		if strings.HasPrefix(mimeType, prefix) {
+			return ""
+		}
+	}
+	return Text
+}
@@ -0,0 +1,197 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teltech/models"
+	"teltech/storage"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		name, mimeType, want string
+	}{
+		{"README.md", "", Markdown},
+		{"data.CSV", "", Table},
+		{"data.tsv", "", Table},
+		{"config.json", "", JSON},
+		{"notes.txt", "", Text},
+		{"main.go", "", Code},
+		{"Dockerfile", "", Code},
+		{"notes", "text/markdown", Markdown},
+		{"export", "text/csv; charset=utf-8", Table},
+		{"reply", "application/json", JSON},
+		{"photo.jpg", "image/jpeg", ""},
+		{"report.pdf", "application/pdf", ""},
+		{"bundle.zip", "application/zip", ""},
+		{"unknown", "", Text},
+	}
+	for _, tt := range tests {
+		if got := kindOf(tt.name, tt.mimeType); got != tt.want {
+			t.Errorf("kindOf(%q, %q) = %q, want %q", tt.name, tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		charset     string
+		truncated   bool
+		want        string
+		wantCharset string
+		wantErr     error
+	}{
+		{name: "utf-8", data: []byte("héllo"), want: "héllo", wantCharset: "utf-8"},
+		{name: "utf-8 with a byte order mark", data: []byte("\xEF\xBB\xBFhi"), want: "hi", wantCharset: "utf-8"},
+		{name: "utf-16le", data: []byte{0xFF, 0xFE, 'h', 0, 'i', 0}, want: "hi", wantCharset: "utf-16le"},
+		{name: "utf-16be", data: []byte{0xFE, 0xFF, 0, 'h', 0, 'i'}, want: "hi", wantCharset: "utf-16be"},
+		{name: "latin-1", data: []byte("caf\xE9"), want: "café", wantCharset: "windows-1252"},
+		{name: "cut off character", data: []byte("caf\xC3"), truncated: true, want: "caf", wantCharset: "utf-8"},
+		{name: "charset given", data: []byte("\xE9t\xE9"), charset: "iso-8859-15", want: "été", wantCharset: "iso-8859-15"},
+		{name: "unknown charset", data: []byte("a"), charset: "klingon", wantErr: ErrCharset},
+		{name: "binary", data: []byte("a\x00b"), wantErr: ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, charset, err := decode(tt.data, tt.charset, tt.truncated)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want || charset != tt.wantCharset {
+				t.Fatalf("got %q as %s, want %q as %s", got, charset, tt.want, tt.wantCharset)
+			}
+		})
+	}
+}
+
+func TestRenderTable(t *testing.T) {
+	t.Setenv("PREVIEW_PAGE_SIZE", "2")
+	text := "name;city\nAnn;Oslo\nBo;<Rome>\nCy;Lima\n"
+
+	p := &Preview{}
+	if err := renderTable(p, text, "people.csv", 2); err != nil {
+		t.Fatal(err)
+	}
+	if p.Rows != 3 || p.Pages != 2 || p.Page != 2 {
+		t.Fatalf("rows %d, pages %d, page %d", p.Rows, p.Pages, p.Page)
+	}
+	// The header repeats on every page, cells are escaped
+	if !strings.Contains(p.HTML, "<th>city</th>") || !strings.Contains(p.HTML, "<td>Lima</td>") || strings.Contains(p.HTML, "Oslo") {
+		t.Fatalf("unexpected page %s", p.HTML)
+	}
+
+	p = &Preview{}
+	renderTable(p, text, "people.csv", 99)
+	if p.Page != 2 || !strings.Contains(p.HTML, "Lima") {
+		t.Fatalf("page past the end gave page %d", p.Page)
+	}
+	p = &Preview{}
+	renderTable(p, text, "people.csv", 1)
+	if !strings.Contains(p.HTML, "<td>&lt;Rome&gt;</td>") {
+		t.Fatalf("cell not escaped: %s", p.HTML)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	tests := []struct {
+		text, name string
+		want       rune
+	}{
+		{"a,b,c\n1,2,3", "a.csv", ','},
+		{"a;b;c\n1;2;3", "a.csv", ';'},
+		{"a|b|c", "a.csv", '|'},
+		{"a,b;c,d", "a.tsv", '\t'},
+		{"single", "a.csv", ','},
+	}
+	for _, tt := range tests {
+		if got := separator(tt.text, tt.name); got != tt.want {
+			t.Errorf("separator(%q, %q) = %q, want %q", tt.text, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	got, err := renderMarkdown("# Title\n\n<script>alert(1)</script>\n\n[link](javascript:alert(1)) <img src=x onerror=alert(1)>\n\n| a |\n|---|\n| b |\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"<script", "javascript:", "onerror"} {
+		if strings.Contains(got, bad) {
+			t.Errorf("%q left in %s", bad, got)
+		}
+	}
+	if !strings.Contains(got, "<h1") || !strings.Contains(got, "<table>") {
+		t.Errorf("Markdown not rendered: %s", got)
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	got, err := renderJSON(`{"b": [1, "<x>"], "a": null}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys keep their order and strings are escaped
+	if b, a := strings.Index(got, "&#34;b&#34;"), strings.Index(got, "&#34;a&#34;"); b < 0 || a < 0 || b > a {
+		t.Errorf("keys out of order in %s", got)
+	}
+	if strings.Contains(got, "<x>") {
+		t.Errorf("string not escaped in %s", got)
+	}
+
+	for _, text := range []string{`{"a": 1`, `{} {}`, strings.Repeat("[", maxJSONDepth+2) + strings.Repeat("]", maxJSONDepth+2)} {
+		if _, err := renderJSON(text); err == nil {
+			t.Errorf("rendered %.20q", text)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	t.Setenv("PREVIEW_MAX_SIZE", "64")
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	store := func(name, mimeType, content string) *models.File {
+		path := filepath.Join(root, name)
+		os.WriteFile(path, []byte(content), 0644)
+		return &models.File{Name: name, Path: path, Size: int64(len(content)), MimeType: mimeType}
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		file          *models.File
+		wantKind      string
+		wantLanguage  string
+		wantTruncated bool
+		wantErr       error
+	}{
+		{file: store("main.go", "", "package main\n"), wantKind: Code, wantLanguage: "Go"},
+		{file: store("a.json", "", `{"a": 1}`), wantKind: JSON},
+		{file: store("broken.json", "", `{"a": `), wantKind: Code, wantLanguage: "JSON"},
+		{file: store("a.csv", "", "a,b\n1,2\n"), wantKind: Table},
+		{file: store("long.txt", "", strings.Repeat("line\n", 20)), wantKind: Text, wantTruncated: true},
+		{file: store("a.png", "image/png", "\x89PNG"), wantErr: ErrUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file.Name, func(t *testing.T) {
+			p, err := Render(ctx, tt.file, Options{Page: 1})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.Kind != tt.wantKind || p.Language != tt.wantLanguage || p.Truncated != tt.wantTruncated || p.HTML == "" {
+				t.Fatalf("unexpected preview %+v", p)
+			}
+		})
+	}
+}
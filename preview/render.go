@@ -0,0 +1,222 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"teltech/config"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// maxJSONDepth caps how deeply nested JSON is rendered as a tree
+const maxJSONDepth = 100
+
+var (
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	sanitize = bluemonday.UGCPolicy()
+)
+
+// renderText shows plain text as it is
+func renderText(text string) string {
+	return `<pre class="preview-text">` + html.EscapeString(text) + `</pre>`
+}
+
+// renderMarkdown renders Markdown to HTML, removing scripts, event handlers and anything
+// else that could run in the viewer's browser
+func renderMarkdown(text string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(text), &buf); err != nil {
+		return "", err
+	}
+	return `<div class="preview-markdown">` + sanitize.Sanitize(buf.String()) + `</div>`, nil
+}
+
+// renderCode highlights source code with inline styles and line numbers, so the
+// fragment needs no stylesheet
+func renderCode(text string, lexer chroma.Lexer) (string, error) {
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	style := styles.Get(config.String("PREVIEW_CODE_STYLE", "github"))
+	formatter := chromahtml.New(chromahtml.WithLineNumbers(true), chromahtml.TabWidth(4))
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<div class="preview-code">`)
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		return "", err
+	}
+	buf.WriteString(`</div>`)
+	return buf.String(), nil
+}
+
+// renderTable renders a page of CSV or TSV rows as a table, repeating the header row
+// on every page. The separator of CSV files is guessed from the first line, as
+// spreadsheets in many locales write semicolons.
+func renderTable(p *Preview, text, name string, page int) error {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = separator(text, name)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+	if p.Truncated && len(rows) > 1 {
+		rows = rows[:len(rows)-1] // Probably cut off
+	}
+
+	pageSize := int(config.Int64("PREVIEW_PAGE_SIZE", 100))
+	p.Rows = max(len(rows)-1, 0)
+	p.Pages = max((p.Rows+pageSize-1)/pageSize, 1)
+	p.Page = min(max(page, 1), p.Pages)
+
+	var buf strings.Builder
+	buf.WriteString(`<table class="preview-table">`)
+	if len(rows) > 0 {
+		buf.WriteString("<thead><tr>")
+		for _, cell := range rows[0] {
+			buf.WriteString("<th>" + html.EscapeString(cell) + "</th>")
+		}
+		buf.WriteString("</tr></thead>")
+	}
+	buf.WriteString("<tbody>")
+	start := 1 + (p.Page-1)*pageSize
+	for _, row := range rows[min(start, len(rows)):min(start+pageSize, len(rows))] {
+		buf.WriteString("<tr>")
+		for _, cell := range row {
+			buf.WriteString("<td>" + html.EscapeString(cell) + "</td>")
+		}
+		buf.WriteString("</tr>")
+	}
+	buf.WriteString("</tbody></table>")
+	p.HTML = buf.String()
+	return nil
+}
+
+// separator returns the field separator of a CSV or TSV file
+func separator(text, name string) rune {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tsv", ".tab":
+		return '\t'
+	}
+	first, _, _ := strings.Cut(text, "\n")
+	best, count := ',', strings.Count(first, ",")
+	for _, r := range []rune{';', '\t', '|'} {
+		if n := strings.Count(first, string(r)); n > count {
+			best, count = r, n
+		}
+	}
+	return best
+}
+
+// renderJSON renders a JSON document as nested collapsible lists, keeping the order of
+// object keys. It fails for anything but a single complete document.
+func renderJSON(text string) (string, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var buf strings.Builder
+	buf.WriteString(`<div class="preview-json">`)
+	if err := renderJSONValue(&buf, decoder, 0); err != nil {
+		return "", err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return "", errors.New("trailing data after JSON document")
+	}
+	buf.WriteString(`</div>`)
+	return buf.String(), nil
+}
+
+// renderJSONValue renders the next value from decoder
+func renderJSONValue(buf *strings.Builder, decoder *json.Decoder, depth int) error {
+	if depth > maxJSONDepth {
+		return errors.New("JSON is nested too deeply")
+	}
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		buf.WriteString(jsonScalar(token))
+		return nil
+	}
+	start, end := "{", "}"
+	if delim == '[' {
+		start, end = "[", "]"
+	}
+
+	// Entries are rendered first, as the summary shows how many there are
+	var entries strings.Builder
+	count := 0
+	for decoder.More() {
+		entries.WriteString("<li>")
+		if delim == '{' {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			entries.WriteString(`<span class="json-key">` + html.EscapeString(strconv.Quote(key.(string))) + `</span>: `)
+		}
+		if err := renderJSONValue(&entries, decoder, depth+1); err != nil {
+			return err
+		}
+		entries.WriteString("</li>")
+		count++
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+
+	if count == 0 {
+		buf.WriteString(`<span class="json-empty">` + start + end + `</span>`)
+		return nil
+	}
+	noun := "items"
+	if delim == '{' {
+		noun = "keys"
+	}
+	buf.WriteString(`<details open><summary>` + start + ` <span class="json-count">` + strconv.Itoa(count) + " " + noun + `</span> ` + end + `</summary><ul>`)
+	buf.WriteString(entries.String())
+	buf.WriteString(`</ul></details>`)
+	return nil
+}
+
+// jsonScalar renders a string, number, boolean or null
+func jsonScalar(token json.Token) string {
+	switch v := token.(type) {
+	case string:
+		return `<span class="json-string">` + html.EscapeString(strconv.Quote(v)) + `</span>`
+	case json.Number:
+		return `<span class="json-number">` + html.EscapeString(v.String()) + `</span>`
+	case bool:
+		return `<span class="json-boolean">` + strconv.FormatBool(v) + `</span>`
+	}
+	return `<span class="json-null">null</span>`
+}
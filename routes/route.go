@@ -2,6 +2,8 @@ package routes
 
 import (
 	"teltech/controllers"
+	"teltech/metrics"
+	"teltech/middleware"
 
 	"github.com/gin-gonic/gin"
 )
@@ -28,16 +30,55 @@ func SetupRoutes(router *gin.Engine) {
 	router.DELETE("/folder/delete", controllers.DeleteFolder) // Delete a folder and its contents
 
 	// File management routes
-	router.POST("/file/upload", controllers.UploadFile)    // Upload a file
-	router.GET("/file/download", controllers.DownloadFile) // Download a file
+	router.POST("/file/upload", controllers.UploadFile)                                              // Upload a file
+	router.POST("/file/upload/by-hash", middleware.AuthMiddleware(), controllers.UploadByHash)       // Store a file from content the server already has
+	router.POST("/file/extract", middleware.AuthMiddleware(), controllers.ExtractFile)               // Unpack a stored ZIP or tar archive
+	router.GET("/file/archive/entries", middleware.AuthMiddleware(), controllers.ListArchiveEntries) // List the entries of a stored archive
+	router.GET("/file/archive/entry", middleware.AuthMiddleware(), controllers.DownloadArchiveEntry) // Download one entry of a stored archive
+	router.GET("/file/download", middleware.AuthMiddleware(), controllers.DownloadFile)              // Download a file
+	router.HEAD("/file/download", middleware.AuthMiddleware(), controllers.DownloadFile)             // Size, type and validators of a download
+	router.POST("/file/presign", middleware.AuthMiddleware(), controllers.PresignURL)                // Mint a pre-signed download or upload URL
+	router.GET("/file/presigned", controllers.PresignedDownload)                                     // Download through a pre-signed URL
+	router.HEAD("/file/presigned", controllers.PresignedDownload)                                    // Size, type and validators through a pre-signed URL
+	router.PUT("/file/presigned", controllers.PresignedUpload)                                       // Upload through a pre-signed URL
+	router.GET("/file/info", middleware.AuthMiddleware(), controllers.GetFileInfo)                   // Describe a file, with the metadata read from it
+	router.GET("/file/thumbnail", middleware.AuthMiddleware(), controllers.GetThumbnail)             // Get a scaled-down copy of an image file
+	router.GET("/file/preview", middleware.AuthMiddleware(), controllers.PreviewFile)                // Render a text file for viewing in the browser
+	router.GET("/file/content", middleware.AuthMiddleware(), controllers.GetFileContent)             // Load a text file for editing
+	router.PUT("/file/content", middleware.AuthMiddleware(), controllers.SaveFileContent)            // Save an edited text file unless it changed meanwhile
+	router.GET("/file/download/zip", middleware.AuthMiddleware(), controllers.DownloadZip)           // Download folders and files as a ZIP archive
+	router.POST("/file/download/zip", middleware.AuthMiddleware(), controllers.DownloadZip)          // Same, for selections too long for a URL
 
 	// File sharing routes
-	router.POST("/file/share", controllers.GenerateShareableLink)       // Generate a shareable link
-	router.GET("/file/share/:share_link", controllers.AccessSharedFile) // Access a file via shareable link
+	router.POST("/file/share", middleware.AuthMiddleware(), controllers.GenerateShareableLink)                     // Generate a shareable link
+	router.GET("/file/shares", middleware.AuthMiddleware(), controllers.ListShares)                                // List share links of a file, folder or user
+	router.PATCH("/file/shares/:id", middleware.AuthMiddleware(), controllers.UpdateShare)                         // Change the settings of a share link
+	router.DELETE("/file/shares/:id", middleware.AuthMiddleware(), controllers.RevokeShare)                        // Revoke a share link
+	router.GET("/file/shares/:id/accesses", middleware.AuthMiddleware(), controllers.ListShareAccesses)            // Requests made through a share link
+	router.GET("/file/shares/:id/uploads", middleware.AuthMiddleware(), controllers.ListShareUploads)              // Files uploaded through a write share link
+	router.GET("/file/share/:share_link", middleware.ShareAccessLog(), controllers.AccessSharedFile)               // Access a file via shareable link
+	router.HEAD("/file/share/:share_link", middleware.ShareAccessLog(), controllers.AccessSharedFile)              // Size, type and validators of a shared file
+	router.POST("/file/share/:share_link/unlock", middleware.ShareAccessLog(), controllers.UnlockShare)            // Unlock a password protected share
+	router.GET("/file/share/:share_link/file", middleware.ShareAccessLog(), controllers.DownloadSharedFolderFile)  // Download a file in a shared folder
+	router.HEAD("/file/share/:share_link/file", middleware.ShareAccessLog(), controllers.DownloadSharedFolderFile) // Size, type and validators of a file in a shared folder
+	router.GET("/file/share/:share_link/view", middleware.ShareAccessLog(), controllers.ViewSharedFile)            // Page showing a shared file
+	router.GET("/file/share/:share_link/zip", middleware.ShareAccessLog(), controllers.DownloadSharedZip)          // Download a shared folder as a ZIP archive
+	router.GET("/file/share/:share_link/preview", middleware.ShareAccessLog(), controllers.PreviewSharedFile)      // Render a shared text file for viewing in the browser
+	router.POST("/file/share/:share_link/upload", middleware.ShareAccessLog(), controllers.UploadToShare)          // Upload a file into a folder through a write share link
 
 	// Dashboard summary data
 	router.GET("/api/dashboard/summary", controllers.GetDashboardSummary) // Get summary data for dashboard
 
+	// Administration routes
+	admin := router.Group("/admin", middleware.AuthMiddleware(), middleware.AdminOnly())
+	admin.GET("/scrub/report", controllers.GetScrubReport) // Latest integrity scrub results
+	admin.POST("/scrub", controllers.StartScrub)           // Start an integrity scrub now
+	admin.GET("/fsck", controllers.PreviewFsck)            // List disk and database drift
+	admin.POST("/fsck", controllers.RepairFsck)            // Repair drift a preview listed
+
+	// Operational metrics in the Prometheus text format, for admins only
+	router.GET("/metrics", middleware.AuthMiddleware(), middleware.AdminOnly(), gin.WrapH(metrics.Handler()))
+
 	// Authentication routes
 	router.POST("/register", controllers.Register) // Register a new user
 	router.POST("/login", controllers.Login)       // Login for existing users
@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// token signs a session for a user with role, as Login does
+func token(t *testing.T, role string) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": 1,
+		"role":    role,
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("your_jwt_secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestProtectedRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	SetupRoutes(router)
+
+	routes := []struct {
+		method, path string
+		adminOnly    bool
+	}{
+		{method: http.MethodPost, path: "/file/upload/by-hash"},
+		{method: http.MethodPost, path: "/file/extract"},
+		{method: http.MethodGet, path: "/file/archive/entries"},
+		{method: http.MethodGet, path: "/file/archive/entry"},
+		{method: http.MethodGet, path: "/file/download"},
+		{method: http.MethodHead, path: "/file/download"},
+		{method: http.MethodPost, path: "/file/presign"},
+		{method: http.MethodGet, path: "/file/info"},
+		{method: http.MethodGet, path: "/file/thumbnail"},
+		{method: http.MethodGet, path: "/file/preview"},
+		{method: http.MethodGet, path: "/file/content"},
+		{method: http.MethodPut, path: "/file/content"},
+		{method: http.MethodPost, path: "/file/share"},
+		{method: http.MethodGet, path: "/file/shares"},
+		{method: http.MethodPatch, path: "/file/shares/1"},
+		{method: http.MethodDelete, path: "/file/shares/1"},
+		{method: http.MethodGet, path: "/file/shares/1/accesses"},
+		{method: http.MethodGet, path: "/file/shares/1/uploads"},
+		{method: http.MethodGet, path: "/admin/scrub/report", adminOnly: true},
+		{method: http.MethodPost, path: "/admin/scrub", adminOnly: true},
+		{method: http.MethodGet, path: "/admin/fsck", adminOnly: true},
+		{method: http.MethodPost, path: "/admin/fsck", adminOnly: true},
+		{method: http.MethodGet, path: "/metrics", adminOnly: true},
+	}
+	for _, route := range routes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(route.method, route.path, nil))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("without a session: got %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+
+			if !route.adminOnly {
+				return
+			}
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.Header.Set("Authorization", "Bearer "+token(t, "user"))
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("as a user: got %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+
+	// Admins can read the metrics
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token(t, "admin"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("metrics as an admin: got %d", w.Code)
+	}
+}
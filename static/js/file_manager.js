@@ -2,6 +2,13 @@ document.addEventListener("DOMContentLoaded", () => {
     const createFolderForm = document.getElementById("create-folder-form");
     const uploadFileForm = document.getElementById("upload-file-form");
     const folderList = document.getElementById("folder-list");
+    const previewPanel = document.getElementById("preview-panel");
+    let previewItem = null;
+    let previewPage = 1;
+    const editorPanel = document.getElementById("editor-panel");
+    const editorContent = document.getElementById("editor-content");
+    let editorItem = null;
+    let editorETag = null;
 
     // Fetch and display the folder contents
     fetchFolderContents();
@@ -75,8 +82,18 @@ document.addEventListener("DOMContentLoaded", () => {
             const listItem = document.createElement("li");
             listItem.textContent = `${item.name} (${item.type})`;
 
-            // Add share button for files
+            // Add preview and share buttons for files
             if (item.type === "file") {
+                const previewButton = document.createElement("button");
+                previewButton.textContent = "Preview";
+                previewButton.addEventListener("click", () => handlePreview(item, 1));
+                listItem.appendChild(previewButton);
+
+                const editButton = document.createElement("button");
+                editButton.textContent = "Edit";
+                editButton.addEventListener("click", () => handleEdit(item));
+                listItem.appendChild(editButton);
+
                 const shareButton = document.createElement("button");
                 shareButton.textContent = "Share";
                 shareButton.addEventListener("click", () => handleShare(item.id));
@@ -87,6 +104,88 @@ document.addEventListener("DOMContentLoaded", () => {
         });
     }
 
+    // Headers authenticating requests with the token saved at login, if any
+    function authHeaders() {
+        const token = localStorage.getItem("token");
+        return token ? { Authorization: `Bearer ${token}` } : {};
+    }
+
+    // Show a preview of a file, or the given page of a table
+    async function handlePreview(item, page) {
+        const params = new URLSearchParams({ file_path: item.path, page: page });
+        const response = await fetch(`/file/preview?${params}`, { headers: authHeaders() });
+        const data = await response.json();
+        if (!response.ok) {
+            alert(`Error previewing file: ${data.error}`);
+            return;
+        }
+
+        const preview = data.preview;
+        previewItem = item;
+        previewPage = preview.page || 1;
+        document.getElementById("preview-title").textContent = data.name;
+        document.getElementById("preview-content").innerHTML = preview.html; // Sanitized by the server
+
+        const notice = document.getElementById("preview-notice");
+        notice.hidden = !preview.truncated;
+        notice.textContent = "Only the start of this file is shown. Download it to see everything.";
+
+        document.getElementById("preview-pages").hidden = !(preview.pages > 1);
+        document.getElementById("preview-page").textContent = `Page ${previewPage} of ${preview.pages}`;
+        document.getElementById("preview-prev").disabled = previewPage <= 1;
+        document.getElementById("preview-next").disabled = previewPage >= preview.pages;
+        previewPanel.hidden = false;
+    }
+
+    document.getElementById("preview-close").addEventListener("click", () => {
+        previewPanel.hidden = true;
+    });
+    document.getElementById("preview-prev").addEventListener("click", () => handlePreview(previewItem, previewPage - 1));
+    document.getElementById("preview-next").addEventListener("click", () => handlePreview(previewItem, previewPage + 1));
+
+    // Open a text file in the editor, remembering the version it was loaded at
+    async function handleEdit(item) {
+        const params = new URLSearchParams({ file_path: item.path });
+        const response = await fetch(`/file/content?${params}`, { headers: authHeaders() });
+        if (!response.ok) {
+            const errorData = await response.json();
+            alert(`Error opening file: ${errorData.error}`);
+            return;
+        }
+
+        editorItem = item;
+        editorETag = response.headers.get("ETag");
+        editorContent.value = await response.text();
+        document.getElementById("editor-title").textContent = item.name;
+        editorPanel.hidden = false;
+    }
+
+    // Save the editor's content, unless someone else saved the file since it was loaded
+    document.getElementById("editor-save").addEventListener("click", async () => {
+        const params = new URLSearchParams({ file_path: editorItem.path });
+        const response = await fetch(`/file/content?${params}`, {
+            method: "PUT",
+            headers: { ...authHeaders(), "Content-Type": "text/plain; charset=utf-8", "If-Match": editorETag },
+            body: editorContent.value,
+        });
+
+        if (response.ok) {
+            editorETag = response.headers.get("ETag");
+            alert("File saved successfully!");
+        } else if (response.status === 412) {
+            if (confirm("Someone else changed this file since you opened it. Reload it? Your changes will be lost.")) {
+                handleEdit(editorItem);
+            }
+        } else {
+            const errorData = await response.json();
+            alert(`Error saving file: ${errorData.error}`);
+        }
+    });
+
+    document.getElementById("editor-close").addEventListener("click", () => {
+        editorPanel.hidden = true;
+    });
+
     // Handle sharing of a file
     async function handleShare(fileId) {
         const accessType = prompt("Enter access type (read/write):", "read");
@@ -95,7 +194,7 @@ document.addEventListener("DOMContentLoaded", () => {
 
         const response = await fetch("/file/share", {
             method: "POST",
-            headers: { "Content-Type": "application/json" },
+            headers: { "Content-Type": "application/json", ...authHeaders() },
             body: JSON.stringify({
                 file_id: fileId,
                 access_type: accessType,
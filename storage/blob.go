@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Storage modes selected with STORAGE_MODE
+const (
+	ModePath = "path" // Files are stored at their own path under the root
+	ModeCAS  = "cas"  // File contents are stored once per hash and shared between files
+)
+
+// BlobKey returns the key the content-addressable blob with the given hash is kept under
+func BlobKey(hash string) string {
+	return InternalDir + "/blobs/" + hash[:2] + "/" + hash[2:4] + "/" + hash
+}
+
+// BlobStagingKey returns a fresh key to stage blob content under while its hash is not
+// yet known
+func BlobStagingKey() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	return InternalDir + "/blobs/tmp/" + hex.EncodeToString(raw)
+}
+
+// BlobTrashKey returns the key a blob is moved to while it is being garbage collected
+func BlobTrashKey(hash string) string {
+	return InternalDir + "/blobs/trash/" + hash
+}
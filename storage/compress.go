@@ -0,0 +1,464 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedFrameSize is the amount of content compressed into each independent zstd
+// frame. Range reads decompress only the frames they touch.
+const compressedFrameSize = 1 << 20
+
+const (
+	skippableFrameMagic = 0x184D2A50 // First of the zstd skippable frame magic numbers
+	seekTableMagic      = 0x184D2A5E // Skippable frame magic used for the seek table
+	seekableFooterMagic = 0x8F92EAB1 // Trailer of the zstd seekable format
+)
+
+// compressedHeader opens every object written by Compressed. It is a zstd skippable
+// frame, so the stored object stays a valid zstd stream, and it lets compressed objects
+// be told apart from content stored as-is.
+var compressedHeader = func() []byte {
+	header := binary.LittleEndian.AppendUint32(nil, skippableFrameMagic)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	return append(header, "teltech-zstd-v1\x00"...)
+}()
+
+// DefaultIncompressibleTypes lists content types that are already compressed and are
+// stored as-is
+var DefaultIncompressibleTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic",
+	"video/", "audio/mpeg", "audio/aac", "audio/ogg", "audio/mp4", "audio/flac",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-bzip2", "application/x-xz", "application/pdf",
+	"application/vnd.openxmlformats-officedocument.", "application/epub+zip",
+}
+
+// OriginalSize records the size of content written by Compressed
+type OriginalSize struct {
+	StoredSize int64 // Bytes the object occupied in the backend when the size was recorded
+	Size       int64 // Size of the content before compression
+}
+
+// SizeStore persists the original size of objects written by Compressed, so Stat and
+// List need not read the seek table of every object. An object without a recorded size,
+// or whose stored size no longer matches, has its seek table read instead.
+type SizeStore interface {
+	LoadSizes(keys []string) (map[string]OriginalSize, error) // Omits keys without a recorded size
+	SaveSize(key string, size OriginalSize) error
+	MoveSizes(src, dst string) error // Moves the size of an object or of every object below a folder
+	DeleteSizes(key string) error    // Deletes the size of an object or of every object below a folder
+}
+
+// Compressed wraps a driver so suitable content is stored zstd-compressed. Objects are
+// written in the zstd seekable format: independent frames followed by a seek table, so
+// ranges can be served by decompressing only the frames that cover them.
+type Compressed struct {
+	inner   Driver
+	skip    []string
+	sizes   SizeStore
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// NewCompressed returns a driver compressing what it writes to inner, except content
+// whose type starts with one of the skip prefixes, and recording original sizes in sizes
+func NewCompressed(inner Driver, skip []string, sizes SizeStore) (*Compressed, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Compressed{inner: inner, skip: skip, sizes: sizes, encoder: encoder, decoder: decoder}, nil
+}
+
+// Unwrap returns the driver holding the compressed content
+func (z *Compressed) Unwrap() Driver {
+	return z.inner
+}
+
+// compressible reports whether content of the given type is worth compressing
+func (z *Compressed) compressible(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, prefix := range z.skip {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Put compresses the content unless its declared or sniffed type is already compressed
+func (z *Compressed) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (Info, error) {
+	if strings.HasSuffix(key, "/") {
+		return z.inner.Put(ctx, key, r, opts)
+	}
+
+	// Sniff the start of the content as well, since names are not always truthful
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Info{}, err
+	}
+	head = head[:n]
+	r = io.MultiReader(bytes.NewReader(head), r)
+
+	// Content that happens to start with the header is always wrapped, so it can never be
+	// mistaken for a compressed object
+	skip := !z.compressible(opts.ContentType) || !z.compressible(http.DetectContentType(head))
+	if skip && !bytes.HasPrefix(head, compressedHeader) {
+		info, err := z.inner.Put(ctx, key, r, opts)
+		if err != nil {
+			return Info{}, err
+		}
+		z.saveSize(info)
+		return info, nil
+	}
+
+	framer := &frameWriter{src: r, encoder: z.encoder, out: append([]byte(nil), compressedHeader...)}
+	info, err := z.inner.Put(ctx, key, framer, opts)
+	if err != nil {
+		return Info{}, err
+	}
+	info.Size = framer.size
+	z.saveSize(info)
+	return info, nil
+}
+
+// Get decompresses the frames covering the requested range
+func (z *Compressed) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	table, err := z.seekTable(ctx, key)
+	if errors.Is(err, errNotCompressed) {
+		return z.inner.Get(ctx, key, offset, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size := table.size()
+	if offset >= size || length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+
+	first := sort.Search(len(table.frames), func(i int) bool {
+		return table.frames[i].plainOffset+table.frames[i].plainSize > offset
+	})
+	last := first
+	for last+1 < len(table.frames) && table.frames[last+1].plainOffset < offset+length {
+		last++
+	}
+
+	start := table.frames[first].storedOffset
+	end := table.frames[last].storedOffset + table.frames[last].storedSize
+	body, err := z.inner.Get(ctx, key, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{&frameReader{
+		src:     body,
+		decoder: z.decoder,
+		frames:  table.frames[first : last+1],
+		skip:    offset - table.frames[first].plainOffset,
+		remain:  length,
+	}, body}, nil
+}
+
+// Stat reports the original size of compressed objects
+func (z *Compressed) Stat(ctx context.Context, key string) (Info, error) {
+	info, err := z.inner.Stat(ctx, key)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	infos := []Info{info}
+	z.originalSizes(ctx, infos)
+	return infos[0], nil
+}
+
+// List reports the original size of compressed objects
+func (z *Compressed) List(ctx context.Context, key string) ([]Info, error) {
+	infos, err := z.inner.List(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	z.originalSizes(ctx, infos)
+	return infos, nil
+}
+
+// originalSizes replaces the stored size of the objects in infos with their original
+// size. Sizes are looked up in the size store in one go; only objects it has no current
+// size for have their seek table read, and the size found is recorded for next time.
+func (z *Compressed) originalSizes(ctx context.Context, infos []Info) {
+	var keys []string
+	for _, info := range infos {
+		if !info.IsDir {
+			keys = append(keys, cleanKey(info.Key))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	recorded, err := z.sizes.LoadSizes(keys)
+	if err != nil {
+		log.Printf("Failed to load original sizes: %v", err)
+	}
+
+	for i, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		if size, ok := recorded[cleanKey(info.Key)]; ok && size.StoredSize == info.StoredSize {
+			infos[i].Size = size.Size
+			continue
+		}
+		table, err := z.readSeekTable(ctx, info)
+		switch {
+		case err == nil:
+			infos[i].Size = table.size()
+		case errors.Is(err, errNotCompressed):
+		default:
+			continue
+		}
+		z.saveSize(infos[i])
+	}
+}
+
+// saveSize records the original size of the object described by info. Failures only
+// cost reading its seek table later.
+func (z *Compressed) saveSize(info Info) {
+	key := cleanKey(info.Key)
+	if err := z.sizes.SaveSize(key, OriginalSize{StoredSize: info.StoredSize, Size: info.Size}); err != nil {
+		log.Printf("Failed to record the original size of %s: %v", key, err)
+	}
+}
+
+// Move renames the object or folder and its recorded sizes
+func (z *Compressed) Move(ctx context.Context, src, dst string) error {
+	if err := z.inner.Move(ctx, src, dst); err != nil {
+		return err
+	}
+	return z.sizes.MoveSizes(cleanKey(src), cleanKey(dst))
+}
+
+// Delete removes the object or folder and its recorded sizes
+func (z *Compressed) Delete(ctx context.Context, key string) error {
+	if err := z.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	return z.sizes.DeleteSizes(cleanKey(key))
+}
+
+// errNotCompressed reports an object stored as-is
+var errNotCompressed = errors.New("object is not compressed")
+
+// seekFrame locates one zstd frame in the stored object and in the original content
+type seekFrame struct {
+	storedOffset, storedSize int64
+	plainOffset, plainSize   int64
+}
+
+// seekTable lists the frames of a compressed object in order
+type seekTable struct {
+	frames []seekFrame
+}
+
+// size returns the original size of the content
+func (t *seekTable) size() int64 {
+	if len(t.frames) == 0 {
+		return 0
+	}
+	last := t.frames[len(t.frames)-1]
+	return last.plainOffset + last.plainSize
+}
+
+// seekTable reads the header and seek table of the object at key
+func (z *Compressed) seekTable(ctx context.Context, key string) (*seekTable, error) {
+	info, err := z.inner.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return z.readSeekTable(ctx, info)
+}
+
+// readSeekTable reads the header and seek table of the object described by info, as
+// reported by the inner driver
+func (z *Compressed) readSeekTable(ctx context.Context, info Info) (*seekTable, error) {
+	key := info.Key
+	if info.Size < int64(len(compressedHeader))+9 {
+		return nil, errNotCompressed
+	}
+
+	header, err := readRange(ctx, z.inner, key, 0, int64(len(compressedHeader)))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header, compressedHeader) {
+		return nil, errNotCompressed
+	}
+
+	footer, err := readRange(ctx, z.inner, key, info.Size-9, 9)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableFooterMagic {
+		return nil, errors.New("compressed object has no seek table")
+	}
+	count := int64(binary.LittleEndian.Uint32(footer))
+	entrySize := int64(8)
+	if footer[4]&0x80 != 0 {
+		entrySize = 12 // Entries carry a checksum
+	}
+
+	tableSize := count*entrySize + 9
+	entries, err := readRange(ctx, z.inner, key, info.Size-tableSize, count*entrySize)
+	if err != nil {
+		return nil, err
+	}
+
+	table := &seekTable{frames: make([]seekFrame, 0, count)}
+	storedOffset, plainOffset := int64(len(compressedHeader)), int64(0)
+	for i := int64(0); i < count; i++ {
+		entry := entries[i*entrySize:]
+		frame := seekFrame{
+			storedOffset: storedOffset,
+			storedSize:   int64(binary.LittleEndian.Uint32(entry)),
+			plainOffset:  plainOffset,
+			plainSize:    int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		table.frames = append(table.frames, frame)
+		storedOffset += frame.storedSize
+		plainOffset += frame.plainSize
+	}
+	return table, nil
+}
+
+// readRange reads exactly length bytes at offset of the object at key
+func readRange(ctx context.Context, d Driver, key string, offset, length int64) ([]byte, error) {
+	body, err := d.Get(ctx, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// frameWriter compresses its source into independent zstd frames and appends the seek
+// table once the source is exhausted
+type frameWriter struct {
+	src     io.Reader
+	encoder *zstd.Encoder
+	out     []byte // Compressed bytes not yet returned
+	entries []byte // Seek table entries written so far
+	frames  uint32
+	size    int64 // Original bytes consumed
+	done    bool
+}
+
+func (w *frameWriter) Read(p []byte) (int, error) {
+	for len(w.out) == 0 {
+		if w.done {
+			return 0, io.EOF
+		}
+		if err := w.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, w.out)
+	w.out = w.out[n:]
+	return n, nil
+}
+
+// next compresses the next frame, or emits the seek table at the end of the source
+func (w *frameWriter) next() error {
+	buf := make([]byte, compressedFrameSize)
+	n, err := io.ReadFull(w.src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	if n > 0 {
+		frame := w.encoder.EncodeAll(buf[:n], nil)
+		w.entries = binary.LittleEndian.AppendUint32(w.entries, uint32(len(frame)))
+		w.entries = binary.LittleEndian.AppendUint32(w.entries, uint32(n))
+		w.frames++
+		w.size += int64(n)
+		w.out = frame
+	}
+	if n == compressedFrameSize {
+		return nil
+	}
+
+	// The seek table is itself a skippable frame ending in the seekable footer
+	table := binary.LittleEndian.AppendUint32(nil, seekTableMagic)
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(w.entries)+9))
+	table = append(table, w.entries...)
+	table = binary.LittleEndian.AppendUint32(table, w.frames)
+	table = append(table, 0) // Descriptor: no per-frame checksums
+	table = binary.LittleEndian.AppendUint32(table, seekableFooterMagic)
+	w.out = append(w.out, table...)
+	w.done = true
+	return nil
+}
+
+// frameReader decompresses consecutive frames, trimming the output to a range
+type frameReader struct {
+	src     io.Reader
+	decoder *zstd.Decoder
+	frames  []seekFrame
+	skip    int64 // Original bytes to drop from the first frame
+	remain  int64 // Original bytes still to return
+	out     []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.remain <= 0 || len(r.frames) == 0 {
+			return 0, io.EOF
+		}
+		frame := r.frames[0]
+		r.frames = r.frames[1:]
+
+		compressed := make([]byte, frame.storedSize)
+		if _, err := io.ReadFull(r.src, compressed); err != nil {
+			return 0, err
+		}
+		plain, err := r.decoder.DecodeAll(compressed, make([]byte, 0, frame.plainSize))
+		if err != nil {
+			return 0, err
+		}
+		plain = plain[min(r.skip, int64(len(plain))):]
+		r.skip = 0
+		if int64(len(plain)) > r.remain {
+			plain = plain[:r.remain]
+		}
+		r.remain -= int64(len(plain))
+		r.out = plain
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
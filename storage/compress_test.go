@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memSizes is a SizeStore kept in memory
+type memSizes struct {
+	mu    sync.Mutex
+	sizes map[string]OriginalSize
+}
+
+func (m *memSizes) LoadSizes(keys []string) (map[string]OriginalSize, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make(map[string]OriginalSize)
+	for _, key := range keys {
+		if size, ok := m.sizes[key]; ok {
+			sizes[key] = size
+		}
+	}
+	return sizes, nil
+}
+
+func (m *memSizes) SaveSize(key string, size OriginalSize) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sizes[key] = size
+	return nil
+}
+
+func (m *memSizes) MoveSizes(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, size := range m.sizes {
+		if key == src || strings.HasPrefix(key, src+"/") {
+			delete(m.sizes, key)
+			m.sizes[dst+strings.TrimPrefix(key, src)] = size
+		}
+	}
+	return nil
+}
+
+func (m *memSizes) DeleteSizes(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.sizes {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.sizes, k)
+		}
+	}
+	return nil
+}
+
+// countingDriver counts the reads made of the driver it wraps
+type countingDriver struct {
+	Driver
+	gets int
+}
+
+func (d *countingDriver) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	d.gets++
+	return d.Driver.Get(ctx, key, offset, length)
+}
+
+// newTestCompressed returns a driver compressing to a temporary local root
+func newTestCompressed(t *testing.T) (*Compressed, *countingDriver, *memSizes) {
+	t.Helper()
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &countingDriver{Driver: local}
+	sizes := &memSizes{sizes: make(map[string]OriginalSize)}
+	z, err := NewCompressed(inner, DefaultIncompressibleTypes, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z, inner, sizes
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	random := make([]byte, compressedFrameSize+1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name        string
+		content     []byte
+		contentType string
+		compressed  bool
+	}{
+		{name: "empty", content: []byte{}, compressed: true},
+		{name: "text", content: bytes.Repeat([]byte("hello world "), 1000), compressed: true},
+		{name: "several frames", content: bytes.Repeat([]byte("abcdefgh"), compressedFrameSize/3), compressed: true},
+		{name: "declared incompressible", content: random, contentType: "video/mp4"},
+		{name: "sniffed incompressible", content: append([]byte("\x89PNG\r\n\x1a\n"), random[:5000]...)},
+		{name: "starts with the header", content: append(append([]byte(nil), compressedHeader...), "plain"...), contentType: "image/png", compressed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, _, _ := newTestCompressed(t)
+			ctx := context.Background()
+			size := int64(len(tt.content))
+			info, err := z.Put(ctx, "f.bin", bytes.NewReader(tt.content), PutOptions{ContentType: tt.contentType})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != size {
+				t.Fatalf("Put reported %d bytes, want %d", info.Size, size)
+			}
+			raw := readObject(t, z.Unwrap(), "f.bin", 0, -1)
+			if got := bytes.HasPrefix(raw, compressedHeader); got != tt.compressed {
+				t.Fatalf("compressed %v, want %v", got, tt.compressed)
+			}
+			if info, err := z.Stat(ctx, "f.bin"); err != nil || info.Size != size {
+				t.Fatalf("Stat reported %d bytes, %v", info.Size, err)
+			}
+
+			for _, rg := range [][2]int64{{0, -1}, {3, 7}, {size / 2, -1}, {compressedFrameSize - 2, 4}, {size, 1}} {
+				offset, length := rg[0], rg[1]
+				want := tt.content[min(offset, size):]
+				if length >= 0 && length < int64(len(want)) {
+					want = want[:length]
+				}
+				if got := readObject(t, z, "f.bin", offset, length); !bytes.Equal(got, want) {
+					t.Fatalf("range %d+%d: got %d bytes, want %d", offset, length, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestCompressedPutChecksIngest(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 504)...)
+	tests := []struct {
+		name     string
+		content  []byte
+		limit    int64
+		expected string
+		want     error
+	}{
+		// Content ending with the read that crosses the limit, while filling the sniffed
+		// head or a whole frame
+		{name: "head over the limit", content: bytes.Repeat([]byte("a"), 512), limit: 100, want: ErrTooLarge},
+		{name: "incompressible head over the limit", content: png, limit: 100, want: ErrTooLarge},
+		{name: "frame over the limit", content: bytes.Repeat([]byte("a"), compressedFrameSize), limit: 1000, want: ErrTooLarge},
+		{name: "wrong digest", content: bytes.Repeat([]byte("a"), compressedFrameSize), expected: strings.Repeat("0", 64), want: ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, _, _ := newTestCompressed(t)
+			ctx := context.Background()
+			ingest := NewIngestReader(bytes.NewReader(tt.content), tt.limit, tt.expected)
+			if _, err := z.Put(ctx, "f.bin", ingest, PutOptions{}); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if Exists(ctx, z.Unwrap(), "f.bin") {
+				t.Fatal("rejected content was stored")
+			}
+		})
+	}
+}
+
+func TestCompressedSizes(t *testing.T) {
+	z, inner, sizes := newTestCompressed(t)
+	ctx := context.Background()
+	contents := map[string]string{"d/a.txt": strings.Repeat("a", 5000), "d/b.txt": "short", "d/c.txt": strings.Repeat("c", 100)}
+	for key, content := range contents {
+		if _, err := z.Put(ctx, key, strings.NewReader(content), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Objects written before sizes were recorded have their seek table read once
+	sizes.DeleteSizes("d/c.txt")
+	// An object replaced behind the driver's back no longer matches its recorded size
+	if _, err := z.Unwrap().Put(ctx, "d/b.txt", strings.NewReader("replaced as-is"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	contents["d/b.txt"] = "replaced as-is"
+
+	for _, wantGets := range []int{3, 0} {
+		inner.gets = 0
+		infos, err := z.List(ctx, "d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if want := int64(len(contents[info.Key])); info.Size != want {
+				t.Fatalf("%s: listed %d bytes, want %d", info.Key, info.Size, want)
+			}
+		}
+		if inner.gets != wantGets {
+			t.Fatalf("listing made %d reads, want %d", inner.gets, wantGets)
+		}
+	}
+
+	if err := z.Move(ctx, "d/a.txt", "d/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	inner.gets = 0
+	if info, err := z.Stat(ctx, "d/b.txt"); err != nil || info.Size != 5000 || inner.gets != 0 {
+		t.Fatalf("Stat after a move reported %d bytes with %d reads, %v", info.Size, inner.gets, err)
+	}
+	if err := z.Delete(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes.sizes) != 0 {
+		t.Fatalf("left %d sizes behind", len(sizes.sizes))
+	}
+}
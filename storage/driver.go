@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"teltech/config"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in storage
+var ErrNotFound = errors.New("object not found")
+
+// Info describes a stored object or folder
+type Info struct {
+	Key        string    // Slash-separated key relative to the storage root
+	Size       int64     // Content size in bytes
+	StoredSize int64     // Bytes the content occupies in the backend after compression and encryption
+	ModTime    time.Time // Last modification time
+	IsDir      bool      // Whether the key is a folder
+}
+
+// PutOptions controls how Put stores an object
+type PutOptions struct {
+	NoOverwrite bool   // Fail with ErrExists instead of replacing an existing object
+	ContentType string // MIME type of the content, if known
+}
+
+// Driver stores file contents under slash-separated keys relative to its root. Folders
+// are keys ending in "/" when created with Put and are reported with IsDir set.
+type Driver interface {
+	// Put stores the content read from r under key. The object only becomes visible once
+	// r has been read to a clean EOF, so a failed read never leaves partial content.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (Info, error)
+	// Get reads length bytes of the object starting at offset; a negative length reads to the end
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat describes the object or folder at key
+	Stat(ctx context.Context, key string) (Info, error)
+	// List describes the immediate children of the folder at key
+	List(ctx context.Context, key string) ([]Info, error)
+	// Move renames an object or a whole folder
+	Move(ctx context.Context, src, dst string) error
+	// Delete removes an object or a whole folder; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	defaultDriver Driver
+	root          string
+	masterKeys    *MasterKeys
+	replicated    *Replicated
+)
+
+// Init opens the driver selected by STORAGE_DRIVER, replicates it across
+// STORAGE_REPLICA_ROOTS when set, adds encryption at rest when ENCRYPTION_ENABLED is set
+// and compression when COMPRESSION_ENABLED is set, and makes the result the default
+// driver. File and folder paths in the database are rooted at PARENT_FOLDER whichever
+// driver is used.
+func Init(keys KeyStore, sums SumStore, sizes SizeStore) error {
+	root = filepath.Clean(config.String("PARENT_FOLDER", "./data"))
+	replicated = nil
+
+	var err error
+	switch driver := config.String("STORAGE_DRIVER", "local"); driver {
+	case "local":
+		if extra := config.List("STORAGE_REPLICA_ROOTS"); len(extra) > 0 {
+			roots := append([]string{root}, extra...)
+			replicated, err = NewReplicated(roots, int(config.Int64("STORAGE_REPLICAS", 0)), sums)
+			defaultDriver = replicated
+		} else {
+			defaultDriver, err = NewLocal(root)
+		}
+	case "s3":
+		defaultDriver, err = NewS3(S3Config{
+			Endpoint:  config.String("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:    config.String("S3_REGION", "us-east-1"),
+			Bucket:    config.String("S3_BUCKET", ""),
+			Prefix:    config.String("S3_PREFIX", ""),
+			AccessKey: config.String("S3_ACCESS_KEY", ""),
+			SecretKey: config.String("S3_SECRET_KEY", ""),
+			PathStyle: config.Bool("S3_PATH_STYLE", true),
+			PartSize:  config.Int64("S3_PART_SIZE", 16<<20),
+		})
+	default:
+		err = fmt.Errorf("unknown storage driver %q", driver)
+	}
+	if err != nil {
+		return err
+	}
+
+	if config.Bool("ENCRYPTION_ENABLED", false) {
+		masterKeys, err = LoadMasterKeys(
+			config.String("ENCRYPTION_MASTER_KEY", ""),
+			config.String("ENCRYPTION_KEYFILE", ""),
+			config.String("ENCRYPTION_ACTIVE_KEY", ""),
+		)
+		if err != nil {
+			return err
+		}
+		defaultDriver = NewEncrypted(defaultDriver, masterKeys, keys)
+	}
+
+	// Compress before encrypting, since ciphertext does not compress
+	if config.Bool("COMPRESSION_ENABLED", false) {
+		skip := append(DefaultIncompressibleTypes, config.List("COMPRESSION_SKIP_TYPES")...)
+		defaultDriver, err = NewCompressed(defaultDriver, skip, sizes)
+	}
+	return err
+}
+
+// Master returns the master keys when encryption at rest is enabled, or nil
+func Master() *MasterKeys {
+	return masterKeys
+}
+
+// Replicas returns the replicated driver when STORAGE_REPLICA_ROOTS is set, or nil
+func Replicas() *Replicated {
+	return replicated
+}
+
+// Default returns the driver opened by Init
+func Default() Driver {
+	return defaultDriver
+}
+
+// Root returns the path that file and folder paths in the database are rooted at
+func Root() string {
+	return root
+}
+
+// KeyOf converts a path rooted at Root into a storage key, rejecting paths outside the root
+func KeyOf(p string) (string, error) {
+	rel, err := filepath.Rel(root, filepath.Clean(p))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the storage root", p)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// PathOf converts a storage key into a path rooted at Root
+func PathOf(key string) string {
+	return filepath.Join(root, filepath.FromSlash(key))
+}
+
+// cleanKey normalises a key and strips anything that would escape the root
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// MkdirAll creates the folder at key along with any missing parents
+func MkdirAll(ctx context.Context, d Driver, key string) error {
+	_, err := d.Put(ctx, strings.TrimSuffix(key, "/")+"/", strings.NewReader(""), PutOptions{})
+	return err
+}
+
+// Exists reports whether an object or folder exists at key
+func Exists(ctx context.Context, d Driver, key string) bool {
+	_, err := d.Stat(ctx, key)
+	return err == nil
+}
+
+// Walk calls fn for every object and folder below the folder at key, parents before children
+func Walk(ctx context.Context, d Driver, key string, fn func(Info) error) error {
+	children, err := d.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := fn(child); err != nil {
+			return err
+		}
+		if child.IsDir {
+			if err := Walk(ctx, d, child.Key, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LocalPath returns the file system path of key when d keeps its data on local disk
+func LocalPath(d Driver, key string) (string, bool) {
+	for d != nil {
+		if local, ok := d.(*Local); ok {
+			return local.path(key), true
+		}
+		if replicas, ok := d.(*Replicated); ok {
+			d = replicas.holder(context.Background(), key)
+			continue
+		}
+		unwrapper, ok := d.(interface{ Unwrap() Driver })
+		if !ok {
+			break
+		}
+		d = unwrapper.Unwrap()
+	}
+	return "", false
+}
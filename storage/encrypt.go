@@ -0,0 +1,558 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// encryptedChunkSize is the amount of plaintext sealed per AES-GCM chunk. Chunks are
+// sealed independently so range reads only decrypt the chunks they touch.
+const encryptedChunkSize = 64 << 10
+
+// keyHeaderMagic starts the header of an encrypted object, which names the data key the
+// object was written with. Objects written before keys were named have no header.
+var keyHeaderMagic = []byte("TTK1")
+
+// keyHeaderSize is the size of the header: the magic followed by the raw data key ID
+const keyHeaderSize = 4 + 16
+
+// WrappedKey is a per-object data key encrypted under a master key
+type WrappedKey struct {
+	ID          string // Hex ID in the header of the object the key encrypts, empty for objects without a header
+	MasterKeyID string
+	Key         []byte // Nonce followed by the sealed data key
+}
+
+// KeyStore persists the wrapped data keys of encrypted objects. An object has one data
+// key, except while it is overwritten or moved onto, when the key of its new content is
+// stored ahead of the content and the object's header tells the two apart. Objects
+// without a stored key are treated as plaintext written before encryption was enabled.
+type KeyStore interface {
+	LoadKeys(key string) ([]WrappedKey, error)    // Returns ErrNotFound for plaintext objects
+	SaveKey(key string, wrapped WrappedKey) error // Adds a data key of the object at key, keeping the others
+	DeleteKey(key, id string) error               // Deletes one data key of the object at key
+	MoveKeys(src, dst string) error               // Moves the keys of an object or of every object below a folder
+	DeleteKeys(key string) error                  // Deletes the keys of an object or of every object below a folder
+}
+
+// MasterKeys holds the key-encryption keys. New data keys are wrapped with the active
+// key; the others are kept so existing data keys can still be unwrapped until rotated.
+type MasterKeys struct {
+	Active string
+	keys   map[string][]byte
+}
+
+// LoadMasterKeys reads the master keys from ENCRYPTION_KEYFILE, or the single key in
+// ENCRYPTION_MASTER_KEY. The keyfile holds one "id:base64-key" per line; the active key
+// is ENCRYPTION_ACTIVE_KEY or, when unset, the last one listed.
+func LoadMasterKeys(masterKey, keyFile, active string) (*MasterKeys, error) {
+	keys := &MasterKeys{keys: map[string][]byte{}}
+
+	if masterKey != "" {
+		if err := keys.add("default", masterKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			id, encoded, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed keyfile line %q", line)
+			}
+			if err := keys.add(strings.TrimSpace(id), strings.TrimSpace(encoded)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if active != "" {
+		keys.Active = active
+	}
+	if _, ok := keys.keys[keys.Active]; !ok {
+		return nil, errors.New("no active master key configured")
+	}
+	return keys, nil
+}
+
+// add registers a base64-encoded 256-bit master key and makes it the active one
+func (m *MasterKeys) add(id, encoded string) error {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 32 {
+		return fmt.Errorf("master key %q must be 32 bytes of base64", id)
+	}
+	m.keys[id] = raw
+	m.Active = id
+	return nil
+}
+
+// Wrap seals a data key under the active master key
+func (m *MasterKeys) Wrap(dataKey []byte) (WrappedKey, error) {
+	aead, err := newGCM(m.keys[m.Active])
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return WrappedKey{}, err
+	}
+	return WrappedKey{MasterKeyID: m.Active, Key: aead.Seal(nonce, nonce, dataKey, []byte(m.Active))}, nil
+}
+
+// Unwrap opens a data key sealed by Wrap
+func (m *MasterKeys) Unwrap(wrapped WrappedKey) ([]byte, error) {
+	masterKey, ok := m.keys[wrapped.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", wrapped.MasterKeyID)
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped.Key) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is truncated")
+	}
+	nonce, sealed := wrapped.Key[:aead.NonceSize()], wrapped.Key[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(wrapped.MasterKeyID))
+}
+
+// Rewrap re-seals a data key under the active master key
+func (m *MasterKeys) Rewrap(wrapped WrappedKey) (WrappedKey, error) {
+	dataKey, err := m.Unwrap(wrapped)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	rewrapped, err := m.Wrap(dataKey)
+	rewrapped.ID = wrapped.ID
+	return rewrapped, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted wraps a driver so object contents are encrypted at rest. Every object gets
+// its own random data key, wrapped by a master key and kept in a KeyStore. Content is
+// sealed in fixed-size AES-GCM chunks so ranges can be read without decrypting the
+// whole object.
+type Encrypted struct {
+	inner  Driver
+	master *MasterKeys
+	keys   KeyStore
+}
+
+// NewEncrypted returns a driver encrypting the objects it writes to inner
+func NewEncrypted(inner Driver, master *MasterKeys, keys KeyStore) *Encrypted {
+	return &Encrypted{inner: inner, master: master, keys: keys}
+}
+
+// Unwrap returns the driver holding the ciphertext
+func (e *Encrypted) Unwrap() Driver {
+	return e.inner
+}
+
+// Put encrypts the content under a fresh data key, named in the object's header. The
+// key is recorded before the object is written and the key of any content it replaces
+// dropped only after, so whichever content a reader finds, its key is there.
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (Info, error) {
+	if strings.HasSuffix(key, "/") {
+		return e.inner.Put(ctx, key, r, opts)
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Info{}, err
+	}
+	wrapped, err := e.master.Wrap(dataKey)
+	if err != nil {
+		return Info{}, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return Info{}, err
+	}
+	header := make([]byte, keyHeaderSize)
+	copy(header, keyHeaderMagic)
+	if _, err := rand.Read(header[len(keyHeaderMagic):]); err != nil {
+		return Info{}, err
+	}
+	wrapped.ID = hex.EncodeToString(header[len(keyHeaderMagic):])
+
+	name := cleanKey(key)
+	replaced, err := e.keys.LoadKeys(name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Info{}, err
+	}
+	if err := e.keys.SaveKey(name, wrapped); err != nil {
+		return Info{}, err
+	}
+
+	sealer := &chunkSealer{src: r, aead: aead, buf: make([]byte, encryptedChunkSize)}
+	info, err := e.inner.Put(ctx, key, io.MultiReader(bytes.NewReader(header), sealer), opts)
+	if err != nil {
+		e.keys.DeleteKey(name, wrapped.ID)
+		return Info{}, err
+	}
+	e.dropKeys(name, replaced)
+	info.Size = sealer.plaintext
+	return info, nil
+}
+
+// Get decrypts the chunks covering the requested range
+func (e *Encrypted) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	wrapped, headerSize, err := e.objectKey(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return e.inner.Get(ctx, key, offset, length) // Plaintext written before encryption was enabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.dataCipher(*wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := e.inner.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	chunks := encryptedChunkCount(info.Size - headerSize)
+	size := info.Size - headerSize - chunks*int64(aead.Overhead())
+	if offset >= size || length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+
+	first := offset / encryptedChunkSize
+	last := (offset + length - 1) / encryptedChunkSize
+	sealedChunk := int64(encryptedChunkSize + aead.Overhead())
+	body, err := e.inner.Get(ctx, key, headerSize+first*sealedChunk, (last-first+1)*sealedChunk)
+	if err != nil {
+		return nil, err
+	}
+
+	opener := &chunkOpener{
+		src:    body,
+		aead:   aead,
+		index:  first,
+		final:  chunks - 1,
+		skip:   offset - first*encryptedChunkSize,
+		remain: length,
+		sealed: make([]byte, sealedChunk),
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{opener, body}, nil
+}
+
+// Stat reports the plaintext size of encrypted objects
+func (e *Encrypted) Stat(ctx context.Context, key string) (Info, error) {
+	info, err := e.inner.Stat(ctx, key)
+	if err != nil || info.IsDir {
+		return info, err
+	}
+	return e.plaintextInfo(ctx, info), nil
+}
+
+// List reports the plaintext size of encrypted objects
+func (e *Encrypted) List(ctx context.Context, key string) ([]Info, error) {
+	infos, err := e.inner.List(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for i, info := range infos {
+		if !info.IsDir {
+			infos[i] = e.plaintextInfo(ctx, info)
+		}
+	}
+	return infos, nil
+}
+
+// plaintextInfo converts the ciphertext size in info to the plaintext size
+func (e *Encrypted) plaintextInfo(ctx context.Context, info Info) Info {
+	if _, headerSize, err := e.objectKey(ctx, info.Key); err == nil {
+		info.Size -= headerSize
+		info.Size -= encryptedChunkCount(info.Size) * 16 // AES-GCM tag per chunk
+	}
+	return info
+}
+
+// Move renames the object or folder and its data keys. The keys of an object are copied
+// to dst before the object moves onto whatever is there, and the rest dropped after, as
+// Put does.
+func (e *Encrypted) Move(ctx context.Context, src, dst string) error {
+	info, err := e.inner.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		if err := e.inner.Move(ctx, src, dst); err != nil {
+			return err
+		}
+		return e.keys.MoveKeys(cleanKey(src), cleanKey(dst))
+	}
+
+	from, to := cleanKey(src), cleanKey(dst)
+	moving, err := e.keys.LoadKeys(from)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	replaced, err := e.keys.LoadKeys(to)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	for _, wrapped := range moving {
+		if err := e.keys.SaveKey(to, wrapped); err != nil {
+			return err
+		}
+	}
+	if err := e.inner.Move(ctx, src, dst); err != nil {
+		for _, wrapped := range moving {
+			e.keys.DeleteKey(to, wrapped.ID)
+		}
+		return err
+	}
+	e.dropKeys(to, replaced)
+	return e.keys.DeleteKeys(from)
+}
+
+// Delete removes the object or folder and its data keys
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	if err := e.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	return e.keys.DeleteKeys(cleanKey(key))
+}
+
+// objectKey returns the data key of the object at key and the size of the header naming
+// it. When the object has more than one key, because it is being overwritten, the header
+// is read to tell which one its current content was written with.
+func (e *Encrypted) objectKey(ctx context.Context, key string) (*WrappedKey, int64, error) {
+	keys, err := e.keys.LoadKeys(cleanKey(key))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(keys) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	if len(keys) == 1 {
+		if keys[0].ID == "" {
+			return &keys[0], 0, nil
+		}
+		return &keys[0], keyHeaderSize, nil
+	}
+
+	id, err := e.headerKeyID(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	var unnamed *WrappedKey
+	for i := range keys {
+		if id != "" && keys[i].ID == id {
+			return &keys[i], keyHeaderSize, nil
+		}
+		if keys[i].ID == "" {
+			unnamed = &keys[i]
+		}
+	}
+	if unnamed != nil {
+		return unnamed, 0, nil
+	}
+	return nil, 0, fmt.Errorf("no data key for %s matches its header", key)
+}
+
+// headerKeyID returns the data key ID in the header of the object at key, or "" when the
+// object has no header
+func (e *Encrypted) headerKeyID(ctx context.Context, key string) (string, error) {
+	rc, err := e.inner.Get(ctx, key, 0, keyHeaderSize)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	header := make([]byte, keyHeaderSize)
+	if _, err := io.ReadFull(rc, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", nil
+		}
+		return "", err
+	}
+	if !bytes.Equal(header[:len(keyHeaderMagic)], keyHeaderMagic) {
+		return "", nil
+	}
+	return hex.EncodeToString(header[len(keyHeaderMagic):]), nil
+}
+
+// dropKeys deletes the data keys of content that was replaced at key. Failures only
+// leave an unused key behind.
+func (e *Encrypted) dropKeys(key string, replaced []WrappedKey) {
+	for _, wrapped := range replaced {
+		if err := e.keys.DeleteKey(key, wrapped.ID); err != nil {
+			log.Printf("Failed to delete a replaced data key of %s: %v", key, err)
+		}
+	}
+}
+
+// dataCipher unwraps a data key
+func (e *Encrypted) dataCipher(wrapped WrappedKey) (cipher.AEAD, error) {
+	dataKey, err := e.master.Unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+// encryptedChunkCount returns how many sealed chunks an object of the given ciphertext
+// size holds. Empty content is still sealed as one empty chunk.
+func encryptedChunkCount(sealedSize int64) int64 {
+	sealedChunk := int64(encryptedChunkSize + 16)
+	return max((sealedSize+sealedChunk-1)/sealedChunk, 1)
+}
+
+// chunkNonce derives the nonce of a chunk. Data keys are never reused, so the chunk
+// index alone makes nonces unique.
+func chunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+// chunkAAD binds a chunk to its position and marks the final chunk, so chunks cannot be
+// reordered and truncation is detected
+func chunkAAD(index int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// chunkSealer encrypts its source chunk by chunk. It reads one chunk ahead so it knows
+// which chunk is the final one.
+type chunkSealer struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	buf       []byte // Next plaintext chunk
+	filled    int    // Bytes of buf holding plaintext
+	out       []byte // Sealed bytes not yet returned
+	index     int64
+	plaintext int64
+	started   bool
+	done      bool
+}
+
+func (s *chunkSealer) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// sealNext seals the buffered chunk once it knows whether more content follows
+func (s *chunkSealer) sealNext() error {
+	if !s.started {
+		s.started = true
+		n, err := io.ReadFull(s.src, s.buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		s.filled = n
+	}
+
+	next := make([]byte, encryptedChunkSize)
+	n, err := io.ReadFull(s.src, next)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := n == 0
+
+	s.out = s.aead.Seal(nil, chunkNonce(s.index), s.buf[:s.filled], chunkAAD(s.index, final))
+	s.plaintext += int64(s.filled)
+	s.index++
+	s.buf, s.filled = next, n
+	s.done = final
+	return nil
+}
+
+// chunkOpener decrypts consecutive sealed chunks, trimming the output to a range
+type chunkOpener struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	index  int64 // Index of the next chunk
+	final  int64 // Index of the object's last chunk
+	skip   int64 // Plaintext bytes to drop from the first chunk
+	remain int64 // Plaintext bytes still to return
+	sealed []byte
+	out    []byte
+}
+
+func (o *chunkOpener) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.remain <= 0 {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(o.src, o.sealed)
+		if err == io.EOF || (err != nil && err != io.ErrUnexpectedEOF) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, err := o.aead.Open(nil, chunkNonce(o.index), o.sealed[:n], chunkAAD(o.index, o.index == o.final))
+		if err != nil {
+			return 0, fmt.Errorf("decrypting chunk %d: %w", o.index, err)
+		}
+		o.index++
+		plain = plain[min(o.skip, int64(len(plain))):]
+		o.skip = 0
+		if int64(len(plain)) > o.remain {
+			plain = plain[:o.remain]
+		}
+		o.remain -= int64(len(plain))
+		o.out = plain
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memKeys is a KeyStore kept in memory
+type memKeys struct {
+	mu      sync.Mutex
+	keys    map[string][]WrappedKey
+	saveErr error // Returned by SaveKey when set
+}
+
+func (m *memKeys) LoadKeys(key string) ([]WrappedKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.keys[key]) == 0 {
+		return nil, ErrNotFound
+	}
+	return append([]WrappedKey(nil), m.keys[key]...), nil
+}
+
+func (m *memKeys) SaveKey(key string, wrapped WrappedKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.saveErr != nil {
+		return m.saveErr
+	}
+	m.keys[key] = append(m.keys[key], wrapped)
+	return nil
+}
+
+func (m *memKeys) DeleteKey(key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.keys[key][:0]
+	for _, wrapped := range m.keys[key] {
+		if wrapped.ID != id {
+			kept = append(kept, wrapped)
+		}
+	}
+	m.keys[key] = kept
+	return nil
+}
+
+func (m *memKeys) MoveKeys(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, keys := range m.keys {
+		if key == src || strings.HasPrefix(key, src+"/") {
+			delete(m.keys, key)
+			m.keys[dst+strings.TrimPrefix(key, src)] = keys
+		}
+	}
+	return nil
+}
+
+func (m *memKeys) DeleteKeys(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.keys {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.keys, k)
+		}
+	}
+	return nil
+}
+
+// newTestEncrypted returns a driver encrypting to a temporary local root
+func newTestEncrypted(t *testing.T) (*Encrypted, *memKeys) {
+	t.Helper()
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := LoadMasterKeys(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &memKeys{keys: make(map[string][]WrappedKey)}
+	return NewEncrypted(local, master, keys), keys
+}
+
+// readHook calls fn on the first read, before returning the content of r
+type readHook struct {
+	r    io.Reader
+	fn   func()
+	done bool
+}
+
+func (h *readHook) Read(p []byte) (int, error) {
+	if !h.done {
+		h.done = true
+		h.fn()
+	}
+	return h.r.Read(p)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 100}
+	for _, size := range sizes {
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+		e, _ := newTestEncrypted(t)
+		ctx := context.Background()
+
+		info, err := e.Put(ctx, "a/b.bin", bytes.NewReader(content), PutOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(size) {
+			t.Fatalf("size %d: Put reported %d bytes", size, info.Size)
+		}
+		if info, err := e.Stat(ctx, "a/b.bin"); err != nil || info.Size != int64(size) {
+			t.Fatalf("size %d: Stat reported %d bytes, %v", size, info.Size, err)
+		}
+		if infos, err := e.List(ctx, "a/"); err != nil || len(infos) != 1 || infos[0].Size != int64(size) {
+			t.Fatalf("size %d: List reported %+v, %v", size, infos, err)
+		}
+		raw := readObject(t, e.Unwrap(), "a/b.bin", 0, -1)
+		// A byte or two of content may well turn up in random ciphertext
+		if size >= 16 && bytes.Contains(raw, content) {
+			t.Fatalf("size %d: content is stored in the clear", size)
+		}
+
+		ranges := [][2]int64{{0, -1}, {0, 1}, {1, 10}, {encryptedChunkSize - 3, 6}, {int64(size) / 2, -1}, {int64(size), 5}}
+		for _, rg := range ranges {
+			offset, length := rg[0], rg[1]
+			want := content[min(offset, int64(size)):]
+			if length >= 0 && length < int64(len(want)) {
+				want = want[:length]
+			}
+			if got := readObject(t, e, "a/b.bin", offset, length); !bytes.Equal(got, want) {
+				t.Fatalf("size %d, range %d+%d: got %d bytes, want %d", size, offset, length, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestEncryptedPutChecksIngest(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		limit    int64
+		expected string
+		want     error
+	}{
+		// Content filling whole chunks ends with the read that crosses the limit
+		{name: "one chunk over the limit", size: encryptedChunkSize, limit: 1000, want: ErrTooLarge},
+		{name: "chunks just over the limit", size: 4 * encryptedChunkSize, limit: 4*encryptedChunkSize - 1, want: ErrTooLarge},
+		{name: "wrong digest", size: 2 * encryptedChunkSize, expected: strings.Repeat("0", 64), want: ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestEncrypted(t)
+			ctx := context.Background()
+			ingest := NewIngestReader(bytes.NewReader(make([]byte, tt.size)), tt.limit, tt.expected)
+			if _, err := e.Put(ctx, "a.bin", ingest, PutOptions{}); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if Exists(ctx, e.Unwrap(), "a.bin") {
+				t.Fatal("rejected content was stored")
+			}
+		})
+	}
+}
+
+func TestEncryptedOverwrite(t *testing.T) {
+	ctx := context.Background()
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		content func(e *Encrypted, keys *memKeys, t *testing.T) io.Reader
+		wantErr bool
+	}{
+		{
+			name: "replaced",
+			content: func(e *Encrypted, _ *memKeys, t *testing.T) io.Reader {
+				// Until the new content is in place, the old content still reads back
+				return &readHook{r: strings.NewReader("new"), fn: func() {
+					if got := readObject(t, e, "f.txt", 0, -1); string(got) != "old" {
+						t.Errorf("read %q while overwriting", got)
+					}
+				}}
+			},
+		},
+		{
+			name: "content read fails",
+			content: func(*Encrypted, *memKeys, *testing.T) io.Reader {
+				return &failingReader{n: 10}
+			},
+			wantErr: true,
+		},
+		{
+			name: "key save fails",
+			content: func(_ *Encrypted, keys *memKeys, _ *testing.T) io.Reader {
+				keys.saveErr = failed
+				return strings.NewReader("new")
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, keys := newTestEncrypted(t)
+			if _, err := e.Put(ctx, "f.txt", strings.NewReader("old"), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := e.Put(ctx, "f.txt", tt.content(e, keys, t), PutOptions{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			want := "new"
+			if tt.wantErr {
+				want = "old"
+			}
+			if got := readObject(t, e, "f.txt", 0, -1); string(got) != want {
+				t.Fatalf("read %q, want %q", got, want)
+			}
+			if n := len(keys.keys["f.txt"]); n != 1 {
+				t.Fatalf("left %d data keys", n)
+			}
+		})
+	}
+}
+
+func TestEncryptedMove(t *testing.T) {
+	e, keys := newTestEncrypted(t)
+	ctx := context.Background()
+	for key, content := range map[string]string{"a.txt": "moved", "b.txt": "replaced", "d/c.txt": "in folder"} {
+		if _, err := e.Put(ctx, key, strings.NewReader(content), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := e.Move(ctx, "a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, e, "b.txt", 0, -1); string(got) != "moved" {
+		t.Fatalf("read %q after moving onto an object", got)
+	}
+	if len(keys.keys["a.txt"]) != 0 || len(keys.keys["b.txt"]) != 1 {
+		t.Fatalf("left %d keys at the source and %d at the target", len(keys.keys["a.txt"]), len(keys.keys["b.txt"]))
+	}
+
+	if err := e.Move(ctx, "d", "e"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, e, "e/c.txt", 0, -1); string(got) != "in folder" {
+		t.Fatalf("read %q after moving a folder", got)
+	}
+}
+
+func TestEncryptedUnnamedObjects(t *testing.T) {
+	e, keys := newTestEncrypted(t)
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("legacy "), encryptedChunkSize/5)
+
+	// Plaintext written before encryption was enabled
+	if _, err := e.Unwrap().Put(ctx, "plain.txt", strings.NewReader("plain"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, e, "plain.txt", 1, 3); string(got) != "lai" {
+		t.Fatalf("read %q from a plaintext object", got)
+	}
+
+	// Ciphertext written before data keys were named in a header
+	dataKey := bytes.Repeat([]byte{9}, 32)
+	wrapped, err := e.master.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := newGCM(dataKey)
+	sealer := &chunkSealer{src: bytes.NewReader(content), aead: aead, buf: make([]byte, encryptedChunkSize)}
+	if _, err := e.Unwrap().Put(ctx, "old.txt", sealer, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	keys.SaveKey("old.txt", wrapped)
+
+	if info, err := e.Stat(ctx, "old.txt"); err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("Stat reported %d bytes, %v", info.Size, err)
+	}
+	if got := readObject(t, e, "old.txt", encryptedChunkSize-2, 4); !bytes.Equal(got, content[encryptedChunkSize-2:encryptedChunkSize+2]) {
+		t.Fatalf("read %q from an object without a header", got)
+	}
+
+	// Overwriting it reads the old content until the new one is in place
+	r := &readHook{r: strings.NewReader("new"), fn: func() {
+		if got := readObject(t, e, "old.txt", 0, -1); !bytes.Equal(got, content) {
+			t.Errorf("read %d other bytes while overwriting", len(got))
+		}
+	}}
+	if _, err := e.Put(ctx, "old.txt", r, PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, e, "old.txt", 0, -1); string(got) != "new" {
+		t.Fatalf("read %q after overwriting", got)
+	}
+}
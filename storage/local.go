@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Local stores objects as plain files below a directory on the local file system
+type Local struct {
+	root string
+}
+
+// NewLocal returns a driver storing objects below dir, creating it if needed
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{root: dir}, nil
+}
+
+// path returns the file system path of key
+func (l *Local) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(cleanKey(key)))
+}
+
+// Put writes the content to a synced temporary file next to its destination and moves
+// it into place once r has been read completely
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (Info, error) {
+	if strings.HasSuffix(key, "/") {
+		dir := l.path(key)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return Info{}, err
+		}
+		return l.Stat(ctx, key)
+	}
+
+	target := l.path(key)
+	tmp, _, err := writeTemp(filepath.Dir(target), r)
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp) // No-op once the file has been moved into place
+
+	if err := commit(tmp, target, opts.NoOverwrite); err != nil {
+		return Info{}, err
+	}
+	return l.Stat(ctx, key)
+}
+
+// Get opens the file at key positioned at offset
+func (l *Local) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, mapNotExist(err)
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Stat describes the file or directory at key
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	fi, err := os.Stat(l.path(key))
+	if err != nil {
+		return Info{}, mapNotExist(err)
+	}
+	return Info{Key: strings.TrimSuffix(cleanKey(key), "/"), Size: fi.Size(), StoredSize: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}, nil
+}
+
+// List describes the entries of the directory at key, skipping in-flight uploads
+func (l *Local) List(ctx context.Context, key string) ([]Info, error) {
+	entries, err := os.ReadDir(l.path(key))
+	if err != nil {
+		return nil, mapNotExist(err)
+	}
+
+	prefix := cleanKey(key)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	infos := []Info{}
+	for _, entry := range entries {
+		if IsTempName(entry.Name()) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue // Removed while listing
+		}
+		infos = append(infos, Info{Key: prefix + entry.Name(), Size: fi.Size(), StoredSize: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Move renames the file or directory at src
+func (l *Local) Move(ctx context.Context, src, dst string) error {
+	target := l.path(dst)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return mapNotExist(os.Rename(l.path(src), target))
+}
+
+// Delete removes the file or directory tree at key
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if cleanKey(key) == "" {
+		return os.ErrInvalid // Never remove the root itself
+	}
+	return os.RemoveAll(l.path(key))
+}
+
+// mapNotExist translates file system not-exist errors into ErrNotFound
+func mapNotExist(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// IsTempName reports whether name is a temporary file created by an in-flight upload
+func IsTempName(name string) bool {
+	return strings.HasPrefix(name, ".upload-") && strings.HasSuffix(name, ".tmp")
+}
+
+// writeTemp streams r into a synced temporary file in dir and returns its path. The
+// caller must either commit or remove it.
+func writeTemp(dir string, r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", n, err
+	}
+	return tmp.Name(), n, nil
+}
+
+// commit moves a temporary file written by writeTemp to target. With noClobber set it
+// fails with ErrExists instead of replacing an existing file.
+func commit(tmp, target string, noClobber bool) error {
+	if !noClobber {
+		return os.Rename(tmp, target)
+	}
+
+	// A hard link fails atomically if the target exists, unlike rename
+	if err := os.Link(tmp, target); err != nil {
+		if os.IsExist(err) {
+			return ErrExists
+		}
+		return err
+	}
+	return os.Remove(tmp)
+}
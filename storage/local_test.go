@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readObject reads length bytes of key from offset through d
+func readObject(t *testing.T, d Driver, key string, offset, length int64) []byte {
+	t.Helper()
+	rc, err := d.Get(context.Background(), key, offset, length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLocalPutGet(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		offset, length int64
+		want           string
+	}{
+		{name: "empty", content: "", length: -1, want: ""},
+		{name: "whole", content: "hello world", length: -1, want: "hello world"},
+		{name: "range", content: "hello world", offset: 6, length: 3, want: "wor"},
+		{name: "tail", content: "hello world", offset: 6, length: -1, want: "world"},
+		{name: "past the end", content: "hello", offset: 3, length: 10, want: "lo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLocal(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			info, err := l.Put(ctx, "a/b/c.txt", strings.NewReader(tt.content), PutOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Key != "a/b/c.txt" || info.Size != int64(len(tt.content)) || info.IsDir {
+				t.Fatalf("Put reported %+v", info)
+			}
+			if got := readObject(t, l, "a/b/c.txt", tt.offset, tt.length); string(got) != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalPutFailures(t *testing.T) {
+	root := t.TempDir()
+	l, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := l.Put(ctx, "a.txt", strings.NewReader("old"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Put(ctx, "a.txt", strings.NewReader("new"), PutOptions{NoOverwrite: true}); !errors.Is(err, ErrExists) {
+		t.Fatalf("got error %v, want ErrExists", err)
+	}
+	if _, err := l.Put(ctx, "a.txt", &failingReader{n: 10}, PutOptions{}); err == nil {
+		t.Fatal("Put succeeded on a failed read")
+	}
+	if got := readObject(t, l, "a.txt", 0, -1); string(got) != "old" {
+		t.Fatalf("got %q after failed writes", got)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 1 {
+		t.Fatalf("left %d entries in the root", len(entries))
+	}
+}
+
+func TestLocalTree(t *testing.T) {
+	root := t.TempDir()
+	l, err := NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"d/", "d/b.txt", "d/a.txt", "d/sub/c.txt"} {
+		if _, err := l.Put(ctx, key, strings.NewReader(key), PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// In-flight uploads are not listed
+	os.WriteFile(filepath.Join(root, "d", ".upload-1.tmp"), nil, 0644)
+
+	infos, err := l.List(ctx, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	if strings.Join(keys, ",") != "d/a.txt,d/b.txt,d/sub" || !infos[2].IsDir {
+		t.Fatalf("listed %v", keys)
+	}
+
+	if err := l.Move(ctx, "d", "e/f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, l, "e/f/sub/c.txt", 0, -1); string(got) != "d/sub/c.txt" {
+		t.Fatalf("got %q after moving", got)
+	}
+	if _, err := l.Stat(ctx, "d"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat of a moved folder: %v", err)
+	}
+
+	if err := l.Delete(ctx, "e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete(ctx, "e"); err != nil {
+		t.Fatalf("deleting a missing key: %v", err)
+	}
+	if err := l.Delete(ctx, ""); err == nil {
+		t.Fatal("deleted the root")
+	}
+	if _, err := l.Get(ctx, "e/f/a.txt", 0, -1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after deleting: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// ReaderAt reads a stored object at arbitrary offsets. Reads are served from aligned
+// blocks fetched whole, since formats such as ZIP are read in many small pieces.
+type ReaderAt struct {
+	ctx    context.Context
+	driver Driver
+	key    string
+	start  int64  // Offset of the cached block
+	block  []byte // Cached block
+}
+
+// readAtBlockSize is how much ReaderAt fetches at once
+const readAtBlockSize = 1 << 20
+
+// NewReaderAt returns a ReaderAt for the object at key
+func NewReaderAt(ctx context.Context, d Driver, key string) *ReaderAt {
+	return &ReaderAt{ctx: ctx, driver: d, key: key}
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < r.start || pos >= r.start+int64(len(r.block)) {
+			if err := r.fetch(pos - pos%readAtBlockSize); err != nil {
+				return n, err
+			}
+			if pos >= r.start+int64(len(r.block)) {
+				return n, io.EOF
+			}
+		}
+		n += copy(p[n:], r.block[pos-r.start:])
+	}
+	return n, nil
+}
+
+// fetch loads the block starting at offset
+func (r *ReaderAt) fetch(offset int64) error {
+	reader, err := r.driver.Get(r.ctx, r.key, offset, readAtBlockSize)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if cap(r.block) < readAtBlockSize {
+		r.block = make([]byte, readAtBlockSize)
+	}
+	n, err := io.ReadFull(reader, r.block[:readAtBlockSize])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	r.start, r.block = offset, r.block[:n]
+	return nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ReadSeeker streams a stored object from any offset. Seeking is free: the object is
+// only fetched, from the offset reached, when it is next read, so serving a byte range
+// reads just that part of the backend object.
+type ReadSeeker struct {
+	ctx    context.Context
+	driver Driver
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser // Open stream from offset, nil until the next read
+}
+
+// NewReadSeeker returns a ReadSeeker for the object at key, which holds size bytes
+func NewReadSeeker(ctx context.Context, d Driver, key string, size int64) *ReadSeeker {
+	return &ReadSeeker{ctx: ctx, driver: d, key: key, size: size}
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.driver.Get(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close releases the open stream, if any
+func (r *ReadSeeker) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
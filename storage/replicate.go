@@ -0,0 +1,646 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrReplicaCorrupt is returned by reads when no replica holds content matching the
+	// checksums recorded when the object was written
+	ErrReplicaCorrupt = errors.New("replica content does not match its checksum")
+	// ErrReplicaLost is returned by Repair when no replica holds intact content
+	ErrReplicaLost = errors.New("no intact replica left")
+
+	// errReplicasFailed stops a write once no replica is accepting the content anymore
+	errReplicasFailed = errors.New("every replica failed to store the object")
+)
+
+// ReplicaChunkSize is the span of content each chunk checksum covers, so reads can verify
+// what they return before returning it
+const ReplicaChunkSize = 1 << 20
+
+// StoredSum is the size and hex SHA-256 of an object as written to each replica
+type StoredSum struct {
+	Size   int64
+	SHA256 string
+	Chunks []byte // SHA-256 of each ReplicaChunkSize bytes of the content, concatenated
+}
+
+// hasChunks reports whether the sum has a checksum for every chunk; sums recorded by
+// earlier versions have none
+func (s *StoredSum) hasChunks() bool {
+	return int64(len(s.Chunks)) == (s.Size+ReplicaChunkSize-1)/ReplicaChunkSize*sha256.Size
+}
+
+// chunk returns the checksum of the chunk with the given index
+func (s *StoredSum) chunk(index int64) []byte {
+	return s.Chunks[index*sha256.Size : (index+1)*sha256.Size]
+}
+
+// sumWriter computes the StoredSum of the content written to it
+type sumWriter struct {
+	whole   hash.Hash
+	current hash.Hash
+	inChunk int64
+	size    int64
+	chunks  []byte
+}
+
+func newSumWriter() *sumWriter {
+	return &sumWriter{whole: sha256.New(), current: sha256.New()}
+}
+
+func (w *sumWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	w.whole.Write(p)
+	w.size += int64(written)
+	for len(p) > 0 {
+		n := min(int64(len(p)), ReplicaChunkSize-w.inChunk)
+		w.current.Write(p[:n])
+		w.inChunk += n
+		p = p[n:]
+		if w.inChunk == ReplicaChunkSize {
+			w.chunks = w.current.Sum(w.chunks)
+			w.current.Reset()
+			w.inChunk = 0
+		}
+	}
+	return written, nil
+}
+
+// Sum returns the sum of everything written
+func (w *sumWriter) Sum() StoredSum {
+	chunks := w.chunks
+	if w.inChunk > 0 {
+		chunks = w.current.Sum(chunks)
+	}
+	return StoredSum{Size: w.size, SHA256: hex.EncodeToString(w.whole.Sum(nil)), Chunks: chunks}
+}
+
+// SumStore persists the checksum of every replicated object so damaged replicas can be
+// told apart from intact ones
+type SumStore interface {
+	LoadSum(key string) (*StoredSum, error) // Returns ErrNotFound for objects without a checksum
+	SaveSum(key string, sum StoredSum) error
+	MoveSums(src, dst string) error // Moves the checksum of an object or of every object below a folder
+	DeleteSums(key string) error    // Deletes the checksum of an object or of every object below a folder
+}
+
+// replica is one copy of the storage tree
+type replica struct {
+	name string // Stable identifier used for placement
+	Driver
+}
+
+// Replicated keeps each object on several drivers. Objects are placed on the replicas
+// that rank highest for their key (rendezvous hashing), so adding a root only moves a
+// share of the objects. Folders are created on every replica. Reads fall back to the
+// next replica when one is missing the object or holds the wrong size, and whole-object
+// reads are verified against the checksum recorded at write time.
+type Replicated struct {
+	replicas []replica
+	copies   int
+	sums     SumStore
+}
+
+// NewReplicated returns a driver keeping copies replicas of every object across local
+// directories roots. A copies value outside 1..len(roots) replicates to every root.
+func NewReplicated(roots []string, copies int, sums SumStore) (*Replicated, error) {
+	r := &Replicated{copies: copies, sums: sums}
+	for _, dir := range roots {
+		local, err := NewLocal(dir)
+		if err != nil {
+			return nil, err
+		}
+		r.replicas = append(r.replicas, replica{name: dir, Driver: local})
+	}
+	if r.copies < 1 || r.copies > len(r.replicas) {
+		r.copies = len(r.replicas)
+	}
+	return r, nil
+}
+
+// order returns the replicas ranked for key; the first r.copies hold the object
+func (r *Replicated) order(key string) []replica {
+	key = cleanKey(key)
+	scores := make(map[string]string, len(r.replicas))
+	for _, rep := range r.replicas {
+		sum := sha256.Sum256([]byte(rep.name + "\x00" + key))
+		scores[rep.name] = string(sum[:])
+	}
+
+	ordered := append([]replica(nil), r.replicas...)
+	sort.SliceStable(ordered, func(i, j int) bool { return scores[ordered[i].name] > scores[ordered[j].name] })
+	return ordered
+}
+
+// holder returns the replica that serves reads of key
+func (r *Replicated) holder(ctx context.Context, key string) Driver {
+	ordered := r.order(key)
+	for _, rep := range ordered {
+		if _, err := rep.Stat(ctx, key); err == nil {
+			return rep.Driver
+		}
+	}
+	return ordered[0].Driver
+}
+
+// Put streams the content to every replica the key is placed on at once. The write
+// succeeds as long as one replica stores it; the repair job restores the others.
+func (r *Replicated) Put(ctx context.Context, key string, src io.Reader, opts PutOptions) (Info, error) {
+	if strings.HasSuffix(key, "/") {
+		var info Info
+		for i, rep := range r.replicas {
+			folder, err := rep.Put(ctx, key, src, opts)
+			if err != nil {
+				return Info{}, err
+			}
+			if i == 0 {
+				info = folder
+			}
+		}
+		return info, nil
+	}
+
+	ordered := r.order(key)
+	targets := ordered[:r.copies]
+	if opts.NoOverwrite {
+		// The placed replicas check for themselves, but a copy may linger elsewhere
+		for _, rep := range ordered[r.copies:] {
+			if _, err := rep.Stat(ctx, key); err == nil {
+				return Info{}, ErrExists
+			}
+		}
+	}
+
+	type result struct {
+		info Info
+		err  error
+	}
+	writers := make([]*io.PipeWriter, len(targets))
+	results := make([]chan result, len(targets))
+	for i, rep := range targets {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		results[i] = make(chan result, 1)
+		go func(rep replica, done chan<- result) {
+			defer pr.Close() // Unblocks the writer if Put gives up early
+			info, err := rep.Put(ctx, key, pr, opts)
+			done <- result{info, err}
+		}(rep, results[i])
+	}
+
+	sum, readErr := fanOut(src, writers)
+	for _, pw := range writers {
+		pw.CloseWithError(readErr) // Replicas never commit content that failed to read
+	}
+
+	var stored []replica
+	var info Info
+	var firstErr error
+	exists := false
+	for i, done := range results {
+		res := <-done
+		switch {
+		case res.err == nil:
+			stored = append(stored, targets[i])
+			info = res.info
+		case errors.Is(res.err, ErrExists):
+			exists = true
+		default:
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if readErr == nil || readErr == errReplicasFailed {
+				log.Printf("Failed to write replica of %s to %s: %v", key, targets[i].name, res.err)
+			}
+		}
+	}
+
+	switch {
+	case readErr != nil && readErr != errReplicasFailed:
+		return Info{}, readErr
+	case exists:
+		// Another replica already holds the object, so the new copies must not survive
+		for _, rep := range stored {
+			rep.Delete(context.Background(), key)
+		}
+		return Info{}, ErrExists
+	case len(stored) == 0:
+		return Info{}, firstErr
+	}
+
+	if err := r.sums.SaveSum(key, sum); err != nil {
+		return Info{}, err
+	}
+	// Copies on replicas the key is no longer placed on now hold outdated content
+	for _, rep := range ordered[r.copies:] {
+		rep.Delete(ctx, key)
+	}
+	return info, nil
+}
+
+// fanOut copies src to every writer, returning the checksums of what was read. Writers
+// that fail are dropped so one broken replica does not stall the others.
+func fanOut(src io.Reader, writers []*io.PipeWriter) (StoredSum, error) {
+	sums := newSumWriter()
+	live := append([]*io.PipeWriter(nil), writers...)
+	buf := make([]byte, 256<<10)
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			sums.Write(buf[:n])
+			kept := live[:0]
+			for _, w := range live {
+				if _, werr := w.Write(buf[:n]); werr == nil {
+					kept = append(kept, w)
+				}
+			}
+			live = kept
+		}
+		if err == io.EOF {
+			return sums.Sum(), nil
+		}
+		if err != nil {
+			return StoredSum{}, err
+		}
+		if len(live) == 0 {
+			return StoredSum{}, errReplicasFailed
+		}
+	}
+}
+
+// Get reads from the first replica holding an object of the recorded size. Each chunk
+// is verified against its recorded checksum before any of it is returned; a replica
+// that is unreadable or damaged is repaired in the background and the read carries on
+// from the next one. Objects without a recorded checksum are read unverified.
+func (r *Replicated) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	sum, err := r.sums.LoadSum(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	lastErr := ErrNotFound
+	var candidates []replica
+	for _, rep := range r.order(key) {
+		if sum != nil {
+			if info, err := rep.Stat(ctx, key); err == nil && info.Size == sum.Size {
+				candidates = append(candidates, rep)
+			}
+			continue
+		}
+		rc, err := rep.Get(ctx, key, offset, length)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				lastErr = err
+			}
+			continue
+		}
+		return rc, nil
+	}
+	if len(candidates) == 0 {
+		return nil, lastErr
+	}
+
+	reader := &chunkReader{ctx: ctx, r: r, key: key, sum: sum, replicas: candidates, pos: offset, end: sum.Size}
+	if length >= 0 && offset+length < reader.end {
+		reader.end = offset + length
+	}
+	if !sum.hasChunks() {
+		if err := reader.findIntact(); err != nil {
+			return nil, err
+		}
+	}
+	return reader, nil
+}
+
+// Stat describes the object or folder at key on the first replica holding it
+func (r *Replicated) Stat(ctx context.Context, key string) (Info, error) {
+	lastErr := ErrNotFound
+	for _, rep := range r.order(key) {
+		info, err := rep.Stat(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			lastErr = err
+		}
+	}
+	return Info{}, lastErr
+}
+
+// List merges the children of the folder at key across all replicas
+func (r *Replicated) List(ctx context.Context, key string) ([]Info, error) {
+	merged := make(map[string]Info)
+	found := false
+	for _, rep := range r.replicas {
+		children, err := rep.List(ctx, key)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				log.Printf("Failed to list %s on %s: %v", key, rep.name, err)
+			}
+			continue
+		}
+		found = true
+		for _, child := range children {
+			if _, ok := merged[child.Key]; !ok {
+				merged[child.Key] = child
+			}
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	infos := make([]Info, 0, len(merged))
+	for _, info := range merged {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Move renames the object or folder on every replica holding it. Replicas without it
+// drop whatever they held at dst, which would otherwise resurface as stale content.
+func (r *Replicated) Move(ctx context.Context, src, dst string) error {
+	moved := false
+	var missing []replica
+	for _, rep := range r.replicas {
+		err := rep.Move(ctx, src, dst)
+		switch {
+		case err == nil:
+			moved = true
+		case errors.Is(err, ErrNotFound):
+			missing = append(missing, rep)
+		default:
+			return err
+		}
+	}
+	if !moved {
+		return ErrNotFound
+	}
+
+	for _, rep := range missing {
+		if err := rep.Delete(ctx, dst); err != nil {
+			return err
+		}
+	}
+	return r.sums.MoveSums(src, dst)
+}
+
+// Delete removes the object or folder from every replica
+func (r *Replicated) Delete(ctx context.Context, key string) error {
+	for _, rep := range r.replicas {
+		if err := rep.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return r.sums.DeleteSums(key)
+}
+
+// Repair verifies every copy of the object at key and rewrites the replicas it is placed
+// on that are missing or damaged, then drops copies on replicas it is not placed on.
+// Objects written before replication was enabled get their checksum from the content
+// most of their copies agree on. It reports whether anything was changed.
+func (r *Replicated) Repair(ctx context.Context, key string) (bool, error) {
+	sum, err := r.sums.LoadSum(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	ordered := r.order(key)
+	found := make(map[string]string)   // Replica name to the checksum of its copy
+	sums := make(map[string]StoredSum) // Checksum to the full sums of that content
+	for _, rep := range ordered {
+		copySum, err := hashReplica(ctx, rep, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			found[rep.name] = "" // Unreadable, so treated as damaged
+			continue
+		}
+		if sum == nil || copySum.Size == sum.Size {
+			found[rep.name] = copySum.SHA256
+			sums[copySum.SHA256] = copySum
+		} else {
+			found[rep.name] = ""
+		}
+	}
+	if len(found) == 0 {
+		return false, ErrNotFound
+	}
+
+	if sum == nil {
+		digest := majority(ordered, found)
+		if digest == "" {
+			return false, ErrReplicaLost
+		}
+		picked := sums[digest]
+		sum = &picked
+		if err := r.sums.SaveSum(key, *sum); err != nil {
+			return false, err
+		}
+	} else if intact, ok := sums[sum.SHA256]; ok && !sum.hasChunks() {
+		// Sums recorded before chunk checksums were kept get them now
+		if err := r.sums.SaveSum(key, intact); err != nil {
+			return false, err
+		}
+	}
+
+	var source *replica
+	for i, rep := range ordered {
+		if found[rep.name] == sum.SHA256 {
+			source = &ordered[i]
+			break
+		}
+	}
+	if source == nil {
+		return false, ErrReplicaLost
+	}
+
+	changed := false
+	for _, rep := range ordered[:r.copies] {
+		if found[rep.name] == sum.SHA256 {
+			continue
+		}
+		if err := copyReplica(ctx, *source, rep, key); err != nil {
+			return changed, err
+		}
+		found[rep.name] = sum.SHA256
+		changed = true
+	}
+	for _, rep := range ordered[r.copies:] {
+		if _, ok := found[rep.name]; ok {
+			if err := rep.Delete(ctx, key); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// majority returns the checksum most copies agree on, preferring the highest ranked
+// replica on a tie
+func majority(ordered []replica, found map[string]string) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, rep := range ordered {
+		digest, ok := found[rep.name]
+		if !ok || digest == "" {
+			continue
+		}
+		counts[digest]++
+		if best == "" || counts[digest] > counts[best] {
+			best = digest
+		}
+	}
+	return best
+}
+
+// hashReplica returns the checksums of the copy of key held by rep
+func hashReplica(ctx context.Context, rep replica, key string) (StoredSum, error) {
+	rc, err := rep.Get(ctx, key, 0, -1)
+	if err != nil {
+		return StoredSum{}, err
+	}
+	defer rc.Close()
+
+	sums := newSumWriter()
+	if _, err := io.Copy(sums, rc); err != nil {
+		return StoredSum{}, err
+	}
+	return sums.Sum(), nil
+}
+
+// copyReplica overwrites the copy of key on dst with the one on src
+func copyReplica(ctx context.Context, src, dst replica, key string) error {
+	rc, err := src.Get(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = dst.Put(ctx, key, rc, PutOptions{})
+	return err
+}
+
+// chunkReader reads a range of a replicated object a chunk at a time, verifying each
+// chunk before handing any of it out and moving on to the next replica when one fails
+type chunkReader struct {
+	ctx       context.Context
+	r         *Replicated
+	key       string
+	sum       *StoredSum
+	replicas  []replica     // Replicas still trusted, the one being read first
+	pos, end  int64         // Next byte to return and the end of the range
+	rc        io.ReadCloser // Stream from replicas[0], positioned at a chunk boundary
+	chunk     []byte        // The current chunk
+	buf       []byte        // Verified bytes of the current chunk not yet returned
+	repairing bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		if c.pos >= c.end {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	c.pos += int64(n)
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	if c.rc != nil {
+		return c.rc.Close()
+	}
+	return nil
+}
+
+// next loads and verifies the chunk holding pos
+func (c *chunkReader) next() error {
+	index := c.pos / ReplicaChunkSize
+	start := index * ReplicaChunkSize
+	size := min(ReplicaChunkSize, c.sum.Size-start)
+	for len(c.replicas) > 0 {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		if c.rc == nil {
+			end := min((c.end+ReplicaChunkSize-1)/ReplicaChunkSize*ReplicaChunkSize, c.sum.Size)
+			rc, err := c.replicas[0].Get(c.ctx, c.key, start, end-start)
+			if err != nil {
+				c.drop(err)
+				continue
+			}
+			c.rc = rc
+		}
+		if c.chunk == nil {
+			c.chunk = make([]byte, ReplicaChunkSize)
+		}
+		data := c.chunk[:size]
+		_, err := io.ReadFull(c.rc, data)
+		if err == nil {
+			if digest := sha256.Sum256(data); bytes.Equal(digest[:], c.sum.chunk(index)) {
+				c.buf = data[c.pos-start : min(size, c.end-start)]
+				return nil
+			}
+			err = ErrReplicaCorrupt
+		}
+		c.drop(err)
+	}
+	return ErrReplicaCorrupt
+}
+
+// drop stops trusting the replica being read and has the object repaired
+func (c *chunkReader) drop(err error) {
+	if c.rc != nil {
+		c.rc.Close()
+		c.rc = nil
+	}
+	log.Printf("Failed to read %s from %s, trying the next replica: %v", c.key, c.replicas[0].name, err)
+	c.replicas = c.replicas[1:]
+	if !c.repairing {
+		c.repairing = true
+		go c.r.Repair(context.Background(), c.key)
+	}
+}
+
+// findIntact hashes the replicas of an object whose chunk checksums were never recorded
+// until one matches its whole checksum, and records the chunk checksums of that one
+func (c *chunkReader) findIntact() error {
+	for len(c.replicas) > 0 {
+		sum, err := hashReplica(c.ctx, c.replicas[0], c.key)
+		if err == nil && sum.SHA256 == c.sum.SHA256 {
+			c.sum = &sum
+			if err := c.r.sums.SaveSum(c.key, sum); err != nil {
+				log.Printf("Failed to record the chunk checksums of %s: %v", c.key, err)
+			}
+			return nil
+		}
+		if err == nil {
+			err = ErrReplicaCorrupt
+		}
+		if ctxErr := c.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		c.drop(err)
+	}
+	return ErrReplicaCorrupt
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSums is a SumStore kept in memory
+type memSums struct {
+	mu   sync.Mutex
+	sums map[string]StoredSum
+}
+
+func (m *memSums) LoadSum(key string) (*StoredSum, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sum, ok := m.sums[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &sum, nil
+}
+
+func (m *memSums) SaveSum(key string, sum StoredSum) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sums[key] = sum
+	return nil
+}
+
+func (m *memSums) MoveSums(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, sum := range m.sums {
+		if key == src || strings.HasPrefix(key, src+"/") {
+			delete(m.sums, key)
+			m.sums[dst+strings.TrimPrefix(key, src)] = sum
+		}
+	}
+	return nil
+}
+
+func (m *memSums) DeleteSums(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.sums {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.sums, k)
+		}
+	}
+	return nil
+}
+
+// newTestReplicated returns a driver replicating to every one of n temporary roots
+func newTestReplicated(t *testing.T, n int) (*Replicated, *memSums) {
+	t.Helper()
+	var roots []string
+	for i := 0; i < n; i++ {
+		roots = append(roots, t.TempDir())
+	}
+	sums := &memSums{sums: make(map[string]StoredSum)}
+	r, err := NewReplicated(roots, 0, sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, sums
+}
+
+// replicaFile returns the path of the copy of key on the replica ranked rank
+func replicaFile(r *Replicated, key string, rank int) string {
+	return filepath.Join(r.order(key)[rank].name, filepath.FromSlash(key))
+}
+
+// corrupt flips a byte of the copy of key on the replica ranked rank
+func corrupt(t *testing.T, r *Replicated, key string, rank int, at int64) {
+	t.Helper()
+	f, err := os.OpenFile(replicaFile(r, key, rank), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, at); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicatedGet(t *testing.T) {
+	content := make([]byte, 2*ReplicaChunkSize+ReplicaChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(content)
+	const key = "docs/report.bin"
+
+	tests := []struct {
+		name           string
+		damage         func(t *testing.T, r *Replicated, sums *memSums)
+		offset, length int64
+		repaired       bool // Whether reading has the damaged replica repaired
+		wantErr        error
+	}{
+		{name: "intact", length: -1},
+		{name: "intact range", offset: ReplicaChunkSize - 10, length: ReplicaChunkSize + 20},
+		{name: "intact tail", offset: int64(len(content)) - 5, length: -1},
+		{
+			name:     "first replica corrupt",
+			damage:   func(t *testing.T, r *Replicated, _ *memSums) { corrupt(t, r, key, 0, ReplicaChunkSize+7) },
+			length:   -1,
+			repaired: true,
+		},
+		{
+			name:     "first replica corrupt in range",
+			damage:   func(t *testing.T, r *Replicated, _ *memSums) { corrupt(t, r, key, 0, 2*ReplicaChunkSize+1) },
+			offset:   2 * ReplicaChunkSize,
+			length:   100,
+			repaired: true,
+		},
+		{
+			name: "first replica missing",
+			damage: func(t *testing.T, r *Replicated, _ *memSums) {
+				os.Remove(replicaFile(r, key, 0))
+			},
+			length: -1,
+		},
+		{
+			name: "first replica truncated",
+			damage: func(t *testing.T, r *Replicated, _ *memSums) {
+				os.Truncate(replicaFile(r, key, 0), 10)
+			},
+			offset: 3, length: 4,
+		},
+		{
+			name: "checksum without chunks",
+			damage: func(t *testing.T, r *Replicated, sums *memSums) {
+				sum, _ := sums.LoadSum(key)
+				sum.Chunks = nil
+				sums.SaveSum(key, *sum)
+				corrupt(t, r, key, 0, 0)
+			},
+			length:   -1,
+			repaired: true,
+		},
+		{
+			name: "every replica corrupt",
+			damage: func(t *testing.T, r *Replicated, _ *memSums) {
+				corrupt(t, r, key, 0, 0)
+				corrupt(t, r, key, 1, 0)
+			},
+			length:  -1,
+			wantErr: ErrReplicaCorrupt,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, sums := newTestReplicated(t, 2)
+			ctx := context.Background()
+			if _, err := r.Put(ctx, key, bytes.NewReader(content), PutOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.damage != nil {
+				tt.damage(t, r, sums)
+			}
+
+			want := content[tt.offset:]
+			if tt.length >= 0 {
+				want = want[:tt.length]
+			}
+			var got []byte
+			rc, err := r.Get(ctx, key, tt.offset, tt.length)
+			if err == nil {
+				got, err = io.ReadAll(rc)
+				rc.Close()
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if len(got) != 0 {
+					t.Fatalf("returned %d unverified bytes", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes that differ from the %d written", len(got), len(want))
+			}
+
+			// The damaged replica is repaired in the background
+			if tt.repaired {
+				waitFor(t, func() bool {
+					data, err := os.ReadFile(replicaFile(r, key, 0))
+					return err == nil && bytes.Equal(data, content)
+				})
+				sum, _ := sums.LoadSum(key)
+				if !sum.hasChunks() {
+					t.Fatal("chunk checksums were not recorded")
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedUnrecordedObject(t *testing.T) {
+	r, sums := newTestReplicated(t, 2)
+	ctx := context.Background()
+	if _, err := r.Put(ctx, "a.txt", strings.NewReader("hello"), PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sums.DeleteSums("a.txt")
+
+	rc, err := r.Get(ctx, "a.txt", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, _ := io.ReadAll(rc); string(got) != "ell" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestSumWriterChunks(t *testing.T) {
+	for _, size := range []int{0, 1, ReplicaChunkSize - 1, ReplicaChunkSize, ReplicaChunkSize + 1, 3 * ReplicaChunkSize} {
+		w := newSumWriter()
+		data := bytes.Repeat([]byte{'x'}, size)
+		// Odd write sizes cross chunk boundaries
+		for rest := data; len(rest) > 0; {
+			n := min(len(rest), 300007)
+			w.Write(rest[:n])
+			rest = rest[n:]
+		}
+		sum := w.Sum()
+		if sum.Size != int64(size) || !sum.hasChunks() {
+			t.Fatalf("size %d: got size %d with %d chunk bytes", size, sum.Size, len(sum.Chunks))
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,553 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds the connection settings for an S3-compatible object store
+type S3Config struct {
+	Endpoint  string // Base URL of the service, e.g. https://s3.amazonaws.com or http://127.0.0.1:9000
+	Region    string // Signing region
+	Bucket    string // Bucket holding the objects
+	Prefix    string // Optional key prefix inside the bucket
+	AccessKey string
+	SecretKey string
+	PathStyle bool  // Address the bucket as a path segment instead of a subdomain
+	PartSize  int64 // Part size for multipart uploads; smaller objects use a single PUT
+}
+
+// S3 stores objects in a bucket of an S3-compatible object store. Requests are signed
+// with AWS Signature Version 4, so the driver works with AWS S3, MinIO and the like.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a driver for the bucket described by cfg
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.PartSize < 5<<20 {
+		cfg.PartSize = 5 << 20 // S3 rejects smaller multipart parts
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{}}, nil
+}
+
+// objectName maps a storage key to the object name in the bucket
+func (s *S3) objectName(key string) string {
+	name := cleanKey(key)
+	if strings.HasSuffix(key, "/") && name != "" {
+		name += "/"
+	}
+	if s.cfg.Prefix == "" {
+		return name
+	}
+	if name == "" {
+		return s.cfg.Prefix + "/"
+	}
+	return s.cfg.Prefix + "/" + name
+}
+
+// keyOf maps an object name in the bucket back to a storage key
+func (s *S3) keyOf(name string) string {
+	if s.cfg.Prefix != "" {
+		name = strings.TrimPrefix(name, s.cfg.Prefix+"/")
+	}
+	return strings.TrimSuffix(name, "/")
+}
+
+// Put uploads the content with a single PUT, or as a multipart upload when it is larger
+// than one part. Nothing is committed unless r reaches a clean EOF.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (Info, error) {
+	name := s.objectName(key)
+	headers := http.Header{}
+	if opts.ContentType != "" {
+		headers.Set("Content-Type", opts.ContentType)
+	}
+	if opts.NoOverwrite {
+		headers.Set("If-None-Match", "*")
+	}
+
+	first, err := readPart(r, s.cfg.PartSize, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	if int64(len(first)) < s.cfg.PartSize {
+		resp, err := s.do(ctx, http.MethodPut, name, nil, headers, first)
+		if err != nil {
+			return Info{}, err
+		}
+		resp.Body.Close()
+		return Info{Key: cleanKey(key), Size: int64(len(first)), StoredSize: int64(len(first)), ModTime: time.Now()}, nil
+	}
+
+	size, err := s.putMultipart(ctx, name, first, r, headers)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: cleanKey(key), Size: size, StoredSize: size, ModTime: time.Now()}, nil
+}
+
+// readPart reads up to size bytes from r into buf, returning fewer only at a clean EOF.
+// The buffer grows as the content arrives, so small objects and folder markers do not
+// cost a whole part, and a full buffer is reused for the next part.
+func readPart(r io.Reader, size int64, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	for int64(len(buf)) < size {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), min(max(2*int64(cap(buf)), 4<<10), size))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// putMultipart uploads the content in parts, aborting the upload on any failure
+func (s *S3) putMultipart(ctx context.Context, name string, first []byte, r io.Reader, headers http.Header) (int64, error) {
+	createHeaders := http.Header{}
+	if contentType := headers.Get("Content-Type"); contentType != "" {
+		createHeaders.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, createHeaders, nil)
+	if err != nil {
+		return 0, err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+	var size int64
+
+	abort := func(cause error) (int64, error) {
+		if resp, err := s.do(context.Background(), http.MethodDelete, name, url.Values{"uploadId": {created.UploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return 0, cause
+	}
+
+	part := first
+	for len(part) > 0 {
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {created.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, name, query, nil, part)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+		size += int64(len(part))
+
+		if int64(len(part)) < s.cfg.PartSize {
+			break
+		}
+		if part, err = readPart(r, s.cfg.PartSize, part); err != nil {
+			return abort(err)
+		}
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	completeHeaders := http.Header{}
+	if ifNoneMatch := headers.Get("If-None-Match"); ifNoneMatch != "" {
+		completeHeaders.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err = s.do(ctx, http.MethodPost, name, url.Values{"uploadId": {created.UploadID}}, completeHeaders, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+
+	// CompleteMultipartUpload can report failure in a 200 response body
+	var completed struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&completed); err == nil && completed.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("s3: %s: %s", completed.Code, completed.Message))
+	}
+	return size, nil
+}
+
+// Get downloads the object, using a Range request for partial reads
+func (s *S3) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	headers := http.Header{}
+	if offset > 0 || length >= 0 {
+		if length == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		rangeHeader := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length > 0 {
+			rangeHeader += strconv.FormatInt(offset+length-1, 10)
+		}
+		headers.Set("Range", rangeHeader)
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.objectName(key), nil, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat describes the object at key, or reports a folder if objects exist below it
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	if cleanKey(key) == "" {
+		return Info{Key: "", IsDir: true}, nil
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, s.objectName(key), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return Info{Key: cleanKey(key), Size: size, StoredSize: size, ModTime: modTime, IsDir: strings.HasSuffix(key, "/")}, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return Info{}, err
+	}
+
+	objects, _, err := s.list(ctx, s.objectName(key+"/"), "", 1)
+	if err != nil {
+		return Info{}, err
+	}
+	if len(objects) == 0 {
+		return Info{}, ErrNotFound
+	}
+	return Info{Key: cleanKey(key), IsDir: true}, nil
+}
+
+// List describes the objects and folders directly below key
+func (s *S3) List(ctx context.Context, key string) ([]Info, error) {
+	prefix := s.objectName(key + "/")
+	if cleanKey(key) == "" {
+		prefix = s.objectName("")
+	}
+
+	objects, folders, err := s.list(ctx, prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []Info{}
+	for _, folder := range folders {
+		infos = append(infos, Info{Key: s.keyOf(folder), IsDir: true})
+	}
+	for _, object := range objects {
+		if object.Key == prefix {
+			continue // The folder's own marker object
+		}
+		infos = append(infos, Info{Key: s.keyOf(object.Key), Size: object.Size, StoredSize: object.Size, ModTime: object.LastModified, IsDir: strings.HasSuffix(object.Key, "/")})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// s3Object is an entry of a ListObjectsV2 response
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// list pages through ListObjectsV2, returning objects and common prefixes. A limit of 0
+// lists everything.
+func (s *S3) list(ctx context.Context, prefix, delimiter string, limit int) ([]s3Object, []string, error) {
+	var objects []s3Object
+	var folders []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if limit > 0 {
+			query.Set("max-keys", strconv.Itoa(limit))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var page struct {
+			Contents       []s3Object `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, page.Contents...)
+		for _, common := range page.CommonPrefixes {
+			folders = append(folders, common.Prefix)
+		}
+		if !page.IsTruncated || (limit > 0 && len(objects)+len(folders) >= limit) {
+			return objects, folders, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Move copies the object, or every object below a folder, to dst and deletes the originals
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	info, err := s.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		if err := s.copyObject(ctx, s.objectName(src), s.objectName(dst)); err != nil {
+			return err
+		}
+		return s.deleteObject(ctx, s.objectName(src))
+	}
+
+	srcPrefix := s.objectName(src + "/")
+	dstPrefix := s.objectName(dst + "/")
+	objects, _, err := s.list(ctx, srcPrefix, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.copyObject(ctx, object.Key, dstPrefix+strings.TrimPrefix(object.Key, srcPrefix)); err != nil {
+			return err
+		}
+	}
+	for _, object := range objects {
+		if err := s.deleteObject(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject performs a server-side copy within the bucket
+func (s *S3) copyObject(ctx context.Context, src, dst string) error {
+	headers := http.Header{}
+	headers.Set("X-Amz-Copy-Source", "/"+s.cfg.Bucket+"/"+uriEncode(src, false))
+	resp, err := s.do(ctx, http.MethodPut, dst, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete removes the object at key and every object below it
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if cleanKey(key) == "" {
+		return errors.New("refusing to delete the storage root")
+	}
+	objects, _, err := s.list(ctx, s.objectName(key+"/"), "", 0)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.deleteObject(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return s.deleteObject(ctx, s.objectName(key))
+}
+
+// deleteObject removes a single object; S3 treats missing objects as already deleted
+func (s *S3) deleteObject(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// do sends a signed request for the named object (or the bucket when name is empty) and
+// turns error responses into errors
+func (s *S3) do(ctx context.Context, method, name string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	objectPath := "/" + name
+	if s.cfg.PathStyle {
+		objectPath = "/" + s.cfg.Bucket + objectPath
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + uriEncode(objectPath, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for header, values := range headers {
+		req.Header[header] = values
+	}
+	req.ContentLength = int64(len(body))
+
+	s.sign(req, hashHex(body), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrNotFound
+	case resp.StatusCode == http.StatusPreconditionFailed && req.Header.Get("If-None-Match") == "*":
+		return nil, ErrExists
+	}
+	return nil, fmt.Errorf("s3: %s %s: %d %s %s", method, name, resp.StatusCode, apiErr.Code, apiErr.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{"host"}
+	for header := range req.Header {
+		lower := strings.ToLower(header)
+		if lower == "content-type" || lower == "range" || lower == "if-none-match" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery encodes query parameters sorted by name as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters, and slashes unless
+// encodeSlash is set
+func uriEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
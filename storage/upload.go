@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// InternalDir is the directory under the storage root reserved for TelTech's own data
+const InternalDir = ".teltech"
+
+// Conflict policies applied when an upload targets a name that already exists
+const (
+	ConflictFail      = "fail"      // Reject the upload
+	ConflictOverwrite = "overwrite" // Replace the existing content
+	ConflictRename    = "rename"    // Store under the next free "name (n).ext"
+	ConflictVersion   = "version"   // Keep the existing content as a previous version
+)
+
+var (
+	ErrTooLarge       = errors.New("upload exceeds the maximum allowed size")
+	ErrDigestMismatch = errors.New("uploaded content does not match the supplied digest")
+	ErrExists         = errors.New("a file with this name already exists")
+)
+
+// ParseConflict validates a conflict policy, returning def when none is given
+func ParseConflict(policy, def string) (string, error) {
+	if policy == "" {
+		policy = def
+	}
+	switch policy {
+	case ConflictFail, ConflictOverwrite, ConflictRename, ConflictVersion:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q", policy)
+}
+
+// ParseDigest normalises a client-supplied SHA-256 digest to lowercase hex. It accepts
+// plain hex as well as the "sha-256=<base64>" form used by the Digest header.
+func ParseDigest(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if prefix := "sha-256="; strings.HasPrefix(strings.ToLower(value), prefix) {
+		raw, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+		if err != nil || len(raw) != sha256.Size {
+			return "", errors.New("invalid sha-256 digest")
+		}
+		return hex.EncodeToString(raw), nil
+	}
+	raw, err := hex.DecodeString(value)
+	if err != nil || len(raw) != sha256.Size {
+		return "", errors.New("invalid sha-256 digest")
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// IngestReader hashes and counts everything read through it. It enforces an optional
+// size limit and, on EOF, checks the digest against the expected value. Writers only
+// commit after a clean EOF, so oversized or corrupted uploads are never persisted. A
+// limit or digest error is returned again by every later Read, so it is not lost on
+// readers such as io.ReadFull that drop an error once their buffer is full.
+type IngestReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	n        int64
+	limit    int64
+	expected string
+	head     []byte
+	err      error // Limit or digest error, returned by every Read once it happened
+}
+
+// NewIngestReader wraps r. A limit of 0 disables the size check and an empty expected
+// digest disables verification.
+func NewIngestReader(r io.Reader, limit int64, expected string) *IngestReader {
+	return &IngestReader{r: r, hash: sha256.New(), limit: limit, expected: expected}
+}
+
+func (ir *IngestReader) Read(p []byte) (int, error) {
+	if ir.err != nil {
+		return 0, ir.err
+	}
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.hash.Write(p[:n])
+		ir.n += int64(n)
+		if room := 512 - len(ir.head); room > 0 {
+			ir.head = append(ir.head, p[:min(n, room)]...)
+		}
+		if ir.limit > 0 && ir.n > ir.limit {
+			ir.err = ErrTooLarge
+			return n, ir.err
+		}
+	}
+	if err == io.EOF && ir.expected != "" && ir.Sum() != ir.expected {
+		ir.err = ErrDigestMismatch
+		return n, ir.err
+	}
+	return n, err
+}
+
+// Size returns the number of bytes read so far
+func (ir *IngestReader) Size() int64 {
+	return ir.n
+}
+
+// Sum returns the hex SHA-256 of the bytes read so far
+func (ir *IngestReader) Sum() string {
+	return hex.EncodeToString(ir.hash.Sum(nil))
+}
+
+// ContentType guesses the MIME type from the file name, falling back to sniffing the content
+func (ir *IngestReader) ContentType(name string) string {
+	if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+		return byExt
+	}
+	return http.DetectContentType(ir.head)
+}
+
+// AvailableName returns name unchanged if it is free, otherwise the first
+// "name (n).ext" variant for which exists reports false
+func AvailableName(name string, exists func(string) bool) string {
+	if !exists(name) {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		candidate := base + " (" + strconv.Itoa(i) + ")" + ext
+		if !exists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// StagingKey returns a fresh key to stage an upload under until it replaces the content
+// at its own key
+func StagingKey() string {
+	raw := make([]byte, 16)
+	_, _ = rand.Read(raw)
+	return InternalDir + "/staging/" + hex.EncodeToString(raw)
+}
+
+// VersionPrefix returns the folder key holding the previous versions of a file
+func VersionPrefix(fileID int) string {
+	return InternalDir + "/versions/" + strconv.Itoa(fileID)
+}
+
+// VersionKey returns the key a previous version of a file is kept under
+func VersionKey(fileID, version int) string {
+	return VersionPrefix(fileID) + "/" + strconv.Itoa(version)
+}
+
+// ThumbnailPrefix returns the folder key holding the thumbnails of a file
+func ThumbnailPrefix(fileID int) string {
+	return InternalDir + "/thumbs/" + strconv.Itoa(fileID)
+}
+
+// ThumbnailKey returns the key of a thumbnail made from the file content with the given
+// checksum, so thumbnails of replaced content are never served
+func ThumbnailKey(fileID int, checksum string, size int, format string) string {
+	return ThumbnailPrefix(fileID) + "/" + checksum + "/" + strconv.Itoa(size) + "." + format
+}
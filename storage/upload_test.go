@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestIngestReader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		limit    int64
+		expected string
+		want     error
+	}{
+		{name: "no checks"},
+		{name: "under the limit", limit: int64(len(content))},
+		{name: "over the limit", limit: int64(len(content)) - 1, want: ErrTooLarge},
+		{name: "far over the limit", limit: 10, want: ErrTooLarge},
+		{name: "matching digest", expected: digest},
+		{name: "wrong digest", expected: strings.Repeat("0", 64), want: ErrDigestMismatch},
+		{name: "over the limit with a digest", limit: 100, expected: digest, want: ErrTooLarge},
+	}
+
+	// Callers read through io.Copy, or fill fixed buffers with io.ReadFull, which drops
+	// the error of a read that fills its buffer
+	readers := map[string]func(r io.Reader) error{
+		"copy": func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		},
+		"full buffers": func(r io.Reader) error {
+			buf := make([]byte, 4096)
+			for {
+				_, err := io.ReadFull(r, buf)
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		},
+		"exact buffer": func(r io.Reader) error {
+			buf := make([]byte, len(content))
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			_, err := r.Read(buf)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		},
+	}
+
+	for _, tt := range tests {
+		for how, read := range readers {
+			t.Run(tt.name+"/"+how, func(t *testing.T) {
+				// One byte at a time, so the limit is crossed within a buffer
+				ingest := NewIngestReader(io.LimitReader(&oneByteReader{r: bytes.NewReader(content)}, int64(len(content))), tt.limit, tt.expected)
+				err := read(ingest)
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("got error %v, want %v", err, tt.want)
+				}
+				if tt.want != nil {
+					// The error sticks
+					if _, err := ingest.Read(make([]byte, 10)); !errors.Is(err, tt.want) {
+						t.Fatalf("later read returned %v", err)
+					}
+					return
+				}
+				if ingest.Size() != int64(len(content)) || ingest.Sum() != digest {
+					t.Fatalf("counted %d bytes with sum %s", ingest.Size(), ingest.Sum())
+				}
+			})
+		}
+	}
+}
+
+// oneByteReader returns at most one byte per Read
+type oneByteReader struct{ r io.Reader }
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	hexSum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: ""},
+		{value: hexSum, want: hexSum},
+		{value: strings.ToUpper(hexSum), want: hexSum},
+		{value: "  " + hexSum + " ", want: hexSum},
+		{value: "sha-256=" + base64.StdEncoding.EncodeToString(sum[:]), want: hexSum},
+		{value: "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:]), want: hexSum},
+		{value: hexSum[:62], wantErr: true},
+		{value: "sha-256=" + base64.StdEncoding.EncodeToString(sum[:16]), wantErr: true},
+		{value: "sha-256=***", wantErr: true},
+		{value: "md5=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDigest(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseDigest(%q) = %q, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestParseConflict(t *testing.T) {
+	tests := []struct {
+		policy, def string
+		want        string
+		wantErr     bool
+	}{
+		{"", ConflictFail, ConflictFail, false},
+		{"", ConflictRename, ConflictRename, false},
+		{ConflictOverwrite, ConflictFail, ConflictOverwrite, false},
+		{ConflictVersion, ConflictFail, ConflictVersion, false},
+		{"replace", ConflictFail, "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseConflict(tt.policy, tt.def)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseConflict(%q, %q) = %q, %v", tt.policy, tt.def, got, err)
+		}
+	}
+}
+
+func TestAvailableName(t *testing.T) {
+	tests := []struct {
+		name  string
+		taken []string
+		want  string
+	}{
+		{"a.txt", nil, "a.txt"},
+		{"a.txt", []string{"a.txt"}, "a (2).txt"},
+		{"a.txt", []string{"a.txt", "a (2).txt", "a (3).txt"}, "a (4).txt"},
+		{"README", []string{"README"}, "README (2)"},
+		{"a.tar.gz", []string{"a.tar.gz"}, "a.tar (2).gz"},
+	}
+	for _, tt := range tests {
+		taken := map[string]bool{}
+		for _, name := range tt.taken {
+			taken[name] = true
+		}
+		if got := AvailableName(tt.name, func(name string) bool { return taken[name] }); got != tt.want {
+			t.Errorf("AvailableName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
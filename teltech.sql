@@ -10,6 +10,7 @@ CREATE TABLE users (
                        username VARCHAR(100) UNIQUE NOT NULL,
                        password VARCHAR(255) NOT NULL,
                        role ENUM('user', 'admin') NOT NULL,
+                       email VARCHAR(255) DEFAULT NULL,
                        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
                        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
@@ -43,31 +44,162 @@ CREATE TABLE IF NOT EXISTS files (
                                      name VARCHAR(255) NOT NULL,
                                      path VARCHAR(255) UNIQUE NOT NULL,
                                      size BIGINT NOT NULL,
+                                     stored_size BIGINT NOT NULL DEFAULT 0,
+                                     checksum VARCHAR(64) DEFAULT NULL,
+                                     blob_hash VARCHAR(64) DEFAULT NULL,
+                                     mime_type VARCHAR(255) DEFAULT NULL,
+                                     thumbs_for VARCHAR(64) DEFAULT NULL,
+                                     metadata JSON DEFAULT NULL,
+                                     version INT NOT NULL DEFAULT 1,
                                      folder_id INT NOT NULL,
+                                     owner_id INT NOT NULL DEFAULT 0,
                                      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
                                      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+                                     INDEX (blob_hash),
                                      FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
 );
 
-CREATE TABLE IF NOT EXISTS files (
+CREATE TABLE IF NOT EXISTS file_versions (
                                      id INT AUTO_INCREMENT PRIMARY KEY,
-                                     name VARCHAR(255) NOT NULL,
-                                     path VARCHAR(255) UNIQUE NOT NULL,
+                                     file_id INT NOT NULL,
+                                     version INT NOT NULL,
+                                     path VARCHAR(1024) NOT NULL,
                                      size BIGINT NOT NULL,
-                                     folder_id INT NOT NULL,
+                                     checksum VARCHAR(64) DEFAULT NULL,
+                                     blob_hash VARCHAR(64) DEFAULT NULL,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     INDEX (file_id),
+                                     FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS blobs (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     hash VARCHAR(64) UNIQUE NOT NULL,
+                                     size BIGINT NOT NULL,
+                                     ref_count INT NOT NULL DEFAULT 0,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS data_keys (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     object_key VARCHAR(768) NOT NULL,
+                                     key_id VARCHAR(32) NOT NULL DEFAULT '',
+                                     master_key_id VARCHAR(64) NOT NULL,
+                                     wrapped_key BLOB NOT NULL,
                                      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
                                      updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-                                     FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE
+                                     INDEX (object_key),
+                                     INDEX (master_key_id)
+);
+
+CREATE TABLE IF NOT EXISTS replica_sums (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     object_key VARCHAR(768) UNIQUE NOT NULL,
+                                     size BIGINT NOT NULL,
+                                     checksum VARCHAR(64) NOT NULL,
+                                     chunk_sums LONGBLOB,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS object_sizes (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     object_key VARCHAR(768) UNIQUE NOT NULL,
+                                     stored_size BIGINT NOT NULL,
+                                     size BIGINT NOT NULL,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS file_shares (
                                            id INT AUTO_INCREMENT PRIMARY KEY,
-                                           file_id INT NOT NULL,
+                                           file_id INT DEFAULT NULL,
+                                           folder_id INT DEFAULT NULL,
                                            share_link VARCHAR(255) UNIQUE NOT NULL,
                                            access_type ENUM('read', 'write') DEFAULT 'read',
                                            expiration DATETIME DEFAULT NULL,
                                            password VARCHAR(255) DEFAULT NULL,
+                                           strip_gps BOOLEAN NOT NULL DEFAULT FALSE,
+                                           created_by INT NOT NULL DEFAULT 0,
+                                           revoked_at DATETIME DEFAULT NULL,
+                                           max_downloads INT NOT NULL DEFAULT 0,
+                                           download_count INT NOT NULL DEFAULT 0,
+                                           last_accessed_at DATETIME DEFAULT NULL,
+                                           notify BOOLEAN NOT NULL DEFAULT FALSE,
+                                           hide_contents BOOLEAN NOT NULL DEFAULT FALSE,
+                                           max_upload_size BIGINT NOT NULL DEFAULT 0,
+                                           allowed_types VARCHAR(1024) DEFAULT NULL,
+                                           upload_deadline DATETIME DEFAULT NULL,
                                            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
                                            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-                                           FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE
+                                           FOREIGN KEY (file_id) REFERENCES files(id) ON DELETE CASCADE,
+                                           FOREIGN KEY (folder_id) REFERENCES folders(id) ON DELETE CASCADE,
+                                           INDEX (created_by)
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     action VARCHAR(64) NOT NULL,
+                                     user_id INT NOT NULL DEFAULT 0,
+                                     subject VARCHAR(1024) DEFAULT NULL,
+                                     detail TEXT,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     INDEX (action),
+                                     INDEX (created_at)
+);
+
+CREATE TABLE IF NOT EXISTS scrub_runs (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     started_at DATETIME NOT NULL,
+                                     finished_at DATETIME DEFAULT NULL,
+                                     checked INT NOT NULL DEFAULT 0,
+                                     bytes_hashed BIGINT NOT NULL DEFAULT 0,
+                                     corrupted INT NOT NULL DEFAULT 0,
+                                     missing INT NOT NULL DEFAULT 0,
+                                     unexpected INT NOT NULL DEFAULT 0,
+                                     error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS scrub_issues (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     run_id INT NOT NULL,
+                                     kind VARCHAR(16) NOT NULL,
+                                     object_key VARCHAR(768) NOT NULL,
+                                     file_id INT NOT NULL DEFAULT 0,
+                                     expected VARCHAR(64) DEFAULT NULL,
+                                     actual VARCHAR(64) DEFAULT NULL,
+                                     detail TEXT,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     INDEX (run_id),
+                                     FOREIGN KEY (run_id) REFERENCES scrub_runs(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS share_accesses (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     share_id INT NOT NULL,
+                                     accessed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     ip VARCHAR(64) DEFAULT NULL,
+                                     user_agent VARCHAR(512) DEFAULT NULL,
+                                     request VARCHAR(1024) DEFAULT NULL,
+                                     status INT NOT NULL,
+                                     bytes BIGINT NOT NULL DEFAULT 0,
+                                     outcome VARCHAR(32) NOT NULL,
+                                     INDEX (share_id),
+                                     INDEX (accessed_at),
+                                     FOREIGN KEY (share_id) REFERENCES file_shares(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS share_uploads (
+                                     id INT AUTO_INCREMENT PRIMARY KEY,
+                                     share_id INT NOT NULL,
+                                     file_id INT NOT NULL,
+                                     file_name VARCHAR(255) NOT NULL,
+                                     size BIGINT NOT NULL,
+                                     uploader_name VARCHAR(255) NOT NULL,
+                                     uploader_email VARCHAR(255) NOT NULL,
+                                     ip VARCHAR(64) DEFAULT NULL,
+                                     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                                     INDEX (share_id),
+                                     FOREIGN KEY (share_id) REFERENCES file_shares(id) ON DELETE CASCADE
 );
@@ -0,0 +1,229 @@
+// Package thumbnail renders scaled-down JPEG and WebP copies of image files in the
+// background and keeps them in storage next to the file's other internal data
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // Register the GIF decoder, which yields the first frame
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"teltech/config"
+	"teltech/metrics"
+	"teltech/models"
+	"teltech/storage"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Register the WebP decoder
+)
+
+// Formats thumbnails are rendered in
+const (
+	JPEG = "jpeg"
+	WebP = "webp"
+)
+
+// ErrTooLarge is returned for images with more pixels than THUMBNAIL_MAX_PIXELS
+var ErrTooLarge = errors.New("image is too large to thumbnail")
+
+// Content types thumbnails are made for
+var supportedTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+var (
+	queue   chan int
+	pending sync.Map // IDs of files queued or being rendered
+)
+
+// Supported reports whether thumbnails can be made for content of the given type
+func Supported(mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, t := range supportedTypes {
+		if mimeType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Sizes returns the configured thumbnail sizes in pixels, smallest first. Thumbnails
+// fit within a square of that size.
+func Sizes() []int {
+	var sizes []int
+	for _, value := range config.List("THUMBNAIL_SIZES") {
+		if size, err := strconv.Atoi(value); err == nil && size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = []int{128, 256, 512}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// Fit returns the smallest configured size at least as large as size, or the largest
+// one
+func Fit(size int) int {
+	sizes := Sizes()
+	for _, s := range sizes {
+		if s >= size {
+			return s
+		}
+	}
+	return sizes[len(sizes)-1]
+}
+
+// Ready reports whether the stored thumbnails of file match its current content
+func Ready(file *models.File) bool {
+	return file.Checksum != "" && file.ThumbsFor == file.Checksum
+}
+
+// Start runs workers rendering queued thumbnails
+func Start(workers int) {
+	queue = make(chan int, 1000)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range queue {
+				render(id)
+				pending.Delete(id)
+			}
+		}()
+	}
+}
+
+// Enqueue asks for thumbnails of file to be rendered in the background, unless it is
+// not an image, they are up to date, or it is queued already. Files dropped because the
+// queue is full or not running are picked up when a thumbnail is next requested.
+func Enqueue(file *models.File) {
+	if !Supported(file.MimeType) || Ready(file) {
+		return
+	}
+	if _, queued := pending.LoadOrStore(file.ID, true); queued {
+		return
+	}
+	select {
+	case queue <- file.ID:
+	default:
+		pending.Delete(file.ID)
+	}
+}
+
+// render makes the thumbnails of the file with the given ID, logging failures
+func render(id int) {
+	file, err := models.GetFileByID(id)
+	if err != nil {
+		return // Deleted since it was queued
+	}
+	if !Supported(file.MimeType) || Ready(file) {
+		return
+	}
+	if err := Generate(context.Background(), file); err != nil {
+		metrics.Add("thumbnail_failures_total", 1)
+		log.Printf("Failed to render thumbnails of %s: %v", file.Path, err)
+		return
+	}
+	metrics.Add("thumbnails_generated_total", 1)
+}
+
+// Generate renders every configured size of thumbnail for file in both formats, stores
+// them and removes those made from earlier content
+func Generate(ctx context.Context, file *models.File) error {
+	driver := storage.Default()
+	checksum := file.Checksum
+	if checksum == "" {
+		return errors.New("file has no checksum yet")
+	}
+
+	// Check the dimensions before decoding, as a small file can hold a huge image
+	reader, err := driver.Get(ctx, file.ContentKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > config.Int64("THUMBNAIL_MAX_PIXELS", 50_000_000) {
+		return ErrTooLarge
+	}
+
+	reader, err = driver.Get(ctx, file.ContentKey(), 0, -1)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, size := range Sizes() {
+		thumb := scale(src, size)
+		for _, format := range []string{JPEG, WebP} {
+			var buf bytes.Buffer
+			if err := encode(&buf, thumb, format); err != nil {
+				return err
+			}
+			key := storage.ThumbnailKey(file.ID, checksum, size, format)
+			if _, err := driver.Put(ctx, key, &buf, storage.PutOptions{ContentType: "image/" + format}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Thumbnails of replaced content are kept under their own checksum
+	if stale, err := driver.List(ctx, storage.ThumbnailPrefix(file.ID)); err == nil {
+		for _, info := range stale {
+			if !strings.HasSuffix(info.Key, "/"+checksum) {
+				driver.Delete(ctx, info.Key)
+			}
+		}
+	}
+	return models.SetThumbsFor(file.ID, checksum)
+}
+
+// Open returns the stored thumbnail of file closest to size in format, and the size it
+// has
+func Open(ctx context.Context, file *models.File, size int, format string) (io.ReadCloser, int, error) {
+	size = Fit(size)
+	reader, err := storage.Default().Get(ctx, storage.ThumbnailKey(file.ID, file.ThumbsFor, size, format), 0, -1)
+	return reader, size, err
+}
+
+// scale fits src within a size×size square, never enlarging it
+func scale(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// encode writes img in format. JPEG has no transparency, so transparent areas turn white.
+func encode(w io.Writer, img image.Image, format string) error {
+	if format == WebP {
+		return nativewebp.Encode(w, img, nil)
+	}
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: 80})
+}
@@ -0,0 +1,130 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+// storeImage stores a w×h PNG as a.png and records it with checksum
+func storeImage(t *testing.T, w, h int, checksum string) *models.File {
+	t.Helper()
+	databasetest.Open(t, &models.File{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		img.Set(x, 0, color.NRGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	path := filepath.Join(root, "a.png")
+	os.WriteFile(path, buf.Bytes(), 0644)
+
+	file := &models.File{Name: "a.png", Path: path, Size: int64(buf.Len()), Checksum: checksum, MimeType: "image/png", Version: 1, FolderID: 1}
+	database.DB.Create(file)
+	return file
+}
+
+func TestSupported(t *testing.T) {
+	tests := map[string]bool{
+		"image/jpeg":               true,
+		"image/PNG":                true,
+		"image/webp; charset=utf8": true,
+		"image/gif":                true,
+		"image/svg+xml":            false,
+		"text/plain":               false,
+		"":                         false,
+	}
+	for mimeType, want := range tests {
+		if got := Supported(mimeType); got != want {
+			t.Errorf("Supported(%q) = %v, want %v", mimeType, got, want)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	t.Setenv("THUMBNAIL_SIZES", "512, 64,bad,256")
+	tests := map[int]int{0: 64, 64: 64, 65: 256, 300: 512, 4000: 512}
+	for size, want := range tests {
+		if got := Fit(size); got != want {
+			t.Errorf("Fit(%d) = %d, want %d", size, got, want)
+		}
+	}
+
+	t.Setenv("THUMBNAIL_SIZES", "")
+	if got := Sizes(); len(got) != 3 || got[0] != 128 {
+		t.Errorf("default sizes %v", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	t.Setenv("THUMBNAIL_SIZES", "16,64")
+	file := storeImage(t, 200, 100, "sum1")
+	ctx := context.Background()
+
+	if err := Generate(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	file, _ = models.GetFileByID(file.ID)
+	if !Ready(file) {
+		t.Fatalf("thumbnails recorded for %q", file.ThumbsFor)
+	}
+
+	// Thumbnails keep the aspect ratio and are never enlarged
+	for size, want := range map[int]image.Point{16: {16, 8}, 64: {64, 32}, 1000: {64, 32}} {
+		for _, format := range []string{JPEG, WebP} {
+			reader, got, err := Open(ctx, file, size, format)
+			if err != nil {
+				t.Fatalf("%d %s: %v", size, format, err)
+			}
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			cfg, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || decoded != format || got != want.X || cfg.Width != want.X || cfg.Height != want.Y {
+				t.Errorf("%d %s: got a %s of %dx%d at size %d, %v", size, format, decoded, cfg.Width, cfg.Height, got, err)
+			}
+		}
+	}
+
+	// New content gets new thumbnails and those of the old content go
+	database.DB.Model(file).UpdateColumn("checksum", "sum2")
+	file, _ = models.GetFileByID(file.ID)
+	if Ready(file) {
+		t.Fatal("thumbnails of old content count as ready")
+	}
+	if err := Generate(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := storage.Default().List(ctx, storage.ThumbnailPrefix(file.ID))
+	if len(infos) != 1 || infos[0].Key != storage.ThumbnailPrefix(file.ID)+"/sum2" {
+		t.Fatalf("stored thumbnails %+v", infos)
+	}
+}
+
+func TestGenerateTooLarge(t *testing.T) {
+	t.Setenv("THUMBNAIL_MAX_PIXELS", "100")
+	file := storeImage(t, 20, 20, "sum")
+	if err := Generate(context.Background(), file); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	if file, _ := models.GetFileByID(file.ID); Ready(file) {
+		t.Fatal("failed render recorded as ready")
+	}
+}
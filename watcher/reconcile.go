@@ -0,0 +1,509 @@
+package watcher
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"teltech/database"
+	"teltech/models"
+	"teltech/storage"
+	"time"
+)
+
+// entry is a file or directory found on disk
+type entry struct {
+	isDir bool
+	size  int64
+	mtime time.Time
+}
+
+// reconciler brings the folders and files tables in line with one look at the disk.
+// Only the paths it has been shown are compared: an incremental pass covers the
+// directories events were seen in, a full pass covers everything.
+type reconciler struct {
+	ctx      context.Context
+	root     string
+	settle   time.Duration             // Files modified more recently are left for a later pass
+	disk     map[string]entry          // What is on disk, by path
+	folders  map[string]*models.Folder // Folder rows in scope, by path
+	files    map[string]*models.File   // File rows in scope whose content lives at their path
+	deferred map[string]bool           // Directories to look at again once their files settle
+	changes  int
+}
+
+// newReconciler returns an empty reconciler for the tree at root
+func newReconciler(ctx context.Context, root string, settle time.Duration) *reconciler {
+	return &reconciler{
+		ctx:      ctx,
+		root:     root,
+		settle:   settle,
+		disk:     make(map[string]entry),
+		folders:  make(map[string]*models.Folder),
+		files:    make(map[string]*models.File),
+		deferred: make(map[string]bool),
+	}
+}
+
+// ignored reports whether path is internal data or an upload still being written
+func ignored(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true
+	}
+	first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	return first == storage.InternalDir || storage.IsTempName(filepath.Base(path))
+}
+
+// scanAll puts the whole tree in scope
+func (r *reconciler) scanAll() error {
+	if err := r.scanDisk(r.root, true); err != nil {
+		return err
+	}
+	if folder, err := models.GetFolderByPath(r.root); err == nil {
+		r.folders[r.root] = folder
+	}
+	folders, err := models.GetFoldersUnder(r.root)
+	if err != nil {
+		return err
+	}
+	for i := range folders {
+		r.folders[folders[i].Path] = &folders[i]
+	}
+	return r.addFilesUnder(r.root)
+}
+
+// scanDirs puts the given directories and their immediate children in scope, along with
+// the whole tree below any child that is new on disk or gone from it
+func (r *reconciler) scanDirs(dirs []string) error {
+	for _, dir := range dirs {
+		if ignored(r.root, dir) {
+			continue
+		}
+		if err := r.scanDisk(dir, false); err != nil {
+			return err
+		}
+
+		folder, err := models.GetFolderByPath(dir)
+		if err != nil {
+			continue // Picked up through its parent, which is in scope if the folder is new
+		}
+		r.folders[dir] = folder
+		if _, ok := r.disk[dir]; !ok {
+			// The folder itself is gone, so everything recorded below it is too
+			if err := r.addFoldersUnder(dir); err != nil {
+				return err
+			}
+			if err := r.addFilesUnder(dir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		files, err := models.GetFilesInFolder(folder.ID)
+		if err != nil {
+			return err
+		}
+		for i := range files {
+			r.addFile(&files[i])
+		}
+		children, err := models.GetFoldersUnder(dir)
+		if err != nil {
+			return err
+		}
+		for i := range children {
+			child := &children[i]
+			if filepath.Dir(child.Path) != dir {
+				continue
+			}
+			r.folders[child.Path] = child
+			if _, ok := r.disk[child.Path]; !ok {
+				if err := r.addFoldersUnder(child.Path); err != nil {
+					return err
+				}
+				if err := r.addFilesUnder(child.Path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Directories without a row are new, so everything inside them is too
+	for _, dir := range r.newDirs() {
+		if err := r.scanDisk(dir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanDisk records dir and its children on disk, descending into subdirectories when
+// recursive is set
+func (r *reconciler) scanDisk(dir string, recursive bool) error {
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	r.disk[dir] = entry{isDir: true, mtime: info.ModTime()}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, de := range entries {
+		path := filepath.Join(dir, de.Name())
+		if ignored(r.root, path) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue // Removed while listing
+		}
+		switch {
+		case fi.IsDir():
+			r.disk[path] = entry{isDir: true, mtime: fi.ModTime()}
+			if recursive {
+				if err := r.scanDisk(path, true); err != nil {
+					return err
+				}
+			}
+		case fi.Mode().IsRegular():
+			r.disk[path] = entry{size: fi.Size(), mtime: fi.ModTime()}
+		}
+	}
+	return nil
+}
+
+// addFoldersUnder puts every folder row below path in scope
+func (r *reconciler) addFoldersUnder(path string) error {
+	folders, err := models.GetFoldersUnder(path)
+	if err != nil {
+		return err
+	}
+	for i := range folders {
+		r.folders[folders[i].Path] = &folders[i]
+	}
+	return nil
+}
+
+// addFilesUnder puts every file row below path in scope
+func (r *reconciler) addFilesUnder(path string) error {
+	files, err := models.GetFilesUnder(path)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		r.addFile(&files[i])
+	}
+	return nil
+}
+
+// addFile puts a file row in scope unless its content is a shared blob, which does not
+// live at the file's path
+func (r *reconciler) addFile(file *models.File) {
+	if file.BlobHash == "" {
+		r.files[file.Path] = file
+	}
+}
+
+// apply updates the database to match the disk. Folders and files that moved are
+// recognised by their content so their IDs, and with them any shares, are kept.
+func (r *reconciler) apply() error {
+	if err := r.matchFolderMoves(); err != nil {
+		return err
+	}
+	if err := r.createFolders(); err != nil {
+		return err
+	}
+	if err := r.syncFiles(); err != nil {
+		return err
+	}
+	return r.removeFolders()
+}
+
+// matchFolderMoves finds folders that are gone from disk whose files all turned up,
+// unchanged, in a directory that is new on disk
+func (r *reconciler) matchFolderMoves() error {
+	for _, gone := range r.goneFolders() {
+		if _, ok := r.folders[gone]; !ok {
+			continue // Moved along with a parent
+		}
+		var contents []*models.File
+		for path, file := range r.files {
+			if strings.HasPrefix(path, gone+string(filepath.Separator)) {
+				contents = append(contents, file)
+			}
+		}
+		if len(contents) == 0 {
+			continue // Nothing to recognise it by
+		}
+
+		for _, dir := range r.newDirs() {
+			if !r.holdsMovedFiles(gone, dir, contents) {
+				continue
+			}
+			if err := models.MoveFolderPaths(gone, dir); err != nil {
+				return err
+			}
+			log.Printf("Watcher recorded folder move %s -> %s", gone, dir)
+			r.changes++
+			r.rekey(gone, dir)
+			break
+		}
+	}
+	return nil
+}
+
+// holdsMovedFiles reports whether every file recorded below gone is on disk below dir
+// with the same size
+func (r *reconciler) holdsMovedFiles(gone, dir string, contents []*models.File) bool {
+	for _, file := range contents {
+		e, ok := r.disk[dir+strings.TrimPrefix(file.Path, gone)]
+		if !ok || e.isDir || e.size != storedSize(file) {
+			return false
+		}
+	}
+	return true
+}
+
+// rekey moves the in-memory rows below oldPath to newPath after MoveFolderPaths
+func (r *reconciler) rekey(oldPath, newPath string) {
+	for path, folder := range r.folders {
+		if path == oldPath || strings.HasPrefix(path, oldPath+string(filepath.Separator)) {
+			delete(r.folders, path)
+			folder.Path = newPath + strings.TrimPrefix(path, oldPath)
+			if path == oldPath {
+				folder.Name = filepath.Base(newPath)
+			}
+			r.folders[folder.Path] = folder
+		}
+	}
+	for path, file := range r.files {
+		if strings.HasPrefix(path, oldPath+string(filepath.Separator)) {
+			delete(r.files, path)
+			file.Path = newPath + strings.TrimPrefix(path, oldPath)
+			r.files[file.Path] = file
+		}
+	}
+}
+
+// createFolders adds rows for directories that are new on disk, parents first
+func (r *reconciler) createFolders() error {
+	for _, dir := range r.newDirs() {
+		r.folderOf(dir) // Records the root ahead of the first folder in it
+		folder, created, err := models.RecordFoundFolder(dir)
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Printf("Watcher recorded new folder %s", dir)
+			r.changes++
+		}
+		r.folders[dir] = folder
+	}
+	return nil
+}
+
+// syncFiles records moved, new and changed files and drops the rows of removed ones
+func (r *reconciler) syncFiles() error {
+	var gone []*models.File
+	for path, file := range r.files {
+		if e, ok := r.disk[path]; !ok || e.isDir {
+			gone = append(gone, file)
+		}
+	}
+
+	var added []string
+	for path, e := range r.disk {
+		if e.isDir {
+			continue
+		}
+		file, known := r.files[path]
+		if known && e.size == storedSize(file) && !e.mtime.After(file.UpdatedAt) {
+			continue
+		}
+		if time.Since(e.mtime) < r.settle {
+			r.deferred[filepath.Dir(path)] = true // Possibly still being written
+			continue
+		}
+		if known {
+			if err := r.refresh(file); err != nil {
+				return err
+			}
+			continue
+		}
+		added = append(added, path)
+	}
+	sort.Strings(added)
+
+	for _, path := range added {
+		found, err := models.ReadFoundFile(r.ctx, path)
+		if err != nil {
+			log.Printf("Watcher failed to read %s: %v", path, err)
+			continue
+		}
+
+		if moved := takeMatch(&gone, found); moved != nil {
+			if err := r.move(moved, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.create(path, found); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range gone {
+		if err := models.DeleteFileRecord(r.ctx, file); err != nil {
+			return err
+		}
+		log.Printf("Watcher removed file %s", file.Path)
+		r.changes++
+	}
+	return nil
+}
+
+// removeFolders drops the rows of folders that are gone from disk, children first
+func (r *reconciler) removeFolders() error {
+	gone := r.goneFolders()
+	for i := len(gone) - 1; i >= 0; i-- {
+		if err := models.DeleteFolder(r.folders[gone[i]].ID); err != nil {
+			return err
+		}
+		log.Printf("Watcher removed folder %s", gone[i])
+		r.changes++
+	}
+	return nil
+}
+
+// takeMatch removes and returns the gone file with the same content, if any
+func takeMatch(gone *[]*models.File, found *models.FoundFile) *models.File {
+	for i, file := range *gone {
+		if file.Checksum != "" && file.Checksum == found.Checksum && file.Size == found.Size {
+			*gone = append((*gone)[:i], (*gone)[i+1:]...)
+			return file
+		}
+	}
+	return nil
+}
+
+// move points the row of a file that was renamed on disk to its new path
+func (r *reconciler) move(file *models.File, path string) error {
+	parent := r.folderOf(path)
+	if parent == nil {
+		return nil // Its folder could not be recorded, so try again on the next pass
+	}
+	log.Printf("Watcher recorded file move %s -> %s", file.Path, path)
+	delete(r.files, file.Path)
+	file.Path = path
+	file.Name = filepath.Base(path)
+	file.FolderID = parent.ID
+	r.files[path] = file
+	r.changes++
+	return database.DB.Save(file).Error
+}
+
+// create adds a row for a file that is new on disk
+func (r *reconciler) create(path string, found *models.FoundFile) error {
+	parent := r.folderOf(path)
+	if parent == nil {
+		return nil
+	}
+	file, created, err := models.RecordFoundFile(parent, path, found)
+	if err != nil || !created {
+		return err
+	}
+	log.Printf("Watcher recorded new file %s", path)
+	r.files[path] = file
+	r.changes++
+	return nil
+}
+
+// refresh updates the row of a file whose content changed on disk
+func (r *reconciler) refresh(file *models.File) error {
+	found, err := models.ReadFoundFile(r.ctx, file.Path)
+	if err != nil {
+		log.Printf("Watcher failed to read %s: %v", file.Path, err)
+		return nil
+	}
+	file.Size = found.Size
+	file.StoredSize = found.StoredSize
+	file.MimeType = found.MimeType
+	if file.Checksum != found.Checksum {
+		file.Checksum = found.Checksum
+		log.Printf("Watcher recorded changed file %s", file.Path)
+		r.changes++
+	}
+	// Saving bumps UpdatedAt past the modification time, so the file is not read again
+	return database.DB.Save(file).Error
+}
+
+// folderOf returns the row of the folder holding path, creating one for the root
+func (r *reconciler) folderOf(path string) *models.Folder {
+	dir := filepath.Dir(path)
+	if folder, ok := r.folders[dir]; ok {
+		return folder
+	}
+	folder, err := models.GetFolderByPath(dir)
+	if err != nil && dir == r.root {
+		folder, _, err = models.RecordFoundFolder(dir)
+	}
+	if err != nil {
+		return nil
+	}
+	r.folders[dir] = folder
+	return folder
+}
+
+// newDirs lists directories on disk without a folder row, parents first
+func (r *reconciler) newDirs() []string {
+	var dirs []string
+	for path, e := range r.disk {
+		if _, ok := r.folders[path]; e.isDir && !ok && path != r.root {
+			dirs = append(dirs, path)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// goneFolders lists folder rows without a directory on disk, parents first
+func (r *reconciler) goneFolders() []string {
+	var gone []string
+	for path := range r.folders {
+		if e, ok := r.disk[path]; (!ok || !e.isDir) && path != r.root {
+			gone = append(gone, path)
+		}
+	}
+	sort.Strings(gone)
+	return gone
+}
+
+// deferredDirs lists the directories holding files that were still being written
+func (r *reconciler) deferredDirs() []string {
+	dirs := make([]string, 0, len(r.deferred))
+	for dir := range r.deferred {
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// storedSize returns how many bytes the content of file occupies on disk
+func storedSize(file *models.File) int64 {
+	if file.StoredSize > 0 {
+		return file.StoredSize
+	}
+	return file.Size
+}
@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"teltech/database"
+	"teltech/database/databasetest"
+	"teltech/models"
+	"teltech/storage"
+)
+
+func TestReconcile(t *testing.T) {
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.Blob{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	const owner = 5
+
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	write := func(rel, content string) string {
+		path := filepath.Join(root, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// record stores a file as an upload would have, before the out-of-band changes
+	record := func(folder *models.Folder, rel, content string) *models.File {
+		file := &models.File{Name: filepath.Base(rel), Path: write(rel, content), Size: int64(len(content)),
+			Checksum: sum(content), FolderID: folder.ID, OwnerID: owner}
+		database.DB.Create(file)
+		database.DB.Model(file).UpdateColumn("updated_at", time.Now().Add(-time.Hour))
+		return file
+	}
+
+	rootFolder, _ := models.CreateFolder(filepath.Base(root), root, owner)
+	album, _ := models.CreateFolder("album", filepath.Join(root, "album"), owner)
+	kept := record(rootFolder, "kept.txt", "kept")
+	renamed := record(rootFolder, "old.txt", "renamed")
+	record(rootFolder, "gone.txt", "gone")
+	changed := record(rootFolder, "changed.txt", "before")
+	photo := record(album, "album/photo.jpg", "photo")
+
+	// Changes made on disk behind the application's back
+	os.Rename(filepath.Join(root, "old.txt"), filepath.Join(root, "new.txt"))
+	os.Remove(filepath.Join(root, "gone.txt"))
+	write("changed.txt", "after")
+	os.Rename(filepath.Join(root, "album"), filepath.Join(root, "photos"))
+	write("docs/readme.md", "read me")
+	write(storage.InternalDir+"/versions/1/1", "internal")
+	write(".upload-123.tmp", "partial")
+
+	r := newReconciler(context.Background(), root, 0)
+	if err := r.scanAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]struct {
+		id       int // Expected ID, 0 for a new row
+		checksum string
+	}{
+		"kept.txt":         {kept.ID, sum("kept")},
+		"new.txt":          {renamed.ID, sum("renamed")},
+		"changed.txt":      {changed.ID, sum("after")},
+		"photos/photo.jpg": {photo.ID, sum("photo")},
+		"docs/readme.md":   {0, sum("read me")},
+	}
+	all, _ := models.GetAllFiles()
+	if len(all) != len(files) {
+		t.Errorf("got %d file rows, want %d", len(all), len(files))
+	}
+	for rel, want := range files {
+		file, err := models.GetFileByPath(filepath.Join(root, rel))
+		if err != nil {
+			t.Errorf("%s: no row", rel)
+			continue
+		}
+		if want.id != 0 && file.ID != want.id || file.Checksum != want.checksum || file.OwnerID != owner {
+			t.Errorf("%s: got %+v", rel, file)
+		}
+	}
+
+	if photos, err := models.GetFolderByPath(filepath.Join(root, "photos")); err != nil || photos.ID != album.ID || photos.Name != "photos" {
+		t.Errorf("moved folder: got %+v, %v", photos, err)
+	}
+	if docs, err := models.GetFolderByPath(filepath.Join(root, "docs")); err != nil || docs.OwnerID != owner {
+		t.Errorf("new folder: got %+v, %v", docs, err)
+	}
+	if _, err := models.GetFolderByPath(filepath.Join(root, storage.InternalDir)); err == nil {
+		t.Error("recorded the internal directory")
+	}
+
+	// A second pass finds nothing left to do
+	r = newReconciler(context.Background(), root, 0)
+	if err := r.scanAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.apply(); err != nil || r.changes != 0 {
+		t.Fatalf("second pass made %d changes, %v", r.changes, err)
+	}
+}
+
+func TestReconcileSettle(t *testing.T) {
+	databasetest.Open(t, &models.Folder{}, &models.File{}, &models.FileVersion{}, &models.Blob{})
+	root := t.TempDir()
+	t.Setenv("PARENT_FOLDER", root)
+	if err := storage.Init(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	models.CreateFolder(filepath.Base(root), root, 1)
+	os.WriteFile(filepath.Join(root, "fresh.bin"), []byte("still being written"), 0644)
+
+	// Files modified within the settle time are left for a later pass
+	r := newReconciler(context.Background(), root, time.Hour)
+	if err := r.scanAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.apply(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.GetFileByPath(filepath.Join(root, "fresh.bin")); err == nil {
+		t.Fatal("recorded a file that has not settled")
+	}
+	if dirs := r.deferredDirs(); len(dirs) != 1 || dirs[0] != root {
+		t.Fatalf("deferred %v", dirs)
+	}
+}
@@ -0,0 +1,197 @@
+// Package watcher keeps the folders and files tables in step with changes made directly
+// on disk below PARENT_FOLDER, such as files copied in over NFS or rsync
+package watcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher reconciles the database with the tree below its root as changes happen. Events
+// are collected until the tree has been quiet for the debounce period, then only the
+// directories they touched are compared. A full rescan runs periodically and whenever
+// the kernel drops events.
+type Watcher struct {
+	root     string
+	debounce time.Duration
+	rescan   time.Duration
+	events   *fsnotify.Watcher
+	done     chan struct{}
+}
+
+// Start watches the tree at root, reconciling it in full once right away
+func Start(root string, debounce, rescan time.Duration) (*Watcher, error) {
+	events, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		root:     filepath.Clean(root),
+		debounce: debounce,
+		rescan:   rescan,
+		events:   events,
+		done:     make(chan struct{}),
+	}
+	if err := w.watchTree(w.root); err != nil {
+		events.Close()
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	close(w.done)
+	return w.events.Close()
+}
+
+// run handles events until the watcher is closed
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.rescan)
+	defer ticker.Stop()
+
+	// The timer is only armed while events are pending
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	dirty := make(map[string]bool)
+	var firstEvent time.Time
+
+	// Directories with files still being written are looked at again after a quiet period
+	recheck := func(dirs []string) {
+		for _, dir := range dirs {
+			dirty[dir] = true
+		}
+		if len(dirty) > 0 {
+			firstEvent = time.Now()
+			timer.Reset(w.debounce)
+		}
+	}
+	recheck(w.fullRescan())
+
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case event, ok := <-w.events.Events:
+			if !ok {
+				return
+			}
+			if ignored(w.root, event.Name) {
+				continue
+			}
+			w.track(event, dirty)
+
+			// Keep waiting for quiet, but never postpone a storm's changes indefinitely
+			if len(dirty) > 0 && firstEvent.IsZero() {
+				firstEvent = time.Now()
+			}
+			if time.Since(firstEvent) < 10*w.debounce {
+				timer.Reset(w.debounce)
+			}
+
+		case err, ok := <-w.events.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				log.Printf("Watcher missed events, rescanning %s", w.root)
+				clear(dirty)
+				firstEvent = time.Time{}
+				recheck(w.fullRescan())
+				continue
+			}
+			log.Printf("Watcher error: %v", err)
+
+		case <-timer.C:
+			dirs := make([]string, 0, len(dirty))
+			for dir := range dirty {
+				dirs = append(dirs, dir)
+			}
+			sort.Strings(dirs)
+			clear(dirty)
+			firstEvent = time.Time{}
+			recheck(w.reconcileDirs(dirs))
+
+		case <-ticker.C:
+			recheck(w.fullRescan())
+		}
+	}
+}
+
+// track marks the directories an event affects as needing a look, and starts watching
+// directories that appear
+func (w *Watcher) track(event fsnotify.Event, dirty map[string]bool) {
+	dirty[filepath.Dir(event.Name)] = true
+
+	switch {
+	case event.Has(fsnotify.Create):
+		if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+			dirty[event.Name] = true
+			if err := w.watchTree(event.Name); err != nil {
+				log.Printf("Watcher failed to watch %s: %v", event.Name, err)
+			}
+		}
+	case event.Has(fsnotify.Rename), event.Has(fsnotify.Remove):
+		// A renamed directory keeps its watch under the old name otherwise
+		w.events.Remove(event.Name)
+	}
+}
+
+// watchTree adds a watch for dir and every directory below it
+func (w *Watcher) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed while walking
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if ignored(w.root, path) {
+			return filepath.SkipDir
+		}
+		return w.events.Add(path)
+	})
+}
+
+// reconcileDirs compares the given directories with the database and returns the ones
+// holding files that were still being written
+func (w *Watcher) reconcileDirs(dirs []string) []string {
+	r := newReconciler(context.Background(), w.root, w.debounce)
+	err := r.scanDirs(dirs)
+	if err == nil {
+		err = r.apply()
+	}
+	if err != nil {
+		log.Printf("Watcher failed to reconcile changes: %v", err)
+	}
+	return r.deferredDirs()
+}
+
+// fullRescan reconciles the whole tree, which also catches changes made while the
+// server was down or events were lost
+func (w *Watcher) fullRescan() []string {
+	r := newReconciler(context.Background(), w.root, w.debounce)
+	err := r.scanAll()
+	if err == nil {
+		err = r.apply()
+	}
+	if err != nil {
+		log.Printf("Watcher rescan failed: %v", err)
+	} else if r.changes > 0 {
+		log.Printf("Watcher rescan recorded %d changes", r.changes)
+	}
+	return r.deferredDirs()
+}